@@ -0,0 +1,509 @@
+/*
+TileEx : A Tiling Pattern Extractor written in Go
+Copyright (C) 2023, Sarthak Shah (shahsarthakw@gmail.com)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+  "context"
+  "encoding/csv"
+  "os"
+  "fmt"
+  "flag"
+  "strconv"
+  "strings"
+  "image"
+  "image/color"
+  "log"
+  "runtime"
+  "sync"
+  "time"
+)
+
+// settings holds the options that control how a tile is extracted.
+type settings struct {
+  rowTolerance, colTolerance float64
+  offsetX, offsetY, numProc, highPass int
+  timeout time.Duration
+  outlierThreshold float64
+  tieBreak, algorithm, verifySample string
+  // sampleFraction is the share of the image -verify-sample grades on. It
+  // is all of it unless asked for otherwise, as the grade decides the exit
+  // status with -require-grade, and a sampled one is only an estimate.
+  sampleFraction float64
+  rowPreferFrequency, colPreferFrequency, setLossy, setLossless bool
+  screenshot, rejectOutliers, weightedVote, trimRepeats bool
+  // alphaMetric counts differences in alpha in the detection, which
+  // otherwise only compares the premultiplied colors.
+  alphaMetric bool
+  // progress, if set, is told how many of the lines of a pass have been
+  // analyzed.
+  progress func(done, total int)
+}
+
+// addSettingsFlags registers the flags that fill in s on fs.
+func addSettingsFlags(fs *flag.FlagSet, s *settings) {
+  fs.Float64Var(&s.rowTolerance, "row-tolerance", 0.1, "The minimum frequency of the row periodicity value (percent)")
+  fs.Float64Var(&s.colTolerance, "col-tolerance", 0.1, "The minimum frequency of the col periodicity value (percent)")
+  fs.IntVar(&s.offsetX, "x-offset", 0, "The number of pixels the width of the crop is offset by")
+  fs.IntVar(&s.offsetY, "y-offset", 0, "The number of pixels the height of the crop is offset by")
+  fs.DurationVar(&s.timeout, "timeout", 0, "Give up on an image whose detection takes longer than this, such as 30s (0 for no limit)")
+  fs.IntVar(&s.numProc, "number-of-processes", runtime.NumCPU(), "The maximum number of process to be used")
+  fs.BoolVar(&s.rowPreferFrequency, "row-prefer-frequency", false, "Give preference to the highest frequency match for rows")
+  fs.BoolVar(&s.colPreferFrequency, "col-prefer-frequency", false, "Give preference to the highest frequency match for cols")
+  fs.BoolVar(&s.setLossy, "set-lossy", false, "Set the file type as lossy")
+  fs.BoolVar(&s.setLossless, "set-lossless", false, "Set the file type as lossless")
+  fs.BoolVar(&s.screenshot, "screenshot", false, "Exclude UI elements that do not repeat and extract the tile from the background")
+  fs.BoolVar(&s.rejectOutliers, "reject-outliers", false, "Discard rows and cols whose periodicity score is anomalously poor before voting")
+  fs.IntVar(&s.highPass, "high-pass", 0, "Remove lighting gradients with a wavelength above the given number of pixels before detection (0 to disable)")
+  fs.StringVar(&s.algorithm, "algorithm", "lines", "How to detect the tile: lines (vote over the period of every row and col) keypoints (match repeated corners, for photographs) or ensemble (fuse every detector, slower but more robust)")
+  fs.StringVar(&s.tieBreak, "tie-break", "smallest", "How to choose between periods with equal votes: smallest, largest or lowest-reconstruction-error")
+  fs.StringVar(&s.verifySample, "verify-sample", "100%", "Grade the tile on the given share of the image, such as 10%, drawn from blocks all over it, rather than all of it")
+  fs.BoolVar(&s.trimRepeats, "trim-repeats", true, "Shrink the tile to its fundamental repeat when it repeats within itself")
+  fs.BoolVar(&s.alphaMetric, "alpha-metric", false, "Compare the alpha of pixels along with their colors, for sprites and other images whose transparency repeats")
+  fs.BoolVar(&s.weightedVote, "weighted-vote", false, "Weight the vote of each row and col by how decisive its periodicity was")
+  fs.Float64Var(&s.outlierThreshold, "outlier-threshold", 3.0, "The number of median absolute deviations above the median score at which a row or col is rejected")
+}
+
+// prepare validates s after the flags were parsed and turns the tolerances
+// from percentages into fractions.
+func (s *settings) prepare() error {
+  if err := s.validate(); err != nil {
+    return err
+  }
+  runtime.GOMAXPROCS(s.numProc)
+  return nil
+}
+
+// validate checks the settings and turns the tolerances from percentages
+// into fractions. Unlike prepare, it leaves the process alone.
+func (s *settings) validate() error {
+  if s.setLossy && s.setLossless {
+    return fmt.Errorf("Please select only one of -set-lossy or -set-lossless")
+  }
+  switch s.tieBreak {
+  case "smallest", "largest", "lowest-reconstruction-error":
+  default:
+    return fmt.Errorf("unknown -tie-break %q, expected smallest, largest or lowest-reconstruction-error", s.tieBreak)
+  }
+  if s.numProc < 1 {
+    return fmt.Errorf("the number of processes must be at least 1, got %d", s.numProc)
+  }
+  switch s.algorithm {
+  case "lines", "keypoints", "ensemble":
+  default:
+    return fmt.Errorf("unknown -algorithm %q, expected lines, keypoints or ensemble", s.algorithm)
+  }
+
+  s.sampleFraction = 1
+  if s.verifySample != "" {
+    fraction, err := strconv.ParseFloat(strings.TrimSuffix(s.verifySample, "%"), 64)
+    if strings.HasSuffix(s.verifySample, "%") {
+      fraction /= 100
+    }
+    if err != nil || fraction <= 0 || fraction > 1 {
+      return fmt.Errorf("invalid -verify-sample %q, expected a share of the image such as 10%%", s.verifySample)
+    }
+    s.sampleFraction = fraction
+  }
+
+  if s.rowPreferFrequency {
+    s.rowTolerance = 0.0
+  } else {
+    s.rowTolerance = s.rowTolerance / 100.0
+  }
+
+  if s.colPreferFrequency {
+    s.colTolerance = 0.0
+  } else {
+    s.colTolerance = s.colTolerance / 100.0
+  }
+  return nil
+}
+
+// lineProgress returns the function to call once each of total lines has
+// been analyzed, which passes the count on to s.progress. It returns nil if
+// there is nothing to report to.
+func (s settings) lineProgress(total int) func() {
+  if s.progress == nil {
+    return nil
+  }
+  var mu sync.Mutex
+  done := 0
+  return func() {
+    mu.Lock()
+    defer mu.Unlock()
+    done++
+    s.progress(done, total)
+  }
+}
+
+// context returns the context a detection runs under, which ends after
+// -timeout if one is set.
+func (s settings) context(parent context.Context) (context.Context, context.CancelFunc) {
+  if s.timeout > 0 {
+    cause := fmt.Errorf("Detection took longer than %v: %w", s.timeout, context.DeadlineExceeded)
+    return context.WithTimeoutCause(parent, s.timeout, cause)
+  }
+  return context.WithCancel(parent)
+}
+
+// analysis holds the per-line periodicity results of an image, ready for
+// the frequency vote.
+type analysis struct {
+  // img is the image the tile is cropped from, while detection runs on
+  // detectImg. Both are limited to the background in screenshot mode.
+  img, detectImg image.Image
+  imageFormat int
+  rowLines, colLines []LineResult
+  // rowResults and colResults hold the result of every row and col of
+  // detectImg in order, including those left out of the vote.
+  rowResults, colResults []LineResult
+  // pixels caches the colors of detectImg for scoring tiles.
+  pixels *pixelBuffer
+  // palette is the paletteTable of detectImg, if it is paletted.
+  palette *paletteTable
+}
+
+// buffer returns the pixel buffer of detectImg, reading it on first use.
+func (a *analysis) buffer() *pixelBuffer {
+  if a.pixels == nil {
+    a.pixels = newPixelBuffer(a.detectImg)
+  }
+  return a.pixels
+}
+
+// grade returns the reconstruction error of the tile and its grade, on all
+// of detectImg or on the share of it that -verify-sample asks for, and logs
+// them.
+func (a *analysis) grade(s settings, logger *log.Logger, origin image.Point, width, height int) (float64, Grade) {
+  if s.sampleFraction <= 0 || s.sampleFraction >= 1 {
+    reconstructionError := a.buffer().reconstructionError(origin, width, height)
+    grade := GradeFor(reconstructionError)
+    logger.Printf(tr("Quality grade: %s (reconstruction error %f)\n"), strings.ToUpper(grade.String()), reconstructionError)
+    return reconstructionError, grade
+  }
+  reconstructionError, interval, sampled, blocks := a.buffer().sampledReconstructionError(origin, width, height, s.sampleFraction)
+  grade := GradeFor(reconstructionError)
+  logger.Printf(tr("Quality grade: %s (reconstruction error %f ± %f, from %d of %d blocks)\n"), strings.ToUpper(grade.String()), reconstructionError, interval, sampled, blocks)
+  return reconstructionError, grade
+}
+
+// extraction is the tile chosen by the frequency vote. The confidences, from
+// 0 to 1, are the share of the vote each period received.
+type extraction struct {
+  Origin image.Point
+  Width, Height int
+  RowConfidence, ColConfidence float64
+  Error float64
+  Grade Grade
+}
+
+// votes returns the lines of results that take part in the frequency vote.
+func (s settings) votes(label string, results []LineResult, logger *log.Logger) []LineResult {
+  if s.rejectOutliers {
+    kept := rejectPoorLines(results, s.outlierThreshold)
+    logger.Printf(tr("Rejected %d of %d %ss with anomalously poor scores\n"), len(results) - len(kept), len(results), tr(label))
+    results = kept
+  }
+  return results
+}
+
+// analyze runs the row and col periodicity passes over img, which was read
+// from the file named input. It gives up once ctx is done.
+func analyze(ctx context.Context, img image.Image, input string, s settings, logger *log.Logger) (*analysis, error) {
+  bounds := img.Bounds()
+  if err := checkSize(bounds.Dx(), bounds.Dy()); err != nil {
+    return nil, err
+  }
+  imageFormat := LOSSY
+  if s.setLossless || (!s.setLossy && losslessFile(input)) {
+    imageFormat = LOSSLESS
+    logger.Println(tr("File type: LOSSLESS"))
+  } else {
+    logger.Println(tr("File type: LOSSY"))
+  }
+
+  votes := func(label string, results []LineResult) []LineResult {
+    return s.votes(label, results, logger)
+  }
+
+  detectImg := img
+  if s.highPass > 0 {
+    logger.Printf(tr("Removing gradients with a wavelength above %d pixels\n"), s.highPass)
+    detectImg = HighPass(img, s.highPass)
+  }
+  if !s.alphaMetric {
+    detectImg = ignoreAlpha(detectImg)
+  }
+  // Cropping to the background in screenshot mode keeps the palette.
+  palette := newPaletteTable(detectImg)
+
+  // Screenshot mode needs the lines to find the background even when the
+  // tile itself is found from keypoints.
+  var rowResults, colResults []LineResult
+  if s.algorithm == "lines" || s.screenshot {
+    var err error
+    tick := s.lineProgress(bounds.Dx() + bounds.Dy())
+    if rowResults, err = rowPeriodicities(ctx, detectImg, palette, imageFormat, s.weightedVote, tick); err != nil {
+      return nil, err
+    }
+    if colResults, err = colPeriodicities(ctx, detectImg, palette, imageFormat, s.weightedVote, tick); err != nil {
+      return nil, err
+    }
+  }
+  rowLines := votes("row", rowResults)
+  colLines := votes("col", colResults)
+
+  if s.screenshot {
+    rowVotes := repeatingLines(rowLines, img.Bounds().Dx())
+    colVotes := repeatingLines(colLines, img.Bounds().Dy())
+    if len(rowVotes) == 0 || len(colVotes) == 0 {
+      return nil, fmt.Errorf("%w in the rows and cols", ErrNoPeriodicity)
+    }
+    logger.Printf(tr("Ignoring %d rows and %d cols that do not repeat\n"), len(rowLines) - len(rowVotes), len(colLines) - len(colVotes))
+    // The background is whatever most of the repeating lines agree on.
+    rowPeriodicity, _, err := consensusPeriod(logger, "Row", rowVotes, s.weightedVote, 0.0, true, s.tieBreak)
+    if err != nil {
+      return nil, err
+    }
+    colPeriodicity, _, err := consensusPeriod(logger, "Col", colVotes, s.weightedVote, 0.0, true, s.tieBreak)
+    if err != nil {
+      return nil, err
+    }
+
+    region := screenshotRegion(img.Bounds(), linePeriods(rowResults), linePeriods(colResults), rowPeriodicity, colPeriodicity)
+    if region.Empty() {
+      return nil, fmt.Errorf(tr("%w: no region of the screenshot is free of UI elements"), ErrNoPeriodicity)
+    }
+    logger.Printf(tr("Extracting from the background region %v\n"), region)
+    // detectImg is img as is, filtered into an *image.NRGBA64 or viewed as
+    // opaque, which can all be cropped if img can.
+    sub, ok := img.(subImager)
+    detectSub, detectOK := detectImg.(subImager)
+    if !ok || !detectOK {
+      return nil, fmt.Errorf("cannot crop the background region out of a %T", img)
+    }
+    img = sub.SubImage(region)
+    detectImg = detectSub.SubImage(region)
+
+    tick := s.lineProgress(region.Dx() + region.Dy())
+    if rowResults, err = rowPeriodicities(ctx, detectImg, palette, imageFormat, s.weightedVote, tick); err != nil {
+      return nil, err
+    }
+    if colResults, err = colPeriodicities(ctx, detectImg, palette, imageFormat, s.weightedVote, tick); err != nil {
+      return nil, err
+    }
+    rowLines = votes("row", rowResults)
+    colLines = votes("col", colResults)
+  }
+
+  return &analysis{
+    img: img,
+    detectImg: detectImg,
+    imageFormat: imageFormat,
+    rowLines: rowLines,
+    colLines: colLines,
+    rowResults: rowResults,
+    colResults: colResults,
+    palette: palette,
+  }, nil
+}
+
+// writePeriodsCSV writes the period, score and margin found in every row and
+// col, before the vote, to the CSV file with the given name. Lines are
+// indexed by their y or x coordinate in the image.
+func (a *analysis) writePeriodsCSV(name string) error {
+  var b strings.Builder
+  w := csv.NewWriter(&b)
+  w.Write([]string{"axis", "index", "period", "score", "margin"})
+  write := func(axis string, start int, results []LineResult) {
+    for idx, result := range results {
+      w.Write([]string{
+        axis,
+        strconv.Itoa(start + idx),
+        strconv.Itoa(result.Period),
+        strconv.FormatFloat(result.Score, 'f', -1, 64),
+        strconv.FormatFloat(result.Margin, 'f', -1, 64),
+      })
+    }
+  }
+  bounds := a.detectImg.Bounds()
+  write("row", bounds.Min.Y, a.rowResults)
+  write("col", bounds.Min.X, a.colResults)
+  w.Flush()
+  if err := w.Error(); err != nil {
+    return err
+  }
+  return os.WriteFile(name, []byte(b.String()), 0644)
+}
+
+// extract votes on the tile size and grades the resulting tile. It gives up
+// once ctx is done.
+func (a *analysis) extract(ctx context.Context, s settings, logger *log.Logger) (extraction, error) {
+  origin := a.img.Bounds().Min.Add(image.Pt(s.offsetX, s.offsetY))
+
+  var rowPeriodicity, colPeriodicity int
+  var rowConfidence, colConfidence float64
+  switch s.algorithm {
+  case "keypoints":
+    d := a.keypointDetection(origin, s, logger)
+    rowPeriodicity, colPeriodicity = d.Width, d.Height
+    rowConfidence, colConfidence = d.WidthConfidence, d.HeightConfidence
+  case "ensemble":
+    d, err := a.ensemblePeriods(ctx, origin, s, logger)
+    if err != nil {
+      return extraction{}, err
+    }
+    rowPeriodicity, colPeriodicity = d.Width, d.Height
+    rowConfidence, colConfidence = d.WidthConfidence, d.HeightConfidence
+  default:
+    var err error
+    if rowPeriodicity, rowConfidence, err = consensusPeriod(logger, "Row", a.rowLines, s.weightedVote, s.rowTolerance, s.rowPreferFrequency, s.tieBreak); err != nil {
+      return extraction{}, err
+    }
+    if colPeriodicity, colConfidence, err = consensusPeriod(logger, "Col", a.colLines, s.weightedVote, s.colTolerance, s.colPreferFrequency, s.tieBreak); err != nil {
+      return extraction{}, err
+    }
+  }
+
+  bounds := a.img.Bounds()
+  if rowPeriodicity >= bounds.Dx() && colPeriodicity >= bounds.Dy() {
+    return extraction{}, fmt.Errorf("%w: neither the rows nor the cols repeat", ErrNoPeriodicity)
+  }
+
+  if s.algorithm == "lines" && s.tieBreak == "lowest-reconstruction-error" {
+    rowTied := []int{rowPeriodicity}
+    if s.rowPreferFrequency {
+      rowTied = tiedPeriods(a.rowLines, s.weightedVote, rowPeriodicity)
+    }
+    colTied := []int{colPeriodicity}
+    if s.colPreferFrequency {
+      colTied = tiedPeriods(a.colLines, s.weightedVote, colPeriodicity)
+    }
+    if len(rowTied) > 1 || len(colTied) > 1 {
+      best := rankCandidates(a.buffer(), origin, rowTied, colTied, s.numProc)[0]
+      logger.Printf(tr("Broke the tie between row periods %v and col periods %v by reconstruction error: %dx%d\n"), rowTied, colTied, best.Width, best.Height)
+      rowPeriodicity, colPeriodicity = best.Width, best.Height
+    }
+  }
+
+  if s.trimRepeats {
+    threshold := 0.0
+    if a.imageFormat == LOSSY {
+      threshold = nearExactError
+    }
+    width := a.buffer().fundamentalPeriod(origin, rowPeriodicity, colPeriodicity, true, threshold)
+    height := a.buffer().fundamentalPeriod(origin, width, colPeriodicity, false, threshold)
+    if width != rowPeriodicity || height != colPeriodicity {
+      logger.Printf(tr("Trimmed the %dx%d tile to its fundamental repeat of %dx%d\n"), rowPeriodicity, colPeriodicity, width, height)
+      rowPeriodicity, colPeriodicity = width, height
+    }
+  }
+
+  reconstructionError, grade := a.grade(s, logger, origin, rowPeriodicity, colPeriodicity)
+
+  return extraction{
+    Origin: origin,
+    Width: rowPeriodicity,
+    Height: colPeriodicity,
+    RowConfidence: rowConfidence,
+    ColConfidence: colConfidence,
+    Error: reconstructionError,
+    Grade: grade,
+  }, nil
+}
+
+// DetectionResult is the tile found in one image, as printed by -json.
+type DetectionResult struct {
+  Input string `json:"input,omitempty"`
+  TileWidth int `json:"tile_width"`
+  TileHeight int `json:"tile_height"`
+  RowConfidence float64 `json:"row_confidence"`
+  ColConfidence float64 `json:"col_confidence"`
+  Offset Offset `json:"offset"`
+}
+
+// Offset is the top left corner of a tile within its image.
+type Offset struct {
+  X int `json:"x"`
+  Y int `json:"y"`
+}
+
+func (e extraction) result(input string) DetectionResult {
+  return DetectionResult{
+    Input: input,
+    TileWidth: e.Width,
+    TileHeight: e.Height,
+    RowConfidence: e.RowConfidence,
+    ColConfidence: e.ColConfidence,
+    Offset: Offset{X: e.Origin.X, Y: e.Origin.Y},
+  }
+}
+
+// EdgeMap returns the boundaries between differently colored regions of img:
+// white where a pixel differs from its right or bottom neighbor by more than
+// threshold in any channel, black elsewhere. Swapping the colors of a pattern
+// for another colorway keeps the boundaries, so the edge map repeats with the
+// structure of the pattern rather than with its colors. The last row and
+// column have no neighbors to compare with and are left out.
+func EdgeMap(img image.Image, threshold uint32) *image.Gray {
+  bounds := img.Bounds()
+  bounds.Max = bounds.Max.Sub(image.Pt(1, 1))
+  if bounds.Empty() {
+    return image.NewGray(image.Rectangle{})
+  }
+  edges := image.NewGray(bounds)
+  differs := func(x, y Color) bool {
+    return absDiff(x.R, y.R) > threshold || absDiff(x.G, y.G) > threshold || absDiff(x.B, y.B) > threshold || absDiff(x.A, y.A) > threshold
+  }
+  at := func(x, y int) Color {
+    return colorAt(img, x, y)
+  }
+  for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+    for x := bounds.Min.X; x < bounds.Max.X; x++ {
+      c := at(x, y)
+      if differs(c, at(x + 1, y)) || differs(c, at(x, y + 1)) {
+        edges.SetGray(x, y, color.Gray{Y: 0xff})
+      }
+    }
+  }
+  return edges
+}
+
+// structuralPeriods votes on the periods of the edge map of the image, which
+// repeats with the structure of the pattern even when its colors only repeat
+// every few structural repeats.
+func (a *analysis) structuralPeriods(ctx context.Context, s settings) (int, int, error) {
+  threshold := uint32(0)
+  if a.imageFormat == LOSSY {
+    threshold = 0x1000
+  }
+  edges := EdgeMap(a.detectImg, threshold)
+  bounds := edges.Bounds()
+  tick := s.lineProgress(bounds.Dx() + bounds.Dy())
+  rowLines, err := rowPeriodicities(ctx, edges, nil, a.imageFormat, s.weightedVote, tick)
+  if err != nil {
+    return 0, 0, err
+  }
+  colLines, err := colPeriodicities(ctx, edges, nil, a.imageFormat, s.weightedVote, tick)
+  if err != nil {
+    return 0, 0, err
+  }
+  rowPeriod, _ := choosePeriod(rowLines, s.weightedVote, s.rowTolerance, s.rowPreferFrequency, s.tieBreak)
+  colPeriod, _ := choosePeriod(colLines, s.weightedVote, s.colTolerance, s.colPreferFrequency, s.tieBreak)
+  return rowPeriod, colPeriod, nil
+}
@@ -0,0 +1,428 @@
+/*
+TileEx : A Tiling Pattern Extractor written in Go
+Copyright (C) 2023, Sarthak Shah (shahsarthakw@gmail.com)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+  "bytes"
+  "compress/zlib"
+  "encoding/binary"
+  "errors"
+  "io"
+  "fmt"
+  "sort"
+  "image"
+  "image/color"
+  "image/draw"
+)
+
+// Aseprite files are decoded here as well, so that pixel art can be read
+// from the working file rather than an export. The visible layers of a frame
+// are flattened with their opacities, all in the normal blend mode, and
+// indexed sprites stay paletted as long as no layer or cel is translucent.
+// Tilemap layers are not supported.
+func init() {
+  registerFormat("aseprite", "????\xe0\xa5", decodeAseprite, decodeAsepriteConfig)
+}
+
+// aseLayer is a layer of an Aseprite file.
+type aseLayer struct {
+  name string
+  flags, kind, opacity int
+  // parent is the index of the group the layer is in, or -1 at the top.
+  parent int
+}
+
+// The flags of Aseprite layers that decoding looks at.
+const (
+  aseVisible = 1
+  aseBackground = 8
+  aseReference = 64
+)
+
+// aseCel is the image of one layer in one frame, with the pixels as they
+// are stored in the color depth of the file.
+type aseCel struct {
+  layer, x, y, width, height, opacity, z int
+  pix []byte
+  // tilemap marks the cels of tilemap layers, which hold tile indices.
+  tilemap bool
+}
+
+// aseFile is what flattening the frames of an Aseprite file needs.
+type aseFile struct {
+  width, height, depth int
+  transparent uint8
+  // layerOpacity is whether the opacities of the layers are to be applied,
+  // as files from before they were introduced leave them unset.
+  layerOpacity bool
+  palette color.Palette
+  layers []aseLayer
+  frames [][]aseCel
+}
+
+func readAseprite(data []byte) (*aseFile, error) {
+  le := binary.LittleEndian
+  if len(data) < 128 || le.Uint16(data[4:6]) != 0xa5e0 {
+    return nil, errors.New("aseprite: not an Aseprite file")
+  }
+  f := &aseFile{width: int(le.Uint16(data[8:10])), height: int(le.Uint16(data[10:12])), depth: int(le.Uint16(data[12:14]))}
+  f.layerOpacity = le.Uint32(data[14:18]) & 1 != 0
+  f.transparent = data[28]
+  switch {
+  case f.width == 0 || f.height == 0:
+    return nil, errors.New("aseprite: invalid image size")
+  case f.depth != 8 && f.depth != 16 && f.depth != 32:
+    return nil, fmt.Errorf("aseprite: color depth %d is not supported", f.depth)
+  }
+  bytesPerPixel := f.depth / 8
+  // groups holds the last layer seen at each level of nesting, the parents
+  // of the layers that follow one level deeper.
+  var groups []int
+  newPalette := false
+  at := 128
+  for frame := 0; frame < int(le.Uint16(data[6:8])); frame++ {
+    if at + 16 > len(data) || le.Uint16(data[at + 4:]) != 0xf1fa {
+      return nil, fmt.Errorf("aseprite: frame %d is truncated", frame + 1)
+    }
+    end := at + int(le.Uint32(data[at:]))
+    if end < at + 16 || end > len(data) {
+      return nil, fmt.Errorf("aseprite: frame %d is truncated", frame + 1)
+    }
+    chunks := int(le.Uint32(data[at + 12:]))
+    if chunks == 0 {
+      chunks = int(le.Uint16(data[at + 6:]))
+    }
+    var cels []aseCel
+    at += 16
+    for ; chunks > 0; chunks-- {
+      if at + 6 > end {
+        return nil, fmt.Errorf("aseprite: frame %d is truncated", frame + 1)
+      }
+      size := int(le.Uint32(data[at:]))
+      if size < 6 || size > end - at {
+        return nil, fmt.Errorf("aseprite: frame %d is truncated", frame + 1)
+      }
+      kind, chunk := le.Uint16(data[at + 4:]), data[at + 6:at + size]
+      at += size
+      switch {
+      case kind == 0x0004 && !newPalette && len(chunk) >= 2:
+        // The palette of old files comes in packets of colors, each one
+        // skipping some entries first.
+        entry, rest := 0, chunk[2:]
+        for packets := le.Uint16(chunk); packets > 0 && len(rest) >= 2; packets-- {
+          entry += int(rest[0])
+          count := int(rest[1])
+          if count == 0 {
+            count = 256
+          }
+          rest = rest[2:]
+          for ; count > 0 && len(rest) >= 3 && entry < 256; count-- {
+            for len(f.palette) <= entry {
+              f.palette = append(f.palette, color.NRGBA{A: 0xff})
+            }
+            f.palette[entry] = color.NRGBA{rest[0], rest[1], rest[2], 0xff}
+            entry, rest = entry + 1, rest[3:]
+          }
+        }
+      case kind == 0x2019 && len(chunk) >= 20:
+        newPalette = true
+        size, first, last := int(le.Uint32(chunk)), int(le.Uint32(chunk[4:])), int(le.Uint32(chunk[8:]))
+        if size > 256 || last >= size || first > last {
+          return nil, errors.New("aseprite: invalid palette")
+        }
+        for len(f.palette) < size {
+          f.palette = append(f.palette, color.NRGBA{A: 0xff})
+        }
+        rest := chunk[20:]
+        for entry := first; entry <= last; entry++ {
+          if len(rest) < 6 {
+            return nil, errors.New("aseprite: truncated palette")
+          }
+          f.palette[entry] = color.NRGBA{rest[2], rest[3], rest[4], rest[5]}
+          // Named entries carry their name along.
+          named := le.Uint16(rest) & 1 != 0
+          rest = rest[6:]
+          if named {
+            if len(rest) < 2 || int(le.Uint16(rest)) > len(rest) - 2 {
+              return nil, errors.New("aseprite: truncated palette")
+            }
+            rest = rest[2 + int(le.Uint16(rest)):]
+          }
+        }
+      case kind == 0x2004:
+        if len(chunk) < 18 || int(le.Uint16(chunk[16:])) > len(chunk) - 18 {
+          return nil, errors.New("aseprite: truncated layer")
+        }
+        layer := aseLayer{flags: int(le.Uint16(chunk)), kind: int(le.Uint16(chunk[2:])), opacity: int(chunk[12]), parent: -1}
+        layer.name = string(chunk[18:18 + int(le.Uint16(chunk[16:]))])
+        level := int(le.Uint16(chunk[4:]))
+        if level > len(groups) {
+          return nil, fmt.Errorf("aseprite: layer %q is nested in no group", layer.name)
+        }
+        if level > 0 {
+          layer.parent = groups[level - 1]
+        }
+        groups = append(groups[:level], len(f.layers))
+        f.layers = append(f.layers, layer)
+      case kind == 0x2005:
+        if len(chunk) < 16 {
+          return nil, errors.New("aseprite: truncated cel")
+        }
+        cel := aseCel{layer: int(le.Uint16(chunk)), x: int(int16(le.Uint16(chunk[2:]))), y: int(int16(le.Uint16(chunk[4:]))), opacity: int(chunk[6]), z: int(int16(le.Uint16(chunk[9:])))}
+        body := chunk[16:]
+        switch celType := le.Uint16(chunk[7:]); celType {
+        case 0, 2:
+          if len(body) < 4 {
+            return nil, errors.New("aseprite: truncated cel")
+          }
+          cel.width, cel.height = int(le.Uint16(body)), int(le.Uint16(body[2:]))
+          // Aseprite keeps cels within the size of the sprite, and larger
+          // ones are turned down before a few compressed bytes inflate to
+          // gigabytes.
+          if cel.width > f.width || cel.height > f.height {
+            return nil, fmt.Errorf("aseprite: a cel of %dx%d is larger than the %dx%d sprite", cel.width, cel.height, f.width, f.height)
+          }
+          size := cel.width * cel.height * bytesPerPixel
+          if celType == 0 {
+            cel.pix = body[4:]
+          } else {
+            zr, err := zlib.NewReader(bytes.NewReader(body[4:]))
+            if err != nil {
+              return nil, fmt.Errorf("aseprite: %w", err)
+            }
+            cel.pix, err = io.ReadAll(io.LimitReader(zr, int64(size)))
+            if err != nil {
+              return nil, fmt.Errorf("aseprite: %w", err)
+            }
+          }
+          if len(cel.pix) < size {
+            return nil, errors.New("aseprite: truncated cel")
+          }
+        case 1:
+          // A linked cel shows the cel of the same layer in another frame.
+          if len(body) < 2 {
+            return nil, errors.New("aseprite: truncated cel")
+          }
+          linked := int(le.Uint16(body))
+          if linked >= frame {
+            return nil, fmt.Errorf("aseprite: frame %d links to frame %d", frame + 1, linked + 1)
+          }
+          for _, other := range f.frames[linked] {
+            if other.layer == cel.layer {
+              other.z = cel.z
+              cel = other
+            }
+          }
+        case 3:
+          cel.tilemap = true
+        default:
+          return nil, fmt.Errorf("aseprite: cel type %d is not supported", celType)
+        }
+        cels = append(cels, cel)
+      }
+    }
+    f.frames = append(f.frames, cels)
+    at = end
+  }
+  if len(f.frames) == 0 {
+    return nil, errors.New("aseprite: no frames")
+  }
+  if f.depth == 8 && len(f.palette) == 0 {
+    return nil, errors.New("aseprite: missing palette")
+  }
+  return f, nil
+}
+
+// flatten draws the cels of frame, counting from 0, that belong to the
+// visible layers, or only to layer and the visible layers nested in it if a
+// name is given.
+func (f *aseFile) flatten(frame int, layer string) (image.Image, error) {
+  root := -1
+  if layer != "" {
+    for idx := len(f.layers) - 1; idx >= 0; idx-- {
+      if f.layers[idx].name == layer {
+        root = idx
+      }
+    }
+    if root < 0 {
+      return nil, fmt.Errorf("aseprite: there is no layer %q", layer)
+    }
+  }
+  included := func(idx int) bool {
+    for ; idx >= 0; idx = f.layers[idx].parent {
+      if idx == root {
+        return true
+      }
+      if f.layers[idx].flags & aseVisible == 0 || f.layers[idx].flags & aseReference != 0 {
+        return false
+      }
+    }
+    return root < 0
+  }
+  var cels []aseCel
+  paletted := f.depth == 8
+  for _, cel := range f.frames[frame] {
+    if cel.layer >= len(f.layers) || !included(cel.layer) {
+      continue
+    }
+    if cel.tilemap {
+      return nil, fmt.Errorf("aseprite: layer %q is a tilemap, which is not supported", f.layers[cel.layer].name)
+    }
+    if f.layerOpacity {
+      cel.opacity = (cel.opacity * f.layers[cel.layer].opacity + 127) / 255
+    }
+    paletted = paletted && cel.opacity == 0xff
+    cels = append(cels, cel)
+  }
+  // The z-index of a cel moves it up or down among the layers, and ahead
+  // of the layer it lands on when it is moved down.
+  sort.SliceStable(cels, func(i, j int) bool {
+    if cels[i].layer + cels[i].z != cels[j].layer + cels[j].z {
+      return cels[i].layer + cels[i].z < cels[j].layer + cels[j].z
+    }
+    return cels[i].z < cels[j].z
+  })
+
+  rect := image.Rect(0, 0, f.width, f.height)
+  // Only the transparent index is transparent in indexed sprites, except
+  // in the background layer.
+  palette := make(color.Palette, len(f.palette))
+  copy(palette, f.palette)
+  if int(f.transparent) < len(palette) {
+    palette[f.transparent] = color.NRGBA{}
+  }
+  if paletted {
+    img := image.NewPaletted(rect, palette)
+    for i := range img.Pix {
+      img.Pix[i] = f.transparent
+    }
+    for _, cel := range cels {
+      background := f.layers[cel.layer].flags & aseBackground != 0
+      for y := 0; y < cel.height; y++ {
+        for x := 0; x < cel.width; x++ {
+          index := cel.pix[y * cel.width + x]
+          if image.Pt(cel.x + x, cel.y + y).In(rect) && (index != f.transparent || background) && int(index) < len(palette) {
+            img.Pix[(cel.y + y) * img.Stride + cel.x + x] = index
+          }
+        }
+      }
+    }
+    return img, nil
+  }
+  // Indices past the end of the palette are left transparent.
+  padded, opaque := make(color.Palette, 256), make(color.Palette, 256)
+  for i := range padded {
+    padded[i], opaque[i] = color.NRGBA{}, color.NRGBA{}
+    if i < len(palette) {
+      padded[i], opaque[i] = palette[i], f.palette[i]
+    }
+  }
+  img := image.NewRGBA(rect)
+  for _, cel := range cels {
+    bounds := image.Rect(cel.x, cel.y, cel.x + cel.width, cel.y + cel.height)
+    var src image.Image
+    switch f.depth {
+    case 32:
+      src = &image.NRGBA{Pix: cel.pix, Stride: 4 * cel.width, Rect: bounds}
+    case 16:
+      gray := image.NewNRGBA(bounds)
+      for i := 0; i < cel.width * cel.height; i++ {
+        v, a := cel.pix[2 * i], cel.pix[2 * i + 1]
+        gray.Pix[4 * i], gray.Pix[4 * i + 1], gray.Pix[4 * i + 2], gray.Pix[4 * i + 3] = v, v, v, a
+      }
+      src = gray
+    default:
+      colors := padded
+      if f.layers[cel.layer].flags & aseBackground != 0 {
+        colors = opaque
+      }
+      src = &image.Paletted{Pix: cel.pix, Stride: cel.width, Rect: bounds, Palette: colors}
+    }
+    var mask image.Image
+    if cel.opacity < 0xff {
+      mask = image.NewUniform(color.Alpha{uint8(cel.opacity)})
+    }
+    draw.DrawMask(img, bounds, src, bounds.Min, mask, image.Point{}, draw.Over)
+  }
+  return img, nil
+}
+
+func decodeAsepriteConfig(r io.Reader) (image.Config, error) {
+  data, err := io.ReadAll(r)
+  if err != nil {
+    return image.Config{}, err
+  }
+  f, err := readAseprite(data)
+  if err != nil {
+    return image.Config{}, err
+  }
+  var model color.Model = color.RGBAModel
+  if f.depth == 8 {
+    model = f.palette
+  }
+  return image.Config{ColorModel: model, Width: f.width, Height: f.height}, nil
+}
+
+// decodeAseprite decodes the first frame of an Aseprite file.
+func decodeAseprite(r io.Reader) (image.Image, error) {
+  data, err := io.ReadAll(r)
+  if err != nil {
+    return nil, err
+  }
+  return asepriteFrame(data, 1, "")
+}
+
+// isAseprite reports whether data starts like an Aseprite file.
+func isAseprite(data []byte) bool {
+  return len(data) >= 6 && binary.LittleEndian.Uint16(data[4:]) == 0xa5e0
+}
+
+// asepriteFrame decodes frame of the Aseprite file in data, counting from 1,
+// from only layer if it is given.
+func asepriteFrame(data []byte, frame int, layer string) (image.Image, error) {
+  f, err := readAseprite(data)
+  if err != nil {
+    return nil, err
+  }
+  if err := checkMaxSize(f.width, f.height); err != nil {
+    return nil, err
+  }
+  if frame < 1 || frame > len(f.frames) {
+    return nil, fmt.Errorf("the Aseprite file has %d frames, there is no frame %d", len(f.frames), frame)
+  }
+  return f.flatten(frame - 1, layer)
+}
+
+// asepriteFrames decodes every frame of the Aseprite file in data, from only
+// layer if it is given.
+func asepriteFrames(data []byte, layer string) ([]image.Image, error) {
+  f, err := readAseprite(data)
+  if err != nil {
+    return nil, err
+  }
+  if err := checkMaxSize(f.width, f.height); err != nil {
+    return nil, err
+  }
+  frames := make([]image.Image, len(f.frames))
+  for idx := range f.frames {
+    if frames[idx], err = f.flatten(idx, layer); err != nil {
+      return nil, fmt.Errorf("frame %d: %w", idx + 1, err)
+    }
+  }
+  return frames, nil
+}
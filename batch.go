@@ -0,0 +1,1292 @@
+/*
+TileEx : A Tiling Pattern Extractor written in Go
+Copyright (C) 2023, Sarthak Shah (shahsarthakw@gmail.com)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+  "archive/tar"
+  "archive/zip"
+  "bytes"
+  "compress/gzip"
+  "context"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/csv"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "io"
+  "io/fs"
+  "os"
+  "path"
+  "path/filepath"
+  "fmt"
+  "flag"
+  "sort"
+  "strconv"
+  "strings"
+  "unicode/utf8"
+  "image"
+  "image/gif"
+  "log"
+  "log/slog"
+  "sync"
+  "time"
+)
+
+// Failure records an input that could not be processed in a batch.
+type Failure struct {
+  Input string `json:"input"`
+  Error string `json:"error"`
+  Attempts int `json:"attempts"`
+}
+
+// batch applies the -on-error policy to a run over many inputs and collects
+// the inputs that failed, so that a long run can survive corrupt files while
+// still reporting them.
+type batch struct {
+  onError, failureList, stats string
+  retries int
+  // runID tells apart the log lines of concurrent runs.
+  runID string
+  // halted is set once an input failed under the stop policy.
+  halted bool
+  // log receives the warnings and the failed inputs. The default mode sets
+  // it to its logger, and prepare to a text logger on stderr otherwise.
+  log *slog.Logger
+  Failures []Failure
+  // mu, set by prepare, guards the above and the -stats file against
+  // inputs processed at the same time.
+  mu *sync.Mutex
+}
+
+func addBatchFlags(fs *flag.FlagSet, b *batch) {
+  fs.StringVar(&b.onError, "on-error", "skip", "What to do when an input fails: skip it, stop the batch, or retry:N times before skipping it")
+  fs.StringVar(&b.failureList, "failure-list", "", "Write the inputs that failed to the given JSON file")
+  fs.StringVar(&b.stats, "stats", "", "Append the size, detected tile, confidence, algorithm and timing of every image, but nothing that identifies it, to the given CSV file")
+}
+
+// prepare validates the -on-error policy.
+func (b *batch) prepare() error {
+  b.runID = newRunID()
+  b.mu = new(sync.Mutex)
+  if b.log == nil {
+    b.log = slog.New(&textHandler{w: os.Stderr, level: slog.LevelInfo, mu: new(sync.Mutex)})
+  }
+  switch {
+  case b.onError == "skip" || b.onError == "stop":
+  case strings.HasPrefix(b.onError, "retry:"):
+    retries, err := strconv.Atoi(strings.TrimPrefix(b.onError, "retry:"))
+    if err != nil || retries < 0 {
+      return fmt.Errorf("invalid retry count in -on-error %q", b.onError)
+    }
+    b.retries = retries
+  default:
+    return fmt.Errorf("unknown -on-error policy %q, expected skip, stop or retry:N", b.onError)
+  }
+  return nil
+}
+
+// run processes input with fn, retrying it as often as the policy allows,
+// and records it as failed if it never succeeds.
+func (b *batch) run(input string, fn func() error) error {
+  var err error
+  attempts := 0
+  for attempts <= b.retries {
+    attempts++
+    if err = attempt(fn); err == nil {
+      return nil
+    }
+  }
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  b.Failures = append(b.Failures, Failure{Input: input, Error: err.Error(), Attempts: attempts})
+  if b.onError == "stop" {
+    b.halted = true
+  }
+  return err
+}
+
+// stopped reports whether an input failed under the stop policy, so that no
+// more are to be started.
+func (b *batch) stopped() bool {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  return b.halted
+}
+
+// attempt calls fn, turning a panic, say in the decoder of a corrupt file,
+// into an error, so that it only fails the input at hand.
+func attempt(fn func() error) (err error) {
+  defer func() {
+    if r := recover(); r != nil {
+      err = fmt.Errorf("panic: %v", r)
+    }
+  }()
+  return fn()
+}
+
+// scheduler bounds the images of a run that are processed at once, by their
+// number and by the memory they are estimated to take.
+type scheduler struct {
+  jobs int
+  maxMemory int64
+  mu sync.Mutex
+  cond *sync.Cond
+  running int
+  memory int64
+}
+
+func newScheduler(jobs int, maxMemory int64) *scheduler {
+  s := &scheduler{jobs: jobs, maxMemory: maxMemory}
+  s.cond = sync.NewCond(&s.mu)
+  return s
+}
+
+// acquire waits until an image estimated to take memory bytes may start. A
+// maxMemory of 0 means no limit, and an image over the whole of it still
+// runs, but alone.
+func (s *scheduler) acquire(memory int64) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  for s.running >= s.jobs || (s.running > 0 && s.maxMemory > 0 && s.memory + memory > s.maxMemory) {
+    s.cond.Wait()
+  }
+  s.running++
+  s.memory += memory
+}
+
+func (s *scheduler) release(memory int64) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.running--
+  s.memory -= memory
+  s.cond.Broadcast()
+}
+
+// imageMemory estimates the memory that extracting the tile of the image
+// file with the given name takes from the size in its header, at about 32
+// bytes a pixel for the decoded image and the buffers of the analysis.
+// Files whose header cannot be read count as nothing, and fail when they are
+// decoded instead.
+func imageMemory(name string) int64 {
+  file, err := os.Open(name)
+  if err != nil {
+    return 0
+  }
+  defer file.Close()
+  config, _, err := image.DecodeConfig(file)
+  if err != nil {
+    return 0
+  }
+  return 32 * int64(config.Width) * int64(config.Height)
+}
+
+// logger returns a logger whose lines start with the run ID and the input
+// they are about, so that the interleaved output of images processed at the
+// same time stays attributable.
+func (b *batch) logger(out io.Writer, input string) *log.Logger {
+  return log.New(out, fmt.Sprintf("[%s %s] ", b.runID, input), 0)
+}
+
+// newRunID returns a short random identifier for a run.
+func newRunID() string {
+  var id [3]byte
+  if _, err := rand.Read(id[:]); err != nil {
+    return "000000"
+  }
+  return hex.EncodeToString(id[:])
+}
+
+// statsHeader names the columns of the -stats file.
+var statsHeader = []string{"width", "height", "algorithm", "format", "tile_width", "tile_height", "row_confidence", "col_confidence", "grade", "seconds", "outcome"}
+
+// outcome names the kind of error that ended the processing of an image
+// without its message, which may contain the name of the file.
+func outcome(err error) string {
+  switch {
+  case err == nil:
+    return "ok"
+  case errors.Is(err, ErrNoPeriodicity):
+    return "no-periodicity"
+  case errors.Is(err, ErrAmbiguousPeriod):
+    return "ambiguous"
+  case errors.Is(err, ErrImageTooSmall):
+    return "too-small"
+  case errors.Is(err, ErrImageTooLarge):
+    return "too-large"
+  case errors.Is(err, context.DeadlineExceeded):
+    return "timeout"
+  }
+  return "error"
+}
+
+// record appends a line describing one processed image to the -stats file,
+// if one was given. a is nil if the analysis itself failed. Only features that do not identify the image are kept:
+// its size, the tile found in it, how confident the vote was, the detector
+// that ran and how long it took, but neither its name nor its pixels. A
+// failure to write the line is only a warning.
+func (b *batch) record(s settings, bounds image.Rectangle, a *analysis, ext extraction, elapsed time.Duration, err error) {
+  if b.stats == "" {
+    return
+  }
+  format := ""
+  if a != nil && a.imageFormat == LOSSLESS {
+    format = "lossless"
+  } else if a != nil {
+    format = "lossy"
+  }
+  row := []string{
+    strconv.Itoa(bounds.Dx()),
+    strconv.Itoa(bounds.Dy()),
+    s.algorithm,
+    format,
+    "", "", "", "", "",
+    strconv.FormatFloat(elapsed.Seconds(), 'f', 3, 64),
+    outcome(err),
+  }
+  if err == nil {
+    row[4] = strconv.Itoa(ext.Width)
+    row[5] = strconv.Itoa(ext.Height)
+    row[6] = strconv.FormatFloat(ext.RowConfidence, 'f', 4, 64)
+    row[7] = strconv.FormatFloat(ext.ColConfidence, 'f', 4, 64)
+    row[8] = ext.Grade.String()
+  }
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  if err := appendCSV(b.stats, statsHeader, row); err != nil {
+    b.log.Warn(fmt.Sprintf(tr("Could not write the statistics: %v"), err))
+  }
+}
+
+// appendCSV appends row to the CSV file with the given name, starting the
+// file with header if it is new.
+func appendCSV(name string, header, row []string) error {
+  file, err := os.OpenFile(name, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644)
+  if err != nil {
+    return err
+  }
+  defer file.Close()
+  info, err := file.Stat()
+  if err != nil {
+    return err
+  }
+  w := csv.NewWriter(file)
+  if info.Size() == 0 {
+    w.Write(header)
+  }
+  w.Write(row)
+  w.Flush()
+  return w.Error()
+}
+
+// extractTile analyzes img, read from the file named input, and extracts its
+// tile, recording the outcome in the -stats file.
+func (b *batch) extractTile(ctx context.Context, img image.Image, input string, s settings, logger *log.Logger) (*analysis, extraction, error) {
+  start := time.Now()
+  a, err := analyze(ctx, img, input, s, logger)
+  var ext extraction
+  if err == nil {
+    ext, err = a.extract(ctx, s, logger)
+  }
+  b.record(s, img.Bounds(), a, ext, time.Since(start), err)
+  return a, ext, err
+}
+
+// finish reports the failures and writes the failure list if one was asked
+// for.
+func (b *batch) finish() error {
+  for _, failure := range b.Failures {
+    b.log.Error(fmt.Sprintf(tr("Failed input %s: %s"), failure.Input, failure.Error))
+  }
+  if b.failureList == "" {
+    return nil
+  }
+  failures := b.Failures
+  if failures == nil {
+    failures = []Failure{}
+  }
+  data, err := json.MarshalIndent(failures, "", "  ")
+  if err != nil {
+    return err
+  }
+  return os.WriteFile(b.failureList, append(data, '\n'), 0644)
+}
+
+// manifestEntry records the tile that is expected to be extracted from a
+// source image.
+type manifestEntry struct {
+  Width, Height int
+  Hash string
+}
+
+func (e manifestEntry) String() string {
+  return fmt.Sprintf("%dx%d %s", e.Width, e.Height, e.Hash)
+}
+
+// readManifest reads a manifest made of "path WIDTHxHEIGHT sha256" lines.
+// Blank lines and lines starting with # are ignored.
+func readManifest(name string) (map[string]manifestEntry, error) {
+  data, err := os.ReadFile(name)
+  if err != nil {
+    return nil, err
+  }
+  entries := make(map[string]manifestEntry)
+  for lineNum, line := range strings.Split(string(data), "\n") {
+    line = strings.TrimSpace(line)
+    if line == "" || strings.HasPrefix(line, "#") {
+      continue
+    }
+    fields := strings.Fields(line)
+    var entry manifestEntry
+    if len(fields) != 3 {
+      return nil, fmt.Errorf("%s:%d: expected path, size and hash", name, lineNum + 1)
+    }
+    if _, err := fmt.Sscanf(fields[1], "%dx%d", &entry.Width, &entry.Height); err != nil {
+      return nil, fmt.Errorf("%s:%d: invalid size %q", name, lineNum + 1, fields[1])
+    }
+    entry.Hash = fields[2]
+    entries[fields[0]] = entry
+  }
+  return entries, nil
+}
+
+// writeManifest writes the entries sorted by path.
+func writeManifest(name string, entries map[string]manifestEntry) error {
+  var paths []string
+  for p := range entries {
+    paths = append(paths, p)
+  }
+  sort.Strings(paths)
+
+  var b strings.Builder
+  b.WriteString("# TileEx tile manifest: path WIDTHxHEIGHT sha256-of-pixels\n")
+  for _, p := range paths {
+    fmt.Fprintf(&b, "%s %s\n", p, entries[p])
+  }
+  return os.WriteFile(name, []byte(b.String()), 0644)
+}
+
+// tileHash returns the SHA-256 of the pixels of the tile, so that it does
+// not depend on how the tile is encoded.
+func tileHash(tile *image.RGBA) string {
+  sum := sha256.Sum256(tile.Pix)
+  return hex.EncodeToString(sum[:])
+}
+
+// isImageFile reports whether name has the extension of an image TileEx
+// reads.
+func isImageFile(name string) bool {
+  switch strings.ToLower(filepath.Ext(name)) {
+  case ".png", ".jpg", ".jpeg", ".gif", ".webp", ".tif", ".tiff", ".bmp", ".avif", ".jxl", ".heic", ".heif", ".psd", ".psb", ".ase", ".aseprite":
+    return true
+  }
+  return false
+}
+
+// imageFiles returns the image files found under the given paths.
+func imageFiles(roots []string) ([]string, error) {
+  var files []string
+  for _, root := range roots {
+    err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+      if err != nil {
+        return err
+      }
+      if isImageFile(p) && !d.IsDir() {
+        files = append(files, filepath.ToSlash(p))
+      }
+      return nil
+    })
+    if err != nil {
+      return nil, err
+    }
+  }
+  sort.Strings(files)
+  return files, nil
+}
+
+// isGlob reports whether name is a pattern rather than the name of a file.
+func isGlob(name string) bool {
+  return strings.ContainsAny(name, "*?[")
+}
+
+// globRoot returns the directory that every match of pattern lies under, the
+// part of it before the first segment with a wildcard.
+func globRoot(pattern string) string {
+  segments := strings.Split(filepath.ToSlash(pattern), "/")
+  for i, segment := range segments {
+    if isGlob(segment) {
+      if i == 0 {
+        return "."
+      }
+      return path.Join(segments[:i]...)
+    }
+  }
+  return path.Dir(filepath.ToSlash(pattern))
+}
+
+// matchGlob reports whether name matches pattern, where ** stands for any
+// number of directories, including none, and the other wildcards are those of
+// path.Match within a single directory.
+func matchGlob(pattern, name string) bool {
+  var match func(patterns, parts []string) bool
+  match = func(patterns, parts []string) bool {
+    if len(patterns) == 0 {
+      return len(parts) == 0
+    }
+    if patterns[0] == "**" {
+      for i := 0; i <= len(parts); i++ {
+        if match(patterns[1:], parts[i:]) {
+          return true
+        }
+      }
+      return false
+    }
+    if len(parts) == 0 {
+      return false
+    }
+    ok, err := path.Match(patterns[0], parts[0])
+    return ok && err == nil && match(patterns[1:], parts[1:])
+  }
+  return match(strings.Split(path.Clean(filepath.ToSlash(pattern)), "/"), strings.Split(path.Clean(filepath.ToSlash(name)), "/"))
+}
+
+// globFiles returns the image files matching pattern.
+func globFiles(pattern string) ([]string, error) {
+  if _, err := path.Match(strings.ReplaceAll(filepath.ToSlash(pattern), "**", "*"), ""); err != nil {
+    return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+  }
+  files, err := imageFiles([]string{globRoot(pattern)})
+  if err != nil {
+    return nil, err
+  }
+  var matches []string
+  for _, file := range files {
+    if matchGlob(pattern, file) {
+      matches = append(matches, file)
+    }
+  }
+  return matches, nil
+}
+
+// excludeFiles leaves out the files matching any of the comma separated
+// patterns of -exclude. A pattern without a slash is matched against the
+// name of the file alone, so *_old.png excludes such files in every
+// directory.
+func excludeFiles(files []string, exclude string) []string {
+  if exclude == "" {
+    return files
+  }
+  var kept []string
+  for _, file := range files {
+    excluded := false
+    for _, pattern := range strings.Split(exclude, ",") {
+      pattern = strings.TrimSpace(pattern)
+      if matchGlob(pattern, file) || (!strings.Contains(pattern, "/") && matchGlob(pattern, path.Base(file))) {
+        excluded = true
+        break
+      }
+    }
+    if !excluded {
+      kept = append(kept, file)
+    }
+  }
+  return kept
+}
+
+// isArchive reports whether name is a ZIP or TAR archive, going by its
+// extension. TAR archives may be gzipped.
+func isArchive(name string) bool {
+  lower := strings.ToLower(name)
+  for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+    if strings.HasSuffix(lower, ext) {
+      return true
+    }
+  }
+  return false
+}
+
+// unpackImages copies the images in the archive with the given name into
+// dir, keeping their paths, and leaves everything else out.
+func unpackImages(name, dir string) error {
+  unpack := func(entry string, r io.Reader) error {
+    // Entries must not end up outside of dir.
+    entry = path.Clean("/" + entry)[1:]
+    if entry == "" || !isImageFile(entry) {
+      return nil
+    }
+    target := filepath.Join(dir, filepath.FromSlash(entry))
+    if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+      return err
+    }
+    file, err := os.Create(target)
+    if err != nil {
+      return err
+    }
+    _, err = io.Copy(file, r)
+    if closeErr := file.Close(); err == nil {
+      err = closeErr
+    }
+    return err
+  }
+
+  if strings.HasSuffix(strings.ToLower(name), ".zip") {
+    archive, err := zip.OpenReader(name)
+    if err != nil {
+      return err
+    }
+    defer archive.Close()
+    for _, f := range archive.File {
+      if f.FileInfo().IsDir() {
+        continue
+      }
+      r, err := f.Open()
+      if err != nil {
+        return err
+      }
+      err = unpack(f.Name, r)
+      r.Close()
+      if err != nil {
+        return fmt.Errorf("%s: %w", f.Name, err)
+      }
+    }
+    return nil
+  }
+
+  file, err := os.Open(name)
+  if err != nil {
+    return err
+  }
+  defer file.Close()
+  var r io.Reader = file
+  if lower := strings.ToLower(name); strings.HasSuffix(lower, ".gz") || strings.HasSuffix(lower, ".tgz") {
+    gz, err := gzip.NewReader(file)
+    if err != nil {
+      return err
+    }
+    defer gz.Close()
+    r = gz
+  }
+  archive := tar.NewReader(r)
+  for {
+    header, err := archive.Next()
+    if err == io.EOF {
+      return nil
+    }
+    if err != nil {
+      return err
+    }
+    if header.Typeflag != tar.TypeReg {
+      continue
+    }
+    if err := unpack(header.Name, archive); err != nil {
+      return fmt.Errorf("%s: %w", header.Name, err)
+    }
+  }
+}
+
+// packFiles writes the files under dir into the archive with the given name,
+// following symbolic links.
+func packFiles(name, dir string, o outputSettings) error {
+  file, err := o.create(name)
+  if err != nil {
+    return err
+  }
+  defer file.Close()
+
+  var add func(entry string, data []byte) error
+  var finish func() error
+  lower := strings.ToLower(name)
+  if strings.HasSuffix(lower, ".zip") {
+    archive := zip.NewWriter(file)
+    add = func(entry string, data []byte) error {
+      w, err := archive.CreateHeader(&zip.FileHeader{Name: entry, Method: zip.Deflate, Modified: time.Now()})
+      if err == nil {
+        _, err = w.Write(data)
+      }
+      return err
+    }
+    finish = archive.Close
+  } else {
+    var w io.Writer = file
+    var gz *gzip.Writer
+    if strings.HasSuffix(lower, ".gz") || strings.HasSuffix(lower, ".tgz") {
+      gz = gzip.NewWriter(file)
+      w = gz
+    }
+    archive := tar.NewWriter(w)
+    add = func(entry string, data []byte) error {
+      header := &tar.Header{Name: entry, Mode: 0644, Size: int64(len(data)), ModTime: time.Now(), Typeflag: tar.TypeReg}
+      if err := archive.WriteHeader(header); err != nil {
+        return err
+      }
+      _, err := archive.Write(data)
+      return err
+    }
+    finish = func() error {
+      if err := archive.Close(); err != nil || gz == nil {
+        return err
+      }
+      return gz.Close()
+    }
+  }
+
+  err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+    if err != nil || d.IsDir() {
+      return err
+    }
+    rel, err := filepath.Rel(dir, p)
+    if err != nil {
+      return err
+    }
+    data, err := os.ReadFile(p)
+    if err != nil {
+      return err
+    }
+    return add(filepath.ToSlash(rel), data)
+  })
+  if err != nil {
+    return err
+  }
+  if err := finish(); err != nil {
+    return err
+  }
+  return file.Close()
+}
+
+// ReportEntry describes the tile detected in one input image. The offset is
+// the top left corner of the tile in the coordinates of the whole input.
+type ReportEntry struct {
+  Input string `json:"input"`
+  Output string `json:"output,omitempty"`
+  TileWidth int `json:"tile_width"`
+  TileHeight int `json:"tile_height"`
+  OffsetX int `json:"offset_x"`
+  OffsetY int `json:"offset_y"`
+  SeamScore float64 `json:"seam_score,omitempty"`
+  Grade string `json:"grade,omitempty"`
+  // DuplicateOf is the input with the same bytes that the tile was
+  // extracted from instead, in runs over directories.
+  DuplicateOf string `json:"duplicate_of,omitempty"`
+  // Seconds is how long the tile took, in runs over directories.
+  Seconds float64 `json:"seconds,omitempty"`
+}
+
+// duplicateFiles returns, for every file with the same bytes as an earlier
+// one, that earlier file. Files that cannot be read are left out, and fail
+// when they are decoded instead.
+func duplicateFiles(files []string) map[string]string {
+  duplicates := make(map[string]string)
+  first := make(map[[sha256.Size]byte]string)
+  for _, file := range files {
+    f, err := os.Open(file)
+    if err != nil {
+      continue
+    }
+    hash := sha256.New()
+    _, err = io.Copy(hash, f)
+    f.Close()
+    if err != nil {
+      continue
+    }
+    var sum [sha256.Size]byte
+    copy(sum[:], hash.Sum(nil))
+    if original, ok := first[sum]; ok {
+      duplicates[file] = original
+    } else {
+      first[sum] = file
+    }
+  }
+  return duplicates
+}
+
+// Checkpoint records the progress of a run over a directory or pattern, so
+// that an interrupted run can resume where it stopped instead of starting
+// over. It is the first line of a checkpoint file, followed by the report
+// entry of every image that succeeded, one per line, which a resumed run
+// skips. Failed images are tried again. Settings describes the flags that
+// the tiles depend on, so that a run with other ones does not take them.
+type Checkpoint struct {
+  Input string `json:"input"`
+  OutputDir string `json:"output_dir"`
+  Settings string `json:"settings"`
+}
+
+// checkpointSettings describes the settings that the tiles of a run depend
+// on, leaving out those that only change how fast they are found or whether
+// files are replaced.
+func checkpointSettings(s settings, o outputSettings) string {
+  s.numProc, s.timeout, s.progress = 0, 0, nil
+  o.force = false
+  return fmt.Sprintf("%+v %+v", s, o)
+}
+
+// readCheckpoint reads the checkpoint file with the given name. A last line
+// cut off by the interruption is ignored.
+func readCheckpoint(name string) (Checkpoint, []ReportEntry, error) {
+  var c Checkpoint
+  data, err := os.ReadFile(name)
+  if err != nil {
+    return c, nil, err
+  }
+  lines := bytes.Split(data, []byte("\n"))
+  if err := json.Unmarshal(lines[0], &c); err != nil {
+    return c, nil, fmt.Errorf("%s: %w", name, err)
+  }
+  var entries []ReportEntry
+  for _, line := range lines[1:] {
+    var entry ReportEntry
+    if json.Unmarshal(line, &entry) != nil {
+      break
+    }
+    entries = append(entries, entry)
+  }
+  return c, entries, nil
+}
+
+// createCheckpoint starts the checkpoint file with the given name over with
+// c and entries, and opens it to append the entries of further images to.
+// Appending keeps the cost of every image the same however long the run
+// gets, and the new file is renamed over the old one, so that an
+// interruption while writing it leaves the old one intact.
+func createCheckpoint(name string, c Checkpoint, entries []ReportEntry) (*os.File, error) {
+  var b bytes.Buffer
+  encoder := json.NewEncoder(&b)
+  if err := encoder.Encode(c); err != nil {
+    return nil, err
+  }
+  for _, entry := range entries {
+    if err := encoder.Encode(entry); err != nil {
+      return nil, err
+    }
+  }
+  if err := os.WriteFile(name + ".tmp", b.Bytes(), 0644); err != nil {
+    return nil, err
+  }
+  if err := os.Rename(name + ".tmp", name); err != nil {
+    return nil, err
+  }
+  return os.OpenFile(name, os.O_WRONLY | os.O_APPEND, 0644)
+}
+
+// readReport reads a report holding either a single entry or a list of them.
+func readReport(name string) ([]ReportEntry, error) {
+  data, err := os.ReadFile(name)
+  if err != nil {
+    return nil, err
+  }
+  var entries []ReportEntry
+  if strings.HasPrefix(strings.TrimSpace(string(data)), "[") {
+    err = json.Unmarshal(data, &entries)
+  } else {
+    var entry ReportEntry
+    err = json.Unmarshal(data, &entry)
+    entries = append(entries, entry)
+  }
+  if err != nil {
+    return nil, fmt.Errorf("%s: %v", name, err)
+  }
+  return entries, nil
+}
+
+func writeReport(name string, entries []ReportEntry) error {
+  data, err := json.MarshalIndent(entries, "", "  ")
+  if err != nil {
+    return err
+  }
+  return os.WriteFile(name, append(data, '\n'), 0644)
+}
+
+// defaultTileOutput names the tile of input when no output was given, e.g.
+// textures/brick.jpg becomes textures/brick-tile.png.
+func defaultTileOutput(input string) string {
+  return strings.TrimSuffix(input, filepath.Ext(input)) + "-tile.png"
+}
+
+// cropFromReport skips detection and only crops and saves the tiles that a
+// report describes. The output of an entry defaults to output when the report
+// holds a single entry. It returns whether every entry succeeded.
+func cropFromReport(out io.Writer, reportName string, output string, o outputSettings, b *batch) bool {
+  entries, err := readReport(reportName)
+  if err != nil {
+    b.log.Error(err.Error())
+    return false
+  }
+  for _, entry := range entries {
+    entryOutput := entry.Output
+    if entryOutput == "" {
+      if len(entries) == 1 {
+        entryOutput = output
+      } else {
+        entryOutput = defaultTileOutput(entry.Input)
+      }
+    }
+    err := b.run(entry.Input, func() error {
+      if entry.TileWidth <= 0 || entry.TileHeight <= 0 {
+        return fmt.Errorf("invalid tile size %dx%d", entry.TileWidth, entry.TileHeight)
+      }
+      img, err := o.decode(entry.Input)
+      if err != nil {
+        return err
+      }
+      origin := image.Pt(entry.OffsetX, entry.OffsetY)
+      return o.save(entryOutput, o.tile(img, origin, entry.TileWidth, entry.TileHeight))
+    })
+    logger := b.logger(out, entry.Input)
+    if err != nil {
+      logger.Println(tr("Error:"), err)
+      if b.halted {
+        break
+      }
+      continue
+    }
+    logger.Printf(tr("Cropped to %s\n"), entryOutput)
+  }
+  if err := b.finish(); err != nil {
+    b.log.Error(err.Error())
+    return false
+  }
+  return len(b.Failures) == 0
+}
+
+// extractFile extracts the tile of one image of a run over a directory into
+// output, or a name from -output-template under outputDir, and describes it
+// as an entry of the report.
+func extractFile(file, rel, output, outputDir string, e extractOptions, s settings, b *batch, o outputSettings, requiredGrade Grade, detailed io.Writer) (ReportEntry, error) {
+  var ext extraction
+  var seamScore float64
+  start := time.Now()
+  err := b.run(e.label(file), func() error {
+    if e.nameTemplate == nil && !e.dryRun {
+      if err := o.claim(output); err != nil {
+        return err
+      }
+    }
+    img, err := o.decode(file)
+    if err != nil {
+      return err
+    }
+    ctx, cancel := s.context(context.Background())
+    defer cancel()
+    var a *analysis
+    a, ext, err = b.extractTile(ctx, img, file, s, b.logger(detailed, e.label(file)))
+    if err != nil {
+      return err
+    }
+    if ext.Grade < requiredGrade {
+      return fmt.Errorf("the tile is graded %s but %s is required", ext.Grade, requiredGrade)
+    }
+    bounds := a.img.Bounds()
+    if !e.allowLargeTile && (float64(ext.Width) > e.maxTileFraction * float64(bounds.Dx()) || float64(ext.Height) > e.maxTileFraction * float64(bounds.Dy())) {
+      return fmt.Errorf("the %dx%d tile covers more than %.0f%% of the %dx%d image", ext.Width, ext.Height, e.maxTileFraction * 100.0, bounds.Dx(), bounds.Dy())
+    }
+    if e.dryRun {
+      return nil
+    }
+    if e.nameTemplate != nil {
+      name, err := e.tileOutput(file, ext)
+      if err != nil {
+        return err
+      }
+      output = filepath.Join(outputDir, filepath.Dir(rel), name)
+    }
+    if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+      return err
+    }
+    tile := o.tile(a.img, ext.Origin, ext.Width, ext.Height)
+    if err := o.save(output, tile); err != nil {
+      return err
+    }
+    seamScore = SeamScore(tile)
+    if e.companions == "" {
+      return nil
+    }
+    companions, err := companionFiles(file, output, e.companions)
+    if err != nil {
+      return err
+    }
+    for _, c := range companions {
+      if c.img, err = o.decode(c.input); err != nil {
+        return err
+      }
+      if c.img.Bounds() != img.Bounds() {
+        return fmt.Errorf("%s is %dx%d but the image is %dx%d", c.input, c.img.Bounds().Dx(), c.img.Bounds().Dy(), img.Bounds().Dx(), img.Bounds().Dy())
+      }
+      if err := o.save(c.output, o.tile(c.img, ext.Origin, ext.Width, ext.Height)); err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+  return ReportEntry{
+    Input: e.label(file),
+    Output: output,
+    TileWidth: ext.Width,
+    TileHeight: ext.Height,
+    OffsetX: ext.Origin.X,
+    OffsetY: ext.Origin.Y,
+    SeamScore: seamScore,
+    Grade: ext.Grade.String(),
+    Seconds: time.Since(start).Seconds(),
+  }, err
+}
+
+// extractFrames detects the tile of every frame of the animated GIF g. With
+// -frames each, every frame gets its own tile, numbered like the
+// candidates. With -frames consensus, the tile size that most frames agree
+// on wins, and it is cropped from the frame of that size that it
+// reproduces best. With -frames animate, all frames have to repeat alike,
+// and the tile of each is cropped at the same place to keep the animation.
+func extractFrames(frames []image.Image, g *gif.GIF, e extractOptions, s settings, b *batch, o outputSettings, requiredGrade Grade, logger *log.Logger) error {
+  type frameTile struct {
+    a *analysis
+    ext extraction
+  }
+  var tiles []frameTile
+  var lastErr error
+  for idx, frame := range frames {
+    ctx, cancel := s.context(context.Background())
+    a, ext, err := b.extractTile(ctx, frame, e.input, s, logger)
+    cancel()
+    if err == nil && ext.Grade < requiredGrade {
+      err = fmt.Errorf("the tile is graded %s but %s is required", ext.Grade, requiredGrade)
+    }
+    if err != nil {
+      logger.Printf(tr("Frame %d: %v\n"), idx + 1, err)
+      lastErr = err
+      continue
+    }
+    logger.Printf(tr("Frame %d: %dx%d at %d,%d, graded %s\n"), idx + 1, ext.Width, ext.Height, ext.Origin.X, ext.Origin.Y, ext.Grade)
+    tiles = append(tiles, frameTile{a, ext})
+    if e.frames == "each" && !e.dryRun {
+      if err := o.save(candidateOutput(e.output, idx + 1), o.tile(a.img, ext.Origin, ext.Width, ext.Height)); err != nil {
+        return err
+      }
+    }
+  }
+  if len(tiles) == 0 {
+    return fmt.Errorf("none of the %d frames has a tile: %w", len(frames), lastErr)
+  }
+  if e.frames == "animate" {
+    if lastErr != nil {
+      return fmt.Errorf("not every frame has a tile to animate: %w", lastErr)
+    }
+    first := tiles[0].ext
+    animation := make([]image.Image, len(tiles))
+    for idx, tile := range tiles {
+      if tile.ext.Width != first.Width || tile.ext.Height != first.Height {
+        return fmt.Errorf("frame 1 repeats every %dx%d but frame %d every %dx%d, so they cannot be animated together", first.Width, first.Height, idx + 1, tile.ext.Width, tile.ext.Height)
+      }
+      animation[idx] = o.tile(tile.a.img, first.Origin, first.Width, first.Height)
+    }
+    logger.Printf(tr("Animated the %dx%d tile over %d frames\n"), first.Width, first.Height, len(frames))
+    if e.dryRun {
+      return nil
+    }
+    return o.saveAnimation(e.output, animation, g)
+  }
+  if e.frames == "each" {
+    logger.Printf(tr("Extracted the tiles of %d of %d frames\n"), len(tiles), len(frames))
+    return nil
+  }
+
+  votes := make(map[image.Point]int)
+  for _, tile := range tiles {
+    votes[image.Pt(tile.ext.Width, tile.ext.Height)]++
+  }
+  best := tiles[0]
+  for _, tile := range tiles[1:] {
+    size, bestSize := image.Pt(tile.ext.Width, tile.ext.Height), image.Pt(best.ext.Width, best.ext.Height)
+    if votes[size] > votes[bestSize] || (size == bestSize && tile.ext.Error < best.ext.Error) {
+      best = tile
+    }
+  }
+  logger.Printf(tr("Consensus: %d of %d frames repeat every %dx%d\n"), votes[image.Pt(best.ext.Width, best.ext.Height)], len(frames), best.ext.Width, best.ext.Height)
+  if e.dryRun {
+    return nil
+  }
+  return o.save(e.output, o.tile(best.a.img, best.ext.Origin, best.ext.Width, best.ext.Height))
+}
+
+// extractFiles extracts a tile from every one of files, which lie under
+// dir, into outputDir, keeping their paths relative to dir, and ends with a
+// table of the results. Companion maps are cropped along with the image they
+// belong to rather than processed on their own. It returns whether every
+// image succeeded.
+func extractFiles(out io.Writer, dir string, files []string, outputDir string, e extractOptions, s settings, b *batch, o outputSettings, requiredGrade Grade, logs *slog.Logger) bool {
+  if e.companions != "" {
+    isCompanion := make(map[string]bool)
+    for _, file := range files {
+      companions, err := companionFiles(file, file, e.companions)
+      if err != nil {
+        logs.Error(err.Error())
+        return false
+      }
+      for _, c := range companions {
+        isCompanion[filepath.ToSlash(c.input)] = true
+      }
+    }
+    var inputs []string
+    for _, file := range files {
+      if !isCompanion[file] {
+        inputs = append(inputs, file)
+      }
+    }
+    files = inputs
+  }
+  if len(files) == 0 {
+    logs.Error(fmt.Sprintf(tr("No images found in %s"), e.input))
+    return false
+  }
+
+  // The progress is only kept with -resume, which -force starts over.
+  checkpoint := Checkpoint{Input: e.input, OutputDir: outputDir, Settings: checkpointSettings(s, o)}
+  var entries []ReportEntry
+  done := make(map[string]ReportEntry)
+  if e.resume != "" && !e.dryRun && !o.force {
+    previous, previousEntries, err := readCheckpoint(e.resume)
+    if err != nil && !errors.Is(err, fs.ErrNotExist) {
+      logs.Error(err.Error())
+      return false
+    }
+    if err == nil && previous != checkpoint {
+      logs.Error(fmt.Sprintf(tr("%s is the checkpoint of a run over %s into %s or with other settings, not of this one, which -force starts over"), e.resume, previous.Input, previous.OutputDir))
+      return false
+    }
+    for _, entry := range previousEntries {
+      done[entry.Input] = entry
+    }
+    entries = previousEntries
+  }
+  var checkpointFile *os.File
+  if e.resume != "" && !e.dryRun {
+    var err error
+    // A checkpoint that cannot be written only costs the progress.
+    if checkpointFile, err = createCheckpoint(e.resume, checkpoint, entries); err != nil {
+      logs.Warn(err.Error())
+    } else {
+      defer checkpointFile.Close()
+    }
+  }
+
+  // Crawled images often come with many exact copies, which only need to be
+  // analyzed once. Companions may differ between copies, so they turn this
+  // off.
+  var duplicates map[string]string
+  if e.duplicates != "off" && e.companions == "" {
+    duplicates = duplicateFiles(files)
+  }
+  // results holds the entries of the images done so far, to be shared with
+  // their duplicates.
+  results := make(map[string]ReportEntry)
+  for file, entry := range done {
+    results[file] = entry
+  }
+
+  detailed := io.Discard
+  if e.verbose {
+    detailed = out
+  }
+  // save adds the entry of an image that succeeded to the report and the
+  // checkpoint.
+  var mu sync.Mutex
+  save := func(entry ReportEntry) {
+    mu.Lock()
+    defer mu.Unlock()
+    results[entry.Input] = entry
+    if e.dryRun {
+      return
+    }
+    entry.Output = e.label(entry.Output)
+    entries = append(entries, entry)
+    if checkpointFile != nil {
+      data, err := json.Marshal(entry)
+      if err == nil {
+        _, err = checkpointFile.Write(append(data, '\n'))
+      }
+      if err != nil {
+        logs.Warn(err.Error())
+      }
+    }
+  }
+  relative := func(file string) string {
+    rel, err := filepath.Rel(dir, file)
+    if err != nil {
+      return filepath.Base(file)
+    }
+    return rel
+  }
+  outputOf := func(rel string) string {
+    if e.nameTemplate != nil {
+      return "-"
+    }
+    return filepath.Join(outputDir, o.defaultName(defaultTileOutput(rel)))
+  }
+
+  // The images are analyzed -jobs at a time, and their duplicates are
+  // dealt with once the originals are done.
+  type outcome struct {
+    entry ReportEntry
+    err error
+    ran bool
+  }
+  outcomes := make([]outcome, len(files))
+  jobs := newScheduler(e.jobs, e.maxMemory)
+  var wg sync.WaitGroup
+  for i, file := range files {
+    if _, ok := done[e.label(file)]; ok {
+      continue
+    }
+    if _, ok := duplicates[file]; ok {
+      continue
+    }
+    memory := imageMemory(file)
+    jobs.acquire(memory)
+    if b.stopped() {
+      jobs.release(memory)
+      break
+    }
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      defer jobs.release(memory)
+      rel := relative(file)
+      entry, err := extractFile(file, rel, outputOf(rel), outputDir, e, s, b, o, requiredGrade, detailed)
+      if err == nil {
+        save(entry)
+      }
+      outcomes[i] = outcome{entry, err, true}
+    }()
+  }
+  wg.Wait()
+
+  for i, file := range files {
+    original, ok := duplicates[file]
+    if !ok || b.stopped() {
+      continue
+    }
+    rel := relative(file)
+    output := outputOf(rel)
+    var entry ReportEntry
+    err := b.run(e.label(file), func() error {
+      var ok bool
+      entry, ok = results[e.label(original)]
+      if !ok {
+        return fmt.Errorf("same as %s, which failed", e.label(original))
+      }
+      entry.Input = e.label(file)
+      entry.DuplicateOf = e.label(original)
+      entry.Seconds = 0
+      if e.duplicates != "link" || e.dryRun {
+        return nil
+      }
+      if e.nameTemplate != nil {
+        output = filepath.Join(outputDir, filepath.Dir(rel), filepath.Base(entry.Output))
+      }
+      if err := o.claim(output); err != nil {
+        return err
+      }
+      if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+        return err
+      }
+      target, err := filepath.Rel(filepath.Dir(output), entry.Output)
+      if err != nil {
+        return err
+      }
+      if o.force {
+        os.Remove(output)
+      }
+      entry.Output = output
+      return os.Symlink(target, output)
+    })
+    if err == nil {
+      save(entry)
+    }
+    outcomes[i] = outcome{entry, err, true}
+  }
+
+  // Failures come in the order the images finished, and are listed in
+  // the order of the files instead.
+  order := make(map[string]int)
+  for i, file := range files {
+    order[e.label(file)] = i
+  }
+  sort.SliceStable(b.Failures, func(i, j int) bool {
+    return order[b.Failures[i].Input] < order[b.Failures[j].Input]
+  })
+
+  type row struct {
+    input, tile, offset, grade, time, output string
+  }
+  var rows []row
+  for i, file := range files {
+    file = e.label(file)
+    entry, resumed := done[file]
+    if !resumed && !outcomes[i].ran {
+      continue
+    }
+    if !resumed {
+      entry = outcomes[i].entry
+    }
+    if err := outcomes[i].err; err != nil {
+      rows = append(rows, row{file, "-", "-", "-", "-", tr("error: ") + err.Error()})
+      continue
+    }
+    output, seconds := e.label(entry.Output), "-"
+    if e.dryRun {
+      output = "-"
+    }
+    if entry.DuplicateOf != "" && e.duplicates != "link" {
+      output = tr("same as ") + entry.DuplicateOf
+    }
+    if entry.DuplicateOf == "" {
+      seconds = fmt.Sprintf("%.1fs", entry.Seconds)
+    }
+    rows = append(rows, row{file, fmt.Sprintf("%dx%d", entry.TileWidth, entry.TileHeight), fmt.Sprintf("%d,%d", entry.OffsetX, entry.OffsetY), entry.Grade, seconds, output})
+  }
+
+  // The widths of the columns, starting from their headings.
+  headings := []string{tr("Image"), tr("Tile"), tr("Offset"), tr("Grade"), tr("Time"), tr("Output")}
+  widths := [5]int{}
+  for i := range widths {
+    widths[i] = utf8.RuneCountInString(headings[i])
+  }
+  for _, r := range rows {
+    for i, cell := range []string{r.input, r.tile, r.offset, r.grade, r.time} {
+      widths[i] = max(widths[i], utf8.RuneCountInString(cell))
+    }
+  }
+  table := func(input, tile, offset, grade, time, output string) {
+    fmt.Fprintf(out, "%-*s  %-*s  %-*s  %-*s  %-*s  %s\n", widths[0], input, widths[1], tile, widths[2], offset, widths[3], grade, widths[4], time, output)
+  }
+  table(headings[0], headings[1], headings[2], headings[3], headings[4], headings[5])
+  for _, r := range rows {
+    table(r.input, r.tile, r.offset, r.grade, r.time, r.output)
+  }
+  fmt.Fprintf(out, tr("Extracted %d of %d tiles\n"), len(rows) - len(b.Failures), len(files))
+  if e.report != "" && !e.dryRun {
+    if err := writeReport(e.report, entries); err != nil {
+      logs.Error(err.Error())
+      return false
+    }
+  }
+  if err := b.finish(); err != nil {
+    logs.Error(err.Error())
+    return false
+  }
+  return len(b.Failures) == 0
+}
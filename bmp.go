@@ -0,0 +1,172 @@
+/*
+TileEx : A Tiling Pattern Extractor written in Go
+Copyright (C) 2023, Sarthak Shah (shahsarthakw@gmail.com)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+  "bytes"
+  "encoding/binary"
+  "io"
+  "fmt"
+  "image"
+  "image/draw"
+
+  "golang.org/x/image/bmp"
+)
+
+// bmpRLE8Header returns a copy of the headers and the palette of the RLE8
+// BMP in data, marked as uncompressed, along with its size and where its
+// pixels start. ok is false for any other BMP.
+func bmpRLE8Header(data []byte) (header []byte, width, height, pixelsAt int, ok bool) {
+  if len(data) < 54 || binary.LittleEndian.Uint32(data[14:18]) < 40 {
+    return nil, 0, 0, 0, false
+  }
+  if binary.LittleEndian.Uint16(data[28:30]) != 8 || binary.LittleEndian.Uint32(data[30:34]) != 1 {
+    return nil, 0, 0, 0, false
+  }
+  pixelsAt = int(binary.LittleEndian.Uint32(data[10:14]))
+  if pixelsAt < 54 || pixelsAt > len(data) {
+    return nil, 0, 0, 0, false
+  }
+  width, height = int(int32(binary.LittleEndian.Uint32(data[18:22]))), int(int32(binary.LittleEndian.Uint32(data[22:26])))
+  header = bytes.Clone(data[:pixelsAt])
+  binary.LittleEndian.PutUint32(header[30:], 0)
+  return header, width, height, pixelsAt, true
+}
+
+func decodeBMPConfig(r io.Reader) (image.Config, error) {
+  data, err := io.ReadAll(r)
+  if err != nil {
+    return image.Config{}, err
+  }
+  if header, _, _, _, ok := bmpRLE8Header(data); ok {
+    data = header
+  }
+  return bmp.DecodeConfig(bytes.NewReader(data))
+}
+
+func decodeBMP(r io.Reader) (image.Image, error) {
+  data, err := io.ReadAll(r)
+  if err != nil {
+    return nil, err
+  }
+  if header, width, height, pixelsAt, ok := bmpRLE8Header(data); ok {
+    // RLE8 images are always stored bottom up, with a positive height.
+    if width <= 0 || height <= 0 {
+      return nil, fmt.Errorf("bmp: RLE8 image of %dx%d pixels", width, height)
+    }
+    if err := checkMaxSize(width, height); err != nil {
+      return nil, err
+    }
+    data = append(header, bmpRLE8(data[pixelsAt:], width, height, (width + 3) / 4 * 4)...)
+  }
+  return bmp.Decode(bytes.NewReader(data))
+}
+
+// encodeBMP writes img to w as an uncompressed bottom-up BMP, with 24-bit
+// pixels if it is opaque and with 32-bit pixels and a version 4 header,
+// which holds the mask of the alpha channel, if it is not.
+func encodeBMP(w io.Writer, img image.Image) error {
+  bounds := img.Bounds()
+  nrgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+  draw.Draw(nrgba, nrgba.Rect, img, bounds.Min, draw.Src)
+  depth, headerSize, compression := 24, 40, uint32(0)
+  if !nrgba.Opaque() {
+    depth, headerSize, compression = 32, 108, 3
+  }
+  stride := (nrgba.Rect.Dx() * depth + 31) / 32 * 4
+  pixelsAt := 14 + headerSize
+  data := make([]byte, pixelsAt + stride * nrgba.Rect.Dy())
+  copy(data, "BM")
+  binary.LittleEndian.PutUint32(data[2:], uint32(len(data)))
+  binary.LittleEndian.PutUint32(data[10:], uint32(pixelsAt))
+  binary.LittleEndian.PutUint32(data[14:], uint32(headerSize))
+  binary.LittleEndian.PutUint32(data[18:], uint32(nrgba.Rect.Dx()))
+  binary.LittleEndian.PutUint32(data[22:], uint32(nrgba.Rect.Dy()))
+  binary.LittleEndian.PutUint16(data[26:], 1)
+  binary.LittleEndian.PutUint16(data[28:], uint16(depth))
+  binary.LittleEndian.PutUint32(data[30:], compression)
+  binary.LittleEndian.PutUint32(data[34:], uint32(stride * nrgba.Rect.Dy()))
+  if depth == 32 {
+    for i, mask := range []uint32{0xff0000, 0x00ff00, 0x0000ff, 0xff000000} {
+      binary.LittleEndian.PutUint32(data[54 + 4 * i:], mask)
+    }
+    // The colors are sRGB.
+    copy(data[70:], "BGRs")
+  }
+  bytesPerPixel := depth / 8
+  for y := 0; y < nrgba.Rect.Dy(); y++ {
+    dst := data[pixelsAt + (nrgba.Rect.Dy() - 1 - y) * stride:]
+    src := nrgba.Pix[y * nrgba.Stride:]
+    for x := 0; x < nrgba.Rect.Dx(); x++ {
+      d, s := dst[x * bytesPerPixel:], src[4 * x:]
+      d[0], d[1], d[2] = s[2], s[1], s[0]
+      if depth == 32 {
+        d[3] = s[3]
+      }
+    }
+  }
+  _, err := w.Write(data)
+  return err
+}
+
+// bmpRLE8 unpacks RLE8 pixels into rows of stride bytes, in the bottom-up
+// order of the file. Runs are a count and an index to repeat, and a count
+// of 0 starts an escape: 0 ends the row, 1 the image, 2 moves by the next
+// two bytes and anything else is that many literal indices.
+func bmpRLE8(src []byte, width, height, stride int) []byte {
+  out := make([]byte, stride * height)
+  x, y := 0, 0
+  for i := 0; i + 1 < len(src) && y < height; i += 2 {
+    count, value := int(src[i]), src[i + 1]
+    switch {
+    case count > 0:
+      for ; count > 0 && x < width; count-- {
+        out[y * stride + x] = value
+        x++
+      }
+    case value == 0:
+      x, y = 0, y + 1
+    case value == 1:
+      return out
+    case value == 2:
+      if i + 3 >= len(src) {
+        return out
+      }
+      x, y = x + int(src[i + 2]), y + int(src[i + 3])
+      i += 2
+    default:
+      literal := int(value)
+      for j := 0; j < literal && i + 2 + j < len(src); j++ {
+        if x < width && y < height {
+          out[y * stride + x] = src[i + 2 + j]
+        }
+        x++
+      }
+      // Literal runs are padded to an even length.
+      i += literal + literal % 2
+    }
+  }
+  return out
+}
+
+// TIFF images are decoded by golang.org/x/image/tiff, which only reads the
+// first page and has no CMYK. The other pages, which -page and -frames
+// need, are decoded by pointing the header of a copy of the file at them,
+// and CMYK pages by describing their inks as the colors and alpha of an
+// RGBA page that golang.org/x/image/tiff reads. decodeBytes hands the
+// TIFFs whose first page is CMYK to tiffPage.
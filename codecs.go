@@ -0,0 +1,521 @@
+/*
+TileEx : A Tiling Pattern Extractor written in Go
+Copyright (C) 2023, Sarthak Shah (shahsarthakw@gmail.com)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+  "bytes"
+  "encoding/binary"
+  "errors"
+  "io"
+  "os"
+  "os/exec"
+  "path"
+  "path/filepath"
+  "fmt"
+  "strconv"
+  "image"
+  "image/color"
+  "image/draw"
+  "image/gif"
+
+  // WebP images are decoded by the codec from the Go project, as the
+  // standard library has none.
+  _ "golang.org/x/image/webp"
+)
+
+// registeredFormats are the names of the formats image.Decode reads, which
+// the image package has no way to list. The packages imported for their
+// decoders register theirs before registerFormat is first called.
+var registeredFormats = map[string]bool{"png": true, "jpeg": true, "gif": true, "bmp": true, "tiff": true, "webp": true}
+
+// registerFormat registers a decoder with the image package and records the
+// name of its format.
+func registerFormat(name, magic string, decode func(io.Reader) (image.Image, error), decodeConfig func(io.Reader) (image.Config, error)) {
+  image.RegisterFormat(name, magic, decode, decodeConfig)
+  registeredFormats[name] = true
+}
+
+// decodeBytes decodes the image encoded in data, returning the name of its
+// format as image.Decode does.
+func decodeBytes(data []byte) (image.Image, string, error) {
+  // Images that are too large are refused before their pixels are allocated.
+  if config, _, err := decodeConfig(data); err == nil {
+    if err := checkMaxSize(config.Width, config.Height); err != nil {
+      return nil, "", err
+    }
+  }
+  if _, _, _, _, ok := bmpRLE8Header(data); ok {
+    img, err := decodeBMP(bytes.NewReader(data))
+    return img, "bmp", err
+  }
+  if tiffCMYK(data) {
+    img, err := tiffPage(data, 1)
+    return img, "tiff", err
+  }
+  return image.Decode(bytes.NewReader(data))
+}
+
+// decodeConfig returns the size and color model of the image encoded in
+// data, as image.DecodeConfig does, with RLE8 BMPs and CMYK TIFFs as
+// decodeBytes has them.
+func decodeConfig(data []byte) (image.Config, string, error) {
+  if _, _, _, _, ok := bmpRLE8Header(data); ok {
+    config, err := decodeBMPConfig(bytes.NewReader(data))
+    return config, "bmp", err
+  }
+  if tiffCMYK(data) {
+    config, err := decodeTIFFConfig(bytes.NewReader(data))
+    return config, "tiff", err
+  }
+  return image.DecodeConfig(bytes.NewReader(data))
+}
+
+// decodeRaw wraps a raw frame, such as one from a capture card or a game
+// hook, as an image without any container to decode. format is "rgba" for
+// 8-bit RGBA with straight alpha, whose pixels are used in place, "gray" for
+// 8-bit gray, also used in place, "gray16" for 16-bit gray in little-endian
+// byte order, or "nv12" for a full-size Y plane followed by a half-size plane
+// of interleaved Cb and Cr. stride is the number of bytes from one row to
+// the next, or 0 for rows without padding.
+func decodeRaw(data []byte, format string, width, height, stride int) (image.Image, error) {
+  if width <= 0 || height <= 0 {
+    return nil, fmt.Errorf("invalid raw frame size %dx%d", width, height)
+  }
+  if err := checkMaxSize(width, height); err != nil {
+    return nil, err
+  }
+  switch format {
+  case "rgba":
+    if stride == 0 {
+      stride = 4 * width
+    }
+    if stride < 4 * width {
+      return nil, fmt.Errorf("stride %d is too small for %d RGBA pixels", stride, width)
+    }
+    size := stride * (height - 1) + 4 * width
+    if len(data) < size {
+      return nil, fmt.Errorf("raw frame holds %d bytes, expected at least %d", len(data), size)
+    }
+    return &image.NRGBA{Pix: data[:size], Stride: stride, Rect: image.Rect(0, 0, width, height)}, nil
+  case "gray", "gray16":
+    bytesPerPixel := 1
+    if format == "gray16" {
+      bytesPerPixel = 2
+    }
+    if stride == 0 {
+      stride = bytesPerPixel * width
+    }
+    if stride < bytesPerPixel * width {
+      return nil, fmt.Errorf("stride %d is too small for %d %s pixels", stride, width, format)
+    }
+    size := stride * (height - 1) + bytesPerPixel * width
+    if len(data) < size {
+      return nil, fmt.Errorf("raw frame holds %d bytes, expected at least %d", len(data), size)
+    }
+    if format == "gray" {
+      return &image.Gray{Pix: data[:size], Stride: stride, Rect: image.Rect(0, 0, width, height)}, nil
+    }
+    // image.Gray16 holds its levels big-endian.
+    img := image.NewGray16(image.Rect(0, 0, width, height))
+    for y := 0; y < height; y++ {
+      row := data[y * stride:]
+      for x := 0; x < width; x++ {
+        img.Pix[y * img.Stride + 2 * x], img.Pix[y * img.Stride + 2 * x + 1] = row[2 * x + 1], row[2 * x]
+      }
+    }
+    return img, nil
+  case "nv12":
+    if stride == 0 {
+      stride = width
+    }
+    chromaWidth, chromaHeight := (width + 1) / 2, (height + 1) / 2
+    if stride < 2 * chromaWidth {
+      return nil, fmt.Errorf("stride %d is too small for %d NV12 pixels", stride, width)
+    }
+    size := stride * height + stride * (chromaHeight - 1) + 2 * chromaWidth
+    if len(data) < size {
+      return nil, fmt.Errorf("raw frame holds %d bytes, expected at least %d", len(data), size)
+    }
+    img := image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420)
+    for y := 0; y < height; y++ {
+      copy(img.Y[y * img.YStride:y * img.YStride + width], data[y * stride:])
+    }
+    chroma := data[stride * height:]
+    for y := 0; y < chromaHeight; y++ {
+      row := chroma[y * stride:]
+      for x := 0; x < chromaWidth; x++ {
+        img.Cb[y * img.CStride + x] = row[2 * x]
+        img.Cr[y * img.CStride + x] = row[2 * x + 1]
+      }
+    }
+    return img, nil
+  }
+  return nil, fmt.Errorf("unknown raw format %q, expected rgba, gray, gray16 or nv12", format)
+}
+
+// decodeFile reads and decodes the image file with the given name.
+func decodeFile(name string) (image.Image, error) {
+  data, err := os.ReadFile(name)
+  if err != nil {
+    return nil, err
+  }
+  img, _, err := decodeBytes(data)
+  return img, err
+}
+
+// codecTool is a command line tool that converts images between PNG and a
+// format the standard library has no codec for, from a file to a file.
+type codecTool struct {
+  format, name, project string
+  // ext is the extension of files in the format, which tools go by.
+  ext string
+  args func(input, output string, quality int) []string
+}
+
+var (
+  // The colors under transparent pixels are kept, as a tile may be used
+  // with its alpha replaced.
+  cwebp = codecTool{"WebP", "cwebp", "libwebp", ".webp", func(input, output string, quality int) []string {
+    if quality > 0 {
+      return []string{"-quiet", "-exact", "-q", strconv.Itoa(quality), input, "-o", output}
+    }
+    return []string{"-quiet", "-exact", "-lossless", input, "-o", output}
+  }}
+  avifdec = codecTool{"AVIF", "avifdec", "libavif", ".avif", func(input, output string, _ int) []string {
+    return []string{input, output}
+  }}
+  avifenc = codecTool{"AVIF", "avifenc", "libavif", ".avif", func(input, output string, quality int) []string {
+    if quality > 0 {
+      return []string{"-q", strconv.Itoa(quality), input, output}
+    }
+    return []string{"--lossless", input, output}
+  }}
+  // Older releases of libheif call heif-dec heif-convert.
+  heifDec = codecTool{"HEIC", "heif-dec", "libheif", ".heic", func(input, output string, _ int) []string {
+    return []string{input, output}
+  }}
+  heifConvert = codecTool{"HEIC", "heif-convert", "libheif", ".heic", heifDec.args}
+  djxl = codecTool{"JPEG XL", "djxl", "libjxl", ".jxl", func(input, output string, _ int) []string {
+    return []string{"--quiet", input, output}
+  }}
+  // A distance of 0 is lossless.
+  cjxl = codecTool{"JPEG XL", "cjxl", "libjxl", ".jxl", func(input, output string, quality int) []string {
+    if quality > 0 {
+      return []string{"--quiet", "-q", strconv.Itoa(quality), input, output}
+    }
+    return []string{"--quiet", "-d", "0", input, output}
+  }}
+)
+
+// encoders are the tools for the -output-format values other than png.
+var encoders = map[string]codecTool{"webp": cwebp, "avif": avifenc, "jxl": cjxl}
+
+// path finds the tool, so that a missing one can be noticed before a long
+// detection.
+func (t codecTool) path(decoding bool) (string, error) {
+  found, err := exec.LookPath(t.name)
+  if err != nil {
+    doing := "encoding"
+    if decoding {
+      doing = "decoding"
+    }
+    return "", fmt.Errorf("%s %s needs %s from %s on the PATH", doing, t.format, t.name, t.project)
+  }
+  return found, nil
+}
+
+// run converts input to output with the tool in a temporary directory,
+// which it is passed along with the names of the two files.
+func (t codecTool) run(decoding bool, quality int, write func(input string) error, read func(output string) error) error {
+  tool, err := t.path(decoding)
+  if err != nil {
+    return err
+  }
+  dir, err := os.MkdirTemp("", "tileex-" + t.name + "-")
+  if err != nil {
+    return err
+  }
+  defer os.RemoveAll(dir)
+  input, output := filepath.Join(dir, "input" + t.ext), filepath.Join(dir, "output.png")
+  if !decoding {
+    input, output = filepath.Join(dir, "input.png"), filepath.Join(dir, "output" + t.ext)
+  }
+  if err := write(input); err != nil {
+    return err
+  }
+  if out, err := exec.Command(tool, t.args(input, output, quality)...).CombinedOutput(); err != nil {
+    return fmt.Errorf("%s: %v: %s", t.name, err, bytes.TrimSpace(out))
+  }
+  return read(output)
+}
+
+func (t codecTool) decode(r io.Reader) (image.Image, error) {
+  var img image.Image
+  err := t.run(true, 0, func(input string) error {
+    file, err := os.Create(input)
+    if err != nil {
+      return err
+    }
+    _, err = io.Copy(file, r)
+    if closeErr := file.Close(); err == nil {
+      err = closeErr
+    }
+    return err
+  }, func(output string) (err error) {
+    img, err = decodeFile(output)
+    return err
+  })
+  return img, err
+}
+
+// encode writes img to w, lossless unless quality is from 1 to 100.
+func (t codecTool) encode(w io.Writer, img image.Image, quality int) error {
+  return t.run(false, quality, func(input string) error {
+    return savePNG(input, img)
+  }, func(output string) error {
+    file, err := os.Open(output)
+    if err != nil {
+      return err
+    }
+    defer file.Close()
+    _, err = io.Copy(w, file)
+    return err
+  })
+}
+
+// toolDecoder decodes a format whose codec is a command line tool, taking
+// the size of the image from its header first.
+type toolDecoder struct {
+  decode func(io.Reader) (image.Image, error)
+  decodeConfig func(io.Reader) (image.Config, error)
+}
+
+// toolDecoders decode AVIF, HEIC and JPEG XL by the extension of the file.
+// They are not registered with the image package, so that a file only
+// reaches a tool when it is named on the command line with -codec-tools,
+// and never when it is uploaded to tileex serve.
+var toolDecoders = map[string]toolDecoder{
+  ".avif": {avifdec.decode, decodeHEIFConfig},
+  ".heic": {decodeHEIC, decodeHEIFConfig},
+  ".heif": {decodeHEIC, decodeHEIFConfig},
+  ".jxl": {djxl.decode, decodeJXLConfig},
+}
+
+func (d toolDecoder) decodeFile(name string) (image.Image, error) {
+  data, err := os.ReadFile(name)
+  if err != nil {
+    return nil, err
+  }
+  // Images that are too large are refused before a tool decodes them.
+  if config, err := d.decodeConfig(bytes.NewReader(data)); err == nil {
+    if err := checkMaxSize(config.Width, config.Height); err != nil {
+      return nil, err
+    }
+  }
+  return d.decode(bytes.NewReader(data))
+}
+
+// JPEG XL images are decoded by djxl from libjxl, either as a bare
+// codestream or in a container. Their size comes from the size header that
+// starts the codestream.
+
+func decodeJXLConfig(r io.Reader) (image.Config, error) {
+  header := make([]byte, 4096)
+  n, err := io.ReadFull(r, header)
+  if err != nil && err != io.ErrUnexpectedEOF {
+    return image.Config{}, err
+  }
+  header = header[:n]
+  // In a container, the codestream follows the header of a jxlc box, or
+  // that and a part number in the first jxlp box.
+  if !bytes.HasPrefix(header, []byte{0xff, 0x0a}) {
+    at := bytes.Index(header, []byte("jxlc"))
+    if jxlp := bytes.Index(header, []byte("jxlp")); at < 0 && jxlp >= 0 {
+      at = jxlp + 4
+    }
+    if at < 0 || at + 6 > len(header) {
+      return image.Config{}, errors.New("jxl: no codestream in the header")
+    }
+    header = header[at + 4:]
+  }
+  if len(header) < 11 || header[0] != 0xff || header[1] != 0x0a {
+    return image.Config{}, errors.New("jxl: invalid codestream")
+  }
+  // The fields are packed least significant bit first.
+  pos := 16
+  bits := func(n int) uint32 {
+    var v uint32
+    for i := 0; i < n; i++ {
+      v |= uint32(header[pos / 8] >> (pos % 8) & 1) << i
+      pos++
+    }
+    return v
+  }
+  size := func() uint32 {
+    n := [4]int{9, 13, 18, 30}[bits(2)]
+    return 1 + bits(n)
+  }
+  var width, height uint32
+  small := bits(1) == 1
+  if small {
+    height = (bits(5) + 1) * 8
+  } else {
+    height = size()
+  }
+  ratio := bits(3)
+  ratios := [8][2]uint32{{}, {1, 1}, {12, 10}, {4, 3}, {3, 2}, {16, 9}, {5, 4}, {2, 1}}
+  switch {
+  case ratio != 0:
+    width = uint32(uint64(height) * uint64(ratios[ratio][0]) / uint64(ratios[ratio][1]))
+  case small:
+    width = (bits(5) + 1) * 8
+  default:
+    width = size()
+  }
+  return image.Config{ColorModel: color.NRGBAModel, Width: int(width), Height: int(height)}, nil
+}
+
+// AVIF images are decoded by avifdec from libavif, and HEIC images, as
+// iPhones take them, by heif-dec from libheif. As both are HEIF, their size
+// comes from the image spatial extents property, the first ispe box.
+
+func decodeHEIC(r io.Reader) (image.Image, error) {
+  if _, err := heifDec.path(true); err != nil {
+    if _, convertErr := heifConvert.path(true); convertErr == nil {
+      return heifConvert.decode(r)
+    }
+  }
+  return heifDec.decode(r)
+}
+
+func decodeHEIFConfig(r io.Reader) (image.Config, error) {
+  header := make([]byte, 4096)
+  n, err := io.ReadFull(r, header)
+  if err != nil && err != io.ErrUnexpectedEOF {
+    return image.Config{}, err
+  }
+  header = header[:n]
+  // The box is its size and type, a version and flags, and the two sizes.
+  at := bytes.Index(header, []byte("ispe"))
+  if at < 0 || at + 16 > len(header) {
+    return image.Config{}, errors.New("heif: no image size in the header")
+  }
+  return image.Config{
+    ColorModel: color.NRGBAModel,
+    Width: int(binary.BigEndian.Uint32(header[at + 8:])),
+    Height: int(binary.BigEndian.Uint32(header[at + 12:])),
+  }, nil
+}
+
+// webpLossless reports whether the WebP image in r is compressed without
+// loss, which is when it holds a VP8L rather than a VP8 bitstream.
+func webpLossless(r io.ReadSeeker) bool {
+  header := make([]byte, 12)
+  if _, err := io.ReadFull(r, header); err != nil || string(header[8:12]) != "WEBP" {
+    return false
+  }
+  for {
+    chunk := make([]byte, 8)
+    if _, err := io.ReadFull(r, chunk); err != nil {
+      return false
+    }
+    switch string(chunk[:4]) {
+    case "VP8L":
+      return true
+    case "VP8 ":
+      return false
+    }
+    // Chunks are padded to an even size.
+    size := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+    if _, err := r.Seek(size + size % 2, io.SeekCurrent); err != nil {
+      return false
+    }
+  }
+}
+
+// lossyFormat reports whether an image decoded from data in the given
+// format has been through lossy compression. WebP can be either, which its
+// bitstream tells.
+func lossyFormat(format string, data []byte) bool {
+  if format == "webp" {
+    return !webpLossless(bytes.NewReader(data))
+  }
+  return format == "jpeg"
+}
+
+// losslessFile reports whether the image file input is stored without
+// loss, going by its extension and, for WebP, its bitstream.
+func losslessFile(input string) bool {
+  switch path.Ext(input) {
+  case ".png", ".tif", ".tiff", ".bmp", ".jxl", ".psd", ".psb", ".ase", ".aseprite":
+    return true
+  case ".webp":
+    file, err := os.Open(input)
+    if err != nil {
+      return false
+    }
+    defer file.Close()
+    return webpLossless(file)
+  }
+  return false
+}
+
+// gifFrames decodes every frame of the GIF in r as it is shown, on top of
+// what the frames before it left behind.
+func gifFrames(r io.Reader) ([]image.Image, *gif.GIF, error) {
+  g, err := gif.DecodeAll(r)
+  if err != nil {
+    return nil, nil, err
+  }
+  bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+  if err := checkMaxSize(bounds.Dx(), bounds.Dy()); err != nil {
+    return nil, nil, err
+  }
+  clone := func(img *image.RGBA) *image.RGBA {
+    copied := image.NewRGBA(img.Rect)
+    copy(copied.Pix, img.Pix)
+    return copied
+  }
+  canvas := image.NewRGBA(bounds)
+  var frames []image.Image
+  for idx, frame := range g.Image {
+    disposal := byte(0)
+    if idx < len(g.Disposal) {
+      disposal = g.Disposal[idx]
+    }
+    previous := canvas
+    if disposal == gif.DisposalPrevious {
+      previous = clone(canvas)
+    }
+    draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+    frames = append(frames, clone(canvas))
+    switch disposal {
+    case gif.DisposalBackground:
+      draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+    case gif.DisposalPrevious:
+      canvas = previous
+    }
+  }
+  return frames, g, nil
+}
+
+// BMP images are decoded by golang.org/x/image/bmp. It refuses RLE8
+// compression, which older Windows tools write for 256-color images, so
+// decodeBytes hands those to decodeBMP, which unpacks them into the
+// uncompressed BMP that it reads. They cannot be registered with the image
+// package, which would try golang.org/x/image/bmp first.
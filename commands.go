@@ -0,0 +1,895 @@
+/*
+TileEx : A Tiling Pattern Extractor written in Go
+Copyright (C) 2023, Sarthak Shah (shahsarthakw@gmail.com)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+  "context"
+  "encoding/csv"
+  "encoding/json"
+  "io"
+  "os"
+  "fmt"
+  "flag"
+  "sort"
+  "strconv"
+  "strings"
+  "image"
+  "image/draw"
+  "log"
+  "math"
+  "runtime"
+  "runtime/debug"
+)
+
+// checkOptions holds the flags of the check subcommand.
+type checkOptions struct {
+  s settings
+  b batch
+  manifest string
+  update, verbose bool
+}
+
+func (c *checkOptions) addFlags(fs *flag.FlagSet) {
+  fs.StringVar(&c.manifest, "manifest", "tiles.lock", "The manifest of expected tile sizes and hashes")
+  fs.BoolVar(&c.update, "update", false, "Write the current tiles to the manifest instead of checking them")
+  fs.BoolVar(&c.verbose, "v", false, "Show the extraction output for every image")
+  addSettingsFlags(fs, &c.s)
+  addBatchFlags(fs, &c.b)
+}
+
+// runCheck implements the check subcommand, which re-runs the extraction over
+// directories of source art and compares the tiles to a committed manifest.
+// It returns 0 when everything matches, 1 when something changed and 2 when
+// the check could not run.
+func runCheck(args []string) int {
+  var c checkOptions
+  checkFlags := flag.NewFlagSet("check", flag.ContinueOnError)
+  c.addFlags(checkFlags)
+  checkFlags.Usage = func() {
+    fmt.Fprintln(checkFlags.Output(), tr("Usage: tileex check [flags] path..."))
+    checkFlags.PrintDefaults()
+  }
+  parseFlags(checkFlags, "check", args)
+  s, b := c.s, c.b
+
+  if checkFlags.NArg() == 0 {
+    checkFlags.Usage()
+    return exitUsage
+  }
+  if err := s.prepare(); err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitUsage
+  }
+  if err := b.prepare(); err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitUsage
+  }
+
+  files, err := imageFiles(checkFlags.Args())
+  if err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitFailure
+  }
+
+  expected := make(map[string]manifestEntry)
+  if !c.update {
+    expected, err = readManifest(c.manifest)
+    if err != nil {
+      fmt.Fprintln(os.Stderr, tr("Error:"), err)
+      return exitFailure
+    }
+  }
+
+  logOutput := io.Discard
+  if c.verbose {
+    logOutput = os.Stdout
+  }
+  actual := make(map[string]manifestEntry)
+  failed := false
+  for _, file := range files {
+    err := b.run(file, func() error {
+      img, err := decodeFile(file)
+      if err != nil {
+        return err
+      }
+      logger := b.logger(logOutput, file)
+      ctx, cancel := s.context(context.Background())
+      defer cancel()
+      a, ext, err := b.extractTile(ctx, img, file, s, logger)
+      if err != nil {
+        return err
+      }
+      tile := cropTile(a.img, ext.Origin, ext.Width, ext.Height)
+      actual[file] = manifestEntry{Width: ext.Width, Height: ext.Height, Hash: tileHash(tile)}
+      return nil
+    })
+    if err != nil {
+      fmt.Printf("error    %s: %v\n", file, err)
+      failed = true
+      if b.halted {
+        break
+      }
+    }
+  }
+  if err := b.finish(); err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitFailure
+  }
+
+  if c.update {
+    if err := writeManifest(c.manifest, actual); err != nil {
+      fmt.Fprintln(os.Stderr, tr("Error:"), err)
+      return exitFailure
+    }
+    fmt.Printf(tr("Wrote %d entries to %s\n"), len(actual), c.manifest)
+    if failed {
+      return 1
+    }
+    return 0
+  }
+
+  for _, file := range files {
+    got, ok := actual[file]
+    if !ok {
+      continue
+    }
+    want, known := expected[file]
+    switch {
+    case !known:
+      fmt.Printf("new      %s\n+ %s\n", file, got)
+      failed = true
+    case got != want:
+      fmt.Printf("changed  %s\n- %s\n+ %s\n", file, want, got)
+      failed = true
+    }
+  }
+  var missing []string
+  for file := range expected {
+    if _, ok := actual[file]; !ok {
+      if _, err := os.Stat(file); os.IsNotExist(err) {
+        missing = append(missing, file)
+      }
+    }
+  }
+  sort.Strings(missing)
+  for _, file := range missing {
+    fmt.Printf("missing  %s\n- %s\n", file, expected[file])
+    failed = true
+  }
+
+  if failed {
+    return 1
+  }
+  fmt.Printf(tr("All %d tiles match %s\n"), len(actual), c.manifest)
+  return 0
+}
+
+// roundtripOptions holds the flags of the roundtrip subcommand.
+type roundtripOptions struct {
+  s settings
+  synthesis string
+  verbose bool
+}
+
+func (t *roundtripOptions) addFlags(fs *flag.FlagSet) {
+  fs.StringVar(&t.synthesis, "synthesis", "", "Also save the image synthesized from the tile to the given file")
+  fs.BoolVar(&t.verbose, "v", false, "Show the output of both detections")
+  addSettingsFlags(fs, &t.s)
+}
+
+// synthesize repeats tile over an image with the given bounds, lined up so
+// that it lies at origin, as it did in the image it was extracted from.
+func synthesize(tile image.Image, bounds image.Rectangle, origin image.Point) draw.Image {
+  synthesis := newCanvas(tile, bounds)
+  tb := tile.Bounds()
+  w, h := tb.Dx(), tb.Dy()
+  for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+    for x := bounds.Min.X; x < bounds.Max.X; x++ {
+      tx, ty := ((x - origin.X) % w + w) % w, ((y - origin.Y) % h + h) % h
+      synthesis.Set(x, y, tile.At(tb.Min.X + tx, tb.Min.Y + ty))
+    }
+  }
+  return synthesis
+}
+
+// runRoundtrip implements the roundtrip subcommand, a sanity check of the
+// detection on the user's own images. It extracts the tile of an image,
+// repeats it over an image of the same size, extracts the tile of that and
+// checks that both tiles are the same, up to where they start. It returns 0
+// when they are, 1 when they are not and 2 when the check could not run.
+func runRoundtrip(args []string) int {
+  var t roundtripOptions
+  roundtripFlags := flag.NewFlagSet("roundtrip", flag.ContinueOnError)
+  t.addFlags(roundtripFlags)
+  roundtripFlags.Usage = func() {
+    fmt.Fprintln(roundtripFlags.Output(), tr("Usage: tileex roundtrip [flags] image"))
+    roundtripFlags.PrintDefaults()
+  }
+  parseFlags(roundtripFlags, "roundtrip", args)
+  s := t.s
+
+  if roundtripFlags.NArg() != 1 {
+    roundtripFlags.Usage()
+    return exitUsage
+  }
+  if err := s.prepare(); err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitUsage
+  }
+  input := roundtripFlags.Arg(0)
+  img, err := decodeFile(input)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitDecode
+  }
+
+  logOutput := io.Discard
+  if t.verbose {
+    logOutput = os.Stdout
+  }
+  extract := func(img image.Image, name string) (image.Image, extraction, error) {
+    ctx, cancel := s.context(context.Background())
+    defer cancel()
+    logger := log.New(logOutput, fmt.Sprintf("[%s] ", name), 0)
+    a, err := analyze(ctx, img, name, s, logger)
+    if err != nil {
+      return nil, extraction{}, err
+    }
+    ext, err := a.extract(ctx, s, logger)
+    if err != nil {
+      return nil, extraction{}, err
+    }
+    return CropTile(a.img, ext.Origin, ext.Width, ext.Height, false), ext, nil
+  }
+
+  tile, ext, err := extract(img, input)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitCode(err)
+  }
+  fmt.Printf(tr("Original:  %dx%d at %d,%d (%s)\n"), ext.Width, ext.Height, ext.Origin.X, ext.Origin.Y, ext.Grade)
+
+  synthesis := synthesize(tile, img.Bounds(), ext.Origin)
+  if t.synthesis != "" {
+    if err := savePNG(t.synthesis, synthesis); err != nil {
+      fmt.Fprintln(os.Stderr, tr("Error:"), err)
+      return exitFailure
+    }
+  }
+  // The synthesis is stored losslessly, whatever the original was.
+  again, extAgain, err := extract(synthesis, "synthesis.png")
+  if err != nil {
+    fmt.Printf(tr("Mismatch: no tile found in the synthesis: %v\n"), err)
+    return 1
+  }
+  fmt.Printf(tr("Synthesis: %dx%d at %d,%d (%s)\n"), extAgain.Width, extAgain.Height, extAgain.Origin.X, extAgain.Origin.Y, extAgain.Grade)
+
+  if extAgain.Width != ext.Width || extAgain.Height != ext.Height {
+    fmt.Printf(tr("Mismatch: the tile of the synthesis is %dx%d instead of %dx%d\n"), extAgain.Width, extAgain.Height, ext.Width, ext.Height)
+    return 1
+  }
+  // The second tile starts elsewhere in the same repeat, so it is compared
+  // with the first one shifted accordingly.
+  first, second := newPixelBuffer(tile), newPixelBuffer(again)
+  w, h := ext.Width, ext.Height
+  dx, dy := ((extAgain.Origin.X - ext.Origin.X) % w + w) % w, ((extAgain.Origin.Y - ext.Origin.Y) % h + h) % h
+  differing := 0
+  for y := 0; y < h; y++ {
+    for x := 0; x < w; x++ {
+      if second.Pix[y * w + x] != first.Pix[((y + dy) % h) * w + (x + dx) % w] {
+        differing++
+      }
+    }
+  }
+  if differing > 0 {
+    fmt.Printf(tr("Mismatch: %d of the %d pixels of the tiles differ\n"), differing, w * h)
+    return 1
+  }
+  fmt.Println(tr("Match: both tiles are the same"))
+  return 0
+}
+
+// version is the release of this build. Release builds set it with
+// -ldflags "-X main.version=1.2.3".
+var version = "dev"
+
+// features records which optional parts of TileEx are compiled into this
+// build.
+var features = map[string]bool{
+  "server": true,
+}
+
+// decoders are the tools that decode the formats of toolDecoders, any one of
+// which will do.
+var decoders = map[string][]codecTool{"avif": {avifdec}, "heic": {heifDec, heifConvert}, "jxl": {djxl}}
+
+// VersionInfo describes the capabilities of a build, as printed by
+// `tileex version --json`.
+// Formats are read and written by the formats the image package has
+// registered, the decoders of -codec-tools and the encoders of
+// -output-format, so this is always up to date. Tools records for the tools
+// that some of them run whether they are on the PATH, without which those
+// formats fail.
+type VersionInfo struct {
+  Version string `json:"version"`
+  Commit string `json:"commit"`
+  Modified bool `json:"modified"`
+  GoVersion string `json:"go_version"`
+  Features map[string]bool `json:"features"`
+  InputFormats []string `json:"input_formats"`
+  OutputFormats []string `json:"output_formats"`
+  Tools map[string]bool `json:"tools"`
+}
+
+func buildInfo() VersionInfo {
+  info := VersionInfo{
+    Version: version,
+    Commit: "unknown",
+    GoVersion: runtime.Version(),
+    Features: map[string]bool{},
+    Tools: map[string]bool{},
+  }
+  for name, enabled := range features {
+    info.Features[name] = enabled
+  }
+  for format := range registeredFormats {
+    info.InputFormats = append(info.InputFormats, format)
+  }
+  for format := range decoders {
+    info.InputFormats = append(info.InputFormats, format)
+  }
+  sort.Strings(info.InputFormats)
+  for _, format := range completionValues["raw-format"] {
+    info.InputFormats = append(info.InputFormats, "raw " + format)
+  }
+  // Animated PNGs are written by -frames animate rather than picked with
+  // -output-format.
+  info.OutputFormats = []string{"apng"}
+  for format := range outputExtensions {
+    info.OutputFormats = append(info.OutputFormats, format)
+  }
+  sort.Strings(info.OutputFormats)
+  for _, tools := range decoders {
+    for _, tool := range tools {
+      _, err := tool.path(true)
+      info.Tools[tool.name] = err == nil
+    }
+  }
+  info.Features["webp"] = registeredFormats["webp"]
+  info.Features["heic"] = info.Tools[heifDec.name] || info.Tools[heifConvert.name]
+  for _, tool := range encoders {
+    _, err := tool.path(false)
+    info.Tools[tool.name] = err == nil
+  }
+  if bi, ok := debug.ReadBuildInfo(); ok {
+    for _, setting := range bi.Settings {
+      switch setting.Key {
+      case "vcs.revision":
+        info.Commit = setting.Value
+      case "vcs.modified":
+        info.Modified = setting.Value == "true"
+      }
+    }
+  }
+  return info
+}
+
+// versionOptions holds the flags of the version subcommand.
+type versionOptions struct {
+  json bool
+}
+
+func (v *versionOptions) addFlags(fs *flag.FlagSet) {
+  fs.BoolVar(&v.json, "json", false, "Print the version, features and formats as JSON")
+}
+
+// runVersion implements the version subcommand.
+func runVersion(args []string) int {
+  var v versionOptions
+  versionFlags := flag.NewFlagSet("version", flag.ContinueOnError)
+  v.addFlags(versionFlags)
+  versionFlags.Usage = func() {
+    fmt.Fprintln(versionFlags.Output(), tr("Usage: tileex version [flags]"))
+    versionFlags.PrintDefaults()
+  }
+  parseFlags(versionFlags, "version", args)
+
+  info := buildInfo()
+  if v.json {
+    data, err := json.MarshalIndent(info, "", "  ")
+    if err != nil {
+      fmt.Fprintln(os.Stderr, tr("Error:"), err)
+      return exitFailure
+    }
+    fmt.Println(string(data))
+    return 0
+  }
+
+  commit := info.Commit
+  if info.Modified {
+    commit += tr(" (modified)")
+  }
+  fmt.Printf("tileex %s\n", info.Version)
+  fmt.Printf(tr("Commit: %s\n"), commit)
+  fmt.Printf("Go: %s\n", info.GoVersion)
+  names := make([]string, 0, len(info.Features))
+  for name := range info.Features {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  var enabled, disabled []string
+  for _, name := range names {
+    if info.Features[name] {
+      enabled = append(enabled, name)
+    } else {
+      disabled = append(disabled, name)
+    }
+  }
+  if len(enabled) == 0 {
+    enabled = []string{"none"}
+  }
+  fmt.Printf(tr("Features: %s\n"), strings.Join(enabled, ", "))
+  if len(disabled) > 0 {
+    fmt.Printf(tr("Not available: %s\n"), strings.Join(disabled, ", "))
+  }
+  fmt.Printf(tr("Input formats: %s\n"), strings.Join(info.InputFormats, ", "))
+  fmt.Printf(tr("Output formats: %s\n"), strings.Join(info.OutputFormats, ", "))
+  var found, missing []string
+  for name, ok := range info.Tools {
+    if ok {
+      found = append(found, name)
+    } else {
+      missing = append(missing, name)
+    }
+  }
+  sort.Strings(found)
+  sort.Strings(missing)
+  if len(found) > 0 {
+    fmt.Printf(tr("Tools: %s\n"), strings.Join(found, ", "))
+  }
+  if len(missing) > 0 {
+    fmt.Printf(tr("Tools not on the PATH: %s\n"), strings.Join(missing, ", "))
+  }
+  return 0
+}
+
+// detectOptions holds the flags of the detect subcommand.
+type detectOptions struct {
+  s settings
+  b batch
+  verbose, json bool
+}
+
+func (d *detectOptions) addFlags(fs *flag.FlagSet) {
+  fs.BoolVar(&d.verbose, "v", false, "Show the detection output for every image")
+  fs.BoolVar(&d.json, "json", false, "Print one JSON object per image instead of a line of text")
+  addSettingsFlags(fs, &d.s)
+  addBatchFlags(fs, &d.b)
+}
+
+// runDetect implements the detect subcommand, which prints the tile size and
+// offset found in each image without saving anything. It returns 0 when a
+// tile was found in every image, 1 when detection failed for some and 2 when
+// it could not run.
+func runDetect(args []string) int {
+  var d detectOptions
+  detectFlags := flag.NewFlagSet("detect", flag.ContinueOnError)
+  d.addFlags(detectFlags)
+  detectFlags.Usage = func() {
+    fmt.Fprintln(detectFlags.Output(), tr("Usage: tileex detect [flags] image..."))
+    detectFlags.PrintDefaults()
+  }
+  parseFlags(detectFlags, "detect", args)
+  s, b := d.s, d.b
+
+  if detectFlags.NArg() == 0 {
+    detectFlags.Usage()
+    return exitUsage
+  }
+  if err := s.prepare(); err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitUsage
+  }
+  if err := b.prepare(); err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitUsage
+  }
+
+  // With -json, stdout only carries the results, one per line.
+  out := os.Stdout
+  if d.json {
+    out = os.Stderr
+  }
+  logOutput := io.Discard
+  if d.verbose {
+    logOutput = out
+  }
+  failed := false
+  for _, file := range detectFlags.Args() {
+    var ext extraction
+    err := b.run(file, func() error {
+      img, err := decodeFile(file)
+      if err != nil {
+        return err
+      }
+      ctx, cancel := s.context(context.Background())
+      defer cancel()
+      logger := b.logger(logOutput, file)
+      _, ext, err = b.extractTile(ctx, img, file, s, logger)
+      return err
+    })
+    if err != nil {
+      fmt.Fprintf(out, "error    %s: %v\n", file, err)
+      failed = true
+      if b.halted {
+        break
+      }
+      continue
+    }
+    if d.json {
+      data, err := json.Marshal(ext.result(file))
+      if err != nil {
+        fmt.Fprintln(os.Stderr, tr("Error:"), err)
+        return exitFailure
+      }
+      fmt.Println(string(data))
+      continue
+    }
+    fmt.Printf("%s: %dx%d at %d,%d (%s)\n", file, ext.Width, ext.Height, ext.Origin.X, ext.Origin.Y, ext.Grade)
+  }
+  if err := b.finish(); err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitFailure
+  }
+  if failed {
+    return 1
+  }
+  return 0
+}
+
+// tileOptions holds the flags of the tile subcommand.
+type tileOptions struct {
+  o outputSettings
+  output string
+  width, height int
+}
+
+func (t *tileOptions) addFlags(fs *flag.FlagSet) {
+  fs.StringVar(&t.output, "output", "tiled.png", "The output file")
+  fs.IntVar(&t.width, "width", 0, "The width of the output in pixels")
+  fs.IntVar(&t.height, "height", 0, "The height of the output in pixels")
+  addOutputFlags(fs, &t.o)
+}
+
+// runTile implements the tile subcommand, which repeats a tile across an
+// image of the given size, for instance to preview a tile or to rebuild a
+// texture at another resolution.
+func runTile(args []string) int {
+  var t tileOptions
+  tileFlags := flag.NewFlagSet("tile", flag.ContinueOnError)
+  t.addFlags(tileFlags)
+  tileFlags.Usage = func() {
+    fmt.Fprintln(tileFlags.Output(), tr("Usage: tileex tile -width w -height h [flags] tile"))
+    tileFlags.PrintDefaults()
+  }
+  parseFlags(tileFlags, "tile", args)
+
+  if tileFlags.NArg() != 1 || t.width <= 0 || t.height <= 0 {
+    tileFlags.Usage()
+    return exitUsage
+  }
+  if err := t.o.prepare(); err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitUsage
+  }
+  tile, err := t.o.decode(tileFlags.Arg(0))
+  if err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitDecode
+  }
+  if err := t.o.save(t.output, Retile(tile, t.width, t.height)); err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitFailure
+  }
+  fmt.Printf(tr("Tiled %s to %dx%d in %s\n"), tileFlags.Arg(0), t.width, t.height, t.output)
+  return 0
+}
+
+// resizeOptions holds the flags of the resize subcommand.
+type resizeOptions struct {
+  o outputSettings
+  output string
+  scale float64
+  width, height int
+}
+
+func (r *resizeOptions) addFlags(fs *flag.FlagSet) {
+  fs.StringVar(&r.output, "output", "resized.png", "The output file")
+  fs.Float64Var(&r.scale, "scale", 0, "The factor to scale the tile by, such as 0.5 for half its size")
+  fs.IntVar(&r.width, "width", 0, "The width of the output in pixels, instead of scaling it")
+  fs.IntVar(&r.height, "height", 0, "The height of the output in pixels, instead of scaling it")
+  addOutputFlags(fs, &r.o)
+}
+
+// runResize implements the resize subcommand, which scales a tile without
+// breaking its seams.
+func runResize(args []string) int {
+  var r resizeOptions
+  resizeFlags := flag.NewFlagSet("resize", flag.ContinueOnError)
+  r.addFlags(resizeFlags)
+  resizeFlags.Usage = func() {
+    fmt.Fprintln(resizeFlags.Output(), tr("Usage: tileex resize -scale s [flags] tile"))
+    resizeFlags.PrintDefaults()
+  }
+  parseFlags(resizeFlags, "resize", args)
+
+  if resizeFlags.NArg() != 1 || r.scale < 0 || r.width < 0 || r.height < 0 || (r.scale == 0 && (r.width == 0 || r.height == 0)) {
+    resizeFlags.Usage()
+    return exitUsage
+  }
+  if err := r.o.prepare(); err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitUsage
+  }
+  tile, err := r.o.decode(resizeFlags.Arg(0))
+  if err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitDecode
+  }
+  width, height := r.width, r.height
+  if width == 0 {
+    width = max(1, int(math.Round(float64(tile.Bounds().Dx()) * r.scale)))
+  }
+  if height == 0 {
+    height = max(1, int(math.Round(float64(tile.Bounds().Dy()) * r.scale)))
+  }
+  if err := checkMaxSize(width, height); err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitUsage
+  }
+  if err := r.o.save(r.output, ResizeTile(tile, width, height)); err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitFailure
+  }
+  fmt.Printf(tr("Resized %s to %dx%d in %s\n"), resizeFlags.Arg(0), width, height, r.output)
+  return 0
+}
+
+// verifyOptions holds the flags of the verify subcommand.
+type verifyOptions struct {
+  source, requireGrade string
+}
+
+func (v *verifyOptions) addFlags(fs *flag.FlagSet) {
+  fs.StringVar(&v.source, "source", "", "The image the tile was extracted from")
+  fs.StringVar(&v.requireGrade, "require-grade", "near-exact", "The minimum quality grade (exact, near-exact or approximate) for the tile to pass")
+}
+
+// runVerify implements the verify subcommand, which scores how well a tile
+// reproduces the image it came from. It returns 0 when the tile reaches
+// -require-grade, 1 when it does not and 2 when it could not be scored.
+func runVerify(args []string) int {
+  var v verifyOptions
+  verifyFlags := flag.NewFlagSet("verify", flag.ContinueOnError)
+  v.addFlags(verifyFlags)
+  verifyFlags.Usage = func() {
+    fmt.Fprintln(verifyFlags.Output(), tr("Usage: tileex verify -source image [flags] tile"))
+    verifyFlags.PrintDefaults()
+  }
+  parseFlags(verifyFlags, "verify", args)
+
+  if verifyFlags.NArg() != 1 || v.source == "" {
+    verifyFlags.Usage()
+    return exitUsage
+  }
+  requiredGrade, err := ParseGrade(v.requireGrade)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitUsage
+  }
+  source, err := decodeFile(v.source)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitDecode
+  }
+  tile, err := decodeFile(verifyFlags.Arg(0))
+  if err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitDecode
+  }
+
+  origin, reconstructionError := VerifyTile(source, tile)
+  grade := GradeFor(reconstructionError)
+  fmt.Printf(tr("Best alignment: %d,%d\n"), origin.X, origin.Y)
+  fmt.Printf(tr("Quality grade: %s (reconstruction error %f)\n"), strings.ToUpper(grade.String()), reconstructionError)
+  if grade < requiredGrade {
+    fmt.Printf(tr("The tile is graded %s but %s is required\n"), grade, requiredGrade)
+    return 1
+  }
+  return 0
+}
+
+// auditOptions holds the flags of the audit subcommand.
+type auditOptions struct {
+  s settings
+  b batch
+  reference, output string
+  minSimilarity float64
+}
+
+func (a *auditOptions) addFlags(fs *flag.FlagSet) {
+  fs.StringVar(&a.reference, "reference", "", "The directory of reference tiles to look for")
+  fs.StringVar(&a.output, "output", "audit.csv", "The CSV evidence report")
+  fs.Float64Var(&a.minSimilarity, "min-similarity", 0.95, "The similarity, from 0 to 1, from which an image counts as using a reference tile")
+  addSettingsFlags(fs, &a.s)
+  addBatchFlags(fs, &a.b)
+}
+
+// auditMatch is the reference tile that best reproduces one image.
+type auditMatch struct {
+  Reference string
+  Similarity float64
+  Offset image.Point
+}
+
+// bestReference repeats every reference tile across pixels at the offset
+// where it fits best. A reference of the same aspect ratio as the width by
+// height tile found in pixels is also tried scaled to that size, so that
+// resized copies are caught too. The similarity is one minus the RMS color
+// difference.
+func bestReference(pixels *pixelBuffer, width, height int, names []string, references []*pixelBuffer) (auditMatch, bool) {
+  var best auditMatch
+  found := false
+  for idx, reference := range references {
+    candidates := []*pixelBuffer{reference}
+    refWidth, refHeight := reference.Rect.Dx(), reference.Rect.Dy()
+    if (refWidth != width || refHeight != height) && math.Abs(float64(refWidth * height) / float64(refHeight * width) - 1) <= 0.02 {
+      candidates = append(candidates, reference.resized(width, height))
+    }
+    for _, candidate := range candidates {
+      offset, reconstructionError := pixels.alignTile(candidate)
+      similarity := 1 - math.Sqrt(reconstructionError)
+      if !found || similarity > best.Similarity {
+        best = auditMatch{Reference: names[idx], Similarity: similarity, Offset: offset}
+        found = true
+      }
+    }
+  }
+  return best, found
+}
+
+// runAudit implements the audit subcommand, which extracts the tile of every
+// crawled image and looks for it among a set of reference tiles, writing the
+// best match of each image to a CSV report. It returns 0 when no image uses a
+// reference tile, 1 when some do and 2 when the audit could not run.
+func runAudit(args []string) int {
+  var a auditOptions
+  auditFlags := flag.NewFlagSet("audit", flag.ContinueOnError)
+  a.addFlags(auditFlags)
+  auditFlags.Usage = func() {
+    fmt.Fprintln(auditFlags.Output(), tr("Usage: tileex audit -reference dir [flags] path..."))
+    auditFlags.PrintDefaults()
+  }
+  parseFlags(auditFlags, "audit", args)
+  s, b := a.s, a.b
+
+  if auditFlags.NArg() == 0 || a.reference == "" {
+    auditFlags.Usage()
+    return exitUsage
+  }
+  if err := s.prepare(); err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitUsage
+  }
+  if err := b.prepare(); err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitUsage
+  }
+
+  names, err := imageFiles([]string{a.reference})
+  if err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitFailure
+  }
+  if len(names) == 0 {
+    fmt.Fprintf(os.Stderr, tr("Error: No reference tiles in %s\n"), a.reference)
+    return exitUsage
+  }
+  references := make([]*pixelBuffer, len(names))
+  for idx, name := range names {
+    img, err := decodeFile(name)
+    if err != nil {
+      fmt.Fprintln(os.Stderr, tr("Error:"), err)
+      return exitDecode
+    }
+    references[idx] = newPixelBuffer(img)
+  }
+  files, err := imageFiles(auditFlags.Args())
+  if err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitFailure
+  }
+
+  report, err := os.Create(a.output)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitFailure
+  }
+  defer report.Close()
+  w := csv.NewWriter(report)
+  w.Write([]string{"image", "tile_width", "tile_height", "reference", "similarity", "offset_x", "offset_y", "match", "error"})
+
+  matched := 0
+  for _, file := range files {
+    var ext extraction
+    var match auditMatch
+    var found bool
+    err := b.run(file, func() error {
+      img, err := decodeFile(file)
+      if err != nil {
+        return err
+      }
+      ctx, cancel := s.context(context.Background())
+      defer cancel()
+      logger := b.logger(io.Discard, file)
+      var an *analysis
+      if an, ext, err = b.extractTile(ctx, img, file, s, logger); err != nil {
+        return err
+      }
+      match, found = bestReference(an.buffer(), ext.Width, ext.Height, names, references)
+      return nil
+    })
+    if err != nil {
+      fmt.Printf("error    %s: %v\n", file, err)
+      w.Write([]string{file, "", "", "", "", "", "", "", err.Error()})
+      if b.halted {
+        break
+      }
+      continue
+    }
+    row := []string{file, strconv.Itoa(ext.Width), strconv.Itoa(ext.Height), "", "", "", "", "no", ""}
+    if found {
+      isMatch := match.Similarity >= a.minSimilarity
+      row[3] = match.Reference
+      row[4] = strconv.FormatFloat(match.Similarity, 'f', 4, 64)
+      row[5] = strconv.Itoa(match.Offset.X)
+      row[6] = strconv.Itoa(match.Offset.Y)
+      if isMatch {
+        row[7] = "yes"
+        matched++
+        fmt.Printf("match    %s: %s (similarity %.4f)\n", file, match.Reference, match.Similarity)
+      }
+    }
+    w.Write(row)
+  }
+  w.Flush()
+  if err := w.Error(); err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitFailure
+  }
+  if err := b.finish(); err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitFailure
+  }
+
+  fmt.Printf(tr("%d of %d images match a reference tile, see %s\n"), matched, len(files), a.output)
+  if matched > 0 {
+    return 1
+  }
+  return 0
+}
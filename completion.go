@@ -0,0 +1,209 @@
+/*
+TileEx : A Tiling Pattern Extractor written in Go
+Copyright (C) 2023, Sarthak Shah (shahsarthakw@gmail.com)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+  "io"
+  "os"
+  "fmt"
+  "flag"
+  "sort"
+  "strings"
+)
+
+// completionValues lists the words accepted by the flags that take one of a
+// fixed set of values, so the completion scripts can offer them.
+var completionValues = map[string][]string{
+  "combine": {"none", "mean", "median"},
+  "input-alpha": {"auto", "straight", "premultiplied"},
+  "output-alpha": {"straight", "premultiplied"},
+  "tie-break": {"smallest", "largest", "lowest-reconstruction-error"},
+  "require-grade": {"exact", "near-exact", "approximate"},
+  "on-error": {"skip", "stop", "retry:"},
+  "raw-format": {"rgba", "gray", "gray16", "nv12"},
+  "strip": {"horizontal", "vertical", "auto"},
+  "algorithm": {"lines", "keypoints", "ensemble"},
+  "log-format": {"text", "json"},
+  "lang": {"en", "de"},
+  "duplicates": {"record", "link", "off"},
+  "frames": {"each", "consensus", "animate"},
+  "output-format": {"png", "jpeg", "gif", "bmp", "tiff", "dds", "ktx2", "svg", "webp", "avif", "jxl"},
+  "texture-compression": {"none", "bc", "etc"},
+  "proof-page": {"a4", "a3", "letter", "legal", "tabloid"},
+}
+
+// completionShells are the shells `tileex completion` can write a script for.
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// completionCommand is a subcommand and its flags. The default mode, which
+// takes no subcommand, has an empty name.
+type completionCommand struct {
+  name string
+  flags *flag.FlagSet
+}
+
+func completionCommands() []completionCommand {
+  extractFlags := flag.NewFlagSet("tileex", flag.ContinueOnError)
+  new(extractOptions).addFlags(extractFlags)
+  addConfigFlag(extractFlags)
+  addLangFlag(extractFlags)
+  commands := []completionCommand{{"", extractFlags}, {"extract", extractFlags}}
+  for name, cmd := range subcommands {
+    fs := flag.NewFlagSet(name, flag.ContinueOnError)
+    cmd.addFlags(fs)
+    if cmd.config {
+      addConfigFlag(fs)
+      addLangFlag(fs)
+    }
+    commands = append(commands, completionCommand{name, fs})
+  }
+  sort.Slice(commands, func(i, j int) bool { return commands[i].name < commands[j].name })
+  return commands
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+  bf, ok := f.Value.(interface{ IsBoolFlag() bool })
+  return ok && bf.IsBoolFlag()
+}
+
+// writeBashCompletion writes a bash completion function for tileex. zsh
+// loads the same function through bashcompinit.
+func writeBashCompletion(w io.Writer) {
+  var names []string
+  for _, cmd := range completionCommands() {
+    if cmd.name != "" {
+      names = append(names, cmd.name)
+    }
+  }
+
+  fmt.Fprintln(w, "_tileex() {")
+  fmt.Fprintln(w, "  local cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\" cmd=\"\"")
+  fmt.Fprintln(w, "  if [[ $COMP_CWORD -gt 1 ]]; then cmd=\"${COMP_WORDS[1]}\"; fi")
+  fmt.Fprintln(w, "  COMPREPLY=()")
+  // Flags may be written with one dash or two.
+  fmt.Fprintln(w, "  prev=\"${prev/#--/-}\"")
+  fmt.Fprintln(w, "  case \"$prev\" in")
+  flagNames := make([]string, 0, len(completionValues))
+  for name := range completionValues {
+    flagNames = append(flagNames, name)
+  }
+  sort.Strings(flagNames)
+  for _, name := range flagNames {
+    fmt.Fprintf(w, "    -%s) COMPREPLY=($(compgen -W \"%s\" -- \"$cur\")); return;;\n", name, strings.Join(completionValues[name], " "))
+  }
+  fmt.Fprintln(w, "  esac")
+  fmt.Fprintln(w, "  case \"$cmd\" in")
+  // The default mode goes last, as its pattern matches every word.
+  commands := completionCommands()
+  commands = append(commands[1:], commands[0])
+  for _, cmd := range commands {
+    var flags, valueFlags []string
+    cmd.flags.VisitAll(func(f *flag.Flag) {
+      flags = append(flags, "-" + f.Name)
+      if !isBoolFlag(f) {
+        valueFlags = append(valueFlags, "-" + f.Name)
+      }
+    })
+    pattern := cmd.name
+    if pattern == "" {
+      pattern = "*"
+    }
+    fmt.Fprintf(w, "    %s)\n", pattern)
+    if cmd.name == "completion" {
+      fmt.Fprintf(w, "      [[ $COMP_CWORD -eq 2 ]] && COMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n", strings.Join(completionShells, " "))
+      fmt.Fprintln(w, "      return;;")
+      continue
+    }
+    if len(valueFlags) > 0 {
+      // Leave the value of any other flag to the default file completion.
+      fmt.Fprintf(w, "      case \"$prev\" in %s) return;; esac\n", strings.Join(valueFlags, "|"))
+    }
+    if cmd.name == "" {
+      fmt.Fprintln(w, "      if [[ $COMP_CWORD -eq 1 && \"$cur\" != -* ]]; then")
+      fmt.Fprintf(w, "        COMPREPLY=($(compgen -W \"%s\" -- \"$cur\")); return\n", strings.Join(names, " "))
+      fmt.Fprintln(w, "      fi")
+    }
+    fmt.Fprintf(w, "      [[ \"$cur\" == -* ]] && COMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n", strings.Join(flags, " "))
+    fmt.Fprintln(w, "      return;;")
+  }
+  fmt.Fprintln(w, "  esac")
+  fmt.Fprintln(w, "}")
+  fmt.Fprintln(w, "complete -o default -F _tileex tileex")
+}
+
+// fishQuote quotes s as a single-quoted fish string.
+func fishQuote(s string) string {
+  s = strings.ReplaceAll(s, "\\", "\\\\")
+  return "'" + strings.ReplaceAll(s, "'", "\\'") + "'"
+}
+
+func writeFishCompletion(w io.Writer) {
+  var names []string
+  for _, cmd := range completionCommands() {
+    if cmd.name != "" {
+      names = append(names, cmd.name)
+    }
+  }
+  noSubcommand := "not __fish_seen_subcommand_from " + strings.Join(names, " ")
+
+  fmt.Fprintln(w, "complete -c tileex -e")
+  for _, cmd := range completionCommands() {
+    if cmd.name == "" {
+      continue
+    }
+    fmt.Fprintf(w, "complete -c tileex -f -n __fish_use_subcommand -a %s\n", cmd.name)
+  }
+  fmt.Fprintf(w, "complete -c tileex -f -n '__fish_seen_subcommand_from completion' -a %s\n", fishQuote(strings.Join(completionShells, " ")))
+  for _, cmd := range completionCommands() {
+    condition := "__fish_seen_subcommand_from " + cmd.name
+    if cmd.name == "" {
+      condition = noSubcommand
+    }
+    cmd.flags.VisitAll(func(f *flag.Flag) {
+      line := fmt.Sprintf("complete -c tileex -n %s -o %s", fishQuote(condition), f.Name)
+      if values, ok := completionValues[f.Name]; ok {
+        line += " -x -a " + fishQuote(strings.Join(values, " "))
+      } else if !isBoolFlag(f) {
+        line += " -r -F"
+      }
+      fmt.Fprintln(w, line + " -d " + fishQuote(f.Usage))
+    })
+  }
+}
+
+// runCompletion implements the completion subcommand, which writes a shell
+// completion script for tileex to stdout.
+func runCompletion(args []string) int {
+  if len(args) != 1 {
+    fmt.Println("Usage: tileex completion bash|zsh|fish")
+    return exitUsage
+  }
+  switch args[0] {
+  case "bash":
+    writeBashCompletion(os.Stdout)
+  case "zsh":
+    fmt.Println("autoload -U +X bashcompinit && bashcompinit")
+    writeBashCompletion(os.Stdout)
+  case "fish":
+    writeFishCompletion(os.Stdout)
+  default:
+    fmt.Println("Error: Unknown shell", args[0], "(expected bash, zsh or fish)")
+    return exitUsage
+  }
+  return 0
+}
@@ -0,0 +1,221 @@
+/*
+TileEx : A Tiling Pattern Extractor written in Go
+Copyright (C) 2023, Sarthak Shah (shahsarthakw@gmail.com)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+  "errors"
+  "io"
+  "os"
+  "path"
+  "fmt"
+  "flag"
+  "strings"
+)
+
+// configFiles are the config files looked for in the current directory when
+// no -config is given.
+var configFiles = []string{"tileex.toml", "tileex.yaml", "tileex.yml"}
+
+// readConfig reads a config file of flag defaults, returning them by section.
+// Settings outside of any section are under "". Both a flat subset of TOML,
+// with key = value lines and [section] headers, and of YAML, with key: value
+// lines and sections as keys whose settings are indented below them, are
+// understood. Keys are flag names, in which underscores may stand for dashes.
+func readConfig(name string) (map[string]map[string]string, error) {
+  data, err := os.ReadFile(name)
+  if err != nil {
+    return nil, err
+  }
+  yaml := path.Ext(name) == ".yaml" || path.Ext(name) == ".yml"
+  config := map[string]map[string]string{"": {}}
+  section := ""
+  for idx, line := range strings.Split(string(data), "\n") {
+    indented := strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")
+    line = strings.TrimSpace(line)
+    if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+      continue
+    }
+    var key, value string
+    var found bool
+    if yaml {
+      key, value, found = strings.Cut(line, ":")
+      if !indented {
+        section = ""
+      }
+    } else if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+      section = strings.TrimSpace(line[1:len(line) - 1])
+      config[section] = make(map[string]string)
+      continue
+    } else {
+      key, value, found = strings.Cut(line, "=")
+    }
+    if !found {
+      return nil, fmt.Errorf("%s:%d: expected a setting, got %q", name, idx + 1, line)
+    }
+    key = strings.ReplaceAll(strings.TrimSpace(key), "_", "-")
+    if yaml && !indented && strings.TrimSpace(value) == "" {
+      section = key
+      config[section] = make(map[string]string)
+      continue
+    }
+    config[section][key] = configValue(value)
+  }
+  return config, nil
+}
+
+// configValue strips the quotes or the trailing comment from a config value.
+func configValue(value string) string {
+  value = strings.TrimSpace(value)
+  if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') {
+    if end := strings.IndexByte(value[1:], value[0]); end >= 0 {
+      return value[1:end + 1]
+    }
+  }
+  if before, _, found := strings.Cut(value, "#"); found {
+    value = strings.TrimSpace(before)
+  }
+  return value
+}
+
+func addConfigFlag(fs *flag.FlagSet) *string {
+  return fs.String("config", "", "Read flag defaults from the given TOML or YAML file (default: tileex.toml or tileex.yaml if present)")
+}
+
+func addLangFlag(fs *flag.FlagSet) *string {
+  return fs.String("lang", "en", "The language of the messages: en (English) or de (German)")
+}
+
+// parseFlags parses the flags of a command, then fills in the flags that
+// were not given on the command line from the config file named by -config
+// or found in the current directory. The settings of the command's own
+// section override those outside of any section. Errors in the config file
+// exit with exitUsage, as errors in the flags do. Last, it sets the
+// language of the messages from -lang.
+func parseFlags(fs *flag.FlagSet, command string, args []string) {
+  configName := addConfigFlag(fs)
+  lang := addLangFlag(fs)
+  // fs continues on errors, so that they exit with exitUsage rather than
+  // the 2 of the flag package. The flag package would also report them in
+  // English, so they are reported here instead, in the language of a -lang
+  // given before the mistake.
+  output := fs.Output()
+  fs.SetOutput(io.Discard)
+  err := fs.Parse(args)
+  fs.SetOutput(output)
+  if err != nil {
+    if _, ok := catalogs[*lang]; ok {
+      language = *lang
+    }
+    if errors.Is(err, flag.ErrHelp) {
+      fs.Usage()
+      os.Exit(0)
+    }
+    fmt.Fprintln(fs.Output(), trFlagError(err))
+    fs.Usage()
+    os.Exit(exitUsage)
+  }
+  if *configName == "" {
+    for _, name := range configFiles {
+      if _, err := os.Stat(name); err == nil {
+        *configName = name
+        break
+      }
+    }
+  }
+
+  if *configName != "" {
+    config, err := readConfig(*configName)
+    if err == nil {
+      err = applyConfig(fs, command, config[""], config[command], *configName)
+    }
+    if err != nil {
+      fmt.Fprintln(fs.Output(), "Error:", err)
+      os.Exit(exitUsage)
+    }
+  }
+  if _, ok := catalogs[*lang]; !ok && *lang != "en" {
+    fmt.Fprintf(fs.Output(), "Error: unknown -lang %q, expected en or de\n", *lang)
+    os.Exit(exitUsage)
+  }
+  language = *lang
+}
+
+// trFlagError translates an error of the flag package, which formats its
+// messages itself, by their format strings in the catalog.
+func trFlagError(err error) string {
+  message := err.Error()
+  for _, format := range []string{"flag provided but not defined: %s", "flag needs an argument: %s", "bad flag syntax: %s"} {
+    if rest, ok := strings.CutPrefix(message, strings.TrimSuffix(format, "%s")); ok {
+      return fmt.Sprintf(tr(format), rest)
+    }
+  }
+  for _, format := range []string{"invalid value %s for flag %s: %s", "invalid boolean value %s for %s: %s"} {
+    prefix, rest, _ := strings.Cut(format, "%s")
+    middle, _, _ := strings.Cut(rest, "%s")
+    if rest, ok := strings.CutPrefix(message, prefix); ok {
+      if value, rest, ok := strings.Cut(rest, middle); ok {
+        if name, reason, ok := strings.Cut(rest, ": "); ok {
+          return fmt.Sprintf(tr(format), value, name, tr(reason))
+        }
+      }
+    }
+  }
+  return message
+}
+
+// applyConfig sets the flags of fs that were not given on the command line
+// from the shared and the command's settings. A shared setting that no
+// command knows is an error, while one that only other commands know is
+// skipped.
+func applyConfig(fs *flag.FlagSet, command string, shared, own map[string]string, configName string) error {
+  given := make(map[string]bool)
+  fs.Visit(func(f *flag.Flag) {
+    given[f.Name] = true
+  })
+  known := make(map[string]bool)
+  for _, cmd := range completionCommands() {
+    cmd.flags.VisitAll(func(f *flag.Flag) {
+      known[f.Name] = true
+    })
+  }
+
+  values := make(map[string]string)
+  for key, value := range shared {
+    if !known[key] {
+      return fmt.Errorf("unknown setting %q in %s", key, configName)
+    }
+    if fs.Lookup(key) != nil {
+      values[key] = value
+    }
+  }
+  for key, value := range own {
+    if fs.Lookup(key) == nil {
+      return fmt.Errorf("unknown setting %q for %s in %s", key, command, configName)
+    }
+    values[key] = value
+  }
+  for key, value := range values {
+    if given[key] || key == "config" {
+      continue
+    }
+    if err := fs.Set(key, value); err != nil {
+      return fmt.Errorf("invalid value %q for %s in %s: %v", value, key, configName, err)
+    }
+  }
+  return nil
+}
@@ -0,0 +1,289 @@
+/*
+TileEx : A Tiling Pattern Extractor written in Go
+Copyright (C) 2023, Sarthak Shah (shahsarthakw@gmail.com)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+  "io"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "fmt"
+  "strings"
+  "image"
+  "runtime"
+)
+
+// notify shows a desktop notification in the background. Clicking it opens
+// preview, if there is one, where the platform allows it. Failures are
+// ignored since the result is printed as well.
+func notify(title, text, preview string) {
+  var cmd *exec.Cmd
+  switch runtime.GOOS {
+  case "windows":
+    cmd = exec.Command("powershell", "-NoProfile", "-Command",
+      "Add-Type -AssemblyName System.Windows.Forms; " +
+      "$n = New-Object System.Windows.Forms.NotifyIcon; " +
+      "$n.Icon = [System.Drawing.SystemIcons]::Information; $n.Visible = $true; " +
+      "Register-ObjectEvent $n BalloonTipClicked -Action { if ($env:TILEEX_PREVIEW) { Start-Process $env:TILEEX_PREVIEW } } | Out-Null; " +
+      "$n.ShowBalloonTip(10000, $env:TILEEX_TITLE, $env:TILEEX_MESSAGE, 'Info'); " +
+      "Start-Sleep 10; $n.Dispose()")
+  case "darwin":
+    if _, err := exec.LookPath("terminal-notifier"); err == nil {
+      cmd = exec.Command("terminal-notifier", "-title", title, "-message", text)
+      if preview != "" {
+        if abs, err := filepath.Abs(preview); err == nil {
+          cmd.Args = append(cmd.Args, "-open", "file://" + filepath.ToSlash(abs))
+        }
+      }
+    } else {
+      cmd = exec.Command("osascript", "-e",
+        "display notification (system attribute \"TILEEX_MESSAGE\") with title (system attribute \"TILEEX_TITLE\")")
+    }
+  default:
+    cmd = exec.Command("notify-send", "--app-name=TileEx", title, text)
+    if preview != "" {
+      cmd.Args = append(cmd.Args, "--action=open=Open")
+    }
+  }
+  cmd.Env = append(os.Environ(), "TILEEX_TITLE=" + title, "TILEEX_MESSAGE=" + text, "TILEEX_PREVIEW=" + preview)
+  go func() {
+    out, err := cmd.Output()
+    // notify-send prints the name of the action that was clicked.
+    if err == nil && preview != "" && strings.TrimSpace(string(out)) == "open" {
+      exec.Command("xdg-open", preview).Run()
+    }
+  }()
+}
+
+// pasteImage writes the image on the clipboard to the PNG file name.
+func pasteImage(name string) error {
+  var cmd *exec.Cmd
+  switch runtime.GOOS {
+  case "windows":
+    cmd = exec.Command("powershell", "-STA", "-NoProfile", "-Command",
+      "Add-Type -AssemblyName System.Windows.Forms; " +
+      "$i = [System.Windows.Forms.Clipboard]::GetImage(); " +
+      "if (-not $i) { exit 1 }; " +
+      "$i.Save($env:TILEEX_FILE, [System.Drawing.Imaging.ImageFormat]::Png)")
+  case "darwin":
+    cmd = exec.Command("osascript",
+      "-e", "set f to open for access (POSIX file (system attribute \"TILEEX_FILE\")) with write permission",
+      "-e", "write (the clipboard as «class PNGf») to f",
+      "-e", "close access f")
+  default:
+    file, err := os.Create(name)
+    if err != nil {
+      return err
+    }
+    defer file.Close()
+    if os.Getenv("WAYLAND_DISPLAY") != "" {
+      cmd = exec.Command("wl-paste", "--type", "image/png")
+    } else {
+      cmd = exec.Command("xclip", "-selection", "clipboard", "-target", "image/png", "-out")
+    }
+    cmd.Stdout = file
+  }
+  cmd.Env = append(os.Environ(), "TILEEX_FILE=" + name)
+  if err := cmd.Run(); err != nil {
+    if _, ok := err.(*exec.ExitError); ok {
+      return fmt.Errorf("The clipboard does not hold an image")
+    }
+    return err
+  }
+  return nil
+}
+
+// copyImage puts the PNG file name on the clipboard.
+func copyImage(name string) error {
+  var cmd *exec.Cmd
+  switch runtime.GOOS {
+  case "windows":
+    cmd = exec.Command("powershell", "-STA", "-NoProfile", "-Command",
+      "Add-Type -AssemblyName System.Windows.Forms; " +
+      "$i = [System.Drawing.Image]::FromFile($env:TILEEX_FILE); " +
+      "[System.Windows.Forms.Clipboard]::SetImage($i); $i.Dispose()")
+  case "darwin":
+    cmd = exec.Command("osascript", "-e",
+      "set the clipboard to (read (POSIX file (system attribute \"TILEEX_FILE\")) as «class PNGf»)")
+  default:
+    if os.Getenv("WAYLAND_DISPLAY") != "" {
+      file, err := os.Open(name)
+      if err != nil {
+        return err
+      }
+      defer file.Close()
+      cmd = exec.Command("wl-copy", "--type", "image/png")
+      cmd.Stdin = file
+    } else {
+      cmd = exec.Command("xclip", "-selection", "clipboard", "-target", "image/png", "-in", name)
+    }
+  }
+  cmd.Env = append(os.Environ(), "TILEEX_FILE=" + name)
+  return cmd.Run()
+}
+
+// decodeClipboard reads the image on the clipboard, going through a temporary
+// PNG file since that is what every clipboard tool can produce.
+func (o outputSettings) decodeClipboard() (image.Image, error) {
+  dir, err := os.MkdirTemp("", "tileex")
+  if err != nil {
+    return nil, err
+  }
+  defer os.RemoveAll(dir)
+  name := filepath.Join(dir, "clipboard.png")
+  if err := pasteImage(name); err != nil {
+    return nil, err
+  }
+  return o.decode(name)
+}
+
+// saveClipboard puts the tile on the clipboard as a PNG image.
+func (o outputSettings) saveClipboard(tile image.Image) error {
+  dir, err := os.MkdirTemp("", "tileex")
+  if err != nil {
+    return err
+  }
+  // xclip and wl-copy read the file before they return, so it can go as soon
+  // as copyImage is done.
+  defer os.RemoveAll(dir)
+  name := filepath.Join(dir, "tile.png")
+  if err := o.save(name, tile); err != nil {
+    return err
+  }
+  return copyImage(name)
+}
+
+// isTerminal reports whether f is a terminal rather than a file or a pipe.
+func isTerminal(f *os.File) bool {
+  info, err := f.Stat()
+  return err == nil && info.Mode() & os.ModeCharDevice != 0
+}
+
+// progressBar returns a progress callback that draws a bar on w, redrawing
+// it only when the percentage changes and ending the line once a pass is
+// done.
+func progressBar(w io.Writer) func(done, total int) {
+  const width = 30
+  last := -1
+  return func(done, total int) {
+    percent := done * 100 / total
+    if percent == last {
+      return
+    }
+    last = percent
+    filled := percent * width / 100
+    fmt.Fprintf(w, "\rAnalyzing [%s%s] %3d%% (%d/%d lines)", strings.Repeat("#", filled), strings.Repeat(".", width - filled), percent, done, total)
+    if done == total {
+      fmt.Fprintln(w)
+    }
+  }
+}
+
+// launchedWithoutArguments reports whether TileEx was started with no
+// arguments and without the default input.png or a config file to work from,
+// which is what happens when it is double-clicked from a file manager.
+func launchedWithoutArguments() bool {
+  if len(os.Args) > 1 {
+    return false
+  }
+  for _, name := range append([]string{"input.png"}, configFiles...) {
+    if _, err := os.Stat(name); err == nil {
+      return false
+    }
+  }
+  return true
+}
+
+// pickFile asks for an image with the native file dialog of the platform. It
+// returns an empty name if the dialog was cancelled.
+func pickFile() (string, error) {
+  var cmd *exec.Cmd
+  switch runtime.GOOS {
+  case "windows":
+    cmd = exec.Command("powershell", "-NoProfile", "-Command",
+      "Add-Type -AssemblyName System.Windows.Forms; " +
+      "$d = New-Object System.Windows.Forms.OpenFileDialog; " +
+      "$d.Title = 'Choose an image to extract the tile from'; " +
+      "$d.Filter = 'Images|*.png;*.jpg;*.jpeg'; " +
+      "if ($d.ShowDialog() -eq 'OK') { $d.FileName }")
+  case "darwin":
+    cmd = exec.Command("osascript", "-e",
+      "POSIX path of (choose file with prompt \"Choose an image to extract the tile from\" of type {\"public.png\", \"public.jpeg\"})")
+  default:
+    cmd = exec.Command("zenity", "--file-selection", "--title=Choose an image to extract the tile from", "--file-filter=Images | *.png *.jpg *.jpeg")
+  }
+  out, err := cmd.Output()
+  if err != nil {
+    // All three dialogs exit with a non-zero status when cancelled.
+    if _, ok := err.(*exec.ExitError); ok {
+      return "", nil
+    }
+    return "", err
+  }
+  return strings.TrimSpace(string(out)), nil
+}
+
+// showMessage shows text in a native message box. The text is passed through
+// the environment so that it never has to be quoted for the dialog's script.
+func showMessage(text string) error {
+  var cmd *exec.Cmd
+  switch runtime.GOOS {
+  case "windows":
+    cmd = exec.Command("powershell", "-NoProfile", "-Command",
+      "Add-Type -AssemblyName System.Windows.Forms; " +
+      "[void][System.Windows.Forms.MessageBox]::Show($env:TILEEX_MESSAGE, 'TileEx')")
+  case "darwin":
+    cmd = exec.Command("osascript", "-e",
+      "display dialog (system attribute \"TILEEX_MESSAGE\") with title \"TileEx\" buttons {\"OK\"} default button \"OK\"")
+  default:
+    cmd = exec.Command("zenity", "--info", "--no-markup", "--title=TileEx", "--text=" + text)
+  }
+  cmd.Env = append(os.Environ(), "TILEEX_MESSAGE=" + text)
+  return cmd.Run()
+}
+
+// runDialog picks an input with the file dialog, extracts its tile next to it
+// and shows the output of the extraction in a message box. The extraction
+// runs as a child process so that its output and errors end up in the box.
+func runDialog() int {
+  input, err := pickFile()
+  if err != nil {
+    fmt.Println("Error: No file dialog is available:", err)
+    fmt.Println("Usage: tileex -input image.png -output tile.png")
+    return exitUsage
+  }
+  if input == "" {
+    return 0
+  }
+  exe, err := os.Executable()
+  if err != nil {
+    fmt.Println("Error:", err)
+    return exitFailure
+  }
+  out, err := exec.Command(exe, "-input", input, "-output", defaultTileOutput(input)).CombinedOutput()
+  status := 0
+  if err != nil {
+    status = 1
+  }
+  text := strings.TrimSpace(string(out))
+  fmt.Println(text)
+  if err := showMessage(text); err != nil {
+    fmt.Println("Error:", err)
+  }
+  return status
+}
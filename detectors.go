@@ -0,0 +1,699 @@
+/*
+TileEx : A Tiling Pattern Extractor written in Go
+Copyright (C) 2023, Sarthak Shah (shahsarthakw@gmail.com)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+  "context"
+  "io"
+  "fmt"
+  "sort"
+  "image"
+  "log"
+  "math"
+  "sync"
+)
+
+// keypoint is a corner in the image along with a descriptor of the patch
+// around it.
+type keypoint struct {
+  X, Y int
+  Response float64
+  Desc []float64
+}
+
+const (
+  // maxKeypoints bounds the number of corners that are matched against
+  // each other.
+  maxKeypoints = 800
+  // keypointRadius is the half size of the patch that describes a corner.
+  keypointRadius = 5
+  // keypointMatch is the smallest normalized cross-correlation at which two
+  // patches count as the same feature.
+  keypointMatch = 0.9
+)
+
+// grayLevels returns the luminance of every pixel in [0, 1].
+func (p *pixelBuffer) grayLevels() []float64 {
+  gray := make([]float64, len(p.Pix))
+  for idx, c := range p.Pix {
+    gray[idx] = (0.299 * float64(c.R) + 0.587 * float64(c.G) + 0.114 * float64(c.B)) / 0xffff
+  }
+  return gray
+}
+
+// keypoints finds the strongest corners of the image with the Shi-Tomasi
+// measure, keeping only local maxima, and describes each by its normalized
+// patch.
+func (p *pixelBuffer) keypoints() []keypoint {
+  width, height := p.Rect.Dx(), p.Rect.Dy()
+  gray := p.grayLevels()
+  gx := make([]float64, len(gray))
+  gy := make([]float64, len(gray))
+  for y := 1; y < height - 1; y++ {
+    for x := 1; x < width - 1; x++ {
+      idx := y * width + x
+      gx[idx] = (gray[idx + 1] - gray[idx - 1]) / 2
+      gy[idx] = (gray[idx + width] - gray[idx - width]) / 2
+    }
+  }
+
+  const window = 2
+  response := make([]float64, len(gray))
+  maxResponse := 0.0
+  for y := keypointRadius; y < height - keypointRadius; y++ {
+    for x := keypointRadius; x < width - keypointRadius; x++ {
+      var xx, xy, yy float64
+      for dy := -window; dy <= window; dy++ {
+        for dx := -window; dx <= window; dx++ {
+          idx := (y + dy) * width + x + dx
+          xx += gx[idx] * gx[idx]
+          xy += gx[idx] * gy[idx]
+          yy += gy[idx] * gy[idx]
+        }
+      }
+      // The smaller eigenvalue of the structure tensor.
+      r := (xx + yy) / 2 - math.Sqrt((xx - yy) * (xx - yy) / 4 + xy * xy)
+      response[y * width + x] = r
+      maxResponse = math.Max(maxResponse, r)
+    }
+  }
+  if maxResponse == 0 {
+    return nil
+  }
+
+  var points []keypoint
+  for y := keypointRadius; y < height - keypointRadius; y++ {
+    for x := keypointRadius; x < width - keypointRadius; x++ {
+      r := response[y * width + x]
+      if r < 0.01 * maxResponse {
+        continue
+      }
+      isMax := true
+      for dy := -3; dy <= 3 && isMax; dy++ {
+        for dx := -3; dx <= 3; dx++ {
+          ny, nx := y + dy, x + dx
+          if ny < 0 || ny >= height || nx < 0 || nx >= width {
+            continue
+          }
+          other := response[ny * width + nx]
+          // Break ties between equal neighbors in favor of the first one.
+          if other > r || (other == r && (dy < 0 || (dy == 0 && dx < 0))) {
+            isMax = false
+            break
+          }
+        }
+      }
+      if isMax {
+        points = append(points, keypoint{X: x, Y: y, Response: r})
+      }
+    }
+  }
+  sort.SliceStable(points, func(i, j int) bool {
+    return points[i].Response > points[j].Response
+  })
+  if len(points) > maxKeypoints {
+    points = points[:maxKeypoints]
+  }
+
+  described := points[:0]
+  for _, kp := range points {
+    var desc []float64
+    mean := 0.0
+    for dy := -keypointRadius; dy <= keypointRadius; dy++ {
+      for dx := -keypointRadius; dx <= keypointRadius; dx++ {
+        v := gray[(kp.Y + dy) * width + kp.X + dx]
+        desc = append(desc, v)
+        mean += v
+      }
+    }
+    mean /= float64(len(desc))
+    norm := 0.0
+    for idx := range desc {
+      desc[idx] -= mean
+      norm += desc[idx] * desc[idx]
+    }
+    if norm < 1e-9 {
+      continue
+    }
+    norm = math.Sqrt(norm)
+    for idx := range desc {
+      desc[idx] /= norm
+    }
+    kp.Desc = desc
+    described = append(described, kp)
+  }
+  return described
+}
+
+// displacementVotes matches every pair of keypoints by their patches and
+// counts how often each displacement occurs between matching ones. Both
+// directions of a displacement are counted.
+func displacementVotes(points []keypoint) map[image.Point]int {
+  votes := make(map[image.Point]int)
+  for i := range points {
+    for j := i + 1; j < len(points); j++ {
+      correlation := 0.0
+      for idx, v := range points[i].Desc {
+        correlation += v * points[j].Desc[idx]
+      }
+      if correlation < keypointMatch {
+        continue
+      }
+      d := image.Pt(points[j].X - points[i].X, points[j].Y - points[i].Y)
+      votes[d]++
+      votes[image.Pt(-d.X, -d.Y)]++
+    }
+  }
+  return votes
+}
+
+// latticePeriods returns up to three candidates for the period along one
+// axis, from the displacements that lie on that axis give or take a pixel:
+// the shortest one with at least half the votes of the best, followed by the
+// best supported ones.
+func latticePeriods(votes map[image.Point]int, horizontal bool) []int {
+  counts := make(map[int]int)
+  for d, n := range votes {
+    along, across := d.X, d.Y
+    if !horizontal {
+      along, across = d.Y, d.X
+    }
+    if along >= 2 && absInt(across) <= 1 {
+      counts[along] += n
+    }
+  }
+  var periods []int
+  best := 0
+  for period := range counts {
+    // Votes for a period split over neighboring lengths in lossy images.
+    if counts[period] >= counts[period - 1] && counts[period] >= counts[period + 1] {
+      periods = append(periods, period)
+      best = max(best, counts[period])
+    }
+  }
+  if len(periods) == 0 {
+    return nil
+  }
+  sort.Ints(periods)
+  var candidates []int
+  for _, period := range periods {
+    if 2 * counts[period] >= best {
+      candidates = append(candidates, period)
+      break
+    }
+  }
+  sort.SliceStable(periods, func(i, j int) bool {
+    return counts[periods[i]] > counts[periods[j]]
+  })
+  for _, period := range periods {
+    if len(candidates) == 3 {
+      break
+    }
+    if period != candidates[0] {
+      candidates = append(candidates, period)
+    }
+  }
+  return candidates
+}
+
+// latticeVectors returns the two shortest well supported displacements that
+// are not parallel, which span the lattice of the pattern.
+func latticeVectors(votes map[image.Point]int) (image.Point, image.Point) {
+  best := 0
+  for _, n := range votes {
+    best = max(best, n)
+  }
+  var strong []image.Point
+  for d, n := range votes {
+    // Only one of each pair of opposite displacements.
+    if 2 * n >= best && (d.X > 0 || (d.X == 0 && d.Y > 0)) {
+      strong = append(strong, d)
+    }
+  }
+  sort.Slice(strong, func(i, j int) bool {
+    li, lj := strong[i].X * strong[i].X + strong[i].Y * strong[i].Y, strong[j].X * strong[j].X + strong[j].Y * strong[j].Y
+    if li != lj {
+      return li < lj
+    }
+    return strong[i].X < strong[j].X || (strong[i].X == strong[j].X && strong[i].Y < strong[j].Y)
+  })
+  var first, second image.Point
+  for _, d := range strong {
+    if first == (image.Point{}) {
+      first = d
+    } else if first.X * d.Y - first.Y * d.X != 0 {
+      second = d
+      break
+    }
+  }
+  return first, second
+}
+
+// keypointDetection estimates the tile size from repeated corners rather
+// than from scanlines, which copes better with photographs of brick walls,
+// carpets and the like. Of the candidate periods along each axis, the
+// combination that best reconstructs the image wins. The confidence is the
+// share of the matches along that axis that agree with it. If no corner
+// repeats, the whole image is returned.
+func (a *analysis) keypointDetection(origin image.Point, s settings, logger *log.Logger) detection {
+  pixels := a.buffer()
+  points := pixels.keypoints()
+  votes := displacementVotes(points)
+  logger.Printf(tr("Matched %d keypoints into %d displacements\n"), len(points), len(votes))
+  first, second := latticeVectors(votes)
+  if first != (image.Point{}) {
+    logger.Printf(tr("Lattice vectors: (%d, %d) and (%d, %d)\n"), first.X, first.Y, second.X, second.Y)
+  }
+
+  widths := latticePeriods(votes, true)
+  heights := latticePeriods(votes, false)
+  if len(widths) == 0 || len(heights) == 0 {
+    logger.Println(tr("Could not find keypoints that repeat along both axes"))
+    return detection{Detector: "keypoints", Width: pixels.Rect.Dx(), Height: pixels.Rect.Dy()}
+  }
+  best := rankCandidates(pixels, origin, widths, heights, s.numProc)[0]
+  logger.Printf(tr("Row Periodicity: %d\n"), best.Width)
+  logger.Printf(tr("Col Periodicity: %d\n"), best.Height)
+  return detection{
+    Detector: "keypoints",
+    Width: best.Width,
+    Height: best.Height,
+    WidthConfidence: axisShare(votes, true, best.Width),
+    HeightConfidence: axisShare(votes, false, best.Height),
+  }
+}
+
+// axisShare returns the share of the displacements along one axis that lie
+// within a pixel of period.
+func axisShare(votes map[image.Point]int, horizontal bool, period int) float64 {
+  agree, total := 0, 0
+  for d, n := range votes {
+    along, across := d.X, d.Y
+    if !horizontal {
+      along, across = d.Y, d.X
+    }
+    if along >= 2 && absInt(across) <= 1 {
+      total += n
+      if absInt(along - period) <= 1 {
+        agree += n
+      }
+    }
+  }
+  if total == 0 {
+    return 0
+  }
+  return float64(agree) / float64(total)
+}
+
+// detection is the tile size proposed by one detector, with its confidence
+// in each direction from 0 to 1.
+type detection struct {
+  Detector string
+  Width, Height int
+  WidthConfidence, HeightConfidence float64
+}
+
+// fft transforms x in place. Its length must be a power of two. The inverse
+// transform is left unscaled.
+func fft(x []complex128, inverse bool) {
+  n := len(x)
+  for i, j := 1, 0; i < n; i++ {
+    bit := n >> 1
+    for ; j & bit != 0; bit >>= 1 {
+      j ^= bit
+    }
+    j ^= bit
+    if i < j {
+      x[i], x[j] = x[j], x[i]
+    }
+  }
+  sign := -1.0
+  if inverse {
+    sign = 1.0
+  }
+  for length := 2; length <= n; length <<= 1 {
+    angle := sign * 2 * math.Pi / float64(length)
+    step := complex(math.Cos(angle), math.Sin(angle))
+    for start := 0; start < n; start += length {
+      w := complex(1, 0)
+      for k := 0; k < length / 2; k++ {
+        even, odd := x[start + k], x[start + k + length / 2] * w
+        x[start + k] = even + odd
+        x[start + k + length / 2] = even - odd
+        w *= step
+      }
+    }
+  }
+}
+
+// fftPeriod finds the period along rows (or cols) from the autocorrelation
+// of the luminance, summed over all of them and computed through the FFT.
+// The confidence is the correlation at that lag, where 1 means the lines
+// repeat exactly. Lines that do not repeat give their full length.
+func (p *pixelBuffer) fftPeriod(horizontal bool) (int, float64) {
+  width, height := p.Rect.Dx(), p.Rect.Dy()
+  length, lines := width, height
+  if !horizontal {
+    length, lines = height, width
+  }
+  if length < 4 {
+    return length, 0
+  }
+  gray := p.grayLevels()
+  at := func(line, idx int) float64 {
+    if horizontal {
+      return gray[line * width + idx]
+    }
+    return gray[idx * width + line]
+  }
+
+  // Padding to twice the length keeps the correlation from wrapping around.
+  size := 1
+  for size < 2 * length {
+    size <<= 1
+  }
+  power := make([]float64, size)
+  buf := make([]complex128, size)
+  for line := 0; line < lines; line++ {
+    mean := 0.0
+    for idx := 0; idx < length; idx++ {
+      mean += at(line, idx)
+    }
+    mean /= float64(length)
+    for idx := range buf {
+      buf[idx] = 0
+      if idx < length {
+        buf[idx] = complex(at(line, idx) - mean, 0)
+      }
+    }
+    fft(buf, false)
+    for idx, v := range buf {
+      power[idx] += real(v) * real(v) + imag(v) * imag(v)
+    }
+  }
+  for idx, v := range power {
+    buf[idx] = complex(v, 0)
+  }
+  fft(buf, true)
+  if real(buf[0]) <= 0 {
+    return length, 0
+  }
+
+  // Correlation per overlapping pixel, relative to that at lag 0.
+  maxLag := 3 * length / 4
+  corr := make([]float64, maxLag + 2)
+  for lag := range corr {
+    corr[lag] = real(buf[lag]) / float64(length - lag) / (real(buf[0]) / float64(length))
+  }
+  best := 0
+  for lag := 2; lag <= maxLag; lag++ {
+    if best == 0 || corr[lag] > corr[best] {
+      best = lag
+    }
+  }
+  if best == 0 || corr[best] <= 0 {
+    return length, 0
+  }
+  confidence := math.Min(corr[best], 1.0)
+  // Multiples of the period correlate as well as the period itself, so take
+  // the first peak that comes close to the best one.
+  for lag := 2; lag <= maxLag; lag++ {
+    if corr[lag] >= corr[best] - 0.02 && corr[lag] >= corr[lag - 1] && corr[lag] >= corr[lag + 1] {
+      return lag, confidence
+    }
+  }
+  return best, confidence
+}
+
+// lineDetection runs the per-line detection of the given format and the
+// frequency vote, with the share of the vote as the confidence.
+func (a *analysis) lineDetection(ctx context.Context, name string, imageFormat int, s settings) (detection, error) {
+  bounds := a.detectImg.Bounds()
+  tick := s.lineProgress(bounds.Dx() + bounds.Dy())
+  rowLines, err := rowPeriodicities(ctx, a.detectImg, a.palette, imageFormat, s.weightedVote, tick)
+  if err != nil {
+    return detection{}, err
+  }
+  colLines, err := colPeriodicities(ctx, a.detectImg, a.palette, imageFormat, s.weightedVote, tick)
+  if err != nil {
+    return detection{}, err
+  }
+  width, widthShare := choosePeriod(rowLines, s.weightedVote, s.rowTolerance, s.rowPreferFrequency, s.tieBreak)
+  height, heightShare := choosePeriod(colLines, s.weightedVote, s.colTolerance, s.colPreferFrequency, s.tieBreak)
+  return detection{
+    Detector: name,
+    Width: width,
+    Height: height,
+    WidthConfidence: widthShare / 100.0,
+    HeightConfidence: heightShare / 100.0,
+  }, nil
+}
+
+// ensemblePeriods runs every detector and fuses their results: along each
+// axis, the period with the highest total confidence wins, and the smaller
+// period wins a tie. If no detector finds a repeat, the whole image is
+// returned.
+func (a *analysis) ensemblePeriods(ctx context.Context, origin image.Point, s settings, logger *log.Logger) (detection, error) {
+  pixels := a.buffer()
+  kmp, err := a.lineDetection(ctx, "kmp", LOSSLESS, s)
+  if err != nil {
+    return detection{}, err
+  }
+  ssd, err := a.lineDetection(ctx, "ssd", LOSSY, s)
+  if err != nil {
+    return detection{}, err
+  }
+  fftWidth, fftWidthConfidence := pixels.fftPeriod(true)
+  fftHeight, fftHeightConfidence := pixels.fftPeriod(false)
+  detections := []detection{
+    kmp,
+    ssd,
+    {
+      Detector: "fft",
+      Width: fftWidth,
+      Height: fftHeight,
+      WidthConfidence: fftWidthConfidence,
+      HeightConfidence: fftHeightConfidence,
+    },
+    a.keypointDetection(origin, s, log.New(io.Discard, "", 0)),
+  }
+
+  logger.Println("Detector    Width  Confidence  Height  Confidence")
+  widthVotes := make(map[int]float64)
+  heightVotes := make(map[int]float64)
+  for _, d := range detections {
+    logger.Printf("%-9s  %6d  %10.3f  %6d  %10.3f\n", d.Detector, d.Width, d.WidthConfidence, d.Height, d.HeightConfidence)
+    // A period of a single pixel or of the whole image means that the
+    // detector found nothing to repeat, which is not a vote for anything.
+    if d.Width >= 2 && d.Width < pixels.Rect.Dx() {
+      widthVotes[d.Width] += d.WidthConfidence
+    }
+    if d.Height >= 2 && d.Height < pixels.Rect.Dy() {
+      heightVotes[d.Height] += d.HeightConfidence
+    }
+  }
+  // fuse returns the period with the highest total confidence, along with
+  // its share of the total confidence of all periods.
+  fuse := func(votes map[int]float64, fallback int) (int, float64) {
+    best := 0
+    total := 0.0
+    for period, confidence := range votes {
+      total += confidence
+      if best == 0 || confidence > votes[best] || (confidence == votes[best] && period < best) {
+        best = period
+      }
+    }
+    if best == 0 || total == 0 {
+      return fallback, 0
+    }
+    return best, votes[best] / total
+  }
+  width, widthConfidence := fuse(widthVotes, pixels.Rect.Dx())
+  height, heightConfidence := fuse(heightVotes, pixels.Rect.Dy())
+  logger.Printf(tr("Row Periodicity: %d\n"), width)
+  logger.Printf(tr("Col Periodicity: %d\n"), height)
+  return detection{
+    Detector: "ensemble",
+    Width: width,
+    Height: height,
+    WidthConfidence: widthConfidence,
+    HeightConfidence: heightConfidence,
+  }, nil
+}
+
+// maxMotifSamples bounds how many pixels of a motif are compared at every
+// position of the image, which keeps matching large motifs affordable.
+const maxMotifSamples = 256
+
+// findMotif returns the positions in p at which motif appears, meaning that
+// the normalized mean squared difference over a grid of motif pixels is at
+// most threshold. Of overlapping matches only the best one is kept. The
+// positions are sorted top to bottom, then left to right.
+func (p *pixelBuffer) findMotif(motif *pixelBuffer, threshold float64, workers int) []image.Point {
+  width, height := p.Rect.Dx(), p.Rect.Dy()
+  motifWidth, motifHeight := motif.Rect.Dx(), motif.Rect.Dy()
+  rows, cols := height - motifHeight + 1, width - motifWidth + 1
+  if motifWidth == 0 || motifHeight == 0 || rows <= 0 || cols <= 0 {
+    return nil
+  }
+
+  step := 1
+  for ((motifWidth + step - 1) / step) * ((motifHeight + step - 1) / step) > maxMotifSamples {
+    step++
+  }
+  var offsets []int
+  var colors []Color
+  for y := 0; y < motifHeight; y += step {
+    for x := 0; x < motifWidth; x += step {
+      offsets = append(offsets, y * width + x)
+      colors = append(colors, motif.Pix[y * motifWidth + x])
+    }
+  }
+  limit := int64(threshold * maxColorDiff * float64(len(offsets)))
+
+  type match struct {
+    Pt image.Point
+    Score int64
+  }
+  found := make([][]match, rows)
+  jobs := make(chan int)
+  var wg sync.WaitGroup
+  for w := 0; w < workers; w++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      for y := range jobs {
+        for x := 0; x < cols; x++ {
+          base := y * width + x
+          var score int64
+          for idx, offset := range offsets {
+            score += ColorDiff(p.Pix[base + offset], colors[idx])
+            if score > limit {
+              break
+            }
+          }
+          if score <= limit {
+            found[y] = append(found[y], match{Pt: image.Pt(x, y), Score: score})
+          }
+        }
+      }
+    }()
+  }
+  for y := 0; y < rows; y++ {
+    jobs <- y
+  }
+  close(jobs)
+  wg.Wait()
+
+  var matches []match
+  for _, row := range found {
+    matches = append(matches, row...)
+  }
+  sort.SliceStable(matches, func(i, j int) bool {
+    return matches[i].Score < matches[j].Score
+  })
+  var points []image.Point
+  for _, m := range matches {
+    overlaps := false
+    for _, pt := range points {
+      if 2 * absInt(m.Pt.X - pt.X) < motifWidth && 2 * absInt(m.Pt.Y - pt.Y) < motifHeight {
+        overlaps = true
+        break
+      }
+    }
+    if !overlaps {
+      points = append(points, m.Pt)
+    }
+  }
+  sort.Slice(points, func(i, j int) bool {
+    if points[i].Y != points[j].Y {
+      return points[i].Y < points[j].Y
+    }
+    return points[i].X < points[j].X
+  })
+  for idx := range points {
+    points[idx] = points[idx].Add(p.Rect.Min)
+  }
+  return points
+}
+
+func absInt(x int) int {
+  if x < 0 {
+    return -x
+  }
+  return x
+}
+
+// motifLattice derives the tile size from the positions of a motif: the
+// median distance from each occurrence to the nearest one to its right in the
+// same row, and to the nearest one below it in the same column. Positions up
+// to a pixel apart count as the same row or column. A direction in which the
+// motif does not repeat gets a size of 0.
+func motifLattice(points []image.Point) (int, int) {
+  var across, down []float64
+  for _, pt := range points {
+    right, below := 0, 0
+    for _, other := range points {
+      dx, dy := other.X - pt.X, other.Y - pt.Y
+      if absInt(dy) <= 1 && dx > 0 && (right == 0 || dx < right) {
+        right = dx
+      }
+      if absInt(dx) <= 1 && dy > 0 && (below == 0 || dy < below) {
+        below = dy
+      }
+    }
+    if right > 0 {
+      across = append(across, float64(right))
+    }
+    if below > 0 {
+      down = append(down, float64(below))
+    }
+  }
+  width, height := 0, 0
+  if len(across) > 0 {
+    width = int(math.Round(medianOf(across)))
+  }
+  if len(down) > 0 {
+    height = int(math.Round(medianOf(down)))
+  }
+  return width, height
+}
+
+// matchMotif finds the tile from the occurrences of a motif cropped by the
+// user instead of from the periodicity of the lines, for images where blind
+// detection fails.
+func (a *analysis) matchMotif(motif image.Image, threshold float64, s settings, logger *log.Logger) (extraction, error) {
+  points := a.buffer().findMotif(newPixelBuffer(motif), threshold, s.numProc)
+  logger.Printf(tr("Found the motif %d times\n"), len(points))
+  width, height := motifLattice(points)
+  if width == 0 || height == 0 {
+    return extraction{}, fmt.Errorf("%w: the motif does not repeat both across and down the image, try a larger -motif-threshold", ErrNoPeriodicity)
+  }
+  logger.Printf(tr("Motif lattice: %dx%d\n"), width, height)
+
+  origin := points[0]
+  reconstructionError, grade := a.grade(s, logger, origin, width, height)
+
+  return extraction{
+    Origin: origin,
+    Width: width,
+    Height: height,
+    Error: reconstructionError,
+    Grade: grade,
+  }, nil
+}
@@ -0,0 +1,1098 @@
+/*
+TileEx : A Tiling Pattern Extractor written in Go
+Copyright (C) 2023, Sarthak Shah (shahsarthakw@gmail.com)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "errors"
+  "io"
+  "net/url"
+  "os"
+  "path"
+  "path/filepath"
+  "fmt"
+  "flag"
+  "strings"
+  "text/template"
+  "image"
+  "image/gif"
+  "log"
+  "log/slog"
+  "time"
+)
+
+// tileName holds what -output-template can refer to.
+type tileName struct {
+  // Stem is the name of the input without its directory and extension, and
+  // Ext is its extension, such as .jpg.
+  Stem, Ext string
+  Width, Height, OffsetX, OffsetY int
+  Grade string
+}
+
+// tileOutput names the tile extracted from input after -output-template.
+func (e extractOptions) tileOutput(input string, ext extraction) (string, error) {
+  var name strings.Builder
+  err := e.nameTemplate.Execute(&name, tileName{
+    Stem: strings.TrimSuffix(filepath.Base(input), filepath.Ext(input)),
+    Ext: filepath.Ext(input),
+    Width: ext.Width,
+    Height: ext.Height,
+    OffsetX: ext.Origin.X,
+    OffsetY: ext.Origin.Y,
+    Grade: ext.Grade.String(),
+  })
+  if err != nil {
+    return "", err
+  }
+  if name.Len() == 0 {
+    return "", fmt.Errorf("-output-template gives an empty name for %s", input)
+  }
+  return name.String(), nil
+}
+
+// label names file in the table, the report and the checkpoint. The images
+// of an archive are unpacked into a temporary directory, and tiles bound for
+// one are saved to another, so their files are named by their paths in the
+// archives instead.
+func (e extractOptions) label(file string) string {
+  for _, dirs := range [][2]string{{e.unpacked, e.input}, {e.packed, e.packedAs}} {
+    if dirs[0] == "" {
+      continue
+    }
+    if rel, err := filepath.Rel(dirs[0], file); err == nil && !strings.HasPrefix(rel, "..") {
+      return filepath.ToSlash(filepath.Join(dirs[1], rel))
+    }
+  }
+  return file
+}
+
+// companion is a map that belongs to the same texture as the input, such as
+// its normal or roughness map, and gets cropped the same way.
+type companion struct {
+  input, output string
+  img image.Image
+}
+
+// companionFiles expands the comma separated patterns of -companions, in
+// which * stands for the name of the input without its extension. Each
+// companion is read from next to the input and written next to the output,
+// with * standing for the name of the output there.
+func companionFiles(input, output, patterns string) ([]companion, error) {
+  inputStem := strings.TrimSuffix(filepath.Base(input), filepath.Ext(input))
+  outputStem := strings.TrimSuffix(filepath.Base(output), filepath.Ext(output))
+  var companions []companion
+  for _, pattern := range strings.Split(patterns, ",") {
+    pattern = strings.TrimSpace(pattern)
+    if strings.Count(pattern, "*") != 1 || strings.ContainsRune(pattern, filepath.Separator) {
+      return nil, fmt.Errorf("invalid companion %q, expected a file name with one * such as *_n.png", pattern)
+    }
+    companions = append(companions, companion{
+      input: filepath.Join(filepath.Dir(input), strings.Replace(pattern, "*", inputStem, 1)),
+      output: filepath.Join(filepath.Dir(output), strings.Replace(pattern, "*", outputStem, 1)),
+    })
+  }
+  return companions, nil
+}
+
+// candidateOutput derives the file name of the candidate with the given rank
+// from the output file name, e.g. output.png becomes output-2.png.
+func candidateOutput(output string, rank int) string {
+  ext := path.Ext(output)
+  return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(output, ext), rank, ext)
+}
+
+// extractOptions holds the flags of the default mode, also available as the
+// extract subcommand, which extracts the tile of a single image.
+type extractOptions struct {
+  s settings
+  b batch
+  o outputSettings
+  input, output, requireGrade, sweep, fromReport, report, periodsCSV, svg string
+  numCandidates int
+  // gallery is the folder -candidates are written to for review, and
+  // selectCandidate the rank that a later run picks from it.
+  gallery string
+  selectCandidate int
+  maxTileFraction float64
+  allowLargeTile, colorways, structuralTile bool
+  fromClipboard, toClipboard bool
+  rawFormat string
+  rawWidth, rawHeight, rawStride int
+  motif, axis, center, strip string
+  // css is the file to write a CSS rule that repeats the tile to, with the
+  // tile inlined as a data URI if cssInline is set.
+  css string
+  cssInline bool
+  // proof is the PDF to print a page of proofPage covered with the tile
+  // into, at proofDPI or with tiles proofTileWidth wide, and pageWidth,
+  // pageHeight and proofTile are those in points.
+  proof, proofPage, proofTileWidth string
+  proofDPI float64
+  pageWidth, pageHeight, proofTile float64
+  // preview is the image to save the input and its reconstruction from the
+  // tile into, side by side.
+  preview string
+  // frames is how the frames of an animated GIF are extracted, each,
+  // consensus or animate, or empty to only look at the first.
+  frames string
+  // page is the page of a multi-page TIFF or the frame of an Aseprite file
+  // to extract from, counting from 1.
+  page int
+  // layer is the only layer of an Aseprite file to extract from.
+  layer string
+  polar, json, progress, dryRun bool
+  companions, exclude, watch, resume, outputDir, duplicates string
+  jobs int
+  maxMemory, maxDownload int64
+  fetchTimeout time.Duration
+  // unpacked holds the images of an -input archive, and packed the tiles
+  // bound for the archive named packedAs.
+  unpacked, packed, packedAs string
+  outputTemplate string
+  // nameTemplate is the parsed -output-template.
+  nameTemplate *template.Template
+  verbose, quiet bool
+  logFormat string
+  motifThreshold float64
+  // outputGiven is whether -output was given rather than left to its
+  // default, and requiredGrade is the parsed -require-grade.
+  outputGiven bool
+  requiredGrade Grade
+  // The result of a run goes to stdout and its messages to out, through
+  // logs and logger.
+  out, stdout io.Writer
+  logs *slog.Logger
+  logger *log.Logger
+}
+
+func (e *extractOptions) addFlags(fs *flag.FlagSet) {
+  fs.StringVar(&e.input, "input", "input.png", "The input file, - for stdin, an http:// or https:// URL, or a directory, archive or pattern such as 'textures/**/*.png' of them")
+  fs.DurationVar(&e.fetchTimeout, "fetch-timeout", 30 * time.Second, "Give up on downloading a URL as -input after this long")
+  fs.Int64Var(&e.maxDownload, "max-download", 64 << 20, "The largest image in bytes to download from a URL as -input")
+  fs.StringVar(&e.output, "output", "output.png", "The output file, or - for stdout")
+  fs.StringVar(&e.motif, "motif", "", "Find the tile from the occurrences of this crop of one repeating element instead of from the periodicity of the lines")
+  fs.Float64Var(&e.motifThreshold, "motif-threshold", 0.01, "The largest normalized mean squared difference at which the image still matches -motif")
+  fs.StringVar(&e.axis, "axis", "", "Only report the period along a direction, given as an angle such as 30deg or a vector such as 3,1, for diagonal patterns")
+  fs.IntVar(&e.page, "page", 0, "The page of a multi-page TIFF or frame of an Aseprite file to extract the tile from, counting from 1 (default the first)")
+  fs.StringVar(&e.layer, "layer", "", "Extract the tile from only this layer of an Aseprite file, and the layers in it if it is a group, instead of all visible layers")
+  fs.StringVar(&e.frames, "frames", "", "Detect the tile of every frame of an animated GIF or page of a TIFF and save each of them next to the output (each), the tile most frames agree on (consensus) or an animated GIF or APNG tile when all frames agree (animate)")
+  fs.StringVar(&e.strip, "strip", "", "Extract a strip of a border or frieze that only repeats horizontally or vertically, spanning the whole image the other way, and report its frieze group. auto picks the way the image repeats, as for a web background with a gradient the other way")
+  fs.BoolVar(&e.polar, "polar", false, "Find the rotational symmetry of a radial pattern and save one wedge of it as the tile")
+  fs.StringVar(&e.center, "center", "", "With -polar, the x,y center of the pattern in pixels (default: detected)")
+  fs.StringVar(&e.rawFormat, "raw-format", "", "Read -input as a raw frame in the given pixel format (rgba, gray, gray16 or nv12) instead of an image file")
+  fs.IntVar(&e.rawWidth, "raw-width", 0, "The width of the raw frame in pixels")
+  fs.IntVar(&e.rawHeight, "raw-height", 0, "The height of the raw frame in pixels")
+  fs.IntVar(&e.rawStride, "raw-stride", 0, "The number of bytes from one row of the raw frame to the next (default: no padding)")
+  fs.BoolVar(&e.fromClipboard, "from-clipboard", false, "Read the input image from the clipboard instead of -input")
+  fs.BoolVar(&e.toClipboard, "to-clipboard", false, "Put the tile on the clipboard, and only also write -output if it is given")
+  addSettingsFlags(fs, &e.s)
+  addBatchFlags(fs, &e.b)
+  addOutputFlags(fs, &e.o)
+  fs.IntVar(&e.numCandidates, "candidates", 0, "Report the given number of best (row, col) combinations and save each of them next to the output")
+  fs.StringVar(&e.gallery, "gallery", "", "Write the -candidates (4 unless given) to this folder with 3x3 previews, overlays and an index.html to compare them")
+  fs.IntVar(&e.selectCandidate, "select", 0, "Save candidate N of the -gallery folder, without detecting again")
+  fs.StringVar(&e.requireGrade, "require-grade", "approximate", "The minimum quality grade (exact, near-exact or approximate) for the tile to be saved")
+  fs.Float64Var(&e.maxTileFraction, "max-tile-fraction", 0.75, "The largest fraction of the image width or height a tile may cover without -allow-large-tile")
+  fs.BoolVar(&e.allowLargeTile, "allow-large-tile", false, "Save the tile even if it exceeds -max-tile-fraction of the image")
+  fs.BoolVar(&e.colorways, "colorways", false, "Report when the structure of the pattern repeats more often than its colors")
+  fs.BoolVar(&e.structuralTile, "structural-tile", false, "With -colorways, extract the structural repeat instead of the full color repeat")
+  fs.BoolVar(&e.verbose, "v", false, "Also log debugging details such as timings")
+  fs.BoolVar(&e.quiet, "q", false, "Only log warnings and errors")
+  fs.StringVar(&e.logFormat, "log-format", "text", "The format of the log: text, or json for one JSON object per line")
+  fs.BoolVar(&e.progress, "progress", true, "Show a progress bar on stderr while the lines are analyzed, if stderr is a terminal")
+  fs.StringVar(&e.outputTemplate, "output-template", "", "Name each tile after a template instead of -output, such as '{{.Stem}}_tile_{{.Width}}x{{.Height}}.png', with .Stem, .Ext, .Width, .Height, .OffsetX, .OffsetY and .Grade")
+  fs.StringVar(&e.watch, "watch", "", "Keep extracting the tiles of new and modified images in the given folder, like tileex watch, into -output or a tiles folder inside it")
+  fs.StringVar(&e.outputDir, "output-dir", "", "The directory to save tiles to under their default names, -output's role when -input is a directory or pattern")
+  fs.IntVar(&e.jobs, "jobs", 1, "With a directory or pattern as -input, how many images to process at once")
+  fs.Int64Var(&e.maxMemory, "max-memory", 0, "With a directory or pattern as -input, how many bytes the images processed at once may take together, estimated from their size, or 0 for no limit")
+  fs.StringVar(&e.duplicates, "duplicates", "record", "With a directory or pattern as -input, what to do about images with the same bytes as an earlier one: record (reuse its result in the table and report), link (also symlink its tile) or off (analyze them anyway)")
+  fs.StringVar(&e.resume, "resume", "", "With a directory or pattern as -input, keep the progress in the given checkpoint file, and skip the images it lists as done if it exists already, unless -force starts it over")
+  fs.StringVar(&e.exclude, "exclude", "", "With a directory or pattern as -input, leave out the images matching these comma separated patterns, such as **/old/** or *_preview.png")
+  fs.StringVar(&e.companions, "companions", "", "Comma separated maps of the same texture to crop the same way, such as *_n.png,*_r.png where * is the name of the input")
+  fs.BoolVar(&e.dryRun, "dry-run", false, "Detect the tile and print its size, offset and confidence without writing any output")
+  fs.BoolVar(&e.json, "json", false, "Print the tile size, confidences and offset as JSON on stdout, and everything else on stderr")
+  fs.StringVar(&e.svg, "svg", "", "Also trace a tile of flat color regions, such as a checkerboard or stripes, into an SVG file")
+  fs.StringVar(&e.css, "css", "", "Also write a CSS rule that repeats the tile as a background at its own size into this file")
+  fs.BoolVar(&e.cssInline, "css-inline", false, "Inline the tile into the -css rule as a data URI instead of referring to the tile file")
+  fs.StringVar(&e.preview, "preview", "", "Also save the image next to its reconstruction from the tile, both with the grid of the tile drawn on, into this file")
+  fs.StringVar(&e.proof, "proof", "", "Also write a PDF page covered edge to edge with the tile at its printed size into this file, to proof the pattern")
+  fs.StringVar(&e.proofPage, "proof-page", "a4", "The page size of -proof: a4, a3, letter, legal, tabloid or a size such as 300x200mm")
+  fs.Float64Var(&e.proofDPI, "proof-dpi", 300, "The resolution the tile is printed at in the -proof, in pixels per inch")
+  fs.StringVar(&e.proofTileWidth, "proof-tile-width", "", "The printed width of the tile in the -proof, such as 5cm or 2in, instead of going by -proof-dpi")
+  fs.StringVar(&e.report, "report", "", "Also write the detected tile size and offset to the given JSON report")
+  fs.StringVar(&e.periodsCSV, "periods-csv", "", "Write the period found in every row and col, before the vote, to the given CSV file")
+  fs.StringVar(&e.fromReport, "from-report", "", "Skip detection and crop the tiles described by the given JSON report")
+  fs.StringVar(&e.sweep, "sweep-tolerance", "", "Report the periods chosen over a start:end:step range of tolerances (percent) instead of extracting the tile")
+}
+
+// runExtract implements the default mode, which extracts the tile of an
+// image, or of every image in a directory, archive or pattern, and returns
+// the exit status.
+func runExtract(args []string) int {
+  var e extractOptions
+  extractFlags := flag.NewFlagSet("extract", flag.ContinueOnError)
+  e.addFlags(extractFlags)
+  extractFlags.Usage = func() {
+    fmt.Fprintln(extractFlags.Output(), tr("Usage: tileex -input image.png -output tile.png [flags]"))
+    extractFlags.PrintDefaults()
+  }
+  parseFlags(extractFlags, "extract", args)
+
+  // The result goes to stdout and everything else to out. With -json or
+  // -output -, stdout only carries the result, so that scripts can parse it.
+  e.stdout, e.out = os.Stdout, os.Stdout
+  if e.json || e.output == "-" {
+    e.out = os.Stderr
+  }
+  var err error
+  e.logs, err = newLogger(e.out, e.logFormat, e.verbose, e.quiet)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitUsage
+  }
+  e.logger = slog.NewLogLogger(e.logs.Handler(), slog.LevelInfo)
+  if err := e.prepare(extractFlags); err != nil {
+    e.logs.Error(err.Error())
+    return exitUsage
+  }
+
+  if e.watch != "" {
+    // -output names the folder of the tiles here, as with a directory.
+    w := watchOptions{s: e.s, b: e.b, o: e.o, outputDir: e.outputDir, interval: 2 * time.Second, notify: true}
+    if e.outputGiven {
+      w.outputDir = e.output
+    }
+    return w.watch(e.out, e.watch)
+  }
+  if e.fromReport != "" {
+    if !cropFromReport(e.out, e.fromReport, e.output, e.o, &e.b) {
+      return exitFailure
+    }
+    return 0
+  }
+
+  info, err := os.Stat(e.input)
+  if isURL(e.input) {
+    // URLs are single images, whatever their query looks like.
+  } else if (isGlob(e.input) && err != nil) || (err == nil && (info.IsDir() || isArchive(e.input))) {
+    return e.extractDirectory(info, err)
+  }
+  if e.resume != "" {
+    e.logs.Error(tr("-resume needs a directory or pattern as -input"))
+    return exitUsage
+  }
+
+  img, data, err := e.readInput()
+  if err != nil {
+    e.logs.Error(err.Error())
+    return exitDecode
+  }
+  companions, upload, staging, err := e.prepareOutputs(img)
+  if staging != "" {
+    defer os.RemoveAll(staging)
+  }
+  if err == nil {
+    e.logs.Debug("Decoded the input", "input", e.input, "width", img.Bounds().Dx(), "height", img.Bounds().Dy(), "type", fmt.Sprintf("%T", img))
+    e.logs.Debug("Settings", "algorithm", e.s.algorithm, "row_tolerance", e.s.rowTolerance, "col_tolerance", e.s.colTolerance, "workers", e.s.numProc)
+    switch {
+    case e.frames != "":
+      err = e.extractAllFrames(data)
+    case e.polar:
+      err = e.extractWedge(img)
+    case e.axis != "":
+      err = e.reportAxis(img)
+    default:
+      err = e.extractImage(img, companions, upload)
+    }
+  }
+  if err != nil {
+    e.logs.Error(err.Error())
+    return exitCode(err)
+  }
+  return 0
+}
+
+// prepare checks the flags of the default mode, which were parsed into fs,
+// and completes the settings they leave to it.
+func (e *extractOptions) prepare(fs *flag.FlagSet) error {
+  if err := e.s.prepare(); err != nil {
+    return err
+  }
+  e.b.log = e.logs
+  if err := e.b.prepare(); err != nil {
+    return err
+  }
+  if err := e.o.prepare(); err != nil {
+    return err
+  }
+  var err error
+  if e.requiredGrade, err = ParseGrade(e.requireGrade); err != nil {
+    return err
+  }
+
+  if e.strip != "" && e.strip != "horizontal" && e.strip != "vertical" && e.strip != "auto" {
+    return fmt.Errorf(tr("unknown -strip %q, expected horizontal, vertical or auto"), e.strip)
+  }
+  if e.json && e.output == "-" {
+    return errors.New(tr("-json and -output - both write to stdout"))
+  }
+  if e.strip != "" && e.s.algorithm != "lines" {
+    return errors.New(tr("-strip only works with -algorithm lines"))
+  }
+  if e.selectCandidate != 0 && (e.gallery == "" || e.numCandidates > 0 || e.motif != "" || e.strip != "" || e.polar || e.axis != "" || e.colorways) {
+    return errors.New(tr("-select needs the -gallery folder to pick from and no other detection"))
+  }
+  if e.gallery != "" && e.numCandidates == 0 && e.selectCandidate == 0 {
+    e.numCandidates = 4
+  }
+  if e.frames != "" && e.frames != "each" && e.frames != "consensus" && e.frames != "animate" {
+    return fmt.Errorf(tr("unknown -frames %q, expected each, consensus or animate"), e.frames)
+  }
+  if e.page < 0 || (e.page > 0 && (e.frames != "" || e.fromClipboard || e.rawFormat != "")) {
+    return errors.New(tr("-page needs a page number and a TIFF or Aseprite file, and goes without -frames"))
+  }
+  if e.layer != "" && (e.fromClipboard || e.rawFormat != "") {
+    return errors.New(tr("-layer needs an Aseprite file"))
+  }
+  if e.frames != "" && (e.fromClipboard || e.rawFormat != "" || e.polar || e.axis != "" || e.motif != "" || e.strip != "" || e.sweep != "" || e.numCandidates > 0 || e.selectCandidate > 0 || e.companions != "" || e.preview != "" || e.toClipboard || e.output == "-") {
+    return errors.New(tr("-frames only supports the regular extraction into files"))
+  }
+  fs.Visit(func(f *flag.Flag) {
+    if f.Name == "output" {
+      e.outputGiven = true
+    }
+  })
+  if e.outputGiven && e.outputDir != "" {
+    return errors.New(tr("Please select only one of -output or -output-dir"))
+  }
+  if !e.outputGiven {
+    e.output = e.o.defaultName(e.output)
+  }
+
+  if e.outputTemplate != "" {
+    e.nameTemplate, err = template.New("output").Option("missingkey=error").Parse(e.outputTemplate)
+    // Trying it out catches unknown fields before a long detection.
+    if err == nil {
+      err = e.nameTemplate.Execute(io.Discard, tileName{})
+    }
+    if err != nil {
+      return fmt.Errorf(tr("invalid -output-template: %v"), err)
+    }
+  }
+  return nil
+}
+
+// extractDirectory extracts the tiles of the images in a directory, archive
+// or pattern given as -input, whose os.Stat returned info and err.
+func (e *extractOptions) extractDirectory(info os.FileInfo, err error) int {
+  if e.fromClipboard || e.rawFormat != "" || e.layer != "" || e.css != "" || e.proof != "" || e.preview != "" || e.polar || e.axis != "" || e.motif != "" || e.strip != "" || e.sweep != "" || e.numCandidates > 0 || e.gallery != "" || e.toClipboard {
+    e.logs.Error(tr("A directory or pattern as -input only supports the regular extraction"))
+    return exitUsage
+  }
+  if e.jobs < 1 || e.maxMemory < 0 {
+    e.logs.Error(fmt.Sprintf(tr("-jobs must be at least 1 and -max-memory at least 0, got %d and %d"), e.jobs, e.maxMemory))
+    return exitUsage
+  }
+  switch e.duplicates {
+  case "record", "link", "off":
+  default:
+    e.logs.Error(fmt.Sprintf(tr("unknown -duplicates %q, expected record, link or off"), e.duplicates))
+    return exitUsage
+  }
+  // Archives are unpacked into and packed from temporary directories,
+  // which have to go before returning.
+  var temporary []string
+  defer func() {
+    for _, dir := range temporary {
+      os.RemoveAll(dir)
+    }
+  }()
+  dir, files := e.input, []string(nil)
+  if isGlob(e.input) && err != nil {
+    dir = globRoot(e.input)
+    files, err = globFiles(e.input)
+  } else if !info.IsDir() {
+    if dir, err = os.MkdirTemp("", "tileex"); err == nil {
+      temporary = append(temporary, dir)
+      e.unpacked = dir
+      if err = unpackImages(e.input, dir); err == nil {
+        files, err = imageFiles([]string{dir})
+      }
+    }
+  } else {
+    files, err = imageFiles([]string{e.input})
+  }
+  if err != nil {
+    e.logs.Error(err.Error())
+    return exitFailure
+  }
+  // -output names the directory of the tiles here, or an archive to put
+  // them in.
+  outputDir := "tiles"
+  if e.outputGiven {
+    outputDir = e.output
+  } else if e.outputDir != "" {
+    outputDir = e.outputDir
+  }
+  if isArchive(outputDir) && !e.dryRun {
+    if e.resume != "" {
+      e.logs.Error(tr("-resume cannot resume a run into an archive"))
+      return exitUsage
+    }
+    if err := e.o.claim(outputDir); err != nil {
+      e.logs.Error(err.Error())
+      return exitFailure
+    }
+    e.packedAs = outputDir
+    if outputDir, err = os.MkdirTemp("", "tileex"); err != nil {
+      e.logs.Error(err.Error())
+      return exitFailure
+    }
+    temporary = append(temporary, outputDir)
+    e.packed = outputDir
+  }
+  ok := extractFiles(e.out, dir, excludeFiles(files, e.exclude), outputDir, *e, e.s, &e.b, e.o, e.requiredGrade, e.logs)
+  if e.packed != "" {
+    if err := packFiles(e.packedAs, e.packed, e.o); err != nil {
+      e.logs.Error(err.Error())
+      return exitFailure
+    }
+  }
+  if !ok {
+    return exitFailure
+  }
+  return 0
+}
+
+// readInput decodes the single image given as -input, or the page or layer
+// of it that -page and -layer ask for. It also returns the input itself when
+// it is no file, for -frames to decode again.
+func (e *extractOptions) readInput() (image.Image, []byte, error) {
+  var img image.Image
+  var data []byte
+  var err error
+  if e.fromClipboard {
+    // Clipboard images come out as PNG, so they are analyzed as lossless.
+    e.input = "clipboard.png"
+    img, err = e.o.decodeClipboard()
+  } else if (e.input == "-" || isURL(e.input)) && e.rawFormat == "" {
+    var format string
+    if e.input == "-" {
+      data, err = io.ReadAll(os.Stdin)
+    } else {
+      data, err = fetch(e.input, e.fetchTimeout, e.maxDownload)
+    }
+    if err == nil {
+      img, format, err = decodeBytes(data)
+    }
+    if err == nil {
+      img = reinterpretAlpha(img, e.o.inputAlpha)
+    }
+    // Without a file name, the format of the data tells whether it is lossy,
+    // and the extension of a URL may well be wrong.
+    if !lossyFormat(format, data) && !e.s.setLossy {
+      e.s.setLossless = true
+    } else if lossyFormat(format, data) && !e.s.setLossless {
+      e.s.setLossy = true
+    }
+  } else if e.rawFormat != "" {
+    if e.input == "-" {
+      data, err = io.ReadAll(os.Stdin)
+    } else {
+      data, err = os.ReadFile(e.input)
+    }
+    if err == nil {
+      img, err = decodeRaw(data, e.rawFormat, e.rawWidth, e.rawHeight, e.rawStride)
+    }
+    if err == nil {
+      img = reinterpretAlpha(img, e.o.inputAlpha)
+    }
+    // Uncompressed RGBA and gray are exact, while NV12 has already lost
+    // color detail.
+    if e.rawFormat != "nv12" && !e.s.setLossy {
+      e.s.setLossless = true
+    }
+  } else {
+    img, err = e.o.decode(e.input)
+  }
+  if err == nil && (e.page > 0 || e.layer != "") && e.frames == "" {
+    if data == nil {
+      data, err = os.ReadFile(e.input)
+    }
+    if err == nil {
+      if _, _, tiffErr := readTIFF(data); tiffErr == nil && e.layer == "" {
+        img, err = tiffPage(data, e.page)
+      } else if isAseprite(data) {
+        img, err = asepriteFrame(data, max(e.page, 1), e.layer)
+      } else if e.layer != "" {
+        err = errors.New(tr("-layer needs an Aseprite file"))
+      } else {
+        img, err = tiffPage(data, e.page)
+      }
+    }
+    if err == nil {
+      img = reinterpretAlpha(img, e.o.inputAlpha)
+    }
+  }
+  return img, data, err
+}
+
+// prepareOutputs settles the names of the outputs of the tile of img, reads
+// the -companions and refuses outputs that exist, all before the detection
+// rather than after. A tile for object storage is saved to a file in the
+// staging directory first and uploaded once everything else has gone
+// through, and the caller removes that directory.
+func (e *extractOptions) prepareOutputs(img image.Image) (companions []companion, upload, staging string, err error) {
+  if isObjectURI(e.outputDir) {
+    return nil, "", "", exitError{exitUsage, errors.New(tr("-output-dir has to be a local directory, name an s3:// or gs:// object with -output instead"))}
+  }
+  if e.outputDir != "" {
+    name := "output.png"
+    if u, err := url.Parse(e.input); isURL(e.input) && err == nil && path.Base(u.Path) != "/" && path.Base(u.Path) != "." {
+      name = defaultTileOutput(path.Base(u.Path))
+    } else if e.input != "-" && !e.fromClipboard && !isURL(e.input) {
+      name = filepath.Base(defaultTileOutput(e.input))
+    }
+    e.output = filepath.Join(e.outputDir, e.o.defaultName(name))
+    if !e.dryRun {
+      if err := os.MkdirAll(e.outputDir, 0755); err != nil {
+        return nil, "", "", err
+      }
+    }
+  }
+  if isObjectURI(e.output) {
+    if e.nameTemplate != nil || e.companions != "" {
+      return nil, "", "", exitError{exitUsage, errors.New(tr("An s3:// or gs:// -output takes no name template or -companions"))}
+    }
+    upload = e.output
+    if !e.dryRun && !e.o.force {
+      exists, err := objectExists(upload, e.fetchTimeout)
+      if err == nil && exists {
+        err = fmt.Errorf("%s exists already, pass -force to replace it", upload)
+      }
+      if err != nil {
+        return nil, "", "", exitError{exitUsage, err}
+      }
+    }
+    if staging, err = os.MkdirTemp("", "tileex-"); err != nil {
+      return nil, "", "", err
+    }
+    e.output = filepath.Join(staging, path.Base(upload))
+  }
+  if e.companions != "" {
+    if e.input == "" || e.input == "-" || isURL(e.input) || e.output == "-" || e.polar || e.axis != "" {
+      return nil, "", staging, exitError{exitUsage, errors.New(tr("-companions needs input and output files and a rectangular tile"))}
+    }
+    if companions, err = companionFiles(e.input, e.output, e.companions); err != nil {
+      return nil, "", staging, exitError{exitUsage, err}
+    }
+    // Read them up front, so that a missing or mismatched map does not
+    // waste a whole detection.
+    for i := range companions {
+      c := &companions[i]
+      if c.img, err = e.o.decode(c.input); err != nil {
+        return nil, "", staging, exitError{exitDecode, err}
+      }
+      if c.img.Bounds() != img.Bounds() {
+        return nil, "", staging, fmt.Errorf("%s is %dx%d but %s is %dx%d, companions have to match the input", c.input, c.img.Bounds().Dx(), c.img.Bounds().Dy(), e.input, img.Bounds().Dx(), img.Bounds().Dy())
+      }
+    }
+  }
+  if (e.css != "" || e.cssInline) && (e.css == "" || (!e.cssInline && (!e.saveFile() || e.output == "-"))) {
+    return nil, "", staging, exitError{exitUsage, errors.New(tr("-css needs a tile file to refer to unless -css-inline is given, and -css-inline needs -css"))}
+  }
+  if e.preview != "" && (e.polar || e.axis != "") {
+    return nil, "", staging, exitError{exitUsage, errors.New(tr("-preview needs a rectangular tile"))}
+  }
+  if e.proof != "" {
+    if e.pageWidth, e.pageHeight, err = parsePage(e.proofPage); err == nil && e.proofTileWidth != "" {
+      e.proofTile, err = parseLength(e.proofTileWidth)
+    }
+    if err == nil && e.proofDPI <= 0 {
+      err = fmt.Errorf("-proof-dpi must be positive, got %g", e.proofDPI)
+    }
+    if err != nil {
+      return nil, "", staging, exitError{exitUsage, err}
+    }
+  }
+  if !e.dryRun {
+    outputs := []string{e.svg, e.css, e.proof, e.preview}
+    if e.saveFile() && e.nameTemplate == nil && e.output != "-" && e.frames != "each" {
+      outputs = append(outputs, e.output)
+      for _, c := range companions {
+        outputs = append(outputs, c.output)
+      }
+    }
+    for _, output := range outputs {
+      if output == "" {
+        continue
+      }
+      if err := e.o.claim(output); err != nil {
+        return nil, "", staging, exitError{exitUsage, err}
+      }
+    }
+  }
+  return companions, upload, staging, nil
+}
+
+// saveFile reports whether the tile is saved to a file or stdout, which
+// -to-clipboard leaves out unless an output is named.
+func (e *extractOptions) saveFile() bool {
+  return !e.toClipboard || e.nameTemplate != nil || e.outputGiven || e.outputDir != ""
+}
+
+// extractAllFrames extracts the tiles of the frames of the animated GIF,
+// the pages of the TIFF or the frames of the Aseprite file given as -input,
+// whose contents data holds if it is no file.
+func (e *extractOptions) extractAllFrames(data []byte) error {
+  if data == nil {
+    var err error
+    if data, err = os.ReadFile(e.input); err != nil {
+      return err
+    }
+  }
+  // The pages of a TIFF and the frames of an Aseprite file go through
+  // like the frames of a GIF, only without delays to animate with.
+  var frames []image.Image
+  var g *gif.GIF
+  var err error
+  if _, _, tiffErr := readTIFF(data); tiffErr == nil && e.layer == "" {
+    if e.frames == "animate" {
+      return exitError{exitUsage, errors.New(tr("-frames animate needs an animated GIF"))}
+    }
+    frames, err = tiffPages(data)
+  } else if isAseprite(data) || e.layer != "" {
+    if e.frames == "animate" {
+      return exitError{exitUsage, errors.New(tr("-frames animate needs an animated GIF"))}
+    }
+    frames, err = asepriteFrames(data, e.layer)
+  } else {
+    frames, g, err = gifFrames(bytes.NewReader(data))
+  }
+  if err != nil {
+    return exitError{exitDecode, err}
+  }
+  return extractFrames(frames, g, *e, e.s, &e.b, e.o, e.requiredGrade, e.logger)
+}
+
+// extractWedge saves the wedge of img that repeats around its center with
+// -polar.
+func (e *extractOptions) extractWedge(img image.Image) error {
+  pixels := newPixelBuffer(img)
+  var cx, cy float64
+  if e.center != "" {
+    var err error
+    if cx, cy, err = parseCenter(e.center); err != nil {
+      return exitError{exitUsage, err}
+    }
+  } else {
+    cx, cy = pixels.findCenter()
+    e.logger.Printf(tr("Detected center: %.1f,%.1f\n"), cx, cy)
+  }
+  radius := pixels.polarRadius(cx, cy)
+  if radius < 8 {
+    return errors.New(tr("The center is too close to the edge of the image"))
+  }
+  var radii []float64
+  for r := 1.0; r <= radius; r++ {
+    radii = append(radii, r)
+  }
+  fold, ok := bestFold(foldScores(pixels.unwrap(cx, cy, radii)))
+  if !ok {
+    return exitError{exitNoPeriodicity, errors.New(tr("Could not find any rotational symmetry"))}
+  }
+  e.logger.Printf(tr("Rotational symmetry: %d-fold (a wedge of %.2f degrees)\n"), fold, 360.0 / float64(fold))
+  if e.dryRun {
+    return nil
+  }
+  if err := e.o.save(e.output, Wedge(img, cx, cy, radius, fold)); err != nil {
+    return err
+  }
+  e.logger.Println(tr("Image cropped and saved successfully."))
+  return nil
+}
+
+// reportAxis reports the period of img along the direction of -axis.
+func (e *extractOptions) reportAxis(img image.Image) error {
+  dx, dy, err := parseAxis(e.axis)
+  if err != nil {
+    return exitError{exitUsage, err}
+  }
+  lines := newPixelBuffer(img).axisPeriodicities(dx, dy, e.s.weightedVote)
+  if len(lines) == 0 {
+    return exitError{exitNoPeriodicity, fmt.Errorf(tr("No line along %s repeats"), e.axis)}
+  }
+  period, share := choosePeriod(lines, e.s.weightedVote, e.s.rowTolerance, e.s.rowPreferFrequency, e.s.tieBreak)
+  e.logger.Printf(tr("%d of the lines along %s repeat\n"), len(lines), e.axis)
+  e.logger.Printf(tr("Periodicity along %s is %f percent of total frequency.\n"), e.axis, share)
+  e.logger.Printf(tr("Periodicity along %s: %d\n"), e.axis, period)
+  return nil
+}
+
+// detect finds the tile of img, from -motif, a -gallery candidate or the
+// periodicity of its lines. It returns a nil extraction once -sweep-tolerance
+// has reported on the tolerances instead.
+func (e *extractOptions) detect(ctx context.Context, img image.Image) (*analysis, *extraction, error) {
+  if e.motif != "" {
+    motif, err := e.o.decode(e.motif)
+    if err != nil {
+      return nil, nil, exitError{exitDecode, err}
+    }
+    a := &analysis{img: img, detectImg: img}
+    ext, err := a.matchMotif(motif, e.motifThreshold, e.s, e.logger)
+    if err != nil {
+      return nil, nil, err
+    }
+    // Every occurrence was found, so average them into a clean tile.
+    if e.o.combine == "none" {
+      e.o.combine = "mean"
+    }
+    return a, &ext, nil
+  }
+  if e.selectCandidate > 0 {
+    candidate, err := selectCandidate(e.gallery, e.selectCandidate)
+    if err != nil {
+      return nil, nil, exitError{exitUsage, err}
+    }
+    if candidate.Input != e.input {
+      e.logs.Warn(fmt.Sprintf(tr("The gallery was made for %s, not %s"), candidate.Input, e.input))
+    }
+    ext := extraction{Origin: image.Pt(candidate.OffsetX, candidate.OffsetY), Width: candidate.TileWidth, Height: candidate.TileHeight, RowConfidence: 1, ColConfidence: 1}
+    // Whoever picked it looked at it, so only a garbled grade is refused.
+    if ext.Grade, err = ParseGrade(candidate.Grade); err != nil {
+      return nil, nil, err
+    }
+    e.logger.Printf(tr("Selected candidate %d: %dx%d at %d,%d\n"), e.selectCandidate, ext.Width, ext.Height, ext.Origin.X, ext.Origin.Y)
+    return &analysis{img: img, detectImg: img}, &ext, nil
+  }
+
+  start := time.Now()
+  a, err := analyze(ctx, img, e.input, e.s, e.logger)
+  if err != nil {
+    e.b.record(e.s, img.Bounds(), nil, extraction{}, time.Since(start), err)
+    return nil, nil, err
+  }
+  e.logs.Debug("Analyzed the lines", "rows", len(a.rowResults), "cols", len(a.colResults), "duration", time.Since(start))
+  // Written before the vote, so that it is there to explain a failed one.
+  if e.periodsCSV != "" {
+    if err := a.writePeriodsCSV(e.periodsCSV); err != nil {
+      return nil, nil, err
+    }
+  }
+
+  if e.sweep != "" {
+    start, end, step, err := parseSweep(e.sweep)
+    if err != nil {
+      return nil, nil, exitError{exitUsage, err}
+    }
+    sweepTolerance(e.out, a.rowLines, a.colLines, e.s.weightedVote, start, end, step)
+    return a, nil, nil
+  }
+
+  var ext extraction
+  if e.strip == "auto" {
+    var horizontal bool
+    if horizontal, err = a.stripAxis(e.s, e.logger); err == nil {
+      e.strip = "vertical"
+      if horizontal {
+        e.strip = "horizontal"
+      }
+      ext, err = a.extractStrip(horizontal, e.s, e.logger)
+    }
+  } else if e.strip != "" {
+    ext, err = a.extractStrip(e.strip == "horizontal", e.s, e.logger)
+  } else {
+    ext, err = a.extract(ctx, e.s, e.logger)
+  }
+  e.b.record(e.s, img.Bounds(), a, ext, time.Since(start), err)
+  e.logs.Debug("Voted on the tile", "duration", time.Since(start))
+  if err != nil {
+    return nil, nil, err
+  }
+  return a, &ext, nil
+}
+
+// extractImage finds the tile of img and saves it along with the outputs
+// that go with it, the companions first prepared by prepareOutputs and
+// uploading it to upload if that is set.
+func (e *extractOptions) extractImage(img image.Image, companions []companion, upload string) error {
+  if e.progress && isTerminal(os.Stderr) {
+    e.s.progress = progressBar(os.Stderr)
+  }
+  ctx, cancel := e.s.context(context.Background())
+  defer cancel()
+  a, found, err := e.detect(ctx, img)
+  if err != nil || found == nil {
+    return err
+  }
+  ext := *found
+  // A flat image repeats every pixel, which is no tile to speak of.
+  if ext.Width <= 1 && ext.Height <= 1 {
+    return exitError{exitAmbiguous, fmt.Errorf(tr("The tile is only %dx%d, the image does not seem to repeat"), ext.Width, ext.Height)}
+  }
+  if ext.Grade < e.requiredGrade {
+    return exitError{exitAmbiguous, fmt.Errorf(tr("The tile is graded %s but %s is required, not saving it"), ext.Grade, e.requiredGrade)}
+  }
+
+  if e.colorways {
+    width, height, err := a.structuralPeriods(ctx, e.s)
+    if err != nil {
+      return err
+    }
+    if width > 0 && height > 0 && ((width < ext.Width && ext.Width % width == 0) || (height < ext.Height && ext.Height % height == 0)) {
+      e.logger.Printf(tr("Colorway variants: the structure repeats every %dx%d but the colors only every %dx%d\n"), width, height, ext.Width, ext.Height)
+      if e.structuralTile {
+        e.logger.Println(tr("Extracting the structural tile"))
+        ext.Width, ext.Height = width, height
+      }
+    } else {
+      e.logger.Println(tr("No colorway variants found"))
+    }
+  }
+
+  // A strip spans the whole image across, so only its period is checked.
+  bounds := a.img.Bounds()
+  tooWide := e.strip != "vertical" && float64(ext.Width) > e.maxTileFraction * float64(bounds.Dx())
+  tooTall := e.strip != "horizontal" && float64(ext.Height) > e.maxTileFraction * float64(bounds.Dy())
+  if tooWide || tooTall {
+    e.logs.Warn(fmt.Sprintf(tr("The %dx%d tile covers more than %.0f%% of the %dx%d image, which may not actually tile"), ext.Width, ext.Height, e.maxTileFraction * 100.0, bounds.Dx(), bounds.Dy()))
+    if !e.allowLargeTile && !e.dryRun {
+      return errors.New(tr("Not saving the tile, pass -allow-large-tile to save it anyway"))
+    }
+  }
+
+  if e.dryRun {
+    e.logger.Printf(tr("Tile: %dx%d at %d,%d\n"), ext.Width, ext.Height, ext.Origin.X, ext.Origin.Y)
+    e.logger.Printf(tr("Confidence: %.0f%% of the row vote, %.0f%% of the column vote\n"), ext.RowConfidence * 100, ext.ColConfidence * 100)
+    return e.printJSON(ext)
+  }
+
+  if e.nameTemplate != nil {
+    if e.output, err = e.tileOutput(e.input, ext); err != nil {
+      return err
+    }
+    if e.outputDir != "" {
+      e.output = filepath.Join(e.outputDir, e.output)
+    }
+    if len(companions) > 0 {
+      named, err := companionFiles(e.input, e.output, e.companions)
+      if err != nil {
+        return err
+      }
+      for i := range companions {
+        companions[i].output = named[i].output
+      }
+    }
+  }
+
+  if e.numCandidates > 0 {
+    if err := e.saveCandidates(a, ext); err != nil {
+      return err
+    }
+  }
+
+  tile := e.o.tile(a.img, ext.Origin, ext.Width, ext.Height)
+  if e.toClipboard {
+    if err := e.o.saveClipboard(tile); err != nil {
+      return err
+    }
+    e.logger.Println(tr("Tile copied to the clipboard."))
+  }
+  if e.saveFile() && e.output == "-" {
+    if err := e.o.write(e.stdout, tile); err != nil {
+      return err
+    }
+  } else if e.saveFile() {
+    if err := e.o.save(e.output, tile); err != nil {
+      return err
+    }
+  }
+  seamScore := SeamScore(tile)
+  e.logger.Printf(tr("Seam score: %.2f (about 1 when the seams are as smooth as the rest of the tile)\n"), seamScore)
+  for _, c := range companions {
+    if err := e.o.save(c.output, e.o.tile(c.img, ext.Origin, ext.Width, ext.Height)); err != nil {
+      return err
+    }
+    e.logger.Printf(tr("Cropped %s to %s\n"), c.input, c.output)
+  }
+  if err := e.saveExtras(a, ext, tile, upload); err != nil {
+    return err
+  }
+
+  if upload != "" && e.saveFile() {
+    if err := putObject(upload, e.output, e.fetchTimeout); err != nil {
+      return err
+    }
+    e.logger.Printf(tr("Uploaded the tile to %s\n"), upload)
+    e.output = upload
+  }
+
+  if e.report != "" {
+    entry := ReportEntry{
+      Input: e.input,
+      Output: e.output,
+      TileWidth: ext.Width,
+      TileHeight: ext.Height,
+      OffsetX: ext.Origin.X,
+      OffsetY: ext.Origin.Y,
+      SeamScore: seamScore,
+      Grade: ext.Grade.String(),
+    }
+    if err := writeReport(e.report, []ReportEntry{entry}); err != nil {
+      return err
+    }
+  }
+
+  if err := e.printJSON(ext); err != nil {
+    return err
+  }
+  e.logger.Println(tr("Image cropped and saved successfully."))
+  return nil
+}
+
+// printJSON prints the result of ext to stdout with -json.
+func (e *extractOptions) printJSON(ext extraction) error {
+  if !e.json {
+    return nil
+  }
+  data, err := json.Marshal(ext.result(""))
+  if err != nil {
+    return err
+  }
+  fmt.Fprintln(e.stdout, string(data))
+  return nil
+}
+
+// saveCandidates lists the -candidates next to ext, the tile that won the
+// vote, and saves them next to the output or into the -gallery.
+func (e *extractOptions) saveCandidates(a *analysis, ext extraction) error {
+  rowCandidates := rankedPeriods(a.rowLines, e.s.weightedVote, ext.Width, e.numCandidates)
+  colCandidates := rankedPeriods(a.colLines, e.s.weightedVote, ext.Height, e.numCandidates)
+  candidates := rankCandidates(a.buffer(), ext.Origin, rowCandidates, colCandidates, e.s.numProc)
+  if len(candidates) > e.numCandidates {
+    candidates = candidates[:e.numCandidates]
+  }
+  e.logger.Println("Rank  Width  Height  Reconstruction error")
+  for idx, candidate := range candidates {
+    e.logger.Printf("%4d  %5d  %6d  %f\n", idx + 1, candidate.Width, candidate.Height, candidate.Error)
+    if e.gallery != "" {
+      continue
+    }
+    candidatePath := candidateOutput(e.output, idx + 1)
+    if err := e.o.save(candidatePath, e.o.tile(a.img, ext.Origin, candidate.Width, candidate.Height)); err != nil {
+      return err
+    }
+  }
+  if e.gallery != "" {
+    if err := writeGallery(e.gallery, e.input, a.img, ext.Origin, candidates, e.o); err != nil {
+      return err
+    }
+    e.logger.Printf(tr("Wrote the candidates to %s, pass -gallery %s -select N to save one of them\n"), filepath.Join(e.gallery, "index.html"), e.gallery)
+  }
+  return nil
+}
+
+// saveExtras writes what -svg, -css, -proof and -preview ask for along with
+// the tile, which is bound for upload if that is set.
+func (e *extractOptions) saveExtras(a *analysis, ext extraction, tile image.Image, upload string) error {
+  // A strip spans the gradient of a web background, so it only repeats
+  // along the strip.
+  repeat := "repeat"
+  if e.strip != "" {
+    repeat = "repeat-y"
+    if e.strip == "horizontal" {
+      repeat = "repeat-x"
+    }
+  }
+  if e.strip != "" && e.saveFile() && e.output != "-" {
+    e.logger.Printf(tr("CSS: background: url(%s) %s;\n"), filepath.ToSlash(e.output), repeat)
+  }
+  if e.svg != "" {
+    svg, err := TraceSVG(tile)
+    if err == nil {
+      var file *os.File
+      if file, err = e.o.create(e.svg); err == nil {
+        _, err = file.Write(svg)
+        if closeErr := file.Close(); err == nil {
+          err = closeErr
+        }
+      }
+    }
+    if err != nil {
+      return err
+    }
+    e.logger.Printf(tr("Traced the tile to %s\n"), e.svg)
+  }
+  if e.css != "" {
+    // The rule refers to the tile by its path from the CSS file, or by its
+    // name alone once it is uploaded.
+    url, format := "", e.o.format
+    var err error
+    if e.cssInline {
+      if e.saveFile() && e.output != "-" {
+        format = outputFormat(e.output)
+      }
+    } else if upload != "" {
+      url = path.Base(upload)
+    } else if url, err = filepath.Rel(filepath.Dir(e.css), e.output); err != nil {
+      url = e.output
+    }
+    css, err := e.o.cssRule(tile, filepath.ToSlash(url), format, repeat)
+    if err == nil {
+      var file *os.File
+      if file, err = e.o.create(e.css); err == nil {
+        _, err = file.Write(css)
+        if closeErr := file.Close(); err == nil {
+          err = closeErr
+        }
+      }
+    }
+    if err != nil {
+      return err
+    }
+    e.logger.Printf(tr("Wrote the CSS to %s\n"), e.css)
+  }
+  if e.proof != "" {
+    tileWidth := float64(tile.Bounds().Dx()) * 72 / e.proofDPI
+    if e.proofTile > 0 {
+      tileWidth = e.proofTile
+    }
+    tileHeight := tileWidth * float64(tile.Bounds().Dy()) / float64(tile.Bounds().Dx())
+    file, err := e.o.create(e.proof)
+    if err == nil {
+      err = writeProof(file, tile, e.pageWidth, e.pageHeight, tileWidth, tileHeight)
+      if closeErr := file.Close(); err == nil {
+        err = closeErr
+      }
+    }
+    if err != nil {
+      return err
+    }
+    e.logger.Printf(tr("Wrote a proof with tiles of %.1fx%.1f mm to %s\n"), tileWidth * 25.4 / 72, tileHeight * 25.4 / 72, e.proof)
+  }
+  if e.preview != "" {
+    if err := e.o.save(e.preview, preview(a.img, tile, ext.Origin)); err != nil {
+      return err
+    }
+    e.logger.Printf(tr("Saved the image next to its reconstruction to %s\n"), e.preview)
+  }
+  return nil
+}
@@ -0,0 +1,177 @@
+/*
+TileEx : A Tiling Pattern Extractor written in Go
+Copyright (C) 2023, Sarthak Shah (shahsarthakw@gmail.com)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "os"
+  "path/filepath"
+  "fmt"
+  "html"
+  "image"
+  "image/color"
+  "image/png"
+  "image/draw"
+  "math"
+)
+
+// galleryIndex is the candidates.json of a -gallery folder, which -select
+// reads back to crop a candidate without detecting again.
+type galleryIndex struct {
+  Input string `json:"input"`
+  Candidates []ReportEntry `json:"candidates"`
+}
+
+const galleryIndexFile = "candidates.json"
+
+// thumbnailSide is the longest side of the overlays in a gallery.
+const thumbnailSide = 480
+
+// overlay scales img down to at most thumbnailSide pixels across and draws
+// the grid of width by height tiles starting at origin on top of it, with
+// the tile at origin outlined twice as thick.
+func overlay(img image.Image, origin image.Point, width, height int) *image.RGBA {
+  bounds := img.Bounds()
+  scale := math.Min(1, float64(thumbnailSide) / float64(max(bounds.Dx(), bounds.Dy())))
+  thumb := image.NewRGBA(image.Rect(0, 0, max(1, int(float64(bounds.Dx()) * scale)), max(1, int(float64(bounds.Dy()) * scale))))
+  tb := thumb.Bounds()
+  for y := 0; y < tb.Dy(); y++ {
+    for x := 0; x < tb.Dx(); x++ {
+      thumb.Set(x, y, img.At(bounds.Min.X + int(float64(x) / scale), bounds.Min.Y + int(float64(y) / scale)))
+    }
+  }
+  grid := color.RGBA{R: 255, B: 255, A: 255}
+  line := func(r image.Rectangle) {
+    draw.Draw(thumb, r.Intersect(tb), image.NewUniform(grid), image.Point{}, draw.Src)
+  }
+  // The grid extends to both sides of origin, so start at the first line
+  // left of and above the image.
+  for x := origin.X - bounds.Min.X - (origin.X - bounds.Min.X) / width * width; x < bounds.Dx(); x += width {
+    line(image.Rect(int(float64(x) * scale), 0, int(float64(x) * scale) + 1, tb.Dy()))
+  }
+  for y := origin.Y - bounds.Min.Y - (origin.Y - bounds.Min.Y) / height * height; y < bounds.Dy(); y += height {
+    line(image.Rect(0, int(float64(y) * scale), tb.Dx(), int(float64(y) * scale) + 1))
+  }
+  tile := image.Rect(int(float64(origin.X - bounds.Min.X) * scale), int(float64(origin.Y - bounds.Min.Y) * scale), int(float64(origin.X - bounds.Min.X + width) * scale), int(float64(origin.Y - bounds.Min.Y + height) * scale))
+  line(image.Rect(tile.Min.X, tile.Min.Y, tile.Max.X, tile.Min.Y + 2))
+  line(image.Rect(tile.Min.X, tile.Max.Y - 2, tile.Max.X, tile.Max.Y))
+  line(image.Rect(tile.Min.X, tile.Min.Y, tile.Min.X + 2, tile.Max.Y))
+  line(image.Rect(tile.Max.X - 2, tile.Min.Y, tile.Max.X, tile.Max.Y))
+  return thumb
+}
+
+// preview puts the image and the same area rebuilt from the tile at origin
+// side by side, scaled down like the overlays of the gallery and with the
+// grid of the tile on both, so that a wrong tile shows at a glance as a
+// difference between them.
+func preview(img, tile image.Image, origin image.Point) *image.RGBA {
+  width, height := tile.Bounds().Dx(), tile.Bounds().Dy()
+  original := overlay(img, origin, width, height)
+  rebuilt := overlay(synthesize(tile, img.Bounds(), origin), origin, width, height)
+  const gap = 8
+  side := original.Bounds()
+  out := image.NewRGBA(image.Rect(0, 0, 2 * side.Dx() + gap, side.Dy()))
+  draw.Draw(out, out.Rect, image.White, image.Point{}, draw.Src)
+  draw.Draw(out, side, original, image.Point{}, draw.Over)
+  draw.Draw(out, side.Add(image.Pt(side.Dx() + gap, 0)), rebuilt, image.Point{}, draw.Over)
+  return out
+}
+
+// writeGallery saves every candidate to dir as its tile, the tile repeated
+// 3x3 and an overlay of its grid on the image, and writes an index.html to
+// compare them side by side and the candidates.json that -select reads.
+func writeGallery(dir, input string, img image.Image, origin image.Point, candidates []Candidate, o outputSettings) error {
+  if err := os.MkdirAll(dir, 0755); err != nil {
+    return err
+  }
+  index := galleryIndex{Input: input}
+  var page bytes.Buffer
+  fmt.Fprintf(&page, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n", html.EscapeString(fmt.Sprintf(tr("Candidates for %s"), input)))
+  fmt.Fprintln(&page, "<style>body{font-family:sans-serif}figure{display:inline-block;vertical-align:top;margin:1em}img{display:block;max-width:480px;margin-bottom:.5em;image-rendering:pixelated}</style>\n</head>\n<body>")
+  fmt.Fprintf(&page, "<h1>%s</h1>\n", html.EscapeString(fmt.Sprintf(tr("Candidates for %s"), input)))
+  for idx, candidate := range candidates {
+    rank := idx + 1
+    tile := o.tile(img, origin, candidate.Width, candidate.Height)
+    names := []string{fmt.Sprintf("candidate-%d.png", rank), fmt.Sprintf("candidate-%d-preview.png", rank), fmt.Sprintf("candidate-%d-overlay.png", rank)}
+    images := []image.Image{tile, Retile(tile, 3 * candidate.Width, 3 * candidate.Height), overlay(img, origin, candidate.Width, candidate.Height)}
+    for i := range names {
+      if err := o.save(filepath.Join(dir, names[i]), images[i]); err != nil {
+        return err
+      }
+    }
+    index.Candidates = append(index.Candidates, ReportEntry{
+      Input: input,
+      Output: names[0],
+      TileWidth: candidate.Width,
+      TileHeight: candidate.Height,
+      OffsetX: origin.X,
+      OffsetY: origin.Y,
+      Grade: GradeFor(candidate.Error).String(),
+    })
+    fmt.Fprintf(&page, "<figure>\n<img src=\"%s\" alt=\"\">\n<img src=\"%s\" alt=\"\">\n<a href=\"%s\"><img src=\"%s\" alt=\"\"></a>\n", names[1], names[2], names[0], names[0])
+    fmt.Fprintf(&page, "<figcaption>%s</figcaption>\n</figure>\n", html.EscapeString(fmt.Sprintf(tr("%d: %dx%d, error %f, pass -select %d"), rank, candidate.Width, candidate.Height, candidate.Error, rank)))
+  }
+  fmt.Fprintln(&page, "</body>\n</html>")
+
+  data, err := json.MarshalIndent(index, "", "  ")
+  if err != nil {
+    return err
+  }
+  for name, content := range map[string][]byte{galleryIndexFile: append(data, '\n'), "index.html": page.Bytes()} {
+    file, err := o.create(filepath.Join(dir, name))
+    if err != nil {
+      return err
+    }
+    _, err = file.Write(content)
+    if closeErr := file.Close(); err == nil {
+      err = closeErr
+    }
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// selectCandidate reads candidate rank back from the candidates.json that
+// -gallery wrote to dir.
+func selectCandidate(dir string, rank int) (ReportEntry, error) {
+  data, err := os.ReadFile(filepath.Join(dir, galleryIndexFile))
+  if err != nil {
+    return ReportEntry{}, err
+  }
+  var index galleryIndex
+  if err := json.Unmarshal(data, &index); err != nil {
+    return ReportEntry{}, fmt.Errorf("%s: %w", filepath.Join(dir, galleryIndexFile), err)
+  }
+  if rank < 1 || rank > len(index.Candidates) {
+    return ReportEntry{}, fmt.Errorf(tr("%s has %d candidates, there is no candidate %d"), filepath.Join(dir, galleryIndexFile), len(index.Candidates), rank)
+  }
+  return index.Candidates[rank - 1], nil
+}
+
+func savePNG(name string, img image.Image) error {
+  outputImg, err := os.Create(name)
+  if err != nil {
+    return err
+  }
+  defer outputImg.Close()
+
+  return png.Encode(outputImg, img)
+}
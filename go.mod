@@ -0,0 +1,5 @@
+module github.com/cel7t/TileEx
+
+go 1.26.0
+
+require golang.org/x/image v0.46.0
@@ -0,0 +1,422 @@
+/*
+TileEx : A Tiling Pattern Extractor written in Go
+Copyright (C) 2023, Sarthak Shah (shahsarthakw@gmail.com)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+  mrand "math/rand/v2"
+  "fmt"
+  "sort"
+  "image"
+  "image/draw"
+  "math"
+  "sync"
+)
+
+// Grade classifies how faithfully a tile reproduces its source image.
+type Grade int
+
+const (
+  GradeApproximate Grade = iota
+  GradeNearExact
+  GradeExact
+)
+
+// nearExactError is the largest reconstruction error that is still graded
+// near-exact, about a 3% RMS color difference.
+const nearExactError = 0.001
+
+var gradeNames = map[Grade]string{
+  GradeApproximate: "approximate",
+  GradeNearExact: "near-exact",
+  GradeExact: "exact",
+}
+
+func (g Grade) String() string {
+  return gradeNames[g]
+}
+
+// ParseGrade returns the grade with the given name.
+func ParseGrade(name string) (Grade, error) {
+  for grade, gradeName := range gradeNames {
+    if gradeName == name {
+      return grade, nil
+    }
+  }
+  return GradeApproximate, fmt.Errorf("unknown grade %q, expected exact, near-exact or approximate", name)
+}
+
+// GradeFor returns the grade of a tile with the given reconstruction error.
+func GradeFor(reconstructionError float64) Grade {
+  if reconstructionError == 0 {
+    return GradeExact
+  }
+  if reconstructionError <= nearExactError {
+    return GradeNearExact
+  }
+  return GradeApproximate
+}
+
+// tiedPeriods returns the periods that received exactly as many votes as the
+// chosen period, including the chosen period itself.
+func tiedPeriods(results []LineResult, weighted bool, chosen int) []int {
+  pairs, _ := frequencyPairs(results, weighted, true, "")
+  votes := -1.0
+  for _, pair := range pairs {
+    if pair.Period == chosen {
+      votes = pair.Votes
+    }
+  }
+  var tied []int
+  for _, pair := range pairs {
+    if pair.Votes == votes {
+      tied = append(tied, pair.Period)
+    }
+  }
+  return tied
+}
+
+// rankedPeriods returns up to count periods, starting with the chosen period
+// and followed by the remaining periods in order of their votes.
+func rankedPeriods(results []LineResult, weighted bool, chosen int, count int) []int {
+  pairs, _ := frequencyPairs(results, weighted, true, "")
+  periods := []int{chosen}
+  for _, pair := range pairs {
+    if len(periods) >= count {
+      break
+    }
+    if pair.Period != chosen {
+      periods = append(periods, pair.Period)
+    }
+  }
+  return periods
+}
+
+// Candidate is a joint (row, col) period combination together with how well
+// tiling it reproduces the source image.
+type Candidate struct {
+  Width, Height int
+  Error float64
+}
+
+// rankCandidates scores every combination of the row and col periods on up
+// to workers goroutines and returns them ordered from the lowest
+// reconstruction error.
+func rankCandidates(pixels *pixelBuffer, origin image.Point, rowPeriods, colPeriods []int, workers int) []Candidate {
+  var candidates []Candidate
+  for _, width := range rowPeriods {
+    for _, height := range colPeriods {
+      candidates = append(candidates, Candidate{Width: width, Height: height})
+    }
+  }
+
+  jobs := make(chan int)
+  var wg sync.WaitGroup
+  for w := 0; w < workers && w < len(candidates); w++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      for idx := range jobs {
+        candidates[idx].Error = pixels.reconstructionError(origin, candidates[idx].Width, candidates[idx].Height)
+      }
+    }()
+  }
+  for idx := range candidates {
+    jobs <- idx
+  }
+  close(jobs)
+  wg.Wait()
+
+  sort.SliceStable(candidates, func(i, j int) bool {
+    return candidates[i].Error < candidates[j].Error
+  })
+  return candidates
+}
+
+// pixelBuffer holds the colors of an image in row-major order, so that they
+// can be read over and over without going through image.Image.At.
+type pixelBuffer struct {
+  Rect image.Rectangle
+  Pix []Color
+}
+
+func newPixelBuffer(img image.Image) *pixelBuffer {
+  bounds := img.Bounds()
+  pixels := &pixelBuffer{Rect: bounds, Pix: make([]Color, bounds.Dx() * bounds.Dy())}
+  idx := 0
+  for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+    for x := bounds.Min.X; x < bounds.Max.X; x++ {
+      pixels.Pix[idx] = colorAt(img, x, y)
+      idx++
+    }
+  }
+  return pixels
+}
+
+// at returns the color at (x, y), or opaque black outside of the buffer.
+func (p *pixelBuffer) at(x, y int) Color {
+  if !image.Pt(x, y).In(p.Rect) {
+    return Color{A: 0xffff}
+  }
+  return p.Pix[(y - p.Rect.Min.Y) * p.Rect.Dx() + x - p.Rect.Min.X]
+}
+
+// ReconstructionError returns the mean squared color difference, normalized to
+// [0, 1], between img and the image obtained by repeating the tileWidth by
+// tileHeight tile at origin across all of it. The pixels of the tile itself
+// are left out, so a tile that covers the whole image has nothing to prove and
+// scores 1.
+func ReconstructionError(img image.Image, origin image.Point, tileWidth, tileHeight int) float64 {
+  return newPixelBuffer(img).reconstructionError(origin, tileWidth, tileHeight)
+}
+
+func (p *pixelBuffer) reconstructionError(origin image.Point, tileWidth, tileHeight int) float64 {
+  if p.Rect.Empty() || tileWidth <= 0 || tileHeight <= 0 {
+    return 1.0
+  }
+  sum, count := p.blockError(p.Rect, origin, tileWidth, tileHeight)
+  if count == 0 {
+    return 1.0
+  }
+  return sum / float64(count) / maxColorDiff
+}
+
+// blockError sums the squared color differences between the pixels of block
+// and the tile repeated over them, leaving out the pixels of the tile, and
+// returns the sum and the number of pixels compared.
+func (p *pixelBuffer) blockError(block image.Rectangle, origin image.Point, tileWidth, tileHeight int) (float64, int) {
+  tileRect := image.Rect(origin.X, origin.Y, origin.X + tileWidth, origin.Y + tileHeight)
+  sum := 0.0
+  count := 0
+  for y := block.Min.Y; y < block.Max.Y; y++ {
+    ty := origin.Y + mod(y - origin.Y, tileHeight)
+    for x := block.Min.X; x < block.Max.X; x++ {
+      if image.Pt(x, y).In(tileRect) {
+        continue
+      }
+      count++
+      tx := origin.X + mod(x - origin.X, tileWidth)
+      sum += float64(ColorDiff(p.at(x, y), p.at(tx, ty)))
+    }
+  }
+  return sum, count
+}
+
+// sampleBlock is the side of the blocks that -verify-sample picks from.
+const sampleBlock = 32
+
+// sampledReconstructionError estimates reconstructionError from a fraction
+// of the sampleBlock-sized blocks of the image. The sample is stratified: the
+// blocks are split, in row-major order, into as many runs as are to be
+// sampled, and one block is drawn from each, so that every part of the image
+// is looked at. Along with the estimate, it returns the half-width of its 95%
+// confidence interval and how many of how many blocks were compared.
+func (p *pixelBuffer) sampledReconstructionError(origin image.Point, tileWidth, tileHeight int, fraction float64) (float64, float64, int, int) {
+  if p.Rect.Empty() || tileWidth <= 0 || tileHeight <= 0 {
+    return 1.0, 0, 0, 0
+  }
+  across := (p.Rect.Dx() + sampleBlock - 1) / sampleBlock
+  down := (p.Rect.Dy() + sampleBlock - 1) / sampleBlock
+  blocks := across * down
+  sampled := min(blocks, max(1, int(math.Ceil(fraction * float64(blocks)))))
+  // A fixed seed grades the same image the same way every time.
+  random := mrand.New(mrand.NewPCG(uint64(tileWidth), uint64(tileHeight)))
+  var sum float64
+  var count int
+  var means []float64
+  for i := 0; i < sampled; i++ {
+    start, end := i * blocks / sampled, (i + 1) * blocks / sampled
+    idx := start + random.IntN(end - start)
+    corner := p.Rect.Min.Add(image.Pt(idx % across * sampleBlock, idx / across * sampleBlock))
+    block := image.Rectangle{Min: corner, Max: corner.Add(image.Pt(sampleBlock, sampleBlock))}.Intersect(p.Rect)
+    blockSum, blockCount := p.blockError(block, origin, tileWidth, tileHeight)
+    if blockCount == 0 {
+      continue
+    }
+    sum += blockSum
+    count += blockCount
+    means = append(means, blockSum / float64(blockCount) / maxColorDiff)
+  }
+  if count == 0 {
+    return 1.0, 0, sampled, blocks
+  }
+  estimate := sum / float64(count) / maxColorDiff
+  if len(means) < 2 || sampled == blocks {
+    return estimate, 0, sampled, blocks
+  }
+  variance := 0.0
+  for _, mean := range means {
+    variance += (mean - estimate) * (mean - estimate)
+  }
+  variance /= float64(len(means) - 1)
+  // Drawing without replacement from a finite set of blocks narrows the
+  // interval as the sample approaches all of them.
+  correction := 1 - float64(sampled) / float64(blocks)
+  return estimate, 1.96 * math.Sqrt(variance / float64(len(means)) * correction), sampled, blocks
+}
+
+// VerifyTile finds where tile lines up best with the pattern in source and
+// returns that origin, relative to the top left corner of source, along with
+// the mean squared color difference, normalized to [0, 1], between source
+// and tile repeated across it from there.
+func VerifyTile(source, tile image.Image) (image.Point, float64) {
+  return newPixelBuffer(source).alignTile(newPixelBuffer(tile))
+}
+
+func (p *pixelBuffer) alignTile(tile *pixelBuffer) (image.Point, float64) {
+  width, height := p.Rect.Dx(), p.Rect.Dy()
+  tileWidth, tileHeight := tile.Rect.Dx(), tile.Rect.Dy()
+  if width == 0 || height == 0 || tileWidth == 0 || tileHeight == 0 {
+    return image.Point{}, 1.0
+  }
+  // score sums the differences over every step-th pixel of the source with
+  // the tile repeated from origin.
+  score := func(origin image.Point, step int) int64 {
+    var sum int64
+    for y := 0; y < height; y += step {
+      row := tile.Pix[mod(y - origin.Y, tileHeight) * tileWidth:]
+      for x := 0; x < width; x += step {
+        sum += ColorDiff(p.Pix[y * width + x], row[mod(x - origin.X, tileWidth)])
+      }
+    }
+    return sum
+  }
+
+  step := 1
+  for ((width + step - 1) / step) * ((height + step - 1) / step) > maxMotifSamples {
+    step++
+  }
+  best := image.Point{}
+  bestScore := int64(math.MaxInt64)
+  for y := 0; y < tileHeight; y++ {
+    for x := 0; x < tileWidth; x++ {
+      if s := score(image.Pt(x, y), step); s < bestScore {
+        best, bestScore = image.Pt(x, y), s
+      }
+    }
+  }
+  return best, float64(score(best, 1)) / float64(width * height) / maxColorDiff
+}
+
+// fundamentalPeriod returns the smallest divisor of the tile's width, or of
+// its height when horizontal is not set, at which the tile at origin repeats
+// within itself with a mean squared difference of at most threshold. A chosen
+// period that is a multiple of the true one shrinks back to the true one.
+func (p *pixelBuffer) fundamentalPeriod(origin image.Point, tileWidth, tileHeight int, horizontal bool, threshold float64) int {
+  period := tileHeight
+  if horizontal {
+    period = tileWidth
+  }
+  for d := 1; d < period; d++ {
+    if period % d != 0 {
+      continue
+    }
+    sum := 0.0
+    count := 0
+    for y := origin.Y; y < origin.Y + tileHeight; y++ {
+      for x := origin.X; x < origin.X + tileWidth; x++ {
+        sx, sy := x, y + d
+        if horizontal {
+          sx, sy = x + d, y
+        }
+        if sx >= origin.X + tileWidth || sy >= origin.Y + tileHeight {
+          continue
+        }
+        sum += float64(ColorDiff(p.at(x, y), p.at(sx, sy)))
+        count++
+      }
+      if sum / maxColorDiff > threshold * float64(tileWidth * tileHeight) {
+        break
+      }
+    }
+    if count > 0 && sum / float64(count) / maxColorDiff <= threshold {
+      return d
+    }
+  }
+  return period
+}
+
+func mod(a, b int) int {
+  m := a % b
+  if m < 0 {
+    m += b
+  }
+  return m
+}
+
+// cropTile copies the tileWidth by tileHeight tile at origin out of img.
+func cropTile(img image.Image, origin image.Point, tileWidth, tileHeight int) *image.RGBA {
+  targetImage := image.NewRGBA(image.Rect(0, 0, tileWidth, tileHeight))
+  draw.Draw(targetImage, targetImage.Bounds(), img, origin, draw.Src)
+  return targetImage
+}
+
+// CropTile returns the tileWidth by tileHeight tile at origin. When zeroCopy
+// is set and the tile lies within img, the tile is a SubImage view that shares
+// the pixels of img instead of a copy of them, which saves memory for callers
+// that only re-encode the tile. Note that the bounds of such a view start at
+// origin rather than at (0, 0).
+func CropTile(img image.Image, origin image.Point, tileWidth, tileHeight int, zeroCopy bool) image.Image {
+  rect := image.Rect(origin.X, origin.Y, origin.X + tileWidth, origin.Y + tileHeight)
+  if sub, ok := img.(subImager); ok && zeroCopy && rect.In(img.Bounds()) {
+    return sub.SubImage(rect)
+  }
+  if tile := cropPreserving(img, rect); tile != nil {
+    return tile
+  }
+  tile := newCanvas(img, image.Rect(0, 0, tileWidth, tileHeight))
+  draw.Draw(tile, tile.Bounds(), img, origin, draw.Src)
+  return tile
+}
+
+// SeamScore measures how visible the seams of tile are when it is repeated.
+// It divides the mean squared color difference between the pixels that meet
+// across the wrap-around edges, the last column and the first, and the last
+// row and the first, by that between neighboring pixels inside the tile. A
+// seamless tile scores about 1, and the higher the score, the more its seams
+// stand out from its texture.
+func SeamScore(tile image.Image) float64 {
+  pixels := newPixelBuffer(tile)
+  w, h := pixels.Rect.Dx(), pixels.Rect.Dy()
+  if w < 2 || h < 2 {
+    return 0
+  }
+  diff := func(i, j int) float64 {
+    a, b := pixels.Pix[i], pixels.Pix[j]
+    return float64(ColorDiff(a, b))
+  }
+  var inside, seam float64
+  for y := 0; y < h; y++ {
+    for x := 0; x < w; x++ {
+      i := y * w + x
+      right, down := diff(i, y * w + (x + 1) % w), diff(i, ((y + 1) % h) * w + x)
+      if x == w - 1 {
+        seam += right
+      } else {
+        inside += right
+      }
+      if y == h - 1 {
+        seam += down
+      } else {
+        inside += down
+      }
+    }
+  }
+  // Guard against flat tiles, which are seamless although nothing differs.
+  const epsilon = 1.0
+  return (seam / float64(w + h) + epsilon) / (inside / float64(2 * w * h - w - h) + epsilon)
+}
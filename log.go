@@ -0,0 +1,98 @@
+/*
+TileEx : A Tiling Pattern Extractor written in Go
+Copyright (C) 2023, Sarthak Shah (shahsarthakw@gmail.com)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+  "context"
+  "io"
+  "fmt"
+  "strings"
+  "log/slog"
+  "sync"
+)
+
+// textHandler is a slog.Handler for people reading the log. It writes every
+// message on a line of its own, after "Error: " or "Warning: " where that
+// applies, followed by its attributes as key=value.
+type textHandler struct {
+  w io.Writer
+  level slog.Level
+  mu *sync.Mutex
+  attrs []slog.Attr
+}
+
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+  return level >= h.level
+}
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+  var b strings.Builder
+  switch {
+  case r.Level >= slog.LevelError:
+    b.WriteString(tr("Error: "))
+  case r.Level >= slog.LevelWarn:
+    b.WriteString(tr("Warning: "))
+  }
+  b.WriteString(r.Message)
+  write := func(a slog.Attr) bool {
+    fmt.Fprintf(&b, " %s=%v", a.Key, a.Value)
+    return true
+  }
+  for _, a := range h.attrs {
+    write(a)
+  }
+  r.Attrs(write)
+  b.WriteByte('\n')
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  _, err := io.WriteString(h.w, b.String())
+  return err
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+  with := *h
+  with.attrs = append(h.attrs[:len(h.attrs):len(h.attrs)], attrs...)
+  return &with
+}
+
+func (h *textHandler) WithGroup(name string) slog.Handler {
+  return h
+}
+
+// newLogger returns the logger of the default mode, writing to w in the
+// given format (text or json). It logs informational messages unless quiet
+// is set, when it only logs warnings and errors, and debugging details too
+// if verbose is set.
+func newLogger(w io.Writer, format string, verbose, quiet bool) (*slog.Logger, error) {
+  if verbose && quiet {
+    return nil, fmt.Errorf("-v and -q cannot be combined")
+  }
+  level := slog.LevelInfo
+  if verbose {
+    level = slog.LevelDebug
+  } else if quiet {
+    level = slog.LevelWarn
+  }
+  switch format {
+  case "text":
+    return slog.New(&textHandler{w: w, level: level, mu: new(sync.Mutex)}), nil
+  case "json":
+    return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})), nil
+  }
+  return nil, fmt.Errorf("unknown -log-format %q, expected text or json", format)
+}
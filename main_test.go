@@ -0,0 +1,1938 @@
+package main
+
+import (
+  "bytes"
+  "compress/zlib"
+  "encoding/base64"
+  "encoding/binary"
+  "encoding/json"
+  "encoding/xml"
+  "errors"
+  "flag"
+  "fmt"
+  "hash/crc32"
+  "image"
+  "image/color"
+  "image/draw"
+  "image/png"
+  "io"
+  "log"
+  "math"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "sort"
+  "strings"
+  "testing"
+)
+
+func TestSignedAndAbsDiff(t *testing.T) {
+  tests := []struct {
+    a, b uint32
+    signed int64
+    abs uint32
+  }{
+    {0, 0, 0, 0},
+    {5, 3, 2, 2},
+    // Subtracting the brighter channel used to wrap around to 0xfffffffe.
+    {3, 5, -2, 2},
+    {0, 0xffff, -0xffff, 0xffff},
+    {0, 0xffffffff, -0xffffffff, 0xffffffff},
+  }
+  for _, test := range tests {
+    if got := signedDiff(test.a, test.b); got != test.signed {
+      t.Errorf("signedDiff(%d, %d) = %d, want %d", test.a, test.b, got, test.signed)
+    }
+    if got := absDiff(test.a, test.b); got != test.abs {
+      t.Errorf("absDiff(%d, %d) = %d, want %d", test.a, test.b, got, test.abs)
+    }
+    if got := absDiff(test.b, test.a); got != test.abs {
+      t.Errorf("absDiff(%d, %d) = %d, want %d", test.b, test.a, got, test.abs)
+    }
+  }
+}
+
+var (
+  opaqueBlack = Color{0, 0, 0, 0xffff}
+  opaqueWhite = Color{0xffff, 0xffff, 0xffff, 0xffff}
+  transparentWhite = Color{0xffff, 0xffff, 0xffff, 0}
+  transparent = Color{}
+)
+
+var diffColors = []Color{
+  opaqueBlack,
+  opaqueWhite,
+  transparentWhite,
+  transparent,
+  {0x8000, 0x4000, 0x2000, 0xffff},
+  {0x8001, 0x4000, 0x2000, 0xffff},
+  {0x1000, 0x1000, 0x1000, 0x1000},
+}
+
+func TestColorDiffSymmetric(t *testing.T) {
+  for _, x := range diffColors {
+    for _, y := range diffColors {
+      if a, b := ColorDiff(x, y), ColorDiff(y, x); a != b {
+        t.Errorf("ColorDiff(%v, %v) = %d but ColorDiff(%v, %v) = %d", x, y, a, y, x, b)
+      }
+    }
+  }
+}
+
+func TestColorDiffZeroOnlyForEqualColors(t *testing.T) {
+  for i, x := range diffColors {
+    for j, y := range diffColors {
+      if got := ColorDiff(x, y); (got == 0) != (i == j) {
+        t.Errorf("ColorDiff(%v, %v) = %d", x, y, got)
+      }
+    }
+  }
+}
+
+func TestColorDiffRange(t *testing.T) {
+  if got := ColorDiff(opaqueBlack, opaqueWhite); got != maxColorDiff {
+    t.Errorf("ColorDiff(opaque black, opaque white) = %d, want %d", got, maxColorDiff)
+  }
+  // A difference in alpha on top of one in all three colors is capped.
+  if got := ColorDiff(opaqueBlack, transparentWhite); got != maxColorDiff {
+    t.Errorf("ColorDiff(opaque black, transparent white) = %d, want %d", got, maxColorDiff)
+  }
+  for _, x := range diffColors {
+    for _, y := range diffColors {
+      if got := ColorDiff(x, y); got < 0 || got > maxColorDiff {
+        t.Errorf("ColorDiff(%v, %v) = %d, outside of [0, %d]", x, y, got, maxColorDiff)
+      }
+    }
+  }
+}
+
+func TestColorDiffDarkerFirst(t *testing.T) {
+  // With uint32 channels, 1 - 2 wrapped around to 0xffffffff, so a color
+  // came out as far as possible from one a single step brighter.
+  x, y := Color{1, 1, 1, 0xffff}, Color{2, 1, 1, 0xffff}
+  if got := ColorDiff(x, y); got != 1 {
+    t.Errorf("ColorDiff(%v, %v) = %d, want 1", x, y, got)
+  }
+  if got := ColorDiff(opaqueBlack, Color{0, 0, 0x10, 0xffff}); got != 0x100 {
+    t.Errorf("ColorDiff(opaque black, dark blue) = %d, want %d", got, 0x100)
+  }
+}
+
+func TestCheckMaxSize(t *testing.T) {
+  tests := []struct {
+    width, height int
+    ok bool
+  }{
+    {MaxDimension - 1, 1, true},
+    {MaxDimension, 1, true},
+    {MaxDimension + 1, 1, false},
+    {1, MaxDimension - 1, true},
+    {1, MaxDimension, true},
+    {1, MaxDimension + 1, false},
+    {MaxDimension, MaxDimension, false},
+    // 1<<28 - 1 = 16383 * 16385, and 1<<28 + 1 has no factors within
+    // MaxDimension, so the nearest size above is one more column.
+    {16383, 16385, true},
+    {16384, 16384, true},
+    {16385, 16384, false},
+    {MaxPixels / MaxDimension, MaxDimension, true},
+    {MaxPixels / MaxDimension + 1, MaxDimension, false},
+  }
+  for _, test := range tests {
+    err := checkMaxSize(test.width, test.height)
+    if test.ok && err != nil {
+      t.Errorf("checkMaxSize(%d, %d) = %v, want nil", test.width, test.height, err)
+    }
+    if !test.ok && !errors.Is(err, ErrImageTooLarge) {
+      t.Errorf("checkMaxSize(%d, %d) = %v, want ErrImageTooLarge", test.width, test.height, err)
+    }
+  }
+}
+
+func TestSumsFitInt64(t *testing.T) {
+  if float64(MaxPixels) * maxColorDiff > math.MaxInt64 {
+    t.Fatalf("%d differences of up to %d overflow int64", MaxPixels, int64(maxColorDiff))
+  }
+  // A line of MaxDimension pixels, each as far as possible from the tile,
+  // has to come out as the largest difference rather than wrap around.
+  for _, size := range []image.Point{{MaxDimension, 1}, {1, MaxDimension}} {
+    source := image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+    draw.Draw(source, source.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+    tile := image.NewRGBA(image.Rect(0, 0, 1, 1))
+    tile.Set(0, 0, color.Black)
+    if _, diff := VerifyTile(source, tile); diff != 1 {
+      t.Errorf("VerifyTile of a %dx%d white image with a black tile = %g, want 1", size.X, size.Y, diff)
+    }
+  }
+}
+
+func TestArrayPeriodicityJPGPlus(t *testing.T) {
+  // A line of ten repeats of seven colors, each pixel off by up to three
+  // levels per channel as compression would leave it.
+  base := make([]Color, 7)
+  for idx := range base {
+    base[idx] = Color{R: uint32(idx * 9000), G: uint32(0xffff - idx * 7000), B: uint32(idx * idx * 1000), A: 0xffff}
+  }
+  colors := make([]Color, 70)
+  state := uint32(1)
+  noise := func() uint32 {
+    state = state * 1664525 + 1013904223
+    return (state >> 24) % 7 * 0x101
+  }
+  for idx := range colors {
+    c := base[idx % 7]
+    colors[idx] = Color{R: c.R + noise(), G: c.G + noise() / 2, B: c.B + noise(), A: 0xffff}
+  }
+  // Compared cyclically, every multiple of the period lines the repeats up
+  // as well as the period itself, and only the noise picks one, for the
+  // older ArrayPeriodicityJPG as well. On two repeats, the period is the only
+  // lag up to half the line that does.
+  for _, n := range []int{70, 14} {
+    got, old := ArrayPeriodicityJPGPlus(colors[:n]), ArrayPeriodicityJPG(colors[:n])
+    if got % 7 != 0 || old % 7 != 0 {
+      t.Errorf("%d pixels: period %d, and %d by ArrayPeriodicityJPG, want multiples of 7", n, got, old)
+    }
+    if n == 14 && (got != 7 || old != 7) {
+      t.Errorf("%d pixels: period %d, and %d by ArrayPeriodicityJPG, want 7", n, got, old)
+    }
+  }
+
+  // Lines too short to compare two lags have no better answer than 1.
+  for n := 0; n < 4; n++ {
+    if got := ArrayPeriodicityJPGPlus(colors[:n]); got != 1 {
+      t.Errorf("%d pixels: period %d, want 1", n, got)
+    }
+  }
+}
+
+func TestBestLags(t *testing.T) {
+  // Lag k and lag n - k pair up the same pixels, so only lags up to n/2 are
+  // tried.
+  for _, n := range []int{2, 3, 9, 10} {
+    var tried []int
+    bestLags(n, func(lag int) int {
+      tried = append(tried, lag)
+      return 0
+    })
+    if len(tried) != n / 2 || tried[len(tried) - 1] != n / 2 {
+      t.Errorf("%d pixels: tried lags %v, want 1 to %d", n, tried, n / 2)
+    }
+  }
+
+  // Ties go to the smaller lag, and only the best verifiedLags are kept.
+  sums := map[int]int{1: 50, 2: 30, 3: 10, 4: 30, 5: 10, 6: 20, 7: 40, 8: 5}
+  got := bestLags(16, func(lag int) int { return sums[lag] })
+  want := []lagCandidate{{8, 5}, {3, 10}, {5, 10}, {6, 20}}
+  if fmt.Sprint(got) != fmt.Sprint(want) {
+    t.Errorf("bestLags = %v, want %v", got, want)
+  }
+  if got := bestLags(8, func(int) int { return 0 }); fmt.Sprint(got) != fmt.Sprint([]lagCandidate{{1, 0}, {2, 0}, {3, 0}, {4, 0}}) {
+    t.Errorf("equal sums: bestLags = %v, want lags 1 to 4", got)
+  }
+}
+
+func TestClosestLag(t *testing.T) {
+  // A line of two colors that alternate, at which every even lag is exact.
+  lab := make([]Lab, 12)
+  for idx := range lab {
+    lab[idx] = ToLab(Color{R: uint32(idx % 2 * 0xffff), A: 0xffff})
+  }
+  if got := closestLag(lab, []lagCandidate{{3, 0}, {4, 0}, {1, 0}}); got != 4 {
+    t.Errorf("alternating line: lag %d, want 4", got)
+  }
+  // Ties by CIEDE2000 go to the smaller lag, whatever the order of the
+  // candidates.
+  if got := closestLag(lab, []lagCandidate{{6, 0}, {4, 0}, {2, 0}}); got != 2 {
+    t.Errorf("tie: lag %d, want 2", got)
+  }
+}
+
+func TestPaletteLines(t *testing.T) {
+  // Index 2 repeats the color of 0, so the first row repeats every two
+  // pixels by its colors although its indices do not.
+  palette := color.Palette{color.RGBA{0xff, 0, 0, 0xff}, color.RGBA{0, 0, 0xff, 0xff}, color.RGBA{0xff, 0, 0, 0xff}, color.RGBA{0, 0xff, 0, 0xff}}
+  img := image.NewPaletted(image.Rect(0, 0, 12, 3), palette)
+  copy(img.Pix, []uint8{
+    0, 1, 2, 1, 0, 1, 2, 1, 2, 1, 0, 1,
+    3, 3, 1, 3, 3, 1, 3, 3, 1, 3, 3, 1,
+    0, 3, 1, 2, 3, 1, 2, 3, 1, 0, 3, 3,
+  })
+  table := newPaletteTable(img)
+  if len(table.colors) != 3 {
+    t.Fatalf("%d colors, want 3", len(table.colors))
+  }
+  // The indices have to come out as comparing the colors themselves does.
+  for y := 0; y < 3; y++ {
+    colors := make([]Color, 12)
+    for x := range colors {
+      colors[x] = colorAt(img, x, y)
+    }
+    want := processLine(colors, LOSSLESS, true)
+    got := processPaletteLine(table.line(img, image.Pt(0, y), image.Pt(1, 0), 12), table, true)
+    if got.Period != want.Period || math.Abs(got.Score - want.Score) > 1e-12 || math.Abs(got.Margin - want.Margin) > 1e-12 {
+      t.Errorf("row %d: %+v, want %+v", y, got, want)
+    }
+  }
+  if newPaletteTable(testPattern(2, 2, true)) != nil {
+    t.Error("built a palette table for an image that is not paletted")
+  }
+}
+
+func TestSampledReconstructionError(t *testing.T) {
+  // Repeats of an 8x8 tile over 256x256 pixels, 64 blocks of sampleBlock,
+  // with noise that grows towards the bottom so that the blocks differ.
+  img := tiledPattern(32)
+  state := uint32(1)
+  for y := 0; y < 256; y++ {
+    for x := 0; x < 256; x++ {
+      state = state * 1664525 + 1013904223
+      if int(state >> 24) < y {
+        img.Pix[img.PixOffset(x, y)] ^= 0x40
+      }
+    }
+  }
+  p := newPixelBuffer(img)
+  full := p.reconstructionError(image.Point{}, 8, 8)
+  if full == 0 {
+    t.Fatal("the noise did not change the image")
+  }
+  // The whole of the image is exact.
+  if got, interval, sampled, blocks := p.sampledReconstructionError(image.Point{}, 8, 8, 1); got != full || interval != 0 || sampled != 64 || blocks != 64 {
+    t.Errorf("all blocks: %g ± %g from %d of %d, want %g ± 0 from 64 of 64", got, interval, sampled, blocks, full)
+  }
+  for _, fraction := range []float64{0.1, 0.25, 0.5} {
+    got, interval, sampled, blocks := p.sampledReconstructionError(image.Point{}, 8, 8, fraction)
+    if want := int(math.Ceil(fraction * 64)); sampled != want || blocks != 64 {
+      t.Errorf("%g: sampled %d of %d blocks, want %d of 64", fraction, sampled, blocks, want)
+    }
+    if interval <= 0 || math.Abs(got - full) > interval {
+      t.Errorf("%g: %g ± %g does not cover the full error %g", fraction, got, interval, full)
+    }
+  }
+  // A clean tiling has no error however little of it is looked at.
+  if got, _, _, _ := newPixelBuffer(tiledPattern(32)).sampledReconstructionError(image.Point{}, 8, 8, 0.1); got != 0 {
+    t.Errorf("clean tiling: %g, want 0", got)
+  }
+}
+
+// equalImages fails unless a and b have the same size and the same colors
+// in the color model of want.
+func equalImages(t *testing.T, name string, got, want image.Image) {
+  t.Helper()
+  if got.Bounds().Size() != want.Bounds().Size() {
+    t.Fatalf("%s: size %v, want %v", name, got.Bounds().Size(), want.Bounds().Size())
+  }
+  model := want.ColorModel()
+  for y := 0; y < want.Bounds().Dy(); y++ {
+    for x := 0; x < want.Bounds().Dx(); x++ {
+      w := want.At(want.Bounds().Min.X + x, want.Bounds().Min.Y + y)
+      g := model.Convert(got.At(got.Bounds().Min.X + x, got.Bounds().Min.Y + y))
+      if g != w {
+        t.Fatalf("%s: pixel (%d, %d) is %v, want %v", name, x, y, g, w)
+      }
+    }
+  }
+}
+
+// testPattern returns a width by height image whose pixels all differ from
+// their neighbors, with alpha unless opaque is set.
+func testPattern(width, height int, opaque bool) *image.NRGBA {
+  img := image.NewNRGBA(image.Rect(0, 0, width, height))
+  for y := 0; y < height; y++ {
+    for x := 0; x < width; x++ {
+      a := uint8(0xff)
+      if !opaque {
+        a = uint8(x * 31 + y * 17)
+      }
+      img.SetNRGBA(x, y, color.NRGBA{uint8(x * 40), uint8(y * 70), uint8(x * y + 3), a})
+    }
+  }
+  return img
+}
+
+func TestBMPRoundTrip(t *testing.T) {
+  // Odd widths leave padding at the end of every row.
+  for _, width := range []int{1, 3, 4, 5, 7} {
+    for _, opaque := range []bool{true, false} {
+      want := testPattern(width, 3, opaque)
+      var buf bytes.Buffer
+      if err := encodeBMP(&buf, want); err != nil {
+        t.Fatal(err)
+      }
+      name := fmt.Sprintf("%dx3, opaque %t", width, opaque)
+      config, err := decodeBMPConfig(bytes.NewReader(buf.Bytes()))
+      if err != nil || config.Width != width || config.Height != 3 {
+        t.Errorf("%s: decodeBMPConfig = %v, %v", name, config, err)
+      }
+      got, err := decodeBMP(bytes.NewReader(buf.Bytes()))
+      if err != nil {
+        t.Fatalf("%s: %v", name, err)
+      }
+      equalImages(t, name, got, want)
+    }
+  }
+}
+
+// bmpFile returns a BMP with an info header, the palette and pixels.
+func bmpFile(width, height, depth int, compression uint32, palette []color.RGBA, pixels []byte) []byte {
+  pixelsAt := 54 + 4 * len(palette)
+  data := make([]byte, pixelsAt, pixelsAt + len(pixels))
+  copy(data, "BM")
+  binary.LittleEndian.PutUint32(data[10:], uint32(pixelsAt))
+  binary.LittleEndian.PutUint32(data[14:], 40)
+  binary.LittleEndian.PutUint32(data[18:], uint32(width))
+  binary.LittleEndian.PutUint32(data[22:], uint32(height))
+  binary.LittleEndian.PutUint16(data[26:], 1)
+  binary.LittleEndian.PutUint16(data[28:], uint16(depth))
+  binary.LittleEndian.PutUint32(data[30:], compression)
+  binary.LittleEndian.PutUint32(data[46:], uint32(len(palette)))
+  for i, c := range palette {
+    copy(data[54 + 4 * i:], []byte{c.B, c.G, c.R, 0})
+  }
+  data = append(data, pixels...)
+  binary.LittleEndian.PutUint32(data[2:], uint32(len(data)))
+  return data
+}
+
+func TestBMPPaletted(t *testing.T) {
+  palette := []color.RGBA{{0, 0, 0, 0xff}, {0xff, 0, 0, 0xff}, {0, 0xff, 0, 0xff}}
+  // Three 4-bit pixels per row, padded to four bytes, with a negative
+  // height for rows stored top down.
+  data := bmpFile(3, -2, 4, 0, palette, []byte{
+    0x01, 0x20, 0, 0,
+    0x21, 0x00, 0, 0,
+  })
+  got, err := decodeBMP(bytes.NewReader(data))
+  if err != nil {
+    t.Fatal(err)
+  }
+  want := image.NewPaletted(image.Rect(0, 0, 3, 2), color.Palette{palette[0], palette[1], palette[2]})
+  copy(want.Pix, []uint8{0, 1, 2, 2, 1, 0})
+  equalImages(t, "4-bit", got, want)
+}
+
+func TestBMPRLE8(t *testing.T) {
+  palette := []color.RGBA{{0, 0, 0, 0xff}, {0xff, 0, 0, 0xff}, {0, 0xff, 0, 0xff}, {0, 0, 0xff, 0xff}}
+  // The bottom row is a run of three 1s and a literal run of 2, 3, 1,
+  // padded to an even length, and the next row starts with a run of two
+  // 3s, then moves right by two pixels and ends the image, leaving index 0.
+  rle := []byte{
+    3, 1, 0, 3, 2, 3, 1, 0, 0, 0,
+    2, 3, 0, 2, 2, 0, 0, 1,
+  }
+  data := bmpFile(6, 2, 8, 1, palette, rle)
+  // golang.org/x/image/bmp, which image.Decode would pick, refuses RLE8.
+  got, format, err := decodeBytes(data)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if format != "bmp" {
+    t.Errorf("format %q, want bmp", format)
+  }
+  want := image.NewPaletted(image.Rect(0, 0, 6, 2), color.Palette{palette[0], palette[1], palette[2], palette[3]})
+  copy(want.Pix, []uint8{
+    3, 3, 0, 0, 0, 0,
+    1, 1, 1, 2, 3, 1,
+  })
+  equalImages(t, "RLE8", got, want)
+}
+
+func FuzzBMP(f *testing.F) {
+  for _, opaque := range []bool{true, false} {
+    var buf bytes.Buffer
+    encodeBMP(&buf, testPattern(5, 3, opaque))
+    f.Add(buf.Bytes())
+  }
+  palette := []color.RGBA{{0, 0, 0, 0xff}, {0xff, 0, 0, 0xff}}
+  f.Add(bmpFile(3, -2, 4, 0, palette, []byte{0x01, 0x10, 0, 0, 0x11, 0x00, 0, 0}))
+  f.Add(bmpFile(6, 2, 8, 1, palette, []byte{3, 1, 0, 3, 1, 0, 1, 0, 0, 0, 2, 1, 0, 2, 2, 0, 0, 1}))
+  f.Fuzz(func(t *testing.T, data []byte) {
+    config, err := decodeBMPConfig(bytes.NewReader(data))
+    if err != nil {
+      return
+    }
+    // Sizes the header claims are allocated up front, which is left to
+    // -max-memory rather than looked at here.
+    if config.Width * config.Height > 1 << 20 {
+      return
+    }
+    img, err := decodeBMP(bytes.NewReader(data))
+    if err == nil && img.Bounds() != image.Rect(0, 0, config.Width, config.Height) {
+      t.Errorf("decoded %v from a %dx%d header", img.Bounds(), config.Width, config.Height)
+    }
+  })
+}
+
+func FuzzBMPRLE8(f *testing.F) {
+  f.Add([]byte{3, 1, 0, 3, 2, 3, 1, 0, 0, 0, 2, 3, 0, 2, 2, 0, 0, 1}, uint8(6), uint8(2))
+  f.Add([]byte{0, 2, 0xff, 0xff, 4, 1}, uint8(3), uint8(3))
+  f.Fuzz(func(t *testing.T, src []byte, width, height uint8) {
+    if width == 0 || height == 0 {
+      return
+    }
+    stride := (int(width) + 3) / 4 * 4
+    if got := bmpRLE8(src, int(width), int(height), stride); len(got) != stride * int(height) {
+      t.Errorf("bmpRLE8 returned %d bytes, want %d", len(got), stride * int(height))
+    }
+  })
+}
+
+func TestTIFFRoundTrip(t *testing.T) {
+  opaque, translucent := testPattern(5, 3, true), testPattern(5, 3, false)
+  deep := image.NewNRGBA64(image.Rect(0, 0, 5, 3))
+  inks := image.NewCMYK(image.Rect(0, 0, 5, 3))
+  for y := 0; y < 3; y++ {
+    for x := 0; x < 5; x++ {
+      deep.SetNRGBA64(x, y, color.NRGBA64{uint16(x * 0x3001), uint16(y * 0x5003), 0x0102, uint16(0xffff - x * y * 0x1001)})
+      inks.SetCMYK(x, y, color.CMYK{uint8(x * 50), uint8(y * 80), 7, uint8(x + y)})
+    }
+  }
+  tests := []struct {
+    name string
+    img image.Image
+    cmyk bool
+  }{
+    {"opaque", opaque, false},
+    {"translucent", translucent, false},
+    {"16-bit", deep, false},
+    {"CMYK", inks, false},
+    {"converted to CMYK", opaque, true},
+  }
+  for _, test := range tests {
+    var buf bytes.Buffer
+    if err := encodeTIFF(&buf, test.img, test.cmyk); err != nil {
+      t.Fatal(err)
+    }
+    got, _, err := decodeBytes(buf.Bytes())
+    if err != nil {
+      t.Fatalf("%s: %v", test.name, err)
+    }
+    want := test.img
+    if test.cmyk {
+      converted := image.NewCMYK(test.img.Bounds())
+      draw.Draw(converted, converted.Rect, test.img, image.Point{}, draw.Src)
+      want = converted
+    }
+    equalImages(t, test.name, got, want)
+  }
+}
+
+// tiffEntry is a tag of a TIFF built by tiffFile, with its values stored as
+// LONGs.
+type tiffEntry struct {
+  tag uint16
+  values []uint32
+}
+
+// tiffTestPage is a page of a TIFF built by tiffFile, stored in blocks
+// that are tiles if tiled is set and strips otherwise.
+type tiffTestPage struct {
+  entries []tiffEntry
+  blocks [][]byte
+  tiled bool
+}
+
+// tiffFile returns a TIFF in the given byte order that holds pages, adding
+// the offsets and byte counts of their blocks to their tags.
+func tiffFile(order binary.AppendByteOrder, pages ...tiffTestPage) []byte {
+  data := []byte("II*\x00\x00\x00\x00\x00")
+  if order == binary.BigEndian {
+    data = []byte("MM\x00*\x00\x00\x00\x00")
+  }
+  put := order.(binary.ByteOrder).PutUint32
+  link := 4
+  for _, page := range pages {
+    var offsets, counts []uint32
+    for _, block := range page.blocks {
+      offsets, counts = append(offsets, uint32(len(data))), append(counts, uint32(len(block)))
+      data = append(data, block...)
+    }
+    offsetsTag, countsTag := uint16(273), uint16(279)
+    if page.tiled {
+      offsetsTag, countsTag = 324, 325
+    }
+    entries := append(append([]tiffEntry{}, page.entries...), tiffEntry{offsetsTag, offsets}, tiffEntry{countsTag, counts})
+    sort.Slice(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+    // Values that do not fit into an entry go before the directory.
+    at := make([]uint32, len(entries))
+    for i, e := range entries {
+      if len(e.values) > 1 {
+        at[i] = uint32(len(data))
+        for _, v := range e.values {
+          data = order.AppendUint32(data, v)
+        }
+      }
+    }
+    put(data[link:], uint32(len(data)))
+    data = order.AppendUint16(data, uint16(len(entries)))
+    for i, e := range entries {
+      data = order.AppendUint16(data, e.tag)
+      data = order.AppendUint16(data, 4)
+      data = order.AppendUint32(data, uint32(len(e.values)))
+      if len(e.values) > 1 {
+        data = order.AppendUint32(data, at[i])
+      } else {
+        data = order.AppendUint32(data, e.values[0])
+      }
+    }
+    link = len(data)
+    data = order.AppendUint32(data, 0)
+  }
+  return data
+}
+
+// grayPage returns a width by height page of 8-bit gray in strips of
+// rowsPerStrip rows, compressed with compression.
+func grayPage(width, height, rowsPerStrip int, compression uint32, strips ...[]byte) tiffTestPage {
+  return tiffTestPage{entries: []tiffEntry{
+    {256, []uint32{uint32(width)}},
+    {257, []uint32{uint32(height)}},
+    {258, []uint32{8}},
+    {259, []uint32{compression}},
+    {262, []uint32{1}},
+    {278, []uint32{uint32(rowsPerStrip)}},
+  }, blocks: strips}
+}
+
+// tiffLZWEncode compresses src with TIFF's LZW, starting with a clear code
+// and emitting another one whenever the table fills up.
+func tiffLZWEncode(src []byte) []byte {
+  const clear, end = 256, 257
+  var out []byte
+  var bits uint32
+  var count int
+  width := 9
+  // hi follows the codes the decoder has seen since the last clear code,
+  // which it widens its codes one early by.
+  hi := end
+  emit := func(code int) {
+    bits = bits << width | uint32(code)
+    count += width
+    for count >= 8 {
+      out = append(out, byte(bits >> (count - 8)))
+      count -= 8
+    }
+    if code == clear {
+      width, hi = 9, end
+      return
+    }
+    hi++
+    if hi + 1 >= 1 << width && width < 12 {
+      width++
+    }
+  }
+  table := make(map[string]int)
+  next := end + 1
+  emit(clear)
+  var prefix []byte
+  for _, c := range src {
+    run := append(prefix, c)
+    if len(prefix) == 0 {
+      prefix = run
+      continue
+    }
+    if _, ok := table[string(run)]; ok {
+      prefix = run
+      continue
+    }
+    code := int(prefix[0])
+    if len(prefix) > 1 {
+      code = table[string(prefix)]
+    }
+    emit(code)
+    table[string(run)] = next
+    next++
+    if next == 4094 {
+      emit(clear)
+      table, next = make(map[string]int), end + 1
+    }
+    prefix = []byte{c}
+  }
+  if len(prefix) > 0 {
+    code := int(prefix[0])
+    if len(prefix) > 1 {
+      code = table[string(prefix)]
+    }
+    emit(code)
+  }
+  emit(end)
+  if count > 0 {
+    out = append(out, byte(bits << (8 - count)))
+  }
+  return out
+}
+
+// lzwSample returns n bytes with runs and repeats, enough of them to fill
+// the LZW table several times over.
+func lzwSample(n int) []byte {
+  src := make([]byte, n)
+  state := uint32(1)
+  for i := range src {
+    state = state * 1664525 + 1013904223
+    switch {
+    case i % 700 < 200:
+      src[i] = byte(i / 50)
+    case i % 700 < 400 && i >= 300:
+      src[i] = src[i - 300]
+    default:
+      src[i] = byte(state >> 24)
+    }
+  }
+  return src
+}
+
+func TestTIFFCompression(t *testing.T) {
+  width, height := 40, 30
+  pixels := lzwSample(width * height)
+  want := image.NewGray(image.Rect(0, 0, width, height))
+  copy(want.Pix, pixels)
+  var deflated bytes.Buffer
+  z := zlib.NewWriter(&deflated)
+  z.Write(pixels[:width * 16])
+  z.Close()
+  // The example of Apple's PackBits documentation, followed by literal
+  // runs of 128 bytes and runs of 128 repeats, which take the extremes of
+  // the count byte.
+  packBits := []byte{0xfe, 0xaa, 0x02, 0x80, 0x00, 0x2a, 0xfd, 0xaa, 0x03, 0x80, 0x00, 0x2a, 0x22, 0xf7, 0xaa}
+  unpacked := []byte{0xaa, 0xaa, 0xaa, 0x80, 0x00, 0x2a, 0xaa, 0xaa, 0xaa, 0xaa, 0x80, 0x00, 0x2a, 0x22, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa}
+  for len(unpacked) < width * height {
+    rest := pixels[len(unpacked):]
+    if len(rest) > 128 {
+      rest = rest[:128]
+    }
+    packBits = append(append(packBits, byte(len(rest) - 1)), rest...)
+    unpacked = append(unpacked, rest...)
+    if len(unpacked) + 128 <= width * height {
+      packBits = append(packBits, 0x81, 0x55, 0x80)
+      unpacked = append(unpacked, bytes.Repeat([]byte{0x55}, 128)...)
+    }
+  }
+  packed := image.NewGray(want.Rect)
+  copy(packed.Pix, unpacked)
+
+  tests := []struct {
+    name string
+    compression uint32
+    rowsPerStrip int
+    strips [][]byte
+    want *image.Gray
+  }{
+    {"uncompressed", 1, 16, [][]byte{pixels[:width * 16], pixels[width * 16:]}, want},
+    {"LZW", 5, 16, [][]byte{tiffLZWEncode(pixels[:width * 16]), tiffLZWEncode(pixels[width * 16:])}, want},
+    {"Deflate", 8, 16, [][]byte{deflated.Bytes(), pixels[width * 16:]}, nil},
+    {"PackBits", 32773, height, [][]byte{packBits}, packed},
+  }
+  for _, test := range tests {
+    data := tiffFile(binary.BigEndian, grayPage(width, height, test.rowsPerStrip, test.compression, test.strips...))
+    got, _, err := decodeBytes(data)
+    if test.want == nil {
+      // The second strip of the Deflate file is not compressed.
+      if err == nil {
+        t.Errorf("%s: decoded a strip that does not inflate", test.name)
+      }
+      continue
+    }
+    if err != nil {
+      t.Fatalf("%s: %v", test.name, err)
+    }
+    equalImages(t, test.name, got, test.want)
+  }
+}
+
+func TestTIFFPagesAndTiles(t *testing.T) {
+  // A bilevel page where white is zero, and an RGB page in tiles of 16 by
+  // 16 pixels, which reach past the right and bottom edges of the image.
+  bilevel := []tiffEntry{
+    {256, []uint32{10}},
+    {257, []uint32{2}},
+    {262, []uint32{0}},
+  }
+  tiled := []tiffEntry{
+    {256, []uint32{18}},
+    {257, []uint32{2}},
+    {258, []uint32{8, 8, 8}},
+    {262, []uint32{2}},
+    {277, []uint32{3}},
+    {322, []uint32{16}},
+    {323, []uint32{16}},
+  }
+  rgb := image.NewNRGBA(image.Rect(0, 0, 18, 2))
+  tiles := [][]byte{make([]byte, 16 * 16 * 3), make([]byte, 16 * 16 * 3)}
+  for y := 0; y < 2; y++ {
+    for x := 0; x < 18; x++ {
+      c := color.NRGBA{uint8(x), uint8(10 * y), uint8(x * y + 100), 0xff}
+      rgb.SetNRGBA(x, y, c)
+      copy(tiles[x / 16][3 * (16 * y + x % 16):], []byte{c.R, c.G, c.B})
+    }
+  }
+  data := tiffFile(binary.LittleEndian,
+    tiffTestPage{entries: bilevel, blocks: [][]byte{{0xa5, 0x40, 0x00, 0x80}}},
+    tiffTestPage{entries: tiled, blocks: tiles, tiled: true})
+  pages, err := tiffPages(data)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(pages) != 2 {
+    t.Fatalf("got %d pages, want 2", len(pages))
+  }
+  gray := image.NewGray(image.Rect(0, 0, 10, 2))
+  for x, bit := range []int{1, 0, 1, 0, 0, 1, 0, 1, 0, 1} {
+    gray.Pix[x] = uint8(0xff * (1 - bit))
+  }
+  for x, bit := range []int{0, 0, 0, 0, 0, 0, 0, 0, 1, 0} {
+    gray.Pix[10 + x] = uint8(0xff * (1 - bit))
+  }
+  equalImages(t, "bilevel", pages[0], gray)
+  equalImages(t, "tiled", pages[1], rgb)
+  if _, err := tiffPage(data, 3); err == nil {
+    t.Error("tiffPage found a third page")
+  }
+}
+
+func TestTIFFOversizedBlocks(t *testing.T) {
+  // A few bytes that claim tiles of 65535 16-bit samples per pixel and of
+  // more than MaxDimension pixels across must fail rather than allocate
+  // what the tags claim.
+  for _, tileWidth := range []uint32{65536, 0xffffffff} {
+    for _, compression := range []uint32{1, 5, 32773} {
+      data := tiffFile(binary.LittleEndian, tiffTestPage{entries: []tiffEntry{
+        {256, []uint32{4}},
+        {257, []uint32{4}},
+        {258, []uint32{16}},
+        {259, []uint32{compression}},
+        {262, []uint32{1}},
+        {277, []uint32{65535}},
+        {322, []uint32{tileWidth}},
+        {323, []uint32{4}},
+      }, blocks: [][]byte{{0x80, 0x00}}, tiled: true})
+      if _, _, err := decodeBytes(data); err == nil {
+        t.Errorf("decoded tiles %d pixels across with compression %d", tileWidth, compression)
+      }
+    }
+  }
+}
+
+func FuzzTIFF(f *testing.F) {
+  for _, img := range []image.Image{testPattern(5, 3, true), testPattern(5, 3, false), image.NewNRGBA64(image.Rect(0, 0, 2, 2)), image.NewCMYK(image.Rect(0, 0, 2, 2))} {
+    var buf bytes.Buffer
+    encodeTIFF(&buf, img, false)
+    f.Add(buf.Bytes())
+  }
+  pixels := lzwSample(64)
+  f.Add(tiffFile(binary.BigEndian, grayPage(8, 8, 4, 5, tiffLZWEncode(pixels[:32]), tiffLZWEncode(pixels[32:]))))
+  f.Add(tiffFile(binary.LittleEndian, grayPage(8, 8, 8, 32773, []byte{0xfe, 0xaa, 0x02, 0x80, 0x00, 0x2a, 0x81, 0x55})))
+  f.Fuzz(func(t *testing.T, data []byte) {
+    order, ifds, err := readTIFF(data)
+    if err != nil {
+      return
+    }
+    for _, ifd := range ifds {
+      // Sizes the tags claim are allocated up front, which is left to
+      // -max-memory rather than looked at here.
+      if int64(ifd.get(256, 0)) * int64(ifd.get(257, 0)) > 1 << 20 {
+        continue
+      }
+      decodeTIFFPage(data, order, ifd)
+    }
+  })
+}
+
+// psdFile returns a PSD of the given color mode and depth whose composite
+// image holds pixels, the channels one after the other. With rle, every row
+// is stored as PackBits literals.
+func psdFile(mode, depth, channels, width, height int, palette []byte, rle bool, pixels []byte) []byte {
+  be := binary.BigEndian
+  data := []byte("8BPS\x00\x01\x00\x00\x00\x00\x00\x00")
+  data = be.AppendUint16(data, uint16(channels))
+  data = be.AppendUint32(be.AppendUint32(data, uint32(height)), uint32(width))
+  data = be.AppendUint16(be.AppendUint16(data, uint16(depth)), uint16(mode))
+  data = append(be.AppendUint32(data, uint32(len(palette))), palette...)
+  // No image resources and no layers.
+  data = append(data, make([]byte, 8)...)
+  if !rle {
+    return append(be.AppendUint16(data, 0), pixels...)
+  }
+  data = be.AppendUint16(data, 1)
+  rowBytes := (width * depth + 7) / 8
+  var rows []byte
+  for at := 0; at < len(pixels); at += rowBytes {
+    data = be.AppendUint16(data, uint16(rowBytes + 1))
+    rows = append(append(rows, byte(rowBytes - 1)), pixels[at:at + rowBytes]...)
+  }
+  return append(data, rows...)
+}
+
+func TestPSD(t *testing.T) {
+  rgb := image.NewRGBA(image.Rect(0, 0, 3, 2))
+  var planes [3][]byte
+  for i := 0; i < 6; i++ {
+    c := color.RGBA{uint8(10 * i), uint8(100 + i), uint8(255 - i), 0xff}
+    rgb.SetRGBA(i % 3, i / 3, c)
+    planes[0], planes[1], planes[2] = append(planes[0], c.R), append(planes[1], c.G), append(planes[2], c.B)
+  }
+  rgbPixels := bytes.Join(planes[:], nil)
+  palette := make([]byte, 768)
+  palette[5], palette[256 + 5], palette[512 + 5] = 1, 2, 3
+  indexed := image.NewPaletted(image.Rect(0, 0, 2, 1), make(color.Palette, 256))
+  for i := range indexed.Palette {
+    indexed.Palette[i] = color.RGBA{palette[i], palette[256 + i], palette[512 + i], 0xff}
+  }
+  indexed.Pix[1] = 5
+  gray16 := image.NewGray16(image.Rect(0, 0, 2, 1))
+  gray16.SetGray16(1, 0, color.Gray16{0x1234})
+  bitmap := image.NewGray(image.Rect(0, 0, 9, 1))
+  for x := 0; x < 9; x++ {
+    bitmap.Pix[x] = uint8(0xff * (x % 2))
+  }
+  cmyk := image.NewCMYK(image.Rect(0, 0, 1, 1))
+  cmyk.Pix = []byte{0xff, 0x80, 0, 1}
+
+  tests := []struct {
+    name string
+    data []byte
+    want image.Image
+  }{
+    // A fourth channel, transparency, is left out.
+    {"rgb", psdFile(3, 8, 4, 3, 2, nil, false, append(rgbPixels, make([]byte, 6)...)), rgb},
+    {"rgb rle", psdFile(3, 8, 3, 3, 2, nil, true, rgbPixels), rgb},
+    {"indexed", psdFile(2, 8, 1, 2, 1, palette, false, []byte{0, 5}), indexed},
+    {"gray16", psdFile(1, 16, 1, 2, 1, nil, true, []byte{0, 0, 0x12, 0x34}), gray16},
+    {"bitmap", psdFile(0, 1, 1, 9, 1, nil, false, []byte{0xaa, 0x80}), bitmap},
+    {"cmyk", psdFile(4, 8, 4, 1, 1, nil, false, []byte{0, 0x7f, 0xff, 0xfe}), cmyk},
+  }
+  for _, test := range tests {
+    img, format, err := decodeBytes(test.data)
+    if err != nil {
+      t.Fatalf("%s: %v", test.name, err)
+    }
+    if format != "psd" {
+      t.Errorf("%s: decoded as %s", test.name, format)
+    }
+    equalImages(t, test.name, img, test.want)
+  }
+
+  for _, test := range []struct {
+    name string
+    data []byte
+  }{
+    {"truncated pixels", psdFile(3, 8, 3, 3, 2, nil, false, rgbPixels[:17])},
+    {"truncated rows", psdFile(3, 8, 3, 3, 2, nil, true, rgbPixels)[:60]},
+    {"too few channels", psdFile(3, 8, 2, 3, 2, nil, false, rgbPixels)},
+    {"32 bits", psdFile(3, 32, 3, 1, 1, nil, false, make([]byte, 12))},
+    {"missing palette", psdFile(2, 8, 1, 2, 1, nil, false, []byte{0, 5})},
+  } {
+    if _, err := decodePSD(bytes.NewReader(test.data)); err == nil {
+      t.Errorf("%s: decoded", test.name)
+    }
+  }
+}
+
+func FuzzPSD(f *testing.F) {
+  f.Add(psdFile(3, 8, 3, 2, 2, nil, false, make([]byte, 12)))
+  f.Add(psdFile(3, 16, 4, 2, 2, nil, true, make([]byte, 32)))
+  f.Add(psdFile(2, 8, 1, 2, 1, make([]byte, 768), true, []byte{0, 5}))
+  f.Add(psdFile(4, 8, 4, 1, 1, nil, false, []byte{0, 0x7f, 0xff, 0xfe}))
+  f.Fuzz(func(t *testing.T, data []byte) {
+    h, err := readPSDHeader(data)
+    if err != nil || int64(h.width) * int64(h.height) > 1 << 20 {
+      return
+    }
+    img, err := decodePSD(bytes.NewReader(data))
+    if err == nil && img.Bounds() != image.Rect(0, 0, h.width, h.height) {
+      t.Fatalf("decoded %v of a %dx%d PSD", img.Bounds(), h.width, h.height)
+    }
+  })
+}
+
+// aseChunk returns an Aseprite chunk of kind.
+func aseChunk(kind uint16, data ...[]byte) []byte {
+  body := bytes.Join(data, nil)
+  chunk := binary.LittleEndian.AppendUint32(nil, uint32(6 + len(body)))
+  return append(binary.LittleEndian.AppendUint16(chunk, kind), body...)
+}
+
+// aseLayerChunk returns the chunk of a normal layer at the top level.
+func aseLayerChunk(name string, flags uint16, opacity uint8) []byte {
+  le := binary.LittleEndian
+  layer := le.AppendUint16(nil, flags)
+  layer = append(layer, make([]byte, 10)...)
+  layer = append(layer, opacity, 0, 0, 0)
+  return aseChunk(0x2004, le.AppendUint16(layer, uint16(len(name))), []byte(name))
+}
+
+// aseCelChunk returns the chunk of a cel of layer at x, y, compressed with
+// zlib if compressed is set.
+func aseCelChunk(layer, x, y, width, height int, compressed bool, pix []byte) []byte {
+  le := binary.LittleEndian
+  cel := le.AppendUint16(le.AppendUint16(le.AppendUint16(nil, uint16(layer)), uint16(x)), uint16(y))
+  celType := uint16(0)
+  if compressed {
+    var buf bytes.Buffer
+    zw := zlib.NewWriter(&buf)
+    zw.Write(pix)
+    zw.Close()
+    celType, pix = 2, buf.Bytes()
+  }
+  cel = le.AppendUint16(append(cel, 0xff), celType)
+  cel = append(cel, make([]byte, 7)...)
+  cel = le.AppendUint16(le.AppendUint16(cel, uint16(width)), uint16(height))
+  return aseChunk(0x2005, cel, pix)
+}
+
+// asepriteFile returns an Aseprite sprite of width by height pixels and
+// depth bits, with a frame of the chunks given for each.
+func asepriteFile(width, height, depth int, frames ...[][]byte) []byte {
+  le := binary.LittleEndian
+  header := make([]byte, 128)
+  le.PutUint16(header[4:], 0xa5e0)
+  le.PutUint16(header[6:], uint16(len(frames)))
+  le.PutUint16(header[8:], uint16(width))
+  le.PutUint16(header[10:], uint16(height))
+  le.PutUint16(header[12:], uint16(depth))
+  // The opacities of the layers are set.
+  le.PutUint32(header[14:], 1)
+  data := header
+  for _, chunks := range frames {
+    body := bytes.Join(chunks, nil)
+    frame := make([]byte, 16)
+    le.PutUint32(frame, uint32(16 + len(body)))
+    le.PutUint16(frame[4:], 0xf1fa)
+    le.PutUint32(frame[12:], uint32(len(chunks)))
+    data = append(append(data, frame...), body...)
+  }
+  le.PutUint32(data, uint32(len(data)))
+  return data
+}
+
+func TestAseprite(t *testing.T) {
+  red, blue := []byte{0xff, 0, 0, 0xff}, []byte{0, 0, 0xff, 0xff}
+  // A blue cel of 2x1 over a red layer, then a hidden green one.
+  data := asepriteFile(3, 2, 32,
+    [][]byte{
+      aseLayerChunk("Back", aseVisible, 0xff),
+      aseLayerChunk("Front", aseVisible, 0xff),
+      aseLayerChunk("Hidden", 0, 0xff),
+      aseCelChunk(0, 0, 0, 3, 2, true, bytes.Repeat(red, 6)),
+      aseCelChunk(1, 1, 1, 2, 1, false, bytes.Repeat(blue, 2)),
+      aseCelChunk(2, 0, 0, 1, 1, false, []byte{0, 0xff, 0, 0xff}),
+    },
+    // The second frame moves the blue cel off the sprite by a pixel.
+    [][]byte{
+      aseCelChunk(1, 2, 0, 2, 1, true, bytes.Repeat(blue, 2)),
+    })
+  want := image.NewRGBA(image.Rect(0, 0, 3, 2))
+  for i := 0; i < 6; i++ {
+    want.SetRGBA(i % 3, i / 3, color.RGBA{0xff, 0, 0, 0xff})
+  }
+  want.SetRGBA(1, 1, color.RGBA{0, 0, 0xff, 0xff})
+  want.SetRGBA(2, 1, color.RGBA{0, 0, 0xff, 0xff})
+  img, format, err := decodeBytes(data)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if format != "aseprite" {
+    t.Errorf("decoded as %s", format)
+  }
+  equalImages(t, "first frame", img, want)
+
+  frames, err := asepriteFrames(data, "")
+  if err != nil {
+    t.Fatal(err)
+  }
+  second := image.NewRGBA(image.Rect(0, 0, 3, 2))
+  second.SetRGBA(2, 0, color.RGBA{0, 0, 0xff, 0xff})
+  equalImages(t, "second frame", frames[1], second)
+
+  // A hidden layer is drawn when it is picked.
+  hidden, err := asepriteFrame(data, 1, "Hidden")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if c := hidden.At(0, 0); c != (color.RGBA{0, 0xff, 0, 0xff}) || hidden.At(1, 0) != (color.RGBA{}) {
+    t.Errorf("layer Hidden shows %v and %v", c, hidden.At(1, 0))
+  }
+
+  // Indexed sprites stay paletted.
+  palette := aseChunk(0x2019, []byte{2, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0}, make([]byte, 8), []byte{0, 0, 0, 0, 0, 0xff, 0, 0, 9, 8, 7, 0xff})
+  indexed := asepriteFile(2, 1, 8, [][]byte{palette, aseLayerChunk("Layer", aseVisible, 0xff), aseCelChunk(0, 0, 0, 2, 1, true, []byte{0, 1})})
+  img, _, err = decodeBytes(indexed)
+  if err != nil {
+    t.Fatal(err)
+  }
+  paletted, ok := img.(*image.Paletted)
+  if !ok || !bytes.Equal(paletted.Pix, []byte{0, 1}) || paletted.Palette[1] != (color.NRGBA{9, 8, 7, 0xff}) {
+    t.Errorf("indexed sprite decoded as %T %v", img, img)
+  }
+
+  for _, test := range []struct {
+    name string
+    data []byte
+  }{
+    {"cel larger than the sprite", asepriteFile(3, 2, 32, [][]byte{aseLayerChunk("Layer", aseVisible, 0xff), aseCelChunk(0, 0, 0, 4, 1, true, make([]byte, 16))})},
+    {"truncated cel", asepriteFile(3, 2, 32, [][]byte{aseLayerChunk("Layer", aseVisible, 0xff), aseCelChunk(0, 0, 0, 2, 1, true, make([]byte, 4))})},
+    {"missing palette", asepriteFile(2, 1, 8, [][]byte{aseLayerChunk("Layer", aseVisible, 0xff), aseCelChunk(0, 0, 0, 2, 1, false, []byte{0, 1})})},
+    {"truncated frame", data[:len(data) - 1]},
+  } {
+    if _, err := asepriteFrame(test.data, 1, ""); err == nil {
+      t.Errorf("%s: decoded", test.name)
+    }
+  }
+}
+
+func FuzzAseprite(f *testing.F) {
+  layer := aseLayerChunk("Layer", aseVisible, 0x80)
+  f.Add(asepriteFile(2, 2, 32, [][]byte{layer, aseCelChunk(0, 0, 0, 2, 2, true, make([]byte, 16))}))
+  f.Add(asepriteFile(2, 2, 16, [][]byte{layer, aseCelChunk(0, 1, 1, 1, 1, false, []byte{0x80, 0xff})}, [][]byte{aseCelChunk(0, 0, 0, 1, 1, false, []byte{0, 0xff})}))
+  f.Add(asepriteFile(2, 1, 8, [][]byte{aseChunk(0x2019, []byte{2, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0}, make([]byte, 20)), layer, aseCelChunk(0, 0, 0, 2, 1, true, []byte{0, 1})}))
+  f.Fuzz(func(t *testing.T, data []byte) {
+    // Every frame takes the size of the sprite, which is left to
+    // -max-memory rather than looked at here.
+    sprite, err := readAseprite(data)
+    if err != nil || len(sprite.frames) * sprite.width * sprite.height > 1 << 20 {
+      return
+    }
+    frames, err := asepriteFrames(data, "")
+    for _, frame := range frames {
+      if err == nil && frame.Bounds() != image.Rect(0, 0, sprite.width, sprite.height) {
+        t.Fatalf("decoded %v of a %dx%d sprite", frame.Bounds(), sprite.width, sprite.height)
+      }
+    }
+  })
+}
+
+// decodeBC1 decodes a BC1 block to the RGBA of its 16 pixels, with the
+// palette of the mode its two colors select.
+func decodeBC1(b [8]byte) [16][4]int {
+  c0, c1 := binary.LittleEndian.Uint16(b[0:]), binary.LittleEndian.Uint16(b[2:])
+  e0, e1 := expand565(c0), expand565(c1)
+  palette := [4][4]int{{e0[0], e0[1], e0[2], 255}, {e1[0], e1[1], e1[2], 255}}
+  for c := 0; c < 3; c++ {
+    if c0 > c1 {
+      palette[2][c], palette[3][c] = (2 * e0[c] + e1[c]) / 3, (e0[c] + 2 * e1[c]) / 3
+    } else {
+      palette[2][c] = (e0[c] + e1[c]) / 2
+    }
+  }
+  palette[2][3] = 255
+  if c0 > c1 {
+    palette[3][3] = 255
+  }
+  var out [16][4]int
+  indices := binary.LittleEndian.Uint32(b[4:])
+  for i := range out {
+    out[i] = palette[indices >> (2 * i) & 3]
+  }
+  return out
+}
+
+func TestBC1(t *testing.T) {
+  // Colors that 16 bits hold exactly come back exactly.
+  var exact textureBlock
+  for i := range exact {
+    exact[i] = [4]uint8{255, 0, 0, 255}
+    if i % 3 == 0 {
+      exact[i] = [4]uint8{0, 0, 255, 255}
+    }
+  }
+  for i, got := range decodeBC1(bc1Block(&exact, false)) {
+    if want := [4]int{int(exact[i][0]), int(exact[i][1]), int(exact[i][2]), 255}; got != want {
+      t.Fatalf("pixel %d of two colors is %v, want %v", i, got, want)
+    }
+  }
+
+  // The mixes cover the colors of a gradient closely and the scattered
+  // ones of testPattern at least roughly.
+  gradient := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+  for y := 0; y < 16; y++ {
+    for x := 0; x < 16; x++ {
+      gradient.SetNRGBA(x, y, color.NRGBA{uint8(x * 16), uint8(255 - x * 12), uint8(y * 8), 255})
+    }
+  }
+  for _, test := range []struct {
+    name string
+    img *image.NRGBA
+    maxRMS float64
+  }{
+    {"gradient", gradient, 6},
+    {"pattern", testPattern(16, 16, true), 40},
+  } {
+    sum, n := 0.0, 0
+    for _, block := range textureBlocks(test.img) {
+      for i, got := range decodeBC1(bc1Block(&block, false)) {
+        if got[3] != 255 {
+          t.Fatalf("%s: opaque pixel %d decodes with alpha %d", test.name, i, got[3])
+        }
+        for c := 0; c < 3; c++ {
+          d := float64(got[c] - int(block[i][c]))
+          sum += d * d
+          n++
+        }
+      }
+    }
+    if rms := math.Sqrt(sum / float64(n)); rms > test.maxRMS {
+      t.Errorf("%s: root mean square error %.2f, want at most %v", test.name, rms, test.maxRMS)
+    }
+  }
+
+  // With punch-through, pixels below half alpha become transparent and the
+  // others stay opaque.
+  for _, block := range textureBlocks(testPattern(8, 8, false)) {
+    for i, got := range decodeBC1(bc1Block(&block, true)) {
+      if want := map[bool]int{true: 0, false: 255}[block[i][3] < 0x80]; got[3] != want {
+        t.Fatalf("pixel %d of alpha %d decodes with alpha %d, want %d", i, block[i][3], got[3], want)
+      }
+    }
+  }
+}
+
+func TestDDSHeader(t *testing.T) {
+  opaque, cutout, translucent := testPattern(6, 5, true), testPattern(6, 5, true), testPattern(6, 5, false)
+  cutout.Pix[3] = 0
+  // A 6x5 tile takes 2x2 blocks.
+  tests := []struct {
+    name string
+    img image.Image
+    compression string
+    fourCC string
+    size int
+  }{
+    {"none", opaque, "none", "", 6 * 5 * 4},
+    {"bc opaque", opaque, "bc", "DXT1", 4 * 8},
+    {"bc cutout", cutout, "bc", "DXT1", 4 * 8},
+    {"bc translucent", translucent, "bc", "DXT5", 4 * 16},
+  }
+  le := binary.LittleEndian
+  for _, test := range tests {
+    var buf bytes.Buffer
+    if err := encodeDDS(&buf, test.img, test.compression); err != nil {
+      t.Fatalf("%s: %v", test.name, err)
+    }
+    dds := buf.Bytes()
+    if len(dds) != 128 + test.size {
+      t.Fatalf("%s: %d bytes, want %d", test.name, len(dds), 128 + test.size)
+    }
+    if string(dds[:4]) != "DDS " || le.Uint32(dds[4:]) != 124 || le.Uint32(dds[76:]) != 32 {
+      t.Errorf("%s: no DDS header: %q", test.name, dds[:8])
+    }
+    if height, width := le.Uint32(dds[12:]), le.Uint32(dds[16:]); width != 6 || height != 5 {
+      t.Errorf("%s: size %dx%d, want 6x5", test.name, width, height)
+    }
+    if caps := le.Uint32(dds[108:]); caps != 0x1000 {
+      t.Errorf("%s: caps %#x, want a texture", test.name, caps)
+    }
+    flags := le.Uint32(dds[8:])
+    if test.fourCC == "" {
+      if flags & 0x8 == 0 || le.Uint32(dds[20:]) != 6 * 4 {
+        t.Errorf("%s: flags %#x and pitch %d, want a pitch of 24", test.name, flags, le.Uint32(dds[20:]))
+      }
+      if le.Uint32(dds[80:]) != 0x41 || le.Uint32(dds[88:]) != 32 || le.Uint32(dds[92:]) != 0xff || le.Uint32(dds[104:]) != 0xff000000 {
+        t.Errorf("%s: pixel format %x, want 32-bit RGBA", test.name, dds[80:108])
+      }
+      if !bytes.Equal(dds[128:132], opaque.Pix[:4]) {
+        t.Errorf("%s: first pixel %v, want %v", test.name, dds[128:132], opaque.Pix[:4])
+      }
+      continue
+    }
+    if flags & 0x80000 == 0 || le.Uint32(dds[20:]) != uint32(test.size) {
+      t.Errorf("%s: flags %#x and linear size %d, want %d", test.name, flags, le.Uint32(dds[20:]), test.size)
+    }
+    if le.Uint32(dds[80:]) != 0x4 || string(dds[84:88]) != test.fourCC {
+      t.Errorf("%s: pixel format %#x %q, want %q", test.name, le.Uint32(dds[80:]), dds[84:88], test.fourCC)
+    }
+  }
+  if err := encodeDDS(io.Discard, opaque, "etc"); err == nil {
+    t.Error("DDS with ETC succeeded")
+  }
+}
+
+func TestKTX2Header(t *testing.T) {
+  opaque, translucent := testPattern(6, 5, true), testPattern(6, 5, false)
+  tests := []struct {
+    name string
+    img image.Image
+    compression string
+    vkFormat, blockBytes, size int
+  }{
+    {"none", opaque, "none", 43, 4, 6 * 5 * 4},
+    {"bc opaque", opaque, "bc", 134, 8, 4 * 8},
+    {"bc translucent", translucent, "bc", 138, 16, 4 * 16},
+    {"etc opaque", opaque, "etc", 148, 8, 4 * 8},
+    {"etc translucent", translucent, "etc", 152, 16, 4 * 16},
+  }
+  le := binary.LittleEndian
+  for _, test := range tests {
+    var buf bytes.Buffer
+    if err := encodeKTX2(&buf, test.img, test.compression); err != nil {
+      t.Fatalf("%s: %v", test.name, err)
+    }
+    ktx := buf.Bytes()
+    if string(ktx[:12]) != "\xabKTX 20\xbb\r\n\x1a\n" {
+      t.Fatalf("%s: identifier %q", test.name, ktx[:12])
+    }
+    if vk := le.Uint32(ktx[12:]); vk != uint32(test.vkFormat) {
+      t.Errorf("%s: Vulkan format %d, want %d", test.name, vk, test.vkFormat)
+    }
+    if width, height := le.Uint32(ktx[20:]), le.Uint32(ktx[24:]); width != 6 || height != 5 {
+      t.Errorf("%s: size %dx%d, want 6x5", test.name, width, height)
+    }
+    if faces, levels := le.Uint32(ktx[36:]), le.Uint32(ktx[40:]); faces != 1 || levels != 1 {
+      t.Errorf("%s: %d faces and %d levels, want 1 and 1", test.name, faces, levels)
+    }
+    dfdOffset, dfdLength := le.Uint32(ktx[48:]), le.Uint32(ktx[52:])
+    if dfdOffset != 104 || le.Uint32(ktx[104:]) != dfdLength {
+      t.Fatalf("%s: descriptor at %d of %d bytes, which starts with %d", test.name, dfdOffset, dfdLength, le.Uint32(ktx[104:]))
+    }
+    if samples := (int(dfdLength) - 28) / 16; int(dfdLength) != 28 + 16 * samples || samples < 1 {
+      t.Errorf("%s: descriptor of %d bytes does not hold whole samples", test.name, dfdLength)
+    }
+    if blockBytes := int(ktx[104 + 20]); blockBytes != test.blockBytes {
+      t.Errorf("%s: blocks of %d bytes, want %d", test.name, blockBytes, test.blockBytes)
+    }
+    offset, length, uncompressed := le.Uint64(ktx[80:]), le.Uint64(ktx[88:]), le.Uint64(ktx[96:])
+    if offset % uint64(test.blockBytes) != 0 || offset < uint64(104 + dfdLength) {
+      t.Errorf("%s: level at %d, want a whole block after the descriptor", test.name, offset)
+    }
+    if length != uint64(test.size) || uncompressed != length || offset + length != uint64(len(ktx)) {
+      t.Errorf("%s: level of %d (%d) bytes at %d in %d, want %d", test.name, length, uncompressed, offset, len(ktx), test.size)
+    }
+  }
+}
+
+// pngChunks splits a PNG into its chunks, checking their CRCs.
+func pngChunks(t *testing.T, data []byte) (kinds []string, chunks [][]byte) {
+  t.Helper()
+  if !bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+    t.Fatal("no PNG signature")
+  }
+  for at := 8; at < len(data); {
+    length := int(binary.BigEndian.Uint32(data[at:]))
+    body := data[at + 4:at + 8 + length]
+    if sum := binary.BigEndian.Uint32(data[at + 8 + length:]); sum != crc32.ChecksumIEEE(body) {
+      t.Fatalf("chunk %q has the CRC %#x, want %#x", body[:4], sum, crc32.ChecksumIEEE(body))
+    }
+    kinds, chunks = append(kinds, string(body[:4])), append(chunks, body[4:])
+    at += 12 + length
+  }
+  return kinds, chunks
+}
+
+func TestAPNG(t *testing.T) {
+  frames := []image.Image{testPattern(5, 3, false), testPattern(5, 3, true), image.NewNRGBA(image.Rect(0, 0, 5, 3))}
+  for _, test := range []struct {
+    loopCount int
+    plays uint32
+  }{{0, 0}, {-1, 1}, {2, 3}} {
+    var buf bytes.Buffer
+    if err := encodeAPNG(&buf, frames, []int{10, 20}, test.loopCount); err != nil {
+      t.Fatal(err)
+    }
+    // Plain PNG decoders show the first frame.
+    first, err := png.Decode(bytes.NewReader(buf.Bytes()))
+    if err != nil {
+      t.Fatal(err)
+    }
+    equalImages(t, "default image", first, frames[0])
+
+    kinds, chunks := pngChunks(t, buf.Bytes())
+    if got := strings.Join(kinds, " "); got != "IHDR acTL fcTL IDAT fcTL fdAT fcTL fdAT IEND" {
+      t.Fatalf("chunks %s", got)
+    }
+    if n, plays := binary.BigEndian.Uint32(chunks[1]), binary.BigEndian.Uint32(chunks[1][4:]); n != 3 || plays != test.plays {
+      t.Errorf("loop count %d: %d frames played %d times, want 3 and %d", test.loopCount, n, plays, test.plays)
+    }
+    // Frame controls and data share one sequence, and the frames without a
+    // delay show for none.
+    sequence, frame := uint32(0), 0
+    for idx, kind := range kinds {
+      switch kind {
+      case "fcTL":
+        fctl := chunks[idx]
+        if got := binary.BigEndian.Uint32(fctl); got != sequence {
+          t.Errorf("frame control %d has the sequence number %d", sequence, got)
+        }
+        delay := binary.BigEndian.Uint16(fctl[20:])
+        if want := []uint16{10, 20, 0}[frame]; delay != want || binary.BigEndian.Uint16(fctl[22:]) != 100 {
+          t.Errorf("frame %d shows for %d/%d s, want %d/100", frame + 1, delay, binary.BigEndian.Uint16(fctl[22:]), want)
+        }
+        sequence++
+        frame++
+      case "fdAT":
+        if got := binary.BigEndian.Uint32(chunks[idx]); got != sequence {
+          t.Errorf("frame data %d has the sequence number %d", sequence, got)
+        }
+        sequence++
+        // The rows are not filtered.
+        zr, err := zlib.NewReader(bytes.NewReader(chunks[idx][4:]))
+        if err != nil {
+          t.Fatal(err)
+        }
+        raw, err := io.ReadAll(zr)
+        if err != nil {
+          t.Fatal(err)
+        }
+        got := image.NewNRGBA(image.Rect(0, 0, 5, 3))
+        for y := 0; y < 3; y++ {
+          copy(got.Pix[y * got.Stride:], raw[y * 21 + 1:y * 21 + 21])
+        }
+        equalImages(t, fmt.Sprintf("frame %d", frame), got, frames[frame - 1])
+      }
+    }
+  }
+  if err := encodeAPNG(io.Discard, []image.Image{frames[0], testPattern(4, 3, true)}, nil, 0); err == nil {
+    t.Error("frames of different sizes were encoded")
+  }
+  if err := encodeAPNG(io.Discard, nil, nil, 0); err == nil {
+    t.Error("an animation without frames was encoded")
+  }
+}
+
+func TestQuantize(t *testing.T) {
+  // Images of at most n colors keep them exactly.
+  few := image.NewNRGBA(image.Rect(0, 0, 6, 4))
+  for i := 0; i < 24; i++ {
+    few.SetNRGBA(i % 6, i / 6, []color.NRGBA{{255, 0, 0, 255}, {0, 128, 0, 255}, {1, 2, 3, 4}}[i * i % 3])
+  }
+  equalImages(t, "three colors", quantize(few, 3), few)
+
+  // Paletted images keep their palette.
+  paletted := image.NewPaletted(image.Rect(1, 1, 4, 3), color.Palette{color.Black, color.White})
+  paletted.SetColorIndex(2, 2, 1)
+  got := quantize(paletted, 2)
+  if len(got.Palette) != 2 || got.Palette[1] != color.White {
+    t.Errorf("palette %v, want black and white", got.Palette)
+  }
+  equalImages(t, "paletted", got, paletted)
+
+  // Others get n colors, which stay close for a smooth gradient. All
+  // transparent pixels are one color.
+  gradient := image.NewNRGBA(image.Rect(0, 0, 64, 4))
+  for x := 0; x < 64; x++ {
+    for y := 0; y < 4; y++ {
+      gradient.SetNRGBA(x, y, color.NRGBA{uint8(4 * x), uint8(4 * x), 0, uint8(255 * (y % 2))})
+    }
+  }
+  got = quantize(gradient, 16)
+  if len(got.Palette) != 16 {
+    t.Fatalf("%d colors, want 16", len(got.Palette))
+  }
+  for x := 0; x < 64; x++ {
+    if c := color.NRGBAModel.Convert(got.At(x, 0)).(color.NRGBA); c.A != 0 {
+      t.Fatalf("transparent pixel %d is %v", x, c)
+    }
+    c := color.NRGBAModel.Convert(got.At(x, 1)).(color.NRGBA)
+    if absInt(int(c.R) - 4 * x) > 16 || c.A != 255 {
+      t.Fatalf("pixel %d is %v, want about %d", x, c, 4 * x)
+    }
+  }
+}
+
+func TestPatternSVG(t *testing.T) {
+  tile := testPattern(5, 3, false)
+  var buf bytes.Buffer
+  if err := (outputSettings{}).encodePatternSVG(&buf, tile); err != nil {
+    t.Fatal(err)
+  }
+  var svg struct {
+    Width int `xml:"width,attr"`
+    Height int `xml:"height,attr"`
+    Pattern struct {
+      ID string `xml:"id,attr"`
+      Width int `xml:"width,attr"`
+      Height int `xml:"height,attr"`
+      Image struct {
+        Href string `xml:"href,attr"`
+      } `xml:"image"`
+    } `xml:"defs>pattern"`
+    Rect struct {
+      Fill string `xml:"fill,attr"`
+    } `xml:"rect"`
+  }
+  if err := xml.Unmarshal(buf.Bytes(), &svg); err != nil {
+    t.Fatal(err)
+  }
+  if svg.Width != 15 || svg.Height != 9 || svg.Pattern.Width != 5 || svg.Pattern.Height != 3 {
+    t.Errorf("SVG of %dx%d with a pattern of %dx%d, want 15x9 and 5x3", svg.Width, svg.Height, svg.Pattern.Width, svg.Pattern.Height)
+  }
+  if svg.Rect.Fill != "url(#"+svg.Pattern.ID+")" {
+    t.Errorf("the rectangle is filled with %q, not pattern %q", svg.Rect.Fill, svg.Pattern.ID)
+  }
+  encoded, ok := strings.CutPrefix(svg.Pattern.Image.Href, "data:image/png;base64,")
+  if !ok {
+    t.Fatalf("the pattern shows %.40q, not a PNG", svg.Pattern.Image.Href)
+  }
+  data, err := base64.StdEncoding.DecodeString(encoded)
+  if err != nil {
+    t.Fatal(err)
+  }
+  embedded, err := png.Decode(bytes.NewReader(data))
+  if err != nil {
+    t.Fatal(err)
+  }
+  equalImages(t, "embedded tile", embedded, tile)
+}
+
+func TestTraceSVG(t *testing.T) {
+  // Stripes and a square on a translucent background, which the drawing
+  // paints back exactly.
+  colors := []color.NRGBA{{10, 20, 30, 255}, {200, 0, 0, 255}, {0, 0, 255, 128}}
+  tile := image.NewNRGBA(image.Rect(0, 0, 8, 6))
+  for y := 0; y < 6; y++ {
+    for x := 0; x < 8; x++ {
+      c := colors[2]
+      if x % 4 == 0 {
+        c = colors[0]
+      } else if x >= 5 && y >= 2 && y < 4 {
+        c = colors[1]
+      }
+      tile.SetNRGBA(x, y, c)
+    }
+  }
+  data, err := TraceSVG(tile)
+  if err != nil {
+    t.Fatal(err)
+  }
+  var svg struct {
+    Rects []struct {
+      X int `xml:"x,attr"`
+      Y int `xml:"y,attr"`
+      Width int `xml:"width,attr"`
+      Height int `xml:"height,attr"`
+      Fill string `xml:"fill,attr"`
+      Opacity float64 `xml:"fill-opacity,attr"`
+    } `xml:"rect"`
+  }
+  if err := xml.Unmarshal(data, &svg); err != nil {
+    t.Fatal(err)
+  }
+  got := image.NewNRGBA(tile.Rect)
+  for _, r := range svg.Rects {
+    var c color.NRGBA
+    if _, err := fmt.Sscanf(r.Fill, "#%02x%02x%02x", &c.R, &c.G, &c.B); err != nil {
+      t.Fatalf("fill %q: %v", r.Fill, err)
+    }
+    c.A = 255
+    if r.Opacity != 0 {
+      c.A = uint8(math.Round(r.Opacity * 255))
+    }
+    draw.Draw(got, image.Rect(r.X, r.Y, r.X + r.Width, r.Y + r.Height), image.NewUniform(c), image.Point{}, draw.Src)
+  }
+  equalImages(t, "traced tile", got, tile)
+
+  if _, err := TraceSVG(testPattern(8, 8, true)); err == nil {
+    t.Error("a tile of 64 colors was traced")
+  }
+}
+
+func TestCSSRule(t *testing.T) {
+  tile := testPattern(5, 3, true)
+  css, err := (outputSettings{}).cssRule(tile, `tiles/a "b".png`, "png", "repeat-x")
+  if err != nil {
+    t.Fatal(err)
+  }
+  want := ".tile {\n  background-image: url(\"tiles/a \\\"b\\\".png\");\n  background-size: 5px 3px;\n  background-repeat: repeat-x;\n}\n"
+  if string(css) != want {
+    t.Errorf("rule\n%s\nwant\n%s", css, want)
+  }
+
+  // Formats browsers do not show are inlined as PNG.
+  for _, format := range []string{"png", "tiff"} {
+    css, err := (outputSettings{}).cssRule(tile, "", format, "repeat")
+    if err != nil {
+      t.Fatal(err)
+    }
+    _, uri, _ := strings.Cut(string(css), `url("`)
+    uri, _, _ = strings.Cut(uri, `")`)
+    encoded, ok := strings.CutPrefix(uri, "data:image/png;base64,")
+    if !ok {
+      t.Fatalf("%s: inlined as %.40q, not as PNG", format, uri)
+    }
+    data, err := base64.StdEncoding.DecodeString(encoded)
+    if err != nil {
+      t.Fatal(err)
+    }
+    inlined, err := png.Decode(bytes.NewReader(data))
+    if err != nil {
+      t.Fatal(err)
+    }
+    equalImages(t, format + " data URI", inlined, tile)
+  }
+}
+
+func TestProof(t *testing.T) {
+  cmyk := image.NewCMYK(image.Rect(0, 0, 2, 2))
+  copy(cmyk.Pix, []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16})
+  deep := image.NewNRGBA64(image.Rect(0, 0, 2, 1))
+  deep.SetNRGBA64(0, 0, color.NRGBA64{0x1234, 0x5678, 0x9abc, 0xffff})
+  deep.SetNRGBA64(1, 0, color.NRGBA64{1, 2, 3, 0xffff})
+  for _, test := range []struct {
+    name string
+    tile image.Image
+    colorSpace string
+    samples []byte
+    mask bool
+  }{
+    {"opaque", testPattern(2, 1, true), "/DeviceRGB", []byte{0, 0, 3, 40, 0, 3}, false},
+    // Colors under low alpha keep all of their bits.
+    {"translucent", testPattern(2, 1, false), "/DeviceRGB", []byte{0, 0, 3, 40, 0, 3}, true},
+    {"16-bit", deep, "/DeviceRGB", []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0, 1, 0, 2, 0, 3}, false},
+    {"cmyk", cmyk, "/DeviceCMYK", cmyk.Pix, false},
+  } {
+    var buf bytes.Buffer
+    if err := writeProof(&buf, test.tile, 595.276, 841.89, 72, 36); err != nil {
+      t.Fatal(err)
+    }
+    pdf := buf.String()
+    if !strings.HasPrefix(pdf, "%PDF-1.5\n") || !strings.HasSuffix(pdf, "%%EOF\n") {
+      t.Fatalf("%s: no PDF: %.20q", test.name, pdf)
+    }
+    if !strings.Contains(pdf, "/MediaBox [0 0 595.276 841.890]") {
+      t.Errorf("%s: no A4 media box", test.name)
+    }
+    // The tiles repeat from the top left corner of the page.
+    if !strings.Contains(pdf, "/Matrix [72.0000 0 0 36.0000 0 805.8900]") {
+      t.Errorf("%s: the pattern does not scale the tile to 72x36 points at the top", test.name)
+    }
+    if !strings.Contains(pdf, "/ColorSpace "+test.colorSpace) || strings.Contains(pdf, "/SMask") != test.mask {
+      t.Errorf("%s: want the color space %s and a soft mask %v", test.name, test.colorSpace, test.mask)
+    }
+
+    // The cross-reference table points at every object.
+    _, xref, _ := strings.Cut(pdf, "startxref\n")
+    var at int
+    fmt.Sscanf(xref, "%d", &at)
+    if !strings.HasPrefix(pdf[at:], "xref\n") {
+      t.Fatalf("%s: startxref points at %.10q", test.name, pdf[at:])
+    }
+    lines := strings.Split(pdf[at:], "\n")
+    var n int
+    fmt.Sscanf(lines[1], "0 %d", &n)
+    for idx := 1; idx < n; idx++ {
+      var offset int
+      fmt.Sscanf(lines[2 + idx], "%d", &offset)
+      if !strings.HasPrefix(pdf[offset:], fmt.Sprintf("%d 0 obj\n", idx)) {
+        t.Errorf("%s: object %d is not at %d", test.name, idx, offset)
+      }
+    }
+
+    // The image is the 6th object, its samples compressed with zlib.
+    _, image, _ := strings.Cut(pdf, "6 0 obj\n")
+    _, data, _ := strings.Cut(image, "stream\n")
+    zr, err := zlib.NewReader(strings.NewReader(data))
+    if err != nil {
+      t.Fatal(err)
+    }
+    samples, err := io.ReadAll(zr)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if !bytes.Equal(samples, test.samples) {
+      t.Errorf("%s: samples %v, want %v", test.name, samples, test.samples)
+    }
+  }
+}
+
+func TestDecodeBytesChecksSize(t *testing.T) {
+  // A PNG header that claims 50000x50000 gray pixels and no pixel data has
+  // to be refused before 2.5 GB are allocated for them.
+  header := []byte("\x89PNG\r\n\x1a\n")
+  chunk := func(kind string, data []byte) {
+    header = binary.BigEndian.AppendUint32(header, uint32(len(data)))
+    header = append(append(header, kind...), data...)
+    header = binary.BigEndian.AppendUint32(header, crc32.ChecksumIEEE(append([]byte(kind), data...)))
+  }
+  ihdr := binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 50000), 50000)
+  chunk("IHDR", append(ihdr, 8, 0, 0, 0, 0))
+  chunk("IEND", nil)
+  if _, _, err := decodeBytes(header); !errors.Is(err, ErrImageTooLarge) {
+    t.Errorf("decodeBytes = %v, want ErrImageTooLarge", err)
+  }
+}
+
+func TestCodecToolsOptIn(t *testing.T) {
+  // An AVIF header with an image size, which would have reached avifdec if
+  // the format were registered with the image package.
+  avif := []byte("\x00\x00\x00\x18ftypavif\x00\x00\x00\x00avifmif1")
+  avif = append(avif, "\x00\x00\x00\x14ispe\x00\x00\x00\x00\x00\x00\x00\x04\x00\x00\x00\x04"...)
+  if _, _, err := decodeBytes(avif); !errors.Is(err, image.ErrFormat) {
+    t.Errorf("decodeBytes = %v, want image.ErrFormat", err)
+  }
+  name := filepath.Join(t.TempDir(), "photo.avif")
+  if err := os.WriteFile(name, avif, 0644); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := (outputSettings{}).decode(name); err == nil || !strings.Contains(err.Error(), "-codec-tools") {
+    t.Errorf("decode without -codec-tools = %v, want an error naming -codec-tools", err)
+  }
+  t.Setenv("PATH", "")
+  if _, err := (outputSettings{codecTools: true}).decode(name); err == nil || !strings.Contains(err.Error(), "avifdec") {
+    t.Errorf("decode with -codec-tools = %v, want an error naming avifdec", err)
+  }
+}
+
+// runTileex runs tileex with args in dir, through TestExitStatus in a child
+// process, and returns the status it exits with.
+func runTileex(t *testing.T, dir string, args ...string) int {
+  t.Helper()
+  cmd := exec.Command(os.Args[0], "-test.run=^TestExitStatus$")
+  cmd.Dir = dir
+  cmd.Env = append(os.Environ(), "TILEEX_ARGS=" + strings.Join(args, "\n"))
+  err := cmd.Run()
+  var exitErr *exec.ExitError
+  if errors.As(err, &exitErr) {
+    return exitErr.ExitCode()
+  } else if err != nil {
+    t.Fatal(err)
+  }
+  return 0
+}
+
+// tiledPattern returns repeats by repeats copies of an 8x8 testPattern.
+func tiledPattern(repeats int) *image.NRGBA {
+  tile := testPattern(8, 8, true)
+  img := image.NewNRGBA(image.Rect(0, 0, 8 * repeats, 8 * repeats))
+  for y := 0; y < 8 * repeats; y++ {
+    for x := 0; x < 8 * repeats; x++ {
+      img.Set(x, y, tile.At(x % 8, y % 8))
+    }
+  }
+  return img
+}
+
+func TestExitStatus(t *testing.T) {
+  // The test binary runs main in a child process, with the arguments in
+  // TILEEX_ARGS, to see the status it exits with.
+  if args, ok := os.LookupEnv("TILEEX_ARGS"); ok {
+    os.Args = append([]string{"tileex"}, strings.Split(args, "\n")...)
+    main()
+    os.Exit(0)
+  }
+  dir := t.TempDir()
+  missing := filepath.Join(dir, "missing.png")
+  empty := filepath.Join(dir, "empty")
+  images := filepath.Join(dir, "images")
+  for _, name := range []string{empty, images} {
+    if err := os.Mkdir(name, 0755); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if err := os.WriteFile(filepath.Join(images, "a.png"), nil, 0644); err != nil {
+    t.Fatal(err)
+  }
+  tests := []struct {
+    args []string
+    status int
+  }{
+    {[]string{"-bogus"}, exitUsage},
+    {[]string{"extract", "-bogus"}, exitUsage},
+    {[]string{"-input", missing}, exitDecode},
+    {[]string{"-input", images, "-resume", "r", "-output", filepath.Join(dir, "tiles.zip")}, exitUsage},
+    {[]string{"check", "-bogus"}, exitUsage},
+    {[]string{"check"}, exitUsage},
+    {[]string{"check", "-lang", "xx", empty}, exitUsage},
+    {[]string{"check", "-manifest", missing, empty}, exitFailure},
+    {[]string{"roundtrip", "-bogus"}, exitUsage},
+    {[]string{"roundtrip", missing}, exitDecode},
+    {[]string{"serve", "-bogus"}, exitUsage},
+    {[]string{"serve", "extra"}, exitUsage},
+    {[]string{"version", "-bogus"}, exitUsage},
+    {[]string{"version"}, 0},
+    {[]string{"detect", "-bogus"}, exitUsage},
+    {[]string{"detect"}, exitUsage},
+    {[]string{"detect", "-on-error", "never", missing}, exitUsage},
+    {[]string{"detect", missing}, exitFailure},
+    {[]string{"tile", "-bogus"}, exitUsage},
+    {[]string{"tile", "-width", "4", "-height", "4", missing}, exitDecode},
+    {[]string{"resize", "-bogus"}, exitUsage},
+    {[]string{"resize", "-scale", "2", missing}, exitDecode},
+    {[]string{"resize", missing, "-scale", "2"}, exitUsage},
+    {[]string{"verify", "-bogus"}, exitUsage},
+    {[]string{"verify", "-source", missing, missing}, exitDecode},
+    {[]string{"audit", "-bogus"}, exitUsage},
+    {[]string{"audit", "-reference", empty, empty}, exitUsage},
+    {[]string{"watch", "-bogus"}, exitUsage},
+    {[]string{"watch"}, exitUsage},
+    {[]string{"completion"}, exitUsage},
+    {[]string{"completion", "tcsh"}, exitUsage},
+    {[]string{"completion", "bash"}, 0},
+  }
+  for _, test := range tests {
+    if status := runTileex(t, dir, test.args...); status != test.status {
+      t.Errorf("tileex %s exited with %d, want %d", strings.Join(test.args, " "), status, test.status)
+    }
+  }
+}
+
+// failingWriter is a response whose body cannot be written, as when the
+// client has gone away.
+type failingWriter struct {
+  *httptest.ResponseRecorder
+}
+
+func (failingWriter) Write([]byte) (int, error) {
+  return 0, errors.New("connection reset")
+}
+
+func TestServe(t *testing.T) {
+  var upload bytes.Buffer
+  if err := png.Encode(&upload, tiledPattern(4)); err != nil {
+    t.Fatal(err)
+  }
+  newServer := func(args ...string) (*server, *bytes.Buffer) {
+    var v serveOptions
+    fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+    v.addFlags(fs)
+    if err := fs.Parse(args); err != nil {
+      t.Fatal(err)
+    }
+    if err := v.s.prepare(); err != nil {
+      t.Fatal(err)
+    }
+    var logs bytes.Buffer
+    return &server{v: v, log: log.New(&logs, "", 0), keys: make(map[string]bool), running: make(map[string]int)}, &logs
+  }
+
+  tests := []struct {
+    name string
+    args []string
+    body []byte
+    status int
+    limit string
+  }{
+    {"tile", nil, upload.Bytes(), http.StatusOK, ""},
+    {"oversized body", []string{"-max-upload", "100"}, upload.Bytes(), http.StatusRequestEntityTooLarge, "bytes"},
+    {"too many pixels", []string{"-max-pixels", "100"}, upload.Bytes(), http.StatusRequestEntityTooLarge, "pixels"},
+    {"timeout", []string{"-max-wall-seconds", "1ns"}, upload.Bytes(), http.StatusServiceUnavailable, "seconds"},
+    {"bad image", nil, []byte("not an image"), http.StatusBadRequest, ""},
+  }
+  for _, test := range tests {
+    srv, _ := newServer(test.args...)
+    w := httptest.NewRecorder()
+    srv.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/extract", bytes.NewReader(test.body)))
+    if w.Code != test.status {
+      t.Errorf("%s: status %d, want %d: %s", test.name, w.Code, test.status, w.Body)
+      continue
+    }
+    if test.status == http.StatusOK {
+      got, err := png.Decode(w.Body)
+      if err != nil {
+        t.Fatalf("%s: %v", test.name, err)
+      }
+      if got.Bounds().Size() != image.Pt(8, 8) || w.Header().Get("X-Tile-Width") != "8" || w.Header().Get("X-Tile-Height") != "8" {
+        t.Errorf("%s: tile of %v with headers %v, want 8x8", test.name, got.Bounds().Size(), w.Header())
+      }
+      continue
+    }
+    var body serveError
+    if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+      t.Fatalf("%s: %v", test.name, err)
+    }
+    if body.Limit != test.limit || body.Error == "" {
+      t.Errorf("%s: body %+v, want limit %q", test.name, body, test.limit)
+    }
+  }
+
+  // A tile that cannot be sent is logged, as the status has gone out.
+  srv, logs := newServer()
+  srv.ServeHTTP(failingWriter{httptest.NewRecorder()}, httptest.NewRequest(http.MethodPost, "/extract", bytes.NewReader(upload.Bytes())))
+  if !strings.Contains(logs.String(), "connection reset") {
+    t.Errorf("log %q, want the failed write", logs.String())
+  }
+}
+
+func TestResume(t *testing.T) {
+  dir := t.TempDir()
+  images := filepath.Join(dir, "images")
+  if err := os.Mkdir(images, 0755); err != nil {
+    t.Fatal(err)
+  }
+  // The images differ, as exact copies would only be analyzed once.
+  for i, name := range []string{"a.png", "b.png"} {
+    if err := savePNG(filepath.Join(images, name), tiledPattern(4 + i)); err != nil {
+      t.Fatal(err)
+    }
+  }
+  run := func(args ...string) int {
+    return runTileex(t, dir, append([]string{"-input", "images", "-output", "tiles"}, args...)...)
+  }
+  tiles := func() []string {
+    entries, _ := os.ReadDir(filepath.Join(dir, "tiles"))
+    var names []string
+    for _, entry := range entries {
+      names = append(names, entry.Name())
+    }
+    return names
+  }
+
+  // Without -resume, no state is left behind.
+  if status := run(); status != 0 {
+    t.Fatalf("first run exited with %d", status)
+  }
+  first := tiles()
+  if len(first) != 2 {
+    t.Fatalf("first run wrote %v, want two tiles", first)
+  }
+  if err := os.RemoveAll(filepath.Join(dir, "tiles")); err != nil {
+    t.Fatal(err)
+  }
+
+  if status := run("-resume", "checkpoint.json"); status != 0 {
+    t.Fatalf("run with -resume exited with %d", status)
+  }
+  _, entries, err := readCheckpoint(filepath.Join(dir, "checkpoint.json"))
+  if err != nil || len(entries) != 2 {
+    t.Fatalf("checkpoint holds %d entries, %v, want 2", len(entries), err)
+  }
+  // The images the checkpoint lists are skipped, so a tile removed since
+  // is not written again.
+  removed := filepath.Join(dir, "tiles", first[0])
+  if err := os.Remove(removed); err != nil {
+    t.Fatal(err)
+  }
+  if status := run("-resume", "checkpoint.json"); status != 0 {
+    t.Fatalf("resumed run exited with %d", status)
+  }
+  if _, err := os.Stat(removed); err == nil {
+    t.Error("the resumed run analyzed an image the checkpoint lists")
+  }
+  // Other settings would give other tiles, so the checkpoint is refused
+  // for them unless -force starts it over.
+  if status := run("-resume", "checkpoint.json", "-row-tolerance", "5"); status == 0 {
+    t.Error("resumed a checkpoint with another -row-tolerance")
+  }
+  if status := run("-resume", "checkpoint.json", "-row-tolerance", "5", "-force"); status != 0 {
+    t.Fatalf("run with -force exited with %d", status)
+  }
+  if _, err := os.Stat(removed); err != nil {
+    t.Errorf("-force did not start the checkpoint over: %v", err)
+  }
+}
+
+func TestTrFlagError(t *testing.T) {
+  defer func() { language = "en" }()
+  language = "de"
+  tests := []struct {
+    args []string
+    want string
+  }{
+    {[]string{"-bogus"}, "Flag ist nicht definiert: -bogus"},
+    {[]string{"-n"}, "Flag braucht ein Argument: -n"},
+    {[]string{"-n", "x"}, `ungültiger Wert "x" für Flag -n: Syntaxfehler`},
+    {[]string{"-b=maybe"}, `ungültiger Wahrheitswert "maybe" für -b: Syntaxfehler`},
+    {[]string{"---n"}, "ungültige Flag-Syntax: ---n"},
+  }
+  for _, test := range tests {
+    fs := flag.NewFlagSet("test", flag.ContinueOnError)
+    fs.SetOutput(io.Discard)
+    fs.Int("n", 0, "")
+    fs.Bool("b", false, "")
+    err := fs.Parse(test.args)
+    if err == nil {
+      t.Fatalf("parsing %v succeeded", test.args)
+    }
+    if got := trFlagError(err); got != test.want {
+      t.Errorf("trFlagError(%q) = %q, want %q", err, got, test.want)
+    }
+  }
+}
@@ -0,0 +1,184 @@
+/*
+TileEx : A Tiling Pattern Extractor written in Go
+Copyright (C) 2023, Sarthak Shah (shahsarthakw@gmail.com)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+// language is the language of the messages, as set by -lang.
+var language = "en"
+
+// catalogs translates the messages of the commands from English, the
+// language of the source, into the other languages. A catalog is keyed by
+// the message or format string as it appears in the source, as with
+// gettext, and messages it lacks stay in English.
+var catalogs = map[string]map[string]string{
+  "de": {
+    "Error: ": "Fehler: ",
+    "Warning: ": "Warnung: ",
+    "Error:": "Fehler:",
+    "error: ": "Fehler: ",
+    "Row": "Zeilen",
+    "Col": "Spalten",
+    "row": "Zeilen",
+    "col": "Spalten",
+    "%s periodicity is %f percent of total frequency.\n": "%s-Periodizität hat %f Prozent der Gesamthäufigkeit.\n",
+    "%s Periodicity: %d\n": "%s-Periodizität: %d\n",
+    "Row Periodicity: %d\n": "Zeilen-Periodizität: %d\n",
+    "Col Periodicity: %d\n": "Spalten-Periodizität: %d\n",
+    "Rejected %d of %d %ss with anomalously poor scores\n": "%d von %d %s mit auffällig schlechten Werten verworfen\n",
+    "File type: LOSSLESS": "Dateityp: VERLUSTFREI",
+    "File type: LOSSY": "Dateityp: VERLUSTBEHAFTET",
+    "Removing gradients with a wavelength above %d pixels\n": "Entferne Verläufe mit einer Wellenlänge über %d Pixeln\n",
+    "Ignoring %d rows and %d cols that do not repeat\n": "Ignoriere %d Zeilen und %d Spalten, die sich nicht wiederholen\n",
+    "Extracting from the background region %v\n": "Extrahiere aus dem Hintergrundbereich %v\n",
+    "Broke the tie between row periods %v and col periods %v by reconstruction error: %dx%d\n": "Gleichstand zwischen den Zeilenperioden %v und den Spaltenperioden %v nach Rekonstruktionsfehler aufgelöst: %dx%d\n",
+    "Trimmed the %dx%d tile to its fundamental repeat of %dx%d\n": "Die %dx%d-Kachel wurde auf ihren Grundrapport von %dx%d verkleinert\n",
+    "Quality grade: %s (reconstruction error %f)\n": "Qualitätsstufe: %s (Rekonstruktionsfehler %f)\n",
+    "Quality grade: %s (reconstruction error %f ± %f, from %d of %d blocks)\n": "Qualitätsstufe: %s (Rekonstruktionsfehler %f ± %f, aus %d von %d Blöcken)\n",
+    "Frieze group: %s\n": "Friesgruppe: %s\n",
+    "Matched %d keypoints into %d displacements\n": "%d Merkmalspunkte zu %d Verschiebungen zugeordnet\n",
+    "Lattice vectors: (%d, %d) and (%d, %d)\n": "Gittervektoren: (%d, %d) und (%d, %d)\n",
+    "Could not find keypoints that repeat along both axes": "Keine Merkmalspunkte gefunden, die sich entlang beider Achsen wiederholen",
+    "Found the motif %d times\n": "Motiv %d-mal gefunden\n",
+    "Motif lattice: %dx%d\n": "Motivgitter: %dx%d\n",
+    "Cropped to %s\n": "Zugeschnitten nach %s\n",
+    "Cropped %s to %s\n": "%s zugeschnitten nach %s\n",
+    "Detected center: %.1f,%.1f\n": "Erkannter Mittelpunkt: %.1f,%.1f\n",
+    "Rotational symmetry: %d-fold (a wedge of %.2f degrees)\n": "Drehsymmetrie: %d-zählig (ein Segment von %.2f Grad)\n",
+    "Image cropped and saved successfully.": "Bild erfolgreich zugeschnitten und gespeichert.",
+    "No line along %s repeats": "Keine Linie entlang %s wiederholt sich",
+    "Periodicity along %s is %f percent of total frequency.\n": "Die Periodizität entlang %s hat %f Prozent der Gesamthäufigkeit.\n",
+    "Periodicity along %s: %d\n": "Periodizität entlang %s: %d\n",
+    "Colorway variants: the structure repeats every %dx%d but the colors only every %dx%d\n": "Farbvarianten: Die Struktur wiederholt sich alle %dx%d, die Farben aber erst alle %dx%d\n",
+    "Extracting the structural tile": "Extrahiere die Strukturkachel",
+    "No colorway variants found": "Keine Farbvarianten gefunden",
+    "Tile: %dx%d at %d,%d\n": "Kachel: %dx%d bei %d,%d\n",
+    "Confidence: %.0f%% of the row vote, %.0f%% of the column vote\n": "Konfidenz: %.0f%% der Zeilenabstimmung, %.0f%% der Spaltenabstimmung\n",
+    "Tile copied to the clipboard.": "Kachel in die Zwischenablage kopiert.",
+    "Seam score: %.2f (about 1 when the seams are as smooth as the rest of the tile)\n": "Nahtwert: %.2f (etwa 1, wenn die Nähte so glatt sind wie der Rest der Kachel)\n",
+    "Traced the tile to %s\n": "Kachel vektorisiert nach %s\n",
+    "Wrote the CSS to %s\n": "CSS nach %s geschrieben\n",
+    "Wrote a proof with tiles of %.1fx%.1f mm to %s\n": "Probedruck mit Kacheln von %.1fx%.1f mm nach %s geschrieben\n",
+    "Saved the image next to its reconstruction to %s\n": "Bild neben seiner Rekonstruktion nach %s gespeichert\n",
+    "No images found in %s": "Keine Bilder in %s gefunden",
+    "unknown -strip %q, expected horizontal, vertical or auto": "unbekanntes -strip %q, erwartet horizontal, vertical oder auto",
+    "The image repeats along its rows, extracting a horizontal strip": "Das Bild wiederholt sich entlang der Zeilen, extrahiere einen waagerechten Streifen",
+    "The image repeats down its cols, extracting a vertical strip": "Das Bild wiederholt sich entlang der Spalten, extrahiere einen senkrechten Streifen",
+    "CSS: background: url(%s) %s;\n": "CSS: background: url(%s) %s;\n",
+    "-json and -output - both write to stdout": "-json und -output - schreiben beide auf stdout",
+    "-strip only works with -algorithm lines": "-strip funktioniert nur mit -algorithm lines",
+    "invalid -output-template: %v": "ungültiges -output-template: %v",
+    "A directory or pattern as -input only supports the regular extraction": "Ein Verzeichnis oder Muster als -input unterstützt nur die normale Extraktion",
+    "-companions needs input and output files and a rectangular tile": "-companions braucht Ein- und Ausgabedateien und eine rechteckige Kachel",
+    "The center is too close to the edge of the image": "Der Mittelpunkt liegt zu nah am Bildrand",
+    "Could not find any rotational symmetry": "Keine Drehsymmetrie gefunden",
+    "The tile is graded %s but %s is required, not saving it": "Die Kachel hat die Stufe %s, verlangt ist aber %s, sie wird nicht gespeichert",
+    "The %dx%d tile covers more than %.0f%% of the %dx%d image, which may not actually tile": "Die %dx%d-Kachel bedeckt mehr als %.0f%% des %dx%d-Bildes und ist womöglich gar nicht kachelbar",
+    "Not saving the tile, pass -allow-large-tile to save it anyway": "Die Kachel wird nicht gespeichert, mit -allow-large-tile wird sie trotzdem gespeichert",
+    "%d of the lines along %s repeat\n": "%d der Linien entlang %s wiederholen sich\n",
+    "The tile is only %dx%d, the image does not seem to repeat": "Die Kachel ist nur %dx%d groß, das Bild scheint sich nicht zu wiederholen",
+    "%s is the checkpoint of a run over %s into %s or with other settings, not of this one, which -force starts over": "%s ist der Prüfpunkt eines Laufs über %s nach %s oder mit anderen Einstellungen, nicht dieses Laufs, den -force neu beginnt",
+    "-resume needs a directory or pattern as -input": "-resume braucht ein Verzeichnis oder Muster als -input",
+    "Please select only one of -output or -output-dir": "Bitte nur eines von -output und -output-dir angeben",
+    "unknown -duplicates %q, expected record, link or off": "unbekanntes -duplicates %q, erwartet wird record, link oder off",
+    "same as ": "wie ",
+    "-jobs must be at least 1 and -max-memory at least 0, got %d and %d": "-jobs muss mindestens 1 und -max-memory mindestens 0 sein, nicht %d und %d",
+    "Time": "Zeit",
+    "-resume cannot resume a run into an archive": "-resume kann keinen Lauf in ein Archiv fortsetzen",
+    "Candidates for %s": "Kandidaten für %s",
+    "%d: %dx%d, error %f, pass -select %d": "%d: %dx%d, Fehler %f, mit -select %d wählen",
+    "%s has %d candidates, there is no candidate %d": "%s hat %d Kandidaten, es gibt keinen Kandidaten %d",
+    "-select needs the -gallery folder to pick from and no other detection": "-select braucht den -gallery-Ordner zur Auswahl und keine andere Erkennung",
+    "The gallery was made for %s, not %s": "Die Galerie wurde für %s erstellt, nicht für %s",
+    "Selected candidate %d: %dx%d at %d,%d\n": "Kandidat %d gewählt: %dx%d bei %d,%d\n",
+    "Wrote the candidates to %s, pass -gallery %s -select N to save one of them\n": "Kandidaten nach %s geschrieben, mit -gallery %s -select N einen davon speichern\n",
+    "An s3:// or gs:// -output takes no name template or -companions": "Eine s3://- oder gs://-Ausgabe (-output) nimmt keine Namensvorlage oder -companions",
+    "-output-dir has to be a local directory, name an s3:// or gs:// object with -output instead": "-output-dir muss ein lokales Verzeichnis sein, ein s3://- oder gs://-Objekt mit -output angeben",
+    "Uploaded the tile to %s\n": "Kachel nach %s hochgeladen\n",
+    "unknown -frames %q, expected each, consensus or animate": "unbekanntes -frames %q, erwartet each, consensus oder animate",
+    "Animated the %dx%d tile over %d frames\n": "%dx%d-Kachel über %d Einzelbilder animiert\n",
+    "-frames only supports the regular extraction into files": "-frames unterstützt nur die normale Extraktion in Dateien",
+    "Frame %d: %v\n": "Einzelbild %d: %v\n",
+    "Frame %d: %dx%d at %d,%d, graded %s\n": "Einzelbild %d: %dx%d bei %d,%d, bewertet als %s\n",
+    "Extracted the tiles of %d of %d frames\n": "Kacheln von %d der %d Einzelbilder extrahiert\n",
+    "Consensus: %d of %d frames repeat every %dx%d\n": "Konsens: %d von %d Einzelbildern wiederholen sich alle %dx%d\n",
+    "-page needs a page number and a TIFF or Aseprite file, and goes without -frames": "-page braucht eine Seitennummer und eine TIFF- oder Aseprite-Datei und geht nicht mit -frames",
+    "-layer needs an Aseprite file": "-layer braucht eine Aseprite-Datei",
+    "-preview needs a rectangular tile": "-preview braucht eine rechteckige Kachel",
+    "-css needs a tile file to refer to unless -css-inline is given, and -css-inline needs -css": "-css braucht eine Kacheldatei, auf die es verweist, außer mit -css-inline, und -css-inline braucht -css",
+    "-frames animate needs an animated GIF": "-frames animate braucht ein animiertes GIF",
+    "Best alignment: %d,%d\n": "Beste Ausrichtung: %d,%d\n",
+    "The tile is graded %s but %s is required\n": "Die Kachel hat die Stufe %s, verlangt ist aber %s\n",
+    "Error: No reference tiles in %s\n": "Fehler: Keine Referenzkacheln in %s\n",
+    "%d of %d images match a reference tile, see %s\n": "%d von %d Bildern passen zu einer Referenzkachel, siehe %s\n",
+    "Wrote %d entries to %s\n": "%d Einträge nach %s geschrieben\n",
+    "All %d tiles match %s\n": "Alle %d Kacheln stimmen mit %s überein\n",
+    "Original:  %dx%d at %d,%d (%s)\n": "Original:  %dx%d bei %d,%d (%s)\n",
+    "Mismatch: no tile found in the synthesis: %v\n": "Abweichung: keine Kachel in der Synthese gefunden: %v\n",
+    "Synthesis: %dx%d at %d,%d (%s)\n": "Synthese:  %dx%d bei %d,%d (%s)\n",
+    "Mismatch: the tile of the synthesis is %dx%d instead of %dx%d\n": "Abweichung: Die Kachel der Synthese ist %dx%d statt %dx%d\n",
+    "Mismatch: %d of the %d pixels of the tiles differ\n": "Abweichung: %d der %d Pixel der Kacheln unterscheiden sich\n",
+    "Match: both tiles are the same": "Übereinstimmung: Beide Kacheln sind gleich",
+    "Tiled %s to %dx%d in %s\n": "%s auf %dx%d gekachelt in %s\n",
+    "Resized %s to %dx%d in %s\n": "%s auf %dx%d skaliert in %s\n",
+    "Listening on %s\n": "Lausche auf %s\n",
+    "Commit: %s\n": "Commit: %s\n",
+    "Features: %s\n": "Funktionen: %s\n",
+    "Not available: %s\n": "Nicht verfügbar: %s\n",
+    "Input formats: %s\n": "Eingabeformate: %s\n",
+    "Output formats: %s\n": "Ausgabeformate: %s\n",
+    "Tools: %s\n": "Werkzeuge: %s\n",
+    "Tools not on the PATH: %s\n": "Werkzeuge, die nicht im PATH liegen: %s\n",
+    " (modified)": " (verändert)",
+    "%w: no region of the screenshot is free of UI elements": "%w: kein Bereich des Bildschirmfotos ist frei von Bedienelementen",
+    "Usage: tileex check [flags] path...": "Aufruf: tileex check [Flags] Pfad...",
+    "Usage: tileex roundtrip [flags] image": "Aufruf: tileex roundtrip [Flags] Bild",
+    "Usage: tileex serve [flags]": "Aufruf: tileex serve [Flags]",
+    "Usage: tileex detect [flags] image...": "Aufruf: tileex detect [Flags] Bild...",
+    "Usage: tileex tile -width w -height h [flags] tile": "Aufruf: tileex tile -width w -height h [Flags] Kachel",
+    "Usage: tileex resize -scale s [flags] tile": "Aufruf: tileex resize -scale s [Flags] Kachel",
+    "Usage: tileex verify -source image [flags] tile": "Aufruf: tileex verify -source Bild [Flags] Kachel",
+    "Usage: tileex audit -reference dir [flags] path...": "Aufruf: tileex audit -reference Ordner [Flags] Pfad...",
+    "Usage: tileex watch [flags] folder": "Aufruf: tileex watch [Flags] Ordner",
+    "Usage: tileex version [flags]": "Aufruf: tileex version [Flags]",
+    "Usage: tileex -input image.png -output tile.png [flags]": "Aufruf: tileex -input bild.png -output kachel.png [Flags]",
+    "flag provided but not defined: %s": "Flag ist nicht definiert: %s",
+    "flag needs an argument: %s": "Flag braucht ein Argument: %s",
+    "bad flag syntax: %s": "ungültige Flag-Syntax: %s",
+    "invalid value %s for flag %s: %s": "ungültiger Wert %s für Flag %s: %s",
+    "invalid boolean value %s for %s: %s": "ungültiger Wahrheitswert %s für %s: %s",
+    "parse error": "Syntaxfehler",
+    "value out of range": "Wert außerhalb des Bereichs",
+    "%s: AVIF, HEIC and JPEG XL are only decoded with -codec-tools, which runs avifdec, heif-dec or djxl from the PATH": "%s: AVIF, HEIC und JPEG XL werden nur mit -codec-tools dekodiert, das avifdec, heif-dec oder djxl aus dem PATH aufruft",
+    "Sending the tile to %s failed: %v": "Das Senden der Kachel an %s ist fehlgeschlagen: %v",
+    "Image": "Bild",
+    "Tile": "Kachel",
+    "Offset": "Versatz",
+    "Grade": "Stufe",
+    "Output": "Ausgabe",
+    "Extracted %d of %d tiles\n": "%d von %d Kacheln extrahiert\n",
+    "Failed input %s: %s": "Fehlgeschlagene Eingabe %s: %s",
+    "Could not write the statistics: %v": "Die Statistik konnte nicht geschrieben werden: %v",
+  },
+}
+
+// tr returns message in the language of the messages.
+func tr(message string) string {
+  if translated, ok := catalogs[language][message]; ok {
+    return translated
+  }
+  return message
+}
@@ -0,0 +1,810 @@
+/*
+TileEx : A Tiling Pattern Extractor written in Go
+Copyright (C) 2023, Sarthak Shah (shahsarthakw@gmail.com)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+  "bytes"
+  "compress/zlib"
+  "encoding/base64"
+  "encoding/binary"
+  "hash/crc32"
+  "errors"
+  "io"
+  "io/fs"
+  "os"
+  "path/filepath"
+  "fmt"
+  "flag"
+  "sort"
+  "strconv"
+  "strings"
+  "image"
+  "image/color"
+  "image/png"
+  "image/jpeg"
+  "image/draw"
+  "image/gif"
+)
+
+// outputSettings holds the options that control how the tile is produced
+// from its source and encoded.
+type outputSettings struct {
+  combine, inputAlpha, outputAlpha string
+  zeroCopy, force bool
+  // format is one of outputExtensions for stdout and default names, and the
+  // qualities are those of JPEG and of lossy WebP, AVIF and JPEG XL, or 0
+  // for lossless.
+  format string
+  jpegQuality, webpQuality, avifQuality, jxlQuality int
+  // indexed saves PNG tiles with a palette of at most colors colors.
+  indexed bool
+  colors int
+  // cmyk saves TIFF tiles as CMYK.
+  cmyk bool
+  // textureCompression is none, bc or etc for DDS and KTX2 tiles.
+  textureCompression string
+  // codecTools decodes AVIF, HEIC and JPEG XL inputs with command line
+  // tools.
+  codecTools bool
+}
+
+func addOutputFlags(fs *flag.FlagSet, o *outputSettings) {
+  fs.StringVar(&o.combine, "combine", "none", "Build the tile from every repeat in the image instead of a single one: none, mean or median")
+  fs.StringVar(&o.inputAlpha, "input-alpha", "auto", "How the color values of the input relate to its alpha: auto (as decoded), straight or premultiplied")
+  fs.StringVar(&o.outputAlpha, "output-alpha", "straight", "How to store the color values of the output relative to its alpha: straight or premultiplied")
+  fs.BoolVar(&o.zeroCopy, "zero-copy", false, "Encode the tile straight from the decoded input instead of copying it first")
+  fs.BoolVar(&o.force, "force", false, "Replace output files that exist already")
+  fs.StringVar(&o.format, "output-format", "png", "The format of tiles written to stdout or under default names, png, jpeg, gif, bmp, tiff, dds, ktx2, svg, webp, avif or jxl. Named files get the format of their extension")
+  fs.BoolVar(&o.indexed, "indexed", false, "Save PNG tiles as indexed PNGs, with the palette of a paletted input or one quantized to -colors")
+  fs.IntVar(&o.colors, "colors", 256, "The largest number of colors in the palette of -indexed tiles, from 2 to 256")
+  fs.BoolVar(&o.cmyk, "cmyk", false, "Save TIFF tiles as CMYK for print, converting them from RGB unless the input was CMYK already")
+  fs.StringVar(&o.textureCompression, "texture-compression", "none", "Compress DDS and KTX2 tiles for the GPU: none, bc (BC1, or BC3 with alpha) or etc (ETC2, KTX2 only)")
+  fs.IntVar(&o.jpegQuality, "jpeg-quality", 90, "The quality from 1 to 100 of JPEG tiles")
+  fs.IntVar(&o.webpQuality, "webp-quality", 0, "The quality from 1 to 100 of lossy WebP tiles, or 0 for lossless WebP")
+  fs.IntVar(&o.avifQuality, "avif-quality", 0, "The quality from 1 to 100 of lossy AVIF tiles, or 0 for lossless AVIF")
+  fs.IntVar(&o.jxlQuality, "jxl-quality", 0, "The quality from 1 to 100 of lossy JPEG XL tiles, or 0 for lossless JPEG XL")
+  fs.BoolVar(&o.codecTools, "codec-tools", false, "Decode AVIF, HEIC and JPEG XL inputs, by their extension, with avifdec, heif-dec or djxl from the PATH")
+}
+
+func (o *outputSettings) prepare() error {
+  switch o.combine {
+  case "none", "mean", "median":
+  default:
+    return fmt.Errorf("unknown -combine %q, expected none, mean or median", o.combine)
+  }
+  switch o.inputAlpha {
+  case "auto", "straight", "premultiplied":
+  default:
+    return fmt.Errorf("unknown -input-alpha %q, expected auto, straight or premultiplied", o.inputAlpha)
+  }
+  switch o.outputAlpha {
+  case "straight", "premultiplied":
+  default:
+    return fmt.Errorf("unknown -output-alpha %q, expected straight or premultiplied", o.outputAlpha)
+  }
+  if _, ok := outputExtensions[o.format]; !ok {
+    return fmt.Errorf("unknown -output-format %q, expected png, jpeg, gif, bmp, tiff, dds, ktx2, svg, webp, avif or jxl", o.format)
+  }
+  switch o.textureCompression {
+  case "none", "bc", "etc":
+  default:
+    return fmt.Errorf("unknown -texture-compression %q, expected none, bc or etc", o.textureCompression)
+  }
+  if o.format == "dds" && o.textureCompression == "etc" {
+    return errors.New("DDS textures cannot hold ETC, use -output-format ktx2 instead")
+  }
+  if o.colors < 2 || o.colors > 256 {
+    return fmt.Errorf("-colors must be from 2 to 256, got %d", o.colors)
+  }
+  if o.jpegQuality < 1 || o.jpegQuality > 100 {
+    return fmt.Errorf("-jpeg-quality must be from 1 to 100, got %d", o.jpegQuality)
+  }
+  if o.webpQuality < 0 || o.webpQuality > 100 {
+    return fmt.Errorf("-webp-quality must be from 0 to 100, got %d", o.webpQuality)
+  }
+  if o.avifQuality < 0 || o.avifQuality > 100 {
+    return fmt.Errorf("-avif-quality must be from 0 to 100, got %d", o.avifQuality)
+  }
+  if o.jxlQuality < 0 || o.jxlQuality > 100 {
+    return fmt.Errorf("-jxl-quality must be from 0 to 100, got %d", o.jxlQuality)
+  }
+  if encoder, ok := encoders[o.format]; ok {
+    if _, err := encoder.path(false); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// outputExtensions maps the values of -output-format to the extension of
+// their files.
+var outputExtensions = map[string]string{
+  "png": ".png", "jpeg": ".jpg", "gif": ".gif", "bmp": ".bmp", "tiff": ".tif",
+  "dds": ".dds", "ktx2": ".ktx2", "svg": ".svg",
+  "webp": ".webp", "avif": ".avif", "jxl": ".jxl",
+}
+
+// defaultName gives a default output name ending in .png the extension of
+// -output-format.
+func (o outputSettings) defaultName(name string) string {
+  return strings.TrimSuffix(name, ".png") + outputExtensions[o.format]
+}
+
+// outputFormat is the format a file named name is saved in, going by its
+// extension.
+func outputFormat(name string) string {
+  switch ext := strings.ToLower(filepath.Ext(name)); ext {
+  case ".jpeg":
+    return "jpeg"
+  case ".tiff":
+    return "tiff"
+  default:
+    for format, formatExt := range outputExtensions {
+      if ext == formatExt {
+        return format
+      }
+    }
+  }
+  return "png"
+}
+
+// encode writes the tile to w in format.
+func (o outputSettings) encode(w io.Writer, format string, tile image.Image) error {
+  if o.outputAlpha == "premultiplied" {
+    tile = storePremultiplied(tile)
+  }
+  switch format {
+  case "jpeg":
+    return jpeg.Encode(w, tile, &jpeg.Options{Quality: o.jpegQuality})
+  case "gif":
+    return encodeGIF(w, tile)
+  case "bmp":
+    return encodeBMP(w, tile)
+  case "tiff":
+    return encodeTIFF(w, tile, o.cmyk)
+  case "dds":
+    return encodeDDS(w, tile, o.textureCompression)
+  case "ktx2":
+    return encodeKTX2(w, tile, o.textureCompression)
+  case "webp":
+    return cwebp.encode(w, tile, o.webpQuality)
+  case "avif":
+    return avifenc.encode(w, tile, o.avifQuality)
+  case "jxl":
+    return cjxl.encode(w, tile, o.jxlQuality)
+  case "svg":
+    return o.encodePatternSVG(w, tile)
+  }
+  return o.encodePNG(w, tile)
+}
+
+// pageSizes are the paper sizes -proof-page knows by name, in points.
+var pageSizes = map[string][2]float64{
+  "a4": {595.276, 841.89}, "a3": {841.89, 1190.551}, "letter": {612, 792}, "legal": {612, 1008}, "tabloid": {792, 1224},
+}
+
+// lengthUnits are the units of physical lengths, in points.
+var lengthUnits = map[string]float64{"pt": 1, "mm": 72 / 25.4, "cm": 72 / 2.54, "in": 72}
+
+// parseLength parses a physical length with its unit, such as 5cm or 2in,
+// into points.
+func parseLength(length string) (float64, error) {
+  for unit, points := range lengthUnits {
+    if value, ok := strings.CutSuffix(length, unit); ok {
+      if v, err := strconv.ParseFloat(value, 64); err == nil && v > 0 {
+        return v * points, nil
+      }
+    }
+  }
+  return 0, fmt.Errorf("invalid length %q, expected a number with mm, cm, in or pt", length)
+}
+
+// parsePage parses a paper size, either by name or as width x height with a
+// unit such as 300x200mm, into points.
+func parsePage(page string) (float64, float64, error) {
+  if size, ok := pageSizes[strings.ToLower(page)]; ok {
+    return size[0], size[1], nil
+  }
+  width, height, ok := strings.Cut(page, "x")
+  for unit := range lengthUnits {
+    if ok && strings.HasSuffix(height, unit) && !strings.HasSuffix(width, unit) {
+      width += unit
+    }
+  }
+  w, err := parseLength(width)
+  if err == nil {
+    var h float64
+    if h, err = parseLength(height); err == nil {
+      return w, h, nil
+    }
+  }
+  return 0, 0, fmt.Errorf("invalid page %q, expected a4, a3, letter, legal, tabloid or a size such as 300x200mm", page)
+}
+
+// writeProof writes a PDF page of width by height points to w, covered edge
+// to edge with repeats of the tile from its top left corner on, each of
+// them tileWidth by tileHeight points, for print shops to proof the
+// pattern with. The tile is embedded once, losslessly, and repeated by a
+// tiling pattern. CMYK tiles keep their inks, 16-bit tiles their depth and
+// translucent ones their alpha as a soft mask.
+func writeProof(w io.Writer, tile image.Image, width, height, tileWidth, tileHeight float64) error {
+  bounds := tile.Bounds()
+  var samples, alpha []byte
+  colorSpace, depth := "/DeviceRGB", 8
+  switch src := tile.(type) {
+  case *image.CMYK:
+    colorSpace = "/DeviceCMYK"
+    for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+      samples = append(samples, src.Pix[src.PixOffset(bounds.Min.X, y):src.PixOffset(bounds.Max.X, y)]...)
+    }
+  default:
+    // 8-bit tiles are drawn to 8 bits, as their colors would lose bits
+    // under low alpha on the way through 16 premultiplied ones.
+    var pix []byte
+    var opaque bool
+    if is16Bit(tile) {
+      nrgba := image.NewNRGBA64(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+      draw.Draw(nrgba, nrgba.Rect, tile, bounds.Min, draw.Src)
+      depth, pix, opaque = 16, nrgba.Pix, nrgba.Opaque()
+    } else {
+      nrgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+      draw.Draw(nrgba, nrgba.Rect, tile, bounds.Min, draw.Src)
+      pix, opaque = nrgba.Pix, nrgba.Opaque()
+    }
+    // The samples of 16-bit tiles are big-endian, as in NRGBA64.
+    size := 4 * depth / 8
+    for i := 0; i < len(pix); i += size {
+      samples = append(samples, pix[i:i + size * 3 / 4]...)
+      alpha = append(alpha, pix[i + size * 3 / 4:i + size]...)
+    }
+    if opaque {
+      alpha = nil
+    }
+  }
+  compress := func(data []byte) []byte {
+    var compressed bytes.Buffer
+    zw := zlib.NewWriter(&compressed)
+    zw.Write(data)
+    zw.Close()
+    return compressed.Bytes()
+  }
+  stream := func(dict string, data []byte) string {
+    return fmt.Sprintf("<< %s >>\nstream\n%s\nendstream", strings.TrimSpace(fmt.Sprintf("%s /Length %d", dict, len(data))), data)
+  }
+
+  content := fmt.Sprintf("/Pattern cs /P scn 0 0 %.3f %.3f re f", width, height)
+  pixels := fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace %s /BitsPerComponent %d /Interpolate false /Filter /FlateDecode", bounds.Dx(), bounds.Dy(), colorSpace, depth)
+  if alpha != nil {
+    pixels += " /SMask 7 0 R"
+  }
+  objects := []string{
+    "<< /Type /Catalog /Pages 2 0 R >>",
+    "<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+    fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.3f %.3f] /Resources << /Pattern << /P 5 0 R >> >> /Contents 4 0 R >>", width, height),
+    stream("", []byte(content)),
+    // The pattern draws the image into its unit square, which its matrix
+    // scales to a tile with its top at the top of the page.
+    stream(fmt.Sprintf("/Type /Pattern /PatternType 1 /PaintType 1 /TilingType 1 /BBox [0 0 1 1] /XStep 1 /YStep 1 /Matrix [%.4f 0 0 %.4f 0 %.4f] /Resources << /XObject << /T 6 0 R >> >>", tileWidth, tileHeight, height - tileHeight), []byte("/T Do")),
+    stream(pixels, compress(samples)),
+  }
+  if alpha != nil {
+    objects = append(objects, stream(fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent %d /Interpolate false /Filter /FlateDecode", bounds.Dx(), bounds.Dy(), depth), compress(alpha)))
+  }
+
+  var pdf bytes.Buffer
+  pdf.WriteString("%PDF-1.5\n%\xe2\xe3\xcf\xd3\n")
+  offsets := make([]int, len(objects))
+  for idx, object := range objects {
+    offsets[idx] = pdf.Len()
+    fmt.Fprintf(&pdf, "%d 0 obj\n%s\nendobj\n", idx + 1, object)
+  }
+  xref := pdf.Len()
+  fmt.Fprintf(&pdf, "xref\n0 %d\n0000000000 65535 f \n", len(objects) + 1)
+  for _, offset := range offsets {
+    fmt.Fprintf(&pdf, "%010d 00000 n \n", offset)
+  }
+  fmt.Fprintf(&pdf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects) + 1, xref)
+  _, err := w.Write(pdf.Bytes())
+  return err
+}
+
+// cssMediaTypes are the media types of the tile formats that browsers show,
+// for the data URIs of -css-inline. Tiles in other formats are inlined as
+// PNG.
+var cssMediaTypes = map[string]string{
+  "png": "image/png", "jpeg": "image/jpeg", "gif": "image/gif", "bmp": "image/bmp",
+  "webp": "image/webp", "avif": "image/avif", "svg": "image/svg+xml",
+}
+
+// cssRule returns a CSS rule that fills an element with repeats of the tile
+// at its own size, referring to it by url, or inlined in format as a data
+// URI if url is empty. repeat is repeat, or repeat-x or repeat-y for a strip.
+func (o outputSettings) cssRule(tile image.Image, url, format, repeat string) ([]byte, error) {
+  if url == "" {
+    if _, ok := cssMediaTypes[format]; !ok {
+      format = "png"
+    }
+    var data bytes.Buffer
+    if err := o.encode(&data, format, tile); err != nil {
+      return nil, err
+    }
+    url = "data:" + cssMediaTypes[format] + ";base64," + base64.StdEncoding.EncodeToString(data.Bytes())
+  }
+  var css bytes.Buffer
+  fmt.Fprintf(&css, ".tile {\n  background-image: url(\"%s\");\n", strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(url))
+  fmt.Fprintf(&css, "  background-size: %dpx %dpx;\n  background-repeat: %s;\n}\n", tile.Bounds().Dx(), tile.Bounds().Dy(), repeat)
+  return css.Bytes(), nil
+}
+
+// encodePNG writes the tile to w as a PNG, indexed if -indexed is given.
+func (o outputSettings) encodePNG(w io.Writer, tile image.Image) error {
+  if o.indexed {
+    return png.Encode(w, quantize(tile, o.colors))
+  }
+  return png.Encode(w, tile)
+}
+
+// encodePatternSVG writes the tile to w as an SVG with a <pattern> of one
+// period, which holds the tile as an embedded PNG, to paste into vector
+// documents and fill any shape with by fill="url(#tile)". The SVG itself
+// shows 3x3 repeats of it.
+func (o outputSettings) encodePatternSVG(w io.Writer, tile image.Image) error {
+  var embedded bytes.Buffer
+  if err := o.encodePNG(&embedded, tile); err != nil {
+    return err
+  }
+  width, height := tile.Bounds().Dx(), tile.Bounds().Dy()
+  var svg bytes.Buffer
+  fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="%d" height="%d" viewBox="0 0 %d %d">`+"\n", 3 * width, 3 * height, 3 * width, 3 * height)
+  fmt.Fprintf(&svg, `<defs>`+"\n"+`<pattern id="tile" width="%d" height="%d" patternUnits="userSpaceOnUse">`+"\n", width, height)
+  fmt.Fprintf(&svg, `<image width="%d" height="%d" xlink:href="data:image/png;base64,%s"/>`+"\n", width, height, base64.StdEncoding.EncodeToString(embedded.Bytes()))
+  svg.WriteString("</pattern>\n</defs>\n")
+  fmt.Fprintf(&svg, `<rect width="%d" height="%d" fill="url(#tile)"/>`+"\n", 3 * width, 3 * height)
+  svg.WriteString("</svg>\n")
+  _, err := w.Write(svg.Bytes())
+  return err
+}
+
+// decode reads the image file with the given name, with a tool if it is
+// AVIF, HEIC or JPEG XL and -codec-tools allows it, and interprets its
+// alpha as asked for by -input-alpha.
+func (o outputSettings) decode(name string) (image.Image, error) {
+  decode := decodeFile
+  if tool, ok := toolDecoders[strings.ToLower(filepath.Ext(name))]; ok {
+    if !o.codecTools {
+      return nil, fmt.Errorf(tr("%s: AVIF, HEIC and JPEG XL are only decoded with -codec-tools, which runs avifdec, heif-dec or djxl from the PATH"), name)
+    }
+    decode = tool.decodeFile
+  }
+  img, err := decode(name)
+  if err != nil {
+    return nil, err
+  }
+  return reinterpretAlpha(img, o.inputAlpha), nil
+}
+
+// tile produces the tile at origin, either cropped from img or combined from
+// all of its repeats.
+func (o outputSettings) tile(img image.Image, origin image.Point, tileWidth, tileHeight int) image.Image {
+  if o.combine == "none" {
+    return CropTile(img, origin, tileWidth, tileHeight, o.zeroCopy)
+  }
+  return CombineTile(img, origin, tileWidth, tileHeight, o.combine == "median")
+}
+
+// save encodes the tile, storing premultiplied color values if asked for by
+// -output-alpha. PNG itself always stores straight alpha. Names ending in
+// the extension of one of outputExtensions are saved in that format, and all
+// others as PNG.
+func (o outputSettings) save(name string, tile image.Image) error {
+  file, err := o.create(name)
+  if err != nil {
+    return err
+  }
+  defer file.Close()
+  return o.encode(file, outputFormat(name), tile)
+}
+
+// create creates an output file. Unless -force is given, it refuses to
+// replace one that exists already, as that may well be a hand-tuned tile.
+func (o outputSettings) create(name string) (*os.File, error) {
+  if o.force {
+    return os.Create(name)
+  }
+  file, err := os.OpenFile(name, os.O_WRONLY | os.O_CREATE | os.O_EXCL, 0644)
+  if errors.Is(err, fs.ErrExist) {
+    return nil, fmt.Errorf("%s exists already, pass -force to replace it", name)
+  }
+  return file, err
+}
+
+// claim fails like create would, without creating anything, so that an
+// existing output can be noticed before a long detection.
+func (o outputSettings) claim(name string) error {
+  if _, err := os.Lstat(name); err == nil && !o.force {
+    return fmt.Errorf("%s exists already, pass -force to replace it", name)
+  }
+  if outputFormat(name) == "dds" && o.textureCompression == "etc" {
+    return errors.New("DDS textures cannot hold ETC, save a .ktx2 instead")
+  }
+  if encoder, ok := encoders[outputFormat(name)]; ok {
+    if _, err := encoder.path(false); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// write is save for a stream rather than a file.
+func (o outputSettings) write(w io.Writer, tile image.Image) error {
+  return o.encode(w, o.format, tile)
+}
+
+// reinterpretAlpha relabels the pixels of img without changing them, for
+// files whose color values do not relate to alpha the way their format says.
+// A decoder that returns straight (N-prefixed) pixels for a file that holds
+// premultiplied values gets them treated as premultiplied, and the other way
+// around. Opaque images are not affected.
+func reinterpretAlpha(img image.Image, mode string) image.Image {
+  switch src := img.(type) {
+  case *image.NRGBA:
+    if mode == "premultiplied" {
+      return &image.RGBA{Pix: src.Pix, Stride: src.Stride, Rect: src.Rect}
+    }
+  case *image.NRGBA64:
+    if mode == "premultiplied" {
+      return &image.RGBA64{Pix: src.Pix, Stride: src.Stride, Rect: src.Rect}
+    }
+  case *image.RGBA:
+    if mode == "straight" {
+      return &image.NRGBA{Pix: src.Pix, Stride: src.Stride, Rect: src.Rect}
+    }
+  case *image.RGBA64:
+    if mode == "straight" {
+      return &image.NRGBA64{Pix: src.Pix, Stride: src.Stride, Rect: src.Rect}
+    }
+  }
+  return img
+}
+
+// storePremultiplied returns an image whose stored (straight) color values
+// are the premultiplied colors of img, for consumers that expect
+// premultiplied data in a straight alpha format.
+func storePremultiplied(img image.Image) image.Image {
+  bounds := img.Bounds()
+  out := image.NewNRGBA64(bounds)
+  for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+    for x := bounds.Min.X; x < bounds.Max.X; x++ {
+      r, g, b, a := img.At(x, y).RGBA()
+      out.SetNRGBA64(x, y, color.NRGBA64{R: uint16(r), G: uint16(g), B: uint16(b), A: uint16(a)})
+    }
+  }
+  return out
+}
+
+// is16Bit reports whether img holds more than 8 bits per channel.
+func is16Bit(img image.Image) bool {
+  switch img.(type) {
+  case *image.Gray16, *image.Alpha16, *image.RGBA64, *image.NRGBA64:
+    return true
+  }
+  return false
+}
+
+// newCanvas returns an image with bounds r to draw the pixels of like into,
+// with 16 bits per channel if like has them so that they are not rounded to
+// 8 bits.
+func newCanvas(like image.Image, r image.Rectangle) draw.Image {
+  if is16Bit(like) {
+    return image.NewRGBA64(r)
+  }
+  return image.NewRGBA(r)
+}
+
+// CombineTile builds the tile at origin from every complete repeat of it in
+// img, taking the mean or, if median is set, the median of each pixel. This
+// averages out noise and compression artifacts. The colors are combined
+// premultiplied by alpha, since averaging straight colors lets the colors of
+// nearly transparent pixels bleed into the result as fringes.
+func CombineTile(img image.Image, origin image.Point, tileWidth, tileHeight int, median bool) image.Image {
+  bounds := img.Bounds()
+  // Step back from origin to the first repeat that starts within img.
+  start := image.Pt(
+    origin.X - (origin.X - bounds.Min.X) / tileWidth * tileWidth,
+    origin.Y - (origin.Y - bounds.Min.Y) / tileHeight * tileHeight,
+  )
+  var repeats []image.Point
+  for y := start.Y; y + tileHeight <= bounds.Max.Y; y += tileHeight {
+    for x := start.X; x + tileWidth <= bounds.Max.X; x += tileWidth {
+      repeats = append(repeats, image.Pt(x, y))
+    }
+  }
+  if len(repeats) == 0 {
+    return CropTile(img, origin, tileWidth, tileHeight, false)
+  }
+
+  rect := image.Rect(0, 0, tileWidth, tileHeight)
+  var tile draw.Image
+  if is16Bit(img) {
+    tile = image.NewRGBA64(rect)
+  } else {
+    tile = image.NewRGBA(rect)
+  }
+  samples := make([][4]uint32, len(repeats))
+  for y := 0; y < tileHeight; y++ {
+    for x := 0; x < tileWidth; x++ {
+      for idx, repeat := range repeats {
+        r, g, b, a := img.At(repeat.X + x, repeat.Y + y).RGBA()
+        samples[idx] = [4]uint32{r, g, b, a}
+      }
+      var combined [4]uint32
+      for c := 0; c < 4; c++ {
+        if median {
+          values := make([]int, len(samples))
+          for idx, sample := range samples {
+            values[idx] = int(sample[c])
+          }
+          sort.Ints(values)
+          combined[c] = uint32(values[len(values) / 2])
+        } else {
+          var sum uint64
+          for _, sample := range samples {
+            sum += uint64(sample[c])
+          }
+          combined[c] = uint32((sum + uint64(len(samples)) / 2) / uint64(len(samples)))
+        }
+      }
+      // Medians of separate channels can exceed the median alpha.
+      for c := 0; c < 3; c++ {
+        if combined[c] > combined[3] {
+          combined[c] = combined[3]
+        }
+      }
+      tile.Set(x, y, color.RGBA64{R: uint16(combined[0]), G: uint16(combined[1]), B: uint16(combined[2]), A: uint16(combined[3])})
+    }
+  }
+  return tile
+}
+
+// saveAnimation saves the tiles of the frames of g as an animated GIF when
+// name ends in .gif and as an animated PNG otherwise, each shown as long as
+// its frame and looping as g does.
+func (o outputSettings) saveAnimation(name string, tiles []image.Image, g *gif.GIF) error {
+  file, err := o.create(name)
+  if err != nil {
+    return err
+  }
+  defer file.Close()
+  if !strings.EqualFold(filepath.Ext(name), ".gif") {
+    return encodeAPNG(file, tiles, g.Delay, g.LoopCount)
+  }
+  // The palette of the GIF holds all colors of its frames unless they
+  // bring their own, which then go to the closest ones.
+  colors := g.Image[0].Palette
+  if global, ok := g.Config.ColorModel.(color.Palette); ok && len(global) > 0 {
+    colors = global
+  }
+  animation := &gif.GIF{Delay: g.Delay, LoopCount: g.LoopCount}
+  for _, tile := range tiles {
+    frame := image.NewPaletted(image.Rect(0, 0, tile.Bounds().Dx(), tile.Bounds().Dy()), colors)
+    draw.Draw(frame, frame.Rect, tile, tile.Bounds().Min, draw.Src)
+    animation.Image = append(animation.Image, frame)
+    animation.Disposal = append(animation.Disposal, gif.DisposalNone)
+  }
+  return gif.EncodeAll(file, animation)
+}
+
+// encodeGIF writes img to w as a GIF, quantized to at most 256 colors.
+func encodeGIF(w io.Writer, img image.Image) error {
+  return gif.Encode(w, quantize(img, 256), nil)
+}
+
+// quantize maps img to a palette of at most n colors. A paletted image that
+// fits keeps its own palette and an image of at most n colors keeps them
+// exactly. Others get a palette by median cut, which splits the box of
+// colors with the widest range in any channel at the median pixel of that
+// channel until there are n boxes, and takes the mean color of each box.
+// Pixels are not dithered, as the error dithering spreads does not wrap
+// around the edges of a tile and would show at its seams.
+func quantize(img image.Image, n int) *image.Paletted {
+  bounds := img.Bounds()
+  rect := image.Rect(0, 0, bounds.Dx(), bounds.Dy())
+  if src, ok := img.(*image.Paletted); ok && len(src.Palette) <= n {
+    out := image.NewPaletted(rect, src.Palette)
+    copyRows(out.Pix, out.Stride, src.Pix[src.PixOffset(bounds.Min.X, bounds.Min.Y):], src.Stride, rect.Dx(), rect.Dy())
+    return out
+  }
+
+  type entry struct {
+    c color.NRGBA
+    count int
+  }
+  key := func(c color.NRGBA) uint32 {
+    return uint32(c.R) << 24 | uint32(c.G) << 16 | uint32(c.B) << 8 | uint32(c.A)
+  }
+  channel := func(c color.NRGBA, i int) uint8 {
+    return [4]uint8{c.R, c.G, c.B, c.A}[i]
+  }
+  pixels := make([]color.NRGBA, 0, rect.Dx() * rect.Dy())
+  counts := make(map[color.NRGBA]int)
+  for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+    for x := bounds.Min.X; x < bounds.Max.X; x++ {
+      c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+      if c.A == 0 {
+        c = color.NRGBA{}
+      }
+      pixels = append(pixels, c)
+      counts[c]++
+    }
+  }
+  entries := make([]entry, 0, len(counts))
+  for c, count := range counts {
+    entries = append(entries, entry{c, count})
+  }
+  // Maps are iterated in random order, and the palette should not be.
+  sort.Slice(entries, func(i, j int) bool { return key(entries[i].c) < key(entries[j].c) })
+
+  var boxes [][]entry
+  if len(entries) > 0 {
+    boxes = append(boxes, entries)
+  }
+  for len(boxes) < n {
+    // Pick the box with the widest range in any channel.
+    best, bestChannel, bestRange := -1, 0, 0
+    for idx, box := range boxes {
+      for i := 0; i < 4 && len(box) > 1; i++ {
+        lo, hi := 255, 0
+        for _, e := range box {
+          lo, hi = min(lo, int(channel(e.c, i))), max(hi, int(channel(e.c, i)))
+        }
+        if hi - lo > bestRange {
+          best, bestChannel, bestRange = idx, i, hi - lo
+        }
+      }
+    }
+    if best < 0 {
+      break
+    }
+    box := boxes[best]
+    sort.SliceStable(box, func(i, j int) bool { return channel(box[i].c, bestChannel) < channel(box[j].c, bestChannel) })
+    total := 0
+    for _, e := range box {
+      total += e.count
+    }
+    split, seen := 1, box[0].count
+    for split < len(box) - 1 && 2 * seen < total {
+      seen += box[split].count
+      split++
+    }
+    boxes[best] = box[:split]
+    boxes = append(boxes, box[split:])
+  }
+
+  palette := make(color.Palette, len(boxes))
+  index := make(map[color.NRGBA]uint8, len(entries))
+  for idx, box := range boxes {
+    var sum [4]int
+    total := 0
+    for _, e := range box {
+      for i := range sum {
+        sum[i] += int(channel(e.c, i)) * e.count
+      }
+      total += e.count
+      index[e.c] = uint8(idx)
+    }
+    palette[idx] = color.NRGBA{uint8((sum[0] + total / 2) / total), uint8((sum[1] + total / 2) / total), uint8((sum[2] + total / 2) / total), uint8((sum[3] + total / 2) / total)}
+  }
+  out := image.NewPaletted(rect, palette)
+  for idx, c := range pixels {
+    out.Pix[idx / rect.Dx() * out.Stride + idx % rect.Dx()] = index[c]
+  }
+  return out
+}
+
+// encodeAPNG writes frames of the same size to w as an animated PNG, showing
+// each for its delay in hundredths of a second. A loopCount of 0 loops
+// forever and -1 shows the frames once, as in image/gif. The frames are
+// stored as 8-bit RGBA without filtering, which keeps the encoder short at
+// the cost of some size, as tiles are small.
+func encodeAPNG(w io.Writer, frames []image.Image, delays []int, loopCount int) error {
+  if len(frames) == 0 {
+    return errors.New("apng: no frames")
+  }
+  bounds := frames[0].Bounds()
+  var werr error
+  chunk := func(kind string, data []byte) {
+    if werr != nil {
+      return
+    }
+    var header [8]byte
+    binary.BigEndian.PutUint32(header[:4], uint32(len(data)))
+    copy(header[4:], kind)
+    crc := crc32.NewIEEE()
+    crc.Write(header[4:])
+    crc.Write(data)
+    var sum [4]byte
+    binary.BigEndian.PutUint32(sum[:], crc.Sum32())
+    for _, part := range [][]byte{header[:], data, sum[:]} {
+      if _, werr = w.Write(part); werr != nil {
+        return
+      }
+    }
+  }
+  if _, err := io.WriteString(w, "\x89PNG\r\n\x1a\n"); err != nil {
+    return err
+  }
+  ihdr := make([]byte, 13)
+  binary.BigEndian.PutUint32(ihdr[0:], uint32(bounds.Dx()))
+  binary.BigEndian.PutUint32(ihdr[4:], uint32(bounds.Dy()))
+  ihdr[8], ihdr[9] = 8, 6
+  chunk("IHDR", ihdr)
+  plays := 0
+  if loopCount > 0 {
+    plays = loopCount + 1
+  } else if loopCount < 0 {
+    plays = 1
+  }
+  actl := make([]byte, 8)
+  binary.BigEndian.PutUint32(actl[0:], uint32(len(frames)))
+  binary.BigEndian.PutUint32(actl[4:], uint32(plays))
+  chunk("acTL", actl)
+
+  sequence := uint32(0)
+  for idx, frame := range frames {
+    if frame.Bounds().Size() != bounds.Size() {
+      return fmt.Errorf("apng: frame %d is %v, not %v", idx + 1, frame.Bounds().Size(), bounds.Size())
+    }
+    delay := 0
+    if idx < len(delays) {
+      delay = delays[idx]
+    }
+    fctl := make([]byte, 26)
+    binary.BigEndian.PutUint32(fctl[0:], sequence)
+    binary.BigEndian.PutUint32(fctl[4:], uint32(bounds.Dx()))
+    binary.BigEndian.PutUint32(fctl[8:], uint32(bounds.Dy()))
+    binary.BigEndian.PutUint16(fctl[20:], uint16(delay))
+    binary.BigEndian.PutUint16(fctl[22:], 100)
+    chunk("fcTL", fctl)
+    sequence++
+
+    nrgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+    draw.Draw(nrgba, nrgba.Rect, frame, frame.Bounds().Min, draw.Src)
+    var compressed bytes.Buffer
+    z := zlib.NewWriter(&compressed)
+    for y := 0; y < bounds.Dy(); y++ {
+      z.Write([]byte{0})
+      z.Write(nrgba.Pix[y * nrgba.Stride:y * nrgba.Stride + 4 * bounds.Dx()])
+    }
+    if err := z.Close(); err != nil {
+      return err
+    }
+    // The first frame is the default image that plain PNG decoders show,
+    // and the others follow in frame data chunks numbered along with the
+    // frame controls.
+    if idx == 0 {
+      chunk("IDAT", compressed.Bytes())
+    } else {
+      fdat := make([]byte, 4, 4 + compressed.Len())
+      binary.BigEndian.PutUint32(fdat, sequence)
+      chunk("fdAT", append(fdat, compressed.Bytes()...))
+      sequence++
+    }
+  }
+  chunk("IEND", nil)
+  return werr
+}
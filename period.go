@@ -0,0 +1,1032 @@
+/*
+TileEx : A Tiling Pattern Extractor written in Go
+Copyright (C) 2023, Sarthak Shah (shahsarthakw@gmail.com)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+  "context"
+  "errors"
+  "io"
+  "fmt"
+  "sort"
+  "strconv"
+  "strings"
+  "image"
+  "image/color"
+  "log"
+  "math"
+  "runtime"
+  "sync"
+)
+
+// Color is a pixel as returned by color.Color.RGBA, premultiplied by its
+// alpha A.
+type Color struct {
+  R, G, B, A uint32
+}
+
+// colorAt returns the color of the pixel at (x, y) of img. The RGB that
+// color.CMYK approximates inks with is the same for different inks, such as
+// rich and plain black, so the A of CMYK pixels holds the inverse of their
+// K, which tells them apart.
+func colorAt(img image.Image, x, y int) Color {
+  if cmyk, ok := img.(*image.CMYK); ok {
+    c := cmyk.CMYKAt(x, y)
+    r, g, b, _ := c.RGBA()
+    return Color{R: r, G: g, B: b, A: 0xffff - uint32(c.K) * 0x101}
+  }
+  r, g, b, a := img.At(x, y).RGBA()
+  return Color{R: r, G: g, B: b, A: a}
+}
+
+// LineResult is the outcome of the periodicity search over a single row or
+// column. Score measures how well the line repeats at Period, from 0 for an
+// exact repeat to 1 for no repetition at all. Margin measures how decisive the
+// result was, from 0 when another lag scores as well to 1 when none comes
+// close, and is only computed for weighted voting.
+type LineResult struct {
+  Period int
+  Score float64
+  Margin float64
+}
+
+// subImager is implemented by all of the image types in the standard library.
+type subImager interface {
+  SubImage(r image.Rectangle) image.Image
+}
+
+const (
+  LOSSLESS = 0
+  LOSSY = 1
+)
+
+// VotePair is a candidate period together with the votes it received.
+type VotePair struct {
+  Period int
+  Votes float64
+}
+
+// frequencyPairs tallies the votes of the lines for each period. Every line
+// casts one vote, or a vote weighted by its Margin when weighted is set.
+// Periods with equal votes are ordered by tieBreak: the largest period first
+// for "largest", and the smallest first otherwise.
+func frequencyPairs(results []LineResult, weighted bool, preferFrequency bool, tieBreak string) ([]VotePair, float64) {
+  frequencyMap := make(map[int]float64)
+  for _, result := range results {
+    if weighted {
+      frequencyMap[result.Period] += result.Margin
+    } else {
+      frequencyMap[result.Period]++
+    }
+  }
+  var pairs []VotePair
+  var totalFrequency float64
+  for num, freq := range frequencyMap {
+    pairs = append(pairs, VotePair{Period: num, Votes: freq})
+    totalFrequency += freq
+  }
+  sort.Slice(pairs, func(i, j int) bool {
+    if preferFrequency && pairs[i].Votes != pairs[j].Votes {
+      return pairs[i].Votes > pairs[j].Votes
+    }
+    if !preferFrequency || tieBreak == "largest" {
+      return pairs[i].Period > pairs[j].Period
+    }
+    return pairs[i].Period < pairs[j].Period
+  })
+  return pairs, totalFrequency
+}
+
+func Gray(color Color) float64 {
+  r := float64(color.R) 
+  g := float64(color.G)
+  b := float64(color.B) 
+  return 0.299 * r +  0.587 * g + 0.114 * b
+}
+
+// The channels of a Color are unsigned, so subtracting them directly wraps
+// around whenever the second one is brighter. All color comparisons go
+// through the two helpers below, which never wrap.
+
+// signedDiff returns a - b.
+func signedDiff(a, b uint32) int64 {
+  return int64(a) - int64(b)
+}
+
+// absDiff returns |a - b|.
+func absDiff(a, b uint32) uint32 {
+  if a > b {
+    return a - b
+  }
+  return b - a
+}
+
+// maxColorDiff is the largest value ColorDiff can return, between black and
+// white.
+const maxColorDiff = 3 * 0xffff * 0xffff
+
+// ColorDiff returns the squared Euclidean distance between two colors,
+// alpha included. It is symmetric, zero only for equal colors, and at most
+// maxColorDiff, which it is capped at when a difference in alpha adds to
+// one in all three colors. Between opaque colors it is the distance of the
+// colors alone.
+func ColorDiff(x, y Color) int64 {
+  // This is signedDiff written out, which keeps ColorDiff cheap enough for
+  // the compiler to inline into the loops that call it.
+  R, G, B, A := int64(x.R) - int64(y.R), int64(x.G) - int64(y.G), int64(x.B) - int64(y.B), int64(x.A) - int64(y.A)
+  return min(R*R + G*G + B*B + A*A, maxColorDiff)
+}
+
+// Lab is a color in the CIE L*a*b* space, where distances follow how
+// different colors look.
+type Lab struct {
+  L, A, B float64
+}
+
+// ToLab converts an sRGB color to L*a*b* under the D65 white point.
+func ToLab(c Color) Lab {
+  linear := func(v uint32) float64 {
+    x := float64(v) / 0xffff
+    if x <= 0.04045 {
+      return x / 12.92
+    }
+    return math.Pow((x + 0.055) / 1.055, 2.4)
+  }
+  r, g, b := linear(c.R), linear(c.G), linear(c.B)
+  x := (0.4124 * r + 0.3576 * g + 0.1805 * b) / 0.95047
+  y := 0.2126 * r + 0.7152 * g + 0.0722 * b
+  z := (0.0193 * r + 0.1192 * g + 0.9505 * b) / 1.08883
+  f := func(t float64) float64 {
+    if t > 216.0 / 24389.0 {
+      return math.Cbrt(t)
+    }
+    return (24389.0 / 27.0 * t + 16) / 116
+  }
+  fx, fy, fz := f(x), f(y), f(z)
+  return Lab{L: 116 * fy - 16, A: 500 * (fx - fy), B: 200 * (fy - fz)}
+}
+
+// CIEDE2000 returns the CIEDE2000 color difference between two colors,
+// where about 1 is the smallest difference people notice.
+func CIEDE2000(x, y Lab) float64 {
+  const deg = math.Pi / 180
+  c1 := math.Hypot(x.A, x.B)
+  c2 := math.Hypot(y.A, y.B)
+  c7 := math.Pow((c1 + c2) / 2, 7)
+  g := 0.5 * (1 - math.Sqrt(c7 / (c7 + math.Pow(25, 7))))
+  a1, a2 := (1 + g) * x.A, (1 + g) * y.A
+  c1, c2 = math.Hypot(a1, x.B), math.Hypot(a2, y.B)
+  hue := func(a, b float64) float64 {
+    if a == 0 && b == 0 {
+      return 0
+    }
+    h := math.Atan2(b, a)
+    if h < 0 {
+      h += 2 * math.Pi
+    }
+    return h
+  }
+  h1, h2 := hue(a1, x.B), hue(a2, y.B)
+
+  dL := y.L - x.L
+  dC := c2 - c1
+  dh := 0.0
+  if c1 * c2 != 0 {
+    dh = h2 - h1
+    if dh > math.Pi {
+      dh -= 2 * math.Pi
+    } else if dh < -math.Pi {
+      dh += 2 * math.Pi
+    }
+  }
+  dH := 2 * math.Sqrt(c1 * c2) * math.Sin(dh / 2)
+
+  meanL := (x.L + y.L) / 2
+  meanC := (c1 + c2) / 2
+  meanH := h1 + h2
+  if c1 * c2 != 0 {
+    if math.Abs(h1 - h2) <= math.Pi {
+      meanH /= 2
+    } else if h1 + h2 < 2 * math.Pi {
+      meanH = (h1 + h2 + 2 * math.Pi) / 2
+    } else {
+      meanH = (h1 + h2 - 2 * math.Pi) / 2
+    }
+  }
+  t := 1 - 0.17 * math.Cos(meanH - 30 * deg) + 0.24 * math.Cos(2 * meanH) + 0.32 * math.Cos(3 * meanH + 6 * deg) - 0.2 * math.Cos(4 * meanH - 63 * deg)
+  l50 := (meanL - 50) * (meanL - 50)
+  sL := 1 + 0.015 * l50 / math.Sqrt(20 + l50)
+  sC := 1 + 0.045 * meanC
+  sH := 1 + 0.015 * meanC * t
+  meanC7 := math.Pow(meanC, 7)
+  rT := -2 * math.Sqrt(meanC7 / (meanC7 + math.Pow(25, 7))) * math.Sin(60 * deg * math.Exp(-math.Pow((meanH / deg - 275) / 25, 2)))
+  return math.Sqrt((dL / sL) * (dL / sL) + (dC / sC) * (dC / sC) + (dH / sH) * (dH / sH) + rT * (dC / sC) * (dH / sH))
+}
+
+// verifiedLags is how many of the best lags of the integer pass over a lossy
+// line are compared again with CIEDE2000.
+const verifiedLags = 4
+
+// ArrayPeriodicityJPGPlus returns the period of a lossy line. A cheap pass
+// compares the line with itself at every lag by the absolute differences of
+// its 8-bit channels, and only the best verifiedLags of them are compared
+// again by CIEDE2000, which follows how different compression artifacts and
+// real changes look far better but costs far more.
+func ArrayPeriodicityJPGPlus(colors []Color) int {
+  n := len(colors)
+  if n < 2 {
+    return 1
+  }
+  quantized := make([][3]int, n)
+  for idx, color := range colors {
+    quantized[idx] = [3]int{int(color.R >> 8), int(color.G >> 8), int(color.B >> 8)}
+  }
+  candidates := bestLags(n, func(k int) int {
+    sum := 0
+    for idx, color := range quantized {
+      other := quantized[(idx + k) % n]
+      sum += absInt(other[0] - color[0]) + absInt(other[1] - color[1]) + absInt(other[2] - color[2])
+    }
+    return sum
+  })
+  if len(candidates) == 1 || candidates[0].sum == 0 {
+    return candidates[0].lag
+  }
+
+  lab := make([]Lab, n)
+  for idx, color := range colors {
+    lab[idx] = ToLab(color)
+  }
+  return closestLag(lab, candidates)
+}
+
+// lagCandidate is a lag of a lossy line with the sum of the differences the
+// cheap pass found at it.
+type lagCandidate struct {
+  lag, sum int
+}
+
+// bestLags returns the verifiedLags lags of a line of n pixels with the
+// lowest sum, best first, with ties going to the smaller lag. Comparing
+// cyclically, lag k and lag n - k pair up the same pixels, so only the
+// smaller one of them is tried.
+func bestLags(n int, sum func(lag int) int) []lagCandidate {
+  var candidates []lagCandidate
+  for k := 1; 2 * k <= n; k++ {
+    s := sum(k)
+    if len(candidates) == verifiedLags && s >= candidates[len(candidates) - 1].sum {
+      continue
+    }
+    i := len(candidates)
+    for i > 0 && candidates[i - 1].sum > s {
+      i--
+    }
+    candidates = append(candidates[:i], append([]lagCandidate{{k, s}}, candidates[i:]...)...)
+    if len(candidates) > verifiedLags {
+      candidates = candidates[:verifiedLags]
+    }
+  }
+  return candidates
+}
+
+// closestLag returns the lag of candidates at which the line, given in
+// L*a*b*, differs least from itself by CIEDE2000.
+func closestLag(lab []Lab, candidates []lagCandidate) int {
+  n := len(lab)
+  minidx := candidates[0].lag
+  minsum := math.Inf(1)
+  for _, c := range candidates {
+    sum := 0.0
+    for idx, color := range lab {
+      sum += CIEDE2000(lab[(idx + c.lag) % n], color)
+    }
+    if sum < minsum || (sum == minsum && c.lag < minidx) {
+      minsum = sum
+      minidx = c.lag
+    }
+  }
+  return minidx
+}
+
+func ArrayPeriodicityJPG(colors []Color) int {
+  n := len(colors)
+  grayscale := make([]float64, n)
+  for idx, color := range colors {
+    grayscale[idx] = Gray(color)
+  }
+  var minsum float64
+  minidx := 1
+  for k := 1; k < n; k++ {
+    sum := 0.0
+    for idx, gray := range grayscale {
+      sum += math.Abs(grayscale[(idx + k) % n] - gray)
+    }
+    if k == 1 {
+      minsum = sum
+    } else {
+      if sum < minsum {
+        minsum = sum
+        minidx = k
+      }
+    }
+  }
+  return minidx
+}
+
+// ArrayPeriodicityPNG returns the shortest period of a lossless line, the
+// colors or gray levels of which repeat exactly.
+func ArrayPeriodicityPNG[T comparable](colors []T) int {
+  n := len(colors)
+  var prefixArray = make([]int, n)
+  var j = 0
+  for i := 1; i < n; i++ {
+    for j > 0 && colors[i] != colors[j] {
+      j = prefixArray[j - 1]
+    }
+    if colors[i] == colors[j] {
+      j += 1
+    }
+    prefixArray[i] = j
+  }
+  return n - prefixArray[n - 1]
+}
+
+// PeriodScore returns the mean squared color difference between the line and
+// itself shifted by period, normalized to [0, 1]. A period that leaves nothing
+// to compare scores 1.
+func PeriodScore(colors []Color, period int) float64 {
+  n := len(colors)
+  if period <= 0 || period >= n {
+    return 1.0
+  }
+  sum := 0.0
+  for idx := 0; idx + period < n; idx++ {
+    sum += float64(ColorDiff(colors[idx + period], colors[idx]))
+  }
+  return sum / float64(n - period) / maxColorDiff
+}
+
+// PeriodMargin returns how much worse the second-best lag scores than period,
+// relative to the second-best score. Multiples of period are not counted as
+// competitors since a periodic line repeats at all of them, and neither are
+// lags that leave less than a quarter of the line to compare.
+func PeriodMargin(colors []Color, period int) float64 {
+  return periodMargin(len(colors), period, func(k int) float64 {
+    return PeriodScore(colors, k)
+  })
+}
+
+// periodMargin is PeriodMargin for a line of n pixels that score gives the
+// PeriodScore of.
+func periodMargin(n, period int, score func(period int) float64) float64 {
+  best := score(period)
+  second := math.Inf(1)
+  for k := 1; 4 * k <= 3 * n; k++ {
+    if k % period == 0 {
+      continue
+    }
+    if score := score(k); score < second {
+      second = score
+    }
+  }
+  if math.IsInf(second, 1) || second <= best {
+    return 0.0
+  }
+  return (second - best) / second
+}
+
+func processLine(colors []Color, imageFormat int, withMargin bool) LineResult {
+  var period int
+  if imageFormat == LOSSY {
+    period = ArrayPeriodicityJPGPlus(colors)
+  } else {
+    period = ArrayPeriodicityPNG(colors)
+  }
+  result := LineResult{Period: period, Score: PeriodScore(colors, period)}
+  if withMargin {
+    result.Margin = PeriodMargin(colors, period)
+  }
+  return result
+}
+
+// The lines of grayscale images are compared by their levels alone, which
+// gives the same periods and scores as their colors would at a fraction of
+// the memory and time.
+
+// grayLine returns the 16-bit levels of the n pixels of img from start on,
+// each step further, and false if img is not grayscale.
+func grayLine(img image.Image, start, step image.Point, n int) ([]uint16, bool) {
+  levels := make([]uint16, n)
+  switch gray := img.(type) {
+  case *image.Gray:
+    at, stride := gray.PixOffset(start.X, start.Y), step.Y * gray.Stride + step.X
+    for idx := range levels {
+      levels[idx] = uint16(gray.Pix[at]) * 0x101
+      at += stride
+    }
+  case *image.Gray16:
+    at, stride := gray.PixOffset(start.X, start.Y), step.Y * gray.Stride + 2 * step.X
+    for idx := range levels {
+      levels[idx] = uint16(gray.Pix[at]) << 8 | uint16(gray.Pix[at + 1])
+      at += stride
+    }
+  default:
+    return nil, false
+  }
+  return levels, true
+}
+
+// grayPeriodicityJPGPlus is ArrayPeriodicityJPGPlus for gray levels.
+func grayPeriodicityJPGPlus(levels []uint16) int {
+  n := len(levels)
+  if n < 2 {
+    return 1
+  }
+  quantized := make([]int, n)
+  for idx, level := range levels {
+    quantized[idx] = int(level >> 8)
+  }
+  candidates := bestLags(n, func(k int) int {
+    sum := 0
+    for idx, level := range quantized {
+      sum += absInt(quantized[(idx + k) % n] - level)
+    }
+    return sum
+  })
+  if len(candidates) == 1 || candidates[0].sum == 0 {
+    return candidates[0].lag
+  }
+  lab := make([]Lab, n)
+  for idx, level := range levels {
+    v := uint32(level)
+    lab[idx] = ToLab(Color{R: v, G: v, B: v, A: 0xffff})
+  }
+  return closestLag(lab, candidates)
+}
+
+// grayPeriodScore is PeriodScore for gray levels, which differ in all three
+// colors at once.
+func grayPeriodScore(levels []uint16, period int) float64 {
+  n := len(levels)
+  if period <= 0 || period >= n {
+    return 1.0
+  }
+  sum := 0.0
+  for idx := 0; idx + period < n; idx++ {
+    d := float64(levels[idx + period]) - float64(levels[idx])
+    sum += 3 * d * d
+  }
+  return sum / float64(n - period) / maxColorDiff
+}
+
+// processGrayLine is processLine for gray levels.
+func processGrayLine(levels []uint16, imageFormat int, withMargin bool) LineResult {
+  var period int
+  if imageFormat == LOSSY {
+    period = grayPeriodicityJPGPlus(levels)
+  } else {
+    period = ArrayPeriodicityPNG(levels)
+  }
+  result := LineResult{Period: period, Score: grayPeriodScore(levels, period)}
+  if withMargin {
+    result.Margin = periodMargin(len(levels), period, func(k int) float64 {
+      return grayPeriodScore(levels, k)
+    })
+  }
+  return result
+}
+
+// The lossless lines of paletted images are compared by their palette
+// indices, after giving all indices of the same color the same one, which
+// keeps the comparison exact whatever the order of the palette.
+
+// paletteTable holds what comparing the lines of a paletted image by their
+// indices needs, built once for all of its lines.
+type paletteTable struct {
+  // index maps every index of the palette to that of its color in colors.
+  // Indices past the end of the palette are taken as the first.
+  index [256]uint8
+  colors []Color
+  // diffs holds the ColorDiff of every pair of colors, at the first index
+  // times the number of colors plus the second.
+  diffs []float64
+}
+
+// newPaletteTable returns the paletteTable of img, or nil if img is not
+// paletted.
+func newPaletteTable(img image.Image) *paletteTable {
+  paletted, ok := img.(*image.Paletted)
+  if !ok || len(paletted.Palette) == 0 {
+    return nil
+  }
+  t := &paletteTable{}
+  for idx := range t.index {
+    var c Color
+    if idx < len(paletted.Palette) {
+      r, g, b, a := paletted.Palette[idx].RGBA()
+      c = Color{R: r, G: g, B: b, A: a}
+    } else {
+      c = t.colors[t.index[0]]
+    }
+    t.index[idx] = uint8(len(t.colors))
+    for j, seen := range t.colors {
+      if seen == c {
+        t.index[idx] = uint8(j)
+        break
+      }
+    }
+    if int(t.index[idx]) == len(t.colors) {
+      t.colors = append(t.colors, c)
+    }
+  }
+  t.diffs = make([]float64, len(t.colors) * len(t.colors))
+  for i, x := range t.colors {
+    for j, y := range t.colors {
+      t.diffs[i * len(t.colors) + j] = float64(ColorDiff(x, y))
+    }
+  }
+  return t
+}
+
+// line returns the n pixels of img, the image t was built for, from start
+// on, each step further, as indices into the colors of t.
+func (t *paletteTable) line(img image.Image, start, step image.Point, n int) []uint8 {
+  paletted := img.(*image.Paletted)
+  indices := make([]uint8, n)
+  at, stride := paletted.PixOffset(start.X, start.Y), step.Y * paletted.Stride + step.X
+  for idx := range indices {
+    indices[idx] = t.index[paletted.Pix[at]]
+    at += stride
+  }
+  return indices
+}
+
+// palettePeriodScore is PeriodScore for the indices of a line of the given
+// number of colors. diffs holds the ColorDiff of every pair of them, at the
+// first index times colors plus the second.
+func palettePeriodScore(indices []uint8, diffs []float64, colors, period int) float64 {
+  n := len(indices)
+  if period <= 0 || period >= n {
+    return 1.0
+  }
+  sum := 0.0
+  for idx := 0; idx + period < n; idx++ {
+    sum += diffs[int(indices[idx + period]) * colors + int(indices[idx])]
+  }
+  return sum / float64(n - period) / maxColorDiff
+}
+
+// processPaletteLine is processLine for the indices of a lossless line.
+func processPaletteLine(indices []uint8, t *paletteTable, withMargin bool) LineResult {
+  period := ArrayPeriodicityPNG(indices)
+  result := LineResult{Period: period, Score: palettePeriodScore(indices, t.diffs, len(t.colors), period)}
+  if withMargin {
+    result.Margin = periodMargin(len(indices), period, func(k int) float64 {
+      return palettePeriodScore(indices, t.diffs, len(t.colors), k)
+    })
+  }
+  return result
+}
+
+func processRow(ctx context.Context, img image.Image, palette *paletteTable, imageFormat int, withMargin bool, rowIdx int, wg *sync.WaitGroup, resultRow []LineResult, tick func()) {
+  defer wg.Done()
+  if tick != nil {
+    defer tick()
+  }
+  if ctx.Err() != nil {
+    return
+  }
+
+  bounds := img.Bounds()
+  if levels, ok := grayLine(img, image.Pt(bounds.Min.X, rowIdx), image.Pt(1, 0), bounds.Dx()); ok {
+    resultRow[rowIdx - bounds.Min.Y] = processGrayLine(levels, imageFormat, withMargin)
+    return
+  }
+  if imageFormat == LOSSLESS && palette != nil {
+    indices := palette.line(img, image.Pt(bounds.Min.X, rowIdx), image.Pt(1, 0), bounds.Dx())
+    resultRow[rowIdx - bounds.Min.Y] = processPaletteLine(indices, palette, withMargin)
+    return
+  }
+  rowColors := make([]Color, bounds.Dx())
+
+  for x := bounds.Min.X; x < bounds.Max.X; x++ {
+    rowColors[x - bounds.Min.X] = colorAt(img, x, rowIdx)
+  }
+
+  resultRow[rowIdx - bounds.Min.Y] = processLine(rowColors, imageFormat, withMargin)
+}
+
+func processCol(ctx context.Context, img image.Image, palette *paletteTable, imageFormat int, withMargin bool, colIdx int, wg *sync.WaitGroup, resultCol []LineResult, tick func()) {
+  defer wg.Done()
+  if tick != nil {
+    defer tick()
+  }
+  if ctx.Err() != nil {
+    return
+  }
+
+  bounds := img.Bounds()
+  if levels, ok := grayLine(img, image.Pt(colIdx, bounds.Min.Y), image.Pt(0, 1), bounds.Dy()); ok {
+    resultCol[colIdx - bounds.Min.X] = processGrayLine(levels, imageFormat, withMargin)
+    return
+  }
+  if imageFormat == LOSSLESS && palette != nil {
+    indices := palette.line(img, image.Pt(colIdx, bounds.Min.Y), image.Pt(0, 1), bounds.Dy())
+    resultCol[colIdx - bounds.Min.X] = processPaletteLine(indices, palette, withMargin)
+    return
+  }
+  colColors := make([]Color, bounds.Dy())
+
+  for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+    colColors[y - bounds.Min.Y] = colorAt(img, colIdx, y)
+  }
+
+  resultCol[colIdx - bounds.Min.X] = processLine(colColors, imageFormat, withMargin)
+}
+
+// rowPeriodicities returns the detected period of every row of img, indexed
+// from the top of its bounds. palette is the paletteTable of img, if it is
+// paletted. Rows not yet started when ctx is done are skipped, and the cause
+// of ctx is returned.
+func rowPeriodicities(ctx context.Context, img image.Image, palette *paletteTable, imageFormat int, withMargin bool, tick func()) ([]LineResult, error) {
+  bounds := img.Bounds()
+  resultRow := make([]LineResult, bounds.Dy())
+
+  // A worker per processor rather than a goroutine per row keeps the
+  // goroutines of images analyzed at the same time in check.
+  var wg sync.WaitGroup
+  rows := make(chan int)
+  for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+    go func() {
+      for y := range rows {
+        processRow(ctx, img, palette, imageFormat, withMargin, y, &wg, resultRow, tick)
+      }
+    }()
+  }
+  for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+    wg.Add(1)
+    rows <- y
+  }
+  close(rows)
+  wg.Wait()
+
+  return resultRow, context.Cause(ctx)
+}
+
+// colPeriodicities returns the detected period of every column of img, indexed
+// from the left of its bounds. Like rowPeriodicities, it stops when ctx is
+// done.
+func colPeriodicities(ctx context.Context, img image.Image, palette *paletteTable, imageFormat int, withMargin bool, tick func()) ([]LineResult, error) {
+  bounds := img.Bounds()
+  resultCol := make([]LineResult, bounds.Dx())
+
+  var wg sync.WaitGroup
+  cols := make(chan int)
+  for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+    go func() {
+      for x := range cols {
+        processCol(ctx, img, palette, imageFormat, withMargin, x, &wg, resultCol, tick)
+      }
+    }()
+  }
+  for x := bounds.Min.X; x < bounds.Max.X; x++ {
+    wg.Add(1)
+    cols <- x
+  }
+  close(cols)
+  wg.Wait()
+
+  return resultCol, context.Cause(ctx)
+}
+
+// linePeriods returns just the periods of the line results.
+func linePeriods(results []LineResult) []int {
+  periods := make([]int, len(results))
+  for idx, result := range results {
+    periods[idx] = result.Period
+  }
+  return periods
+}
+
+// rejectPoorLines discards the lines whose score is anomalously poor compared
+// to the rest of the image, such as scanned rows crossed by scratches or dust.
+// A score is anomalous when it lies more than threshold scaled median absolute
+// deviations above the median score.
+func rejectPoorLines(results []LineResult, threshold float64) []LineResult {
+  if len(results) == 0 {
+    return results
+  }
+  scores := make([]float64, len(results))
+  for idx, result := range results {
+    scores[idx] = result.Score
+  }
+  median := medianOf(scores)
+  for idx := range scores {
+    scores[idx] = math.Abs(scores[idx] - median)
+  }
+  // 1.4826 makes the MAD a consistent estimator of the standard deviation.
+  limit := median + threshold * 1.4826 * medianOf(scores)
+
+  var kept []LineResult
+  for _, result := range results {
+    if result.Score <= limit {
+      kept = append(kept, result)
+    }
+  }
+  return kept
+}
+
+func medianOf(values []float64) float64 {
+  sorted := append([]float64(nil), values...)
+  sort.Float64s(sorted)
+  mid := len(sorted) / 2
+  if len(sorted) % 2 == 0 {
+    return (sorted[mid - 1] + sorted[mid]) / 2.0
+  }
+  return sorted[mid]
+}
+
+// choosePeriod runs the frequency vote over the per-line periods and returns
+// the first period whose share of the vote reaches tolerance, together with
+// its share of the vote in percent. If none does, it falls back to the first
+// period.
+func choosePeriod(results []LineResult, weighted bool, tolerance float64, preferFrequency bool, tieBreak string) (int, float64) {
+  period, share, _ := votePeriod(results, weighted, tolerance, preferFrequency, tieBreak)
+  return period, share
+}
+
+// votePeriod is choosePeriod, also reporting whether the period actually
+// reached tolerance.
+func votePeriod(results []LineResult, weighted bool, tolerance float64, preferFrequency bool, tieBreak string) (int, float64, bool) {
+  pairs, totalFrequency := frequencyPairs(results, weighted, preferFrequency, tieBreak)
+  if totalFrequency == 0 {
+    // No line was decisive at all, e.g. a flat image, so count them equally.
+    pairs, totalFrequency = frequencyPairs(results, false, preferFrequency, tieBreak)
+  }
+  if len(pairs) == 0 {
+    return 0, 0.0, false
+  }
+  periodicityIdx := 0
+  for periodicityIdx < len(pairs) &&
+  pairs[periodicityIdx].Votes < math.Floor(totalFrequency * tolerance) {
+    periodicityIdx += 1
+  }
+  pair := pairs[periodicityIdx % len(pairs)]
+  return pair.Period, (pair.Votes/totalFrequency)*100.0, periodicityIdx < len(pairs)
+}
+
+// consensusPeriod is choosePeriod, reporting the outcome of the vote and
+// returning the share of the vote as a confidence from 0 to 1. It fails with
+// ErrAmbiguousPeriod if no period reaches tolerance and with ErrNoPeriodicity
+// if there was nothing to vote on.
+func consensusPeriod(logger *log.Logger, label string, results []LineResult, weighted bool, tolerance float64, preferFrequency bool, tieBreak string) (int, float64, error) {
+  period, share, reached := votePeriod(results, weighted, tolerance, preferFrequency, tieBreak)
+  if period == 0 {
+    return 0, 0, fmt.Errorf("%w: no %s to vote on", ErrNoPeriodicity, strings.ToLower(label))
+  }
+  logger.Printf(tr("%s periodicity is %f percent of total frequency.\n"), tr(label), share)
+  logger.Printf(tr("%s Periodicity: %d\n"), tr(label), period)
+  if !reached {
+    return 0, 0, fmt.Errorf("%w: no %s period reaches %g percent of the vote", ErrAmbiguousPeriod, strings.ToLower(label), tolerance * 100.0)
+  }
+  return period, share / 100.0, nil
+}
+
+// Errors that explain why no tile could be extracted, so that callers can
+// tell a pattern that does not repeat from a file that could not be read.
+var (
+  ErrNoPeriodicity = errors.New("no repeating pattern found")
+  ErrImageTooSmall = errors.New("image too small to find a repeat in")
+  ErrImageTooLarge = errors.New("image too large to analyze")
+  ErrAmbiguousPeriod = errors.New("no period has enough of the vote")
+)
+
+// minImageSize is the smallest width and height in which a repeat is looked
+// for.
+const minImageSize = 4
+
+// MaxDimension and MaxPixels bound the images that are analyzed. Sums of
+// squared color differences are kept in int64, to which a difference of up
+// to maxColorDiff (about 1.3e10) can be added about 7e8 times, so sums over
+// a line stay exact up to MaxDimension and sums over a whole image, as in
+// alignTile, up to MaxPixels. The limits also keep pixel indices within a
+// 32-bit int.
+const (
+  MaxDimension = 1 << 16
+  MaxPixels = 1 << 28
+)
+
+// checkSize fails with ErrImageTooSmall or ErrImageTooLarge unless a width
+// by height image is within the supported sizes.
+func checkSize(width, height int) error {
+  if width < minImageSize || height < minImageSize {
+    return fmt.Errorf("%w: %dx%d", ErrImageTooSmall, width, height)
+  }
+  return checkMaxSize(width, height)
+}
+
+// checkMaxSize fails with ErrImageTooLarge if a width by height image is
+// larger than supported.
+func checkMaxSize(width, height int) error {
+  if width > MaxDimension || height > MaxDimension || int64(width) * int64(height) > MaxPixels {
+    return fmt.Errorf("%w: %dx%d, the limit is %d pixels across and %d in total", ErrImageTooLarge, width, height, MaxDimension, MaxPixels)
+  }
+  return nil
+}
+
+// parseSweep parses a start:end:step range of tolerances in percent.
+func parseSweep(sweep string) (float64, float64, float64, error) {
+  parts := strings.Split(sweep, ":")
+  if len(parts) != 3 {
+    return 0, 0, 0, fmt.Errorf("invalid sweep %q, expected start:end:step", sweep)
+  }
+  var bounds [3]float64
+  for idx, part := range parts {
+    value, err := strconv.ParseFloat(part, 64)
+    if err != nil {
+      return 0, 0, 0, fmt.Errorf("invalid sweep %q: %v", sweep, err)
+    }
+    bounds[idx] = value
+  }
+  if bounds[2] <= 0 || bounds[1] < bounds[0] {
+    return 0, 0, 0, fmt.Errorf("invalid sweep %q, expected start <= end and a positive step", sweep)
+  }
+  return bounds[0], bounds[1], bounds[2], nil
+}
+
+// sweepTolerance reports the periods chosen at every tolerance of the sweep,
+// marking the tolerances at which the choice changes.
+func sweepTolerance(w io.Writer, rowLines, colLines []LineResult, weighted bool, start, end, step float64) {
+  fmt.Fprintln(w, "Tolerance  Row period  Col period")
+  lastRow, lastCol := -1, -1
+  for i := 0; start + float64(i) * step <= end + step * 1e-9; i++ {
+    tolerance := start + float64(i) * step
+    rowPeriod, _ := choosePeriod(rowLines, weighted, tolerance / 100.0, false, "")
+    colPeriod, _ := choosePeriod(colLines, weighted, tolerance / 100.0, false, "")
+    marker := ""
+    if i > 0 && (rowPeriod != lastRow || colPeriod != lastCol) {
+      marker = "  (changed)"
+    }
+    fmt.Fprintf(w, "%8.3f%%  %10d  %10d%s\n", tolerance, rowPeriod, colPeriod, marker)
+    lastRow, lastCol = rowPeriod, colPeriod
+  }
+}
+
+// repeatingLines drops the lines in which no repetition was found at all. In
+// a screenshot these lines cross windows, toolbars and other UI elements, so
+// their votes only add noise.
+func repeatingLines(results []LineResult, length int) []LineResult {
+  var repeating []LineResult
+  for _, result := range results {
+    if result.Period < length {
+      repeating = append(repeating, result)
+    }
+  }
+  return repeating
+}
+
+// cleanBand returns the longest run of consecutive lines whose period agrees
+// with the consensus period. A line agrees when its own period divides the
+// consensus, since flat stretches of a tile legitimately repeat faster.
+func cleanBand(periods []int, period int) (int, int) {
+  bestStart, bestEnd := 0, 0
+  start := 0
+  for idx := 0; idx <= len(periods); idx++ {
+    if idx < len(periods) && periods[idx] > 0 && period % periods[idx] == 0 {
+      continue
+    }
+    if idx - start > bestEnd - bestStart {
+      bestStart, bestEnd = start, idx
+    }
+    start = idx + 1
+  }
+  return bestStart, bestEnd
+}
+
+// screenshotRegion treats lines that disagree with the consensus periods as
+// UI chrome (windows, toolbars, status bars) and returns the largest band of
+// the image that is made up of background only. Every pixel of a row that
+// agrees with the row consensus belongs to the background, so a band of such
+// rows spans the full width of the image, and likewise for columns.
+func screenshotRegion(bounds image.Rectangle, rowPeriods, colPeriods []int, rowPeriod, colPeriod int) image.Rectangle {
+  rowStart, rowEnd := cleanBand(rowPeriods, rowPeriod)
+  colStart, colEnd := cleanBand(colPeriods, colPeriod)
+  rowBand := image.Rect(bounds.Min.X, bounds.Min.Y + rowStart, bounds.Max.X, bounds.Min.Y + rowEnd)
+  colBand := image.Rect(bounds.Min.X + colStart, bounds.Min.Y, bounds.Min.X + colEnd, bounds.Max.Y)
+  if rowBand.Dx() * rowBand.Dy() >= colBand.Dx() * colBand.Dy() {
+    return rowBand
+  }
+  return colBand
+}
+
+// HighPass removes the variations of img whose wavelength is above the given
+// number of pixels, such as a soft lighting gradient across a photo, by
+// subtracting a box blur of that size. The result is centered on mid-gray so
+// that it can still be compared as colors.
+func HighPass(img image.Image, wavelength int) *image.NRGBA64 {
+  bounds := img.Bounds()
+  width, height := bounds.Dx(), bounds.Dy()
+  radius := wavelength / 2
+  if radius < 1 {
+    radius = 1
+  }
+
+  var channels [3][]float64
+  for c := range channels {
+    channels[c] = make([]float64, width * height)
+  }
+  for y := 0; y < height; y++ {
+    for x := 0; x < width; x++ {
+      r, g, b, _ := img.At(bounds.Min.X + x, bounds.Min.Y + y).RGBA()
+      channels[0][y * width + x] = float64(r)
+      channels[1][y * width + x] = float64(g)
+      channels[2][y * width + x] = float64(b)
+    }
+  }
+
+  filtered := image.NewNRGBA64(bounds)
+  for c, channel := range channels {
+    blurred := boxBlur(channel, width, height, radius, 1, width)
+    blurred = boxBlur(blurred, height, width, radius, width, 1)
+    for idx, value := range channel {
+      v := uint16(math.Max(0, math.Min(65535, value - blurred[idx] + 32768)))
+      pix := filtered.Pix[(idx / width) * filtered.Stride + (idx % width) * 8:]
+      pix[c * 2] = uint8(v >> 8)
+      pix[c * 2 + 1] = uint8(v)
+    }
+  }
+  for idx := 0; idx < width * height; idx++ {
+    pix := filtered.Pix[(idx / width) * filtered.Stride + (idx % width) * 8:]
+    pix[6] = 0xff
+    pix[7] = 0xff
+  }
+  return filtered
+}
+
+// opaqueView shows an image as opaque, with the premultiplied colors of its
+// pixels, which are black where it is transparent.
+type opaqueView struct {
+  image.Image
+}
+
+func (v opaqueView) ColorModel() color.Model {
+  return color.RGBA64Model
+}
+
+func (v opaqueView) At(x, y int) color.Color {
+  r, g, b, _ := v.Image.At(x, y).RGBA()
+  return color.RGBA64{R: uint16(r), G: uint16(g), B: uint16(b), A: 0xffff}
+}
+
+func (v opaqueView) SubImage(r image.Rectangle) image.Image {
+  return opaqueView{v.Image.(subImager).SubImage(r)}
+}
+
+// ignoreAlpha returns img as detection sees it without -alpha-metric, which
+// leaves alpha out of the comparison of colors. Opaque images are returned
+// as they are.
+func ignoreAlpha(img image.Image) image.Image {
+  if opaque, ok := img.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+    return img
+  }
+  return opaqueView{img}
+}
+
+// boxBlur averages values over a window of the given radius along one axis.
+// The axis has length entries, each step is step apart, and lines lines
+// of it start lineStep apart. The window is clamped at the edges.
+func boxBlur(values []float64, length, lines, radius, step, lineStep int) []float64 {
+  blurred := make([]float64, len(values))
+  prefix := make([]float64, length + 1)
+  for line := 0; line < lines; line++ {
+    base := line * lineStep
+    for i := 0; i < length; i++ {
+      prefix[i + 1] = prefix[i] + values[base + i * step]
+    }
+    for i := 0; i < length; i++ {
+      lo, hi := i - radius, i + radius + 1
+      if lo < 0 {
+        lo = 0
+      }
+      if hi > length {
+        hi = length
+      }
+      blurred[base + i * step] = (prefix[hi] - prefix[lo]) / float64(hi - lo)
+    }
+  }
+  return blurred
+}
@@ -0,0 +1,275 @@
+/*
+TileEx : A Tiling Pattern Extractor written in Go
+Copyright (C) 2023, Sarthak Shah (shahsarthakw@gmail.com)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+  "bytes"
+  "encoding/binary"
+  "errors"
+  "io"
+  "fmt"
+  "image"
+  "image/color"
+)
+
+// PSD and PSB files are decoded here as well, from the composite image that
+// Photoshop stores next to the layers unless "Maximize Compatibility" was
+// turned off. Bitmap, gray, indexed, RGB and CMYK documents of up to 16 bits
+// are covered, raw or with RLE compression. Extra channels, which hold
+// transparency or saved selections, are left out.
+func init() {
+  registerFormat("psd", "8BPS\x00\x01", decodePSD, decodePSDConfig)
+  registerFormat("psd", "8BPS\x00\x02", decodePSD, decodePSDConfig)
+}
+
+// psdHeader is what decoding a PSD needs from its header and the sections
+// that come before the composite image.
+type psdHeader struct {
+  // version is 1 for PSD and 2 for PSB, the large document format.
+  version, channels, width, height, depth, mode int
+  palette color.Palette
+  // pixels is the offset of the composite image.
+  pixels int
+}
+
+// psdColors are the channels of the composite image of each color mode,
+// from bitmap to CMYK, that make up its colors.
+var psdColors = map[int]int{0: 1, 1: 1, 2: 1, 3: 3, 4: 4}
+
+func readPSDHeader(data []byte) (psdHeader, error) {
+  var h psdHeader
+  if len(data) < 26 || string(data[:4]) != "8BPS" {
+    return h, errors.New("psd: not a PSD")
+  }
+  be := binary.BigEndian
+  h.version = int(be.Uint16(data[4:6]))
+  h.channels, h.height, h.width = int(be.Uint16(data[12:14])), int(be.Uint32(data[14:18])), int(be.Uint32(data[18:22]))
+  h.depth, h.mode = int(be.Uint16(data[22:24])), int(be.Uint16(data[24:26]))
+  colors, ok := psdColors[h.mode]
+  switch {
+  case h.version != 1 && h.version != 2:
+    return h, fmt.Errorf("psd: unknown version %d", h.version)
+  case h.width <= 0 || h.height <= 0:
+    return h, errors.New("psd: invalid image size")
+  case !ok:
+    return h, fmt.Errorf("psd: color mode %d is not supported", h.mode)
+  case h.mode == 0 && h.depth != 1, h.mode == 2 && h.depth != 8, h.mode != 0 && h.depth != 8 && h.depth != 16:
+    return h, fmt.Errorf("psd: %d-bit color mode %d is not supported", h.depth, h.mode)
+  case h.channels < colors:
+    return h, fmt.Errorf("psd: %d channels are too few for color mode %d", h.channels, h.mode)
+  }
+  // Three sections of a given length come before the composite image: the
+  // palette, the image resources and the layers, whose length takes eight
+  // bytes in PSB.
+  at := 26
+  var sections [3][]byte
+  for idx := range sections {
+    lengthSize := 4
+    if idx == 2 && h.version == 2 {
+      lengthSize = 8
+    }
+    if at + lengthSize > len(data) {
+      return h, errors.New("psd: truncated header")
+    }
+    length := uint64(be.Uint32(data[at:]))
+    if lengthSize == 8 {
+      length = be.Uint64(data[at:])
+    }
+    at += lengthSize
+    if length > uint64(len(data) - at) {
+      return h, errors.New("psd: truncated header")
+    }
+    sections[idx] = data[at:at + int(length)]
+    at += int(length)
+  }
+  h.pixels = at
+  if h.mode == 2 {
+    // The palette holds all reds, then all greens and then all blues.
+    if len(sections[0]) < 768 {
+      return h, errors.New("psd: missing palette")
+    }
+    h.palette = make(color.Palette, 256)
+    for i := range h.palette {
+      h.palette[i] = color.RGBA{sections[0][i], sections[0][256 + i], sections[0][512 + i], 0xff}
+    }
+  }
+  return h, nil
+}
+
+func decodePSDConfig(r io.Reader) (image.Config, error) {
+  data, err := io.ReadAll(r)
+  if err != nil {
+    return image.Config{}, err
+  }
+  h, err := readPSDHeader(data)
+  if err != nil {
+    return image.Config{}, err
+  }
+  model := map[int]color.Model{0: color.GrayModel, 1: color.GrayModel, 2: h.palette, 3: color.RGBAModel, 4: color.CMYKModel}[h.mode]
+  return image.Config{ColorModel: model, Width: h.width, Height: h.height}, nil
+}
+
+func decodePSD(r io.Reader) (image.Image, error) {
+  data, err := io.ReadAll(r)
+  if err != nil {
+    return nil, err
+  }
+  h, err := readPSDHeader(data)
+  if err != nil {
+    return nil, err
+  }
+  if err := checkMaxSize(h.width, h.height); err != nil {
+    return nil, err
+  }
+  if h.pixels + 2 > len(data) {
+    return nil, errors.New("psd: missing composite image")
+  }
+  compression := binary.BigEndian.Uint16(data[h.pixels:])
+  body := data[h.pixels + 2:]
+  // The channels are stored one after the other, and only the ones that
+  // make up the colors are read.
+  colors := psdColors[h.mode]
+  rowBytes := (h.width * h.depth + 7) / 8
+  planeSize := h.height * rowBytes
+  size := colors * planeSize
+  var pix []byte
+  switch compression {
+  case 0:
+    pix = body
+  case 1:
+    // Every row of every channel is compressed with PackBits on its own,
+    // and their compressed sizes come first.
+    countSize := 2 * h.version
+    if h.channels * h.height * countSize > len(body) {
+      return nil, errors.New("psd: truncated row sizes")
+    }
+    compressed := 0
+    for row := 0; row < colors * h.height; row++ {
+      if countSize == 2 {
+        compressed += int(binary.BigEndian.Uint16(body[2 * row:]))
+      } else {
+        compressed += int(binary.BigEndian.Uint32(body[4 * row:]))
+      }
+    }
+    body = body[h.channels * h.height * countSize:]
+    if compressed > len(body) {
+      return nil, errors.New("psd: truncated pixels")
+    }
+    pix = unpackBits(body[:compressed], size)
+  default:
+    return nil, fmt.Errorf("psd: compression %d is not supported", compression)
+  }
+  if len(pix) < size {
+    return nil, errors.New("psd: truncated pixels")
+  }
+  plane := func(c, y int) []byte {
+    return pix[c * planeSize + y * rowBytes:c * planeSize + (y + 1) * rowBytes]
+  }
+
+  rect := image.Rect(0, 0, h.width, h.height)
+  switch {
+  case h.mode == 0:
+    // Set bits are black.
+    img := image.NewGray(rect)
+    for y := 0; y < h.height; y++ {
+      row := plane(0, y)
+      for x := 0; x < h.width; x++ {
+        if row[x / 8] & (0x80 >> (x % 8)) == 0 {
+          img.Pix[y * img.Stride + x] = 0xff
+        }
+      }
+    }
+    return img, nil
+  case h.mode == 1 && h.depth == 16:
+    img := image.NewGray16(rect)
+    for y := 0; y < h.height; y++ {
+      copy(img.Pix[y * img.Stride:], plane(0, y))
+    }
+    return img, nil
+  case h.mode == 1:
+    img := image.NewGray(rect)
+    for y := 0; y < h.height; y++ {
+      copy(img.Pix[y * img.Stride:], plane(0, y))
+    }
+    return img, nil
+  case h.mode == 2:
+    img := image.NewPaletted(rect, h.palette)
+    for y := 0; y < h.height; y++ {
+      copy(img.Pix[y * img.Stride:], plane(0, y))
+    }
+    return img, nil
+  case h.mode == 3 && h.depth == 16:
+    img := image.NewRGBA64(rect)
+    for y := 0; y < h.height; y++ {
+      for x := 0; x < h.width; x++ {
+        at := y * img.Stride + 8 * x
+        for c := 0; c < 3; c++ {
+          copy(img.Pix[at + 2 * c:at + 2 * c + 2], plane(c, y)[2 * x:])
+        }
+        img.Pix[at + 6], img.Pix[at + 7] = 0xff, 0xff
+      }
+    }
+    return img, nil
+  case h.mode == 3:
+    img := image.NewRGBA(rect)
+    for y := 0; y < h.height; y++ {
+      for x := 0; x < h.width; x++ {
+        at := y * img.Stride + 4 * x
+        img.Pix[at], img.Pix[at + 1], img.Pix[at + 2], img.Pix[at + 3] = plane(0, y)[x], plane(1, y)[x], plane(2, y)[x], 0xff
+      }
+    }
+    return img, nil
+  }
+  // CMYK inks are stored inverted, with 0 for full ink, and image.CMYK only
+  // holds 8 of their bits.
+  img := image.NewCMYK(rect)
+  bytesPerSample := h.depth / 8
+  for y := 0; y < h.height; y++ {
+    for x := 0; x < h.width; x++ {
+      for c := 0; c < 4; c++ {
+        img.Pix[y * img.Stride + 4 * x + c] = 0xff - plane(c, y)[bytesPerSample * x]
+      }
+    }
+  }
+  return img, nil
+}
+
+// unpackBits unpacks the PackBits compression of PSD files into about size
+// bytes. Runs are a count byte followed by count+1 literal bytes, or by one
+// byte to repeat 1-count times, so two bytes unpack to at most 128. size
+// comes from the header and is not allocated unless block can hold that
+// much.
+func unpackBits(block []byte, size int) []byte {
+  out := make([]byte, 0, min(size, 64 * len(block)))
+  for i := 0; i < len(block) && len(out) < size; {
+    n := int(int8(block[i]))
+    i++
+    switch {
+    case n >= 0 && i + n < len(block):
+      out = append(out, block[i:i + n + 1]...)
+      i += n + 1
+    case n >= 0:
+      out = append(out, block[i:]...)
+      i = len(block)
+    case n != -128 && i < len(block):
+      out = append(out, bytes.Repeat(block[i:i + 1], 1 - n)...)
+      i++
+    }
+  }
+  return out
+}
@@ -0,0 +1,218 @@
+/*
+TileEx : A Tiling Pattern Extractor written in Go
+Copyright (C) 2023, Sarthak Shah (shahsarthakw@gmail.com)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+  "bytes"
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/hex"
+  "io"
+  "net/http"
+  "net/url"
+  "os"
+  "fmt"
+  "sort"
+  "strings"
+  "time"
+)
+
+// isURL reports whether input names an image on the web or in object
+// storage rather than a file.
+func isURL(input string) bool {
+  return strings.HasPrefix(input, "http://") || strings.HasPrefix(input, "https://") || isObjectURI(input)
+}
+
+// isObjectURI reports whether name is an s3:// or gs:// object.
+func isObjectURI(name string) bool {
+  return strings.HasPrefix(name, "s3://") || strings.HasPrefix(name, "gs://")
+}
+
+// objectRequest makes the HTTP request for method on an s3:// or gs://
+// object, with body as its content. S3 requests are signed with the keys in
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY for AWS_REGION, and go to
+// AWS_ENDPOINT_URL instead of AWS when it is set, as for MinIO. Cloud
+// Storage requests carry the token in GOOGLE_OAUTH_ACCESS_TOKEN, such as one
+// from gcloud auth print-access-token. Without them, only public objects
+// can be read.
+func objectRequest(method, uri string, body []byte) (*http.Request, error) {
+  u, err := url.Parse(uri)
+  if err != nil {
+    return nil, err
+  }
+  key := strings.TrimPrefix(u.Path, "/")
+  if u.Host == "" || key == "" {
+    return nil, fmt.Errorf("invalid object %q, expected %s://bucket/key", uri, u.Scheme)
+  }
+  var target string
+  region := os.Getenv("AWS_REGION")
+  if region == "" {
+    region = os.Getenv("AWS_DEFAULT_REGION")
+  }
+  if region == "" {
+    region = "us-east-1"
+  }
+  switch {
+  case u.Scheme == "gs":
+    target = "https://storage.googleapis.com/" + u.Host + "/" + escapeObjectKey(key)
+  case os.Getenv("AWS_ENDPOINT_URL") != "":
+    // Other S3 implementations rarely have a DNS name per bucket.
+    target = strings.TrimSuffix(os.Getenv("AWS_ENDPOINT_URL"), "/") + "/" + u.Host + "/" + escapeObjectKey(key)
+  default:
+    target = "https://" + u.Host + ".s3." + region + ".amazonaws.com/" + escapeObjectKey(key)
+  }
+  req, err := http.NewRequest(method, target, bytes.NewReader(body))
+  if err != nil {
+    return nil, err
+  }
+  if body != nil {
+    req.Header.Set("Content-Type", http.DetectContentType(body))
+  }
+  if u.Scheme == "gs" {
+    if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+      req.Header.Set("Authorization", "Bearer " + token)
+    }
+  } else if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+    if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+      req.Header.Set("X-Amz-Security-Token", token)
+    }
+    signV4(req, body, id, secret, region, "s3", time.Now())
+  }
+  return req, nil
+}
+
+// escapeObjectKey percent-encodes key for a URL path the way AWS signatures
+// expect, keeping only unreserved characters and the slashes.
+func escapeObjectKey(key string) string {
+  var escaped strings.Builder
+  for _, c := range []byte(key) {
+    if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || strings.IndexByte("-._~/", c) >= 0 {
+      escaped.WriteByte(c)
+    } else {
+      fmt.Fprintf(&escaped, "%%%02X", c)
+    }
+  }
+  return escaped.String()
+}
+
+// signV4 signs req with AWS Signature Version 4, covering its host and every
+// header already set on it.
+func signV4(req *http.Request, body []byte, id, secret, region, service string, now time.Time) {
+  sum := func(data []byte) string {
+    hash := sha256.Sum256(data)
+    return hex.EncodeToString(hash[:])
+  }
+  mac := func(key []byte, data string) []byte {
+    h := hmac.New(sha256.New, key)
+    h.Write([]byte(data))
+    return h.Sum(nil)
+  }
+  stamp := now.UTC().Format("20060102T150405Z")
+  req.Header.Set("X-Amz-Date", stamp)
+  req.Header.Set("X-Amz-Content-Sha256", sum(body))
+
+  headers := map[string]string{"host": req.URL.Host}
+  for name, values := range req.Header {
+    headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+  }
+  names := make([]string, 0, len(headers))
+  for name := range headers {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  var canonical strings.Builder
+  fmt.Fprintf(&canonical, "%s\n%s\n%s\n", req.Method, req.URL.EscapedPath(), req.URL.RawQuery)
+  for _, name := range names {
+    fmt.Fprintf(&canonical, "%s:%s\n", name, headers[name])
+  }
+  signed := strings.Join(names, ";")
+  fmt.Fprintf(&canonical, "\n%s\n%s", signed, headers["x-amz-content-sha256"])
+
+  scope := stamp[:8] + "/" + region + "/" + service + "/aws4_request"
+  toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + sum([]byte(canonical.String()))
+  key := mac(mac(mac(mac([]byte("AWS4" + secret), stamp[:8]), region), service), "aws4_request")
+  req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", id, scope, signed, hex.EncodeToString(mac(key, toSign))))
+}
+
+// putObject uploads the file name to the s3:// or gs:// object uri.
+func putObject(uri, name string, timeout time.Duration) error {
+  data, err := os.ReadFile(name)
+  if err != nil {
+    return err
+  }
+  req, err := objectRequest(http.MethodPut, uri, data)
+  if err != nil {
+    return err
+  }
+  resp, err := (&http.Client{Timeout: timeout}).Do(req)
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    return fmt.Errorf("%s: %s", uri, resp.Status)
+  }
+  return nil
+}
+
+// objectExists reports whether the s3:// or gs:// object uri is there
+// already. An object that cannot be looked at is taken not to be.
+func objectExists(uri string, timeout time.Duration) (bool, error) {
+  req, err := objectRequest(http.MethodHead, uri, nil)
+  if err != nil {
+    return false, err
+  }
+  resp, err := (&http.Client{Timeout: timeout}).Do(req)
+  if err != nil {
+    return false, err
+  }
+  resp.Body.Close()
+  return resp.StatusCode == http.StatusOK, nil
+}
+
+// fetch downloads the image at url, giving up after timeout and on images
+// of more than maxBytes.
+func fetch(url string, timeout time.Duration, maxBytes int64) ([]byte, error) {
+  req, err := http.NewRequest(http.MethodGet, url, nil)
+  if isObjectURI(url) {
+    req, err = objectRequest(http.MethodGet, url, nil)
+  }
+  if err != nil {
+    return nil, err
+  }
+  resp, err := (&http.Client{Timeout: timeout}).Do(req)
+  if err != nil {
+    return nil, err
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    return nil, fmt.Errorf("%s: %s", url, resp.Status)
+  }
+  tooLarge := fmt.Errorf("%s is larger than -max-download, %d bytes", url, maxBytes)
+  if resp.ContentLength > maxBytes {
+    return nil, tooLarge
+  }
+  data, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes + 1))
+  if err != nil {
+    return nil, err
+  }
+  if int64(len(data)) > maxBytes {
+    return nil, tooLarge
+  }
+  return data, nil
+}
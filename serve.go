@@ -0,0 +1,258 @@
+/*
+TileEx : A Tiling Pattern Extractor written in Go
+Copyright (C) 2023, Sarthak Shah (shahsarthakw@gmail.com)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+  "context"
+  "encoding/json"
+  "errors"
+  "io"
+  "net"
+  "net/http"
+  "os"
+  "fmt"
+  "flag"
+  "strconv"
+  "strings"
+  "image/png"
+  "log"
+  "runtime"
+  "sync"
+  "time"
+)
+
+// serveOptions holds the flags of the serve subcommand.
+type serveOptions struct {
+  s settings
+  addr, keyHeader, apiKeys string
+  maxPixels, maxUpload int64
+  maxConcurrent, maxAnalyses int
+  // maxWallTime limits the wall-clock time of a detection rather than the
+  // CPU time it takes, and is checked between the lines it compares.
+  maxWallTime time.Duration
+}
+
+func (v *serveOptions) addFlags(fs *flag.FlagSet) {
+  fs.StringVar(&v.addr, "addr", "localhost:8080", "The address to listen on")
+  fs.Int64Var(&v.maxPixels, "max-pixels", 1 << 24, "The largest number of pixels an uploaded image may have")
+  fs.Int64Var(&v.maxUpload, "max-upload", 64 << 20, "The largest upload in bytes")
+  fs.IntVar(&v.maxConcurrent, "max-concurrent", 2, "The number of analyses one key may run at the same time")
+  fs.IntVar(&v.maxAnalyses, "max-analyses", runtime.NumCPU(), "The number of analyses the server runs at the same time, for all keys together")
+  fs.DurationVar(&v.maxWallTime, "max-wall-seconds", 30 * time.Second, "The longest wall-clock time the detection of one upload may take, however busy the server is")
+  fs.StringVar(&v.keyHeader, "key-header", "X-API-Key", "The request header that identifies a client with one of the -api-keys, which falls back to its IP address")
+  fs.StringVar(&v.apiKeys, "api-keys", "", "A file of the API keys clients may identify with, one per line")
+  addSettingsFlags(fs, &v.s)
+}
+
+// serveError is the body of a failed request. Limit names the limit that
+// was hit, if any, and Max its value.
+type serveError struct {
+  Error string `json:"error"`
+  Limit string `json:"limit,omitempty"`
+  Max float64 `json:"max,omitempty"`
+}
+
+// server extracts the tiles of uploaded images, limiting what a single
+// request or client can take from the others.
+type server struct {
+  v serveOptions
+  // keys are the API keys from -api-keys. A header that holds none of them
+  // is ignored, as clients could otherwise pick a new one for every request
+  // to get around -max-concurrent.
+  keys map[string]bool
+  // log reports what cannot be sent to the client.
+  log *log.Logger
+  mu sync.Mutex
+  // running counts the analyses running for each key, and total those of
+  // all keys.
+  running map[string]int
+  total int
+}
+
+func (srv *server) fail(w http.ResponseWriter, status int, body serveError) {
+  w.Header().Set("Content-Type", "application/json")
+  if status == http.StatusTooManyRequests || body.Limit == "analyses" {
+    w.Header().Set("Retry-After", "1")
+  }
+  w.WriteHeader(status)
+  json.NewEncoder(w).Encode(body)
+}
+
+// acquire counts another analysis for key unless it already runs as many as
+// it may, or the server does, in which case it returns the status and body
+// to fail with.
+func (srv *server) acquire(key string) (int, serveError, bool) {
+  srv.mu.Lock()
+  defer srv.mu.Unlock()
+  if srv.running[key] >= srv.v.maxConcurrent {
+    return http.StatusTooManyRequests, serveError{Error: "Too many analyses running at the same time", Limit: "concurrency", Max: float64(srv.v.maxConcurrent)}, false
+  }
+  if srv.total >= srv.v.maxAnalyses {
+    return http.StatusServiceUnavailable, serveError{Error: "The server is busy with other analyses", Limit: "analyses", Max: float64(srv.v.maxAnalyses)}, false
+  }
+  srv.running[key]++
+  srv.total++
+  return 0, serveError{}, true
+}
+
+func (srv *server) release(key string) {
+  srv.mu.Lock()
+  defer srv.mu.Unlock()
+  srv.total--
+  if srv.running[key]--; srv.running[key] == 0 {
+    delete(srv.running, key)
+  }
+}
+
+// client returns the key that r counts against: the API key it was sent
+// with if that is one of -api-keys, and otherwise its IP address.
+func (srv *server) client(r *http.Request) string {
+  if key := r.Header.Get(srv.v.keyHeader); srv.keys[key] {
+    return "key " + key
+  }
+  if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+    return "ip " + host
+  }
+  return "ip " + r.RemoteAddr
+}
+
+// ServeHTTP takes an image as the body of a POST request and responds with
+// its tile as PNG, with the size and offset of the tile in the X-Tile-Width,
+// X-Tile-Height, X-Tile-Offset-X and X-Tile-Offset-Y headers.
+func (srv *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    w.Header().Set("Allow", http.MethodPost)
+    srv.fail(w, http.StatusMethodNotAllowed, serveError{Error: "POST an image to extract its tile"})
+    return
+  }
+  key := srv.client(r)
+  if status, body, ok := srv.acquire(key); !ok {
+    srv.fail(w, status, body)
+    return
+  }
+  defer srv.release(key)
+
+  data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, srv.v.maxUpload))
+  var tooLarge *http.MaxBytesError
+  if errors.As(err, &tooLarge) {
+    srv.fail(w, http.StatusRequestEntityTooLarge, serveError{Error: "The upload is too large", Limit: "bytes", Max: float64(srv.v.maxUpload)})
+    return
+  } else if err != nil {
+    srv.fail(w, http.StatusBadRequest, serveError{Error: err.Error()})
+    return
+  }
+  // The size is checked before the pixels are allocated.
+  config, format, err := decodeConfig(data)
+  if err != nil {
+    srv.fail(w, http.StatusBadRequest, serveError{Error: err.Error()})
+    return
+  }
+  if int64(config.Width) * int64(config.Height) > srv.v.maxPixels || checkMaxSize(config.Width, config.Height) != nil {
+    srv.fail(w, http.StatusRequestEntityTooLarge, serveError{Error: fmt.Sprintf("The %dx%d image has too many pixels", config.Width, config.Height), Limit: "pixels", Max: float64(srv.v.maxPixels)})
+    return
+  }
+  img, _, err := decodeBytes(data)
+  if err != nil {
+    srv.fail(w, http.StatusBadRequest, serveError{Error: err.Error()})
+    return
+  }
+
+  s := srv.v.s
+  if !s.setLossy && !s.setLossless {
+    s.setLossy = lossyFormat(format, data)
+    s.setLossless = !s.setLossy
+  }
+  ctx, cancel := s.context(r.Context())
+  defer cancel()
+  ctx, cancelServe := context.WithTimeout(ctx, srv.v.maxWallTime)
+  defer cancelServe()
+  logger := log.New(io.Discard, "", 0)
+  a, err := analyze(ctx, img, "", s, logger)
+  var ext extraction
+  if err == nil {
+    ext, err = a.extract(ctx, s, logger)
+  }
+  switch {
+  case errors.Is(err, context.DeadlineExceeded):
+    // The upload itself was fine, the server just gave up on it.
+    limit := srv.v.maxWallTime
+    if s.timeout > 0 && s.timeout < limit {
+      limit = s.timeout
+    }
+    srv.fail(w, http.StatusServiceUnavailable, serveError{Error: "The detection took too long", Limit: "seconds", Max: limit.Seconds()})
+    return
+  case err != nil:
+    srv.fail(w, http.StatusUnprocessableEntity, serveError{Error: err.Error()})
+    return
+  }
+
+  w.Header().Set("Content-Type", "image/png")
+  w.Header().Set("X-Tile-Width", strconv.Itoa(ext.Width))
+  w.Header().Set("X-Tile-Height", strconv.Itoa(ext.Height))
+  w.Header().Set("X-Tile-Offset-X", strconv.Itoa(ext.Origin.X))
+  w.Header().Set("X-Tile-Offset-Y", strconv.Itoa(ext.Origin.Y))
+  // The status has been sent by now, so a client that went away can only be
+  // logged.
+  if err := png.Encode(w, CropTile(a.img, ext.Origin, ext.Width, ext.Height, false)); err != nil {
+    srv.log.Printf(tr("Sending the tile to %s failed: %v"), key, err)
+  }
+}
+
+// runServe implements the serve subcommand, which extracts tiles over HTTP
+// for a shared service. Each request is limited in the size of its upload,
+// its number of pixels and the time its detection may take, each client in
+// the number of analyses it may run at once, and the server in the number it
+// runs in all.
+func runServe(args []string) int {
+  var v serveOptions
+  serveFlags := flag.NewFlagSet("serve", flag.ContinueOnError)
+  v.addFlags(serveFlags)
+  serveFlags.Usage = func() {
+    fmt.Fprintln(serveFlags.Output(), tr("Usage: tileex serve [flags]"))
+    serveFlags.PrintDefaults()
+  }
+  parseFlags(serveFlags, "serve", args)
+
+  if serveFlags.NArg() != 0 || v.maxPixels <= 0 || v.maxUpload <= 0 || v.maxConcurrent <= 0 || v.maxAnalyses <= 0 || v.maxWallTime <= 0 {
+    serveFlags.Usage()
+    return exitUsage
+  }
+  if err := v.s.prepare(); err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitUsage
+  }
+  srv := &server{v: v, log: log.New(os.Stderr, "", log.LstdFlags), keys: make(map[string]bool), running: make(map[string]int)}
+  if v.apiKeys != "" {
+    data, err := os.ReadFile(v.apiKeys)
+    if err != nil {
+      fmt.Fprintln(os.Stderr, tr("Error:"), err)
+      return exitFailure
+    }
+    for _, key := range strings.Fields(string(data)) {
+      srv.keys[key] = true
+    }
+  }
+  mux := http.NewServeMux()
+  mux.Handle("/extract", srv)
+  fmt.Printf(tr("Listening on %s\n"), v.addr)
+  if err := http.ListenAndServe(v.addr, mux); err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitFailure
+  }
+  return 0
+}
@@ -0,0 +1,486 @@
+/*
+TileEx : A Tiling Pattern Extractor written in Go
+Copyright (C) 2023, Sarthak Shah (shahsarthakw@gmail.com)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+  "fmt"
+  "strconv"
+  "strings"
+  "image"
+  "log"
+  "math"
+  "sync"
+)
+
+// parseAxis parses a direction given as an angle in degrees, such as "30deg"
+// or "30", or as a vector such as "3,1", with y pointing down. It returns
+// the direction as a unit vector.
+func parseAxis(axis string) (float64, float64, error) {
+  if parts := strings.Split(axis, ","); len(parts) == 2 {
+    x, errX := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+    y, errY := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+    length := math.Hypot(x, y)
+    if errX != nil || errY != nil || length == 0 {
+      return 0, 0, fmt.Errorf("invalid axis vector %q, expected x,y", axis)
+    }
+    return x / length, y / length, nil
+  }
+  degrees, err := strconv.ParseFloat(strings.TrimSuffix(axis, "deg"), 64)
+  if err != nil {
+    return 0, 0, fmt.Errorf("invalid axis %q, expected an angle such as 30deg or a vector such as 3,1", axis)
+  }
+  radians := degrees * math.Pi / 180.0
+  return math.Cos(radians), math.Sin(radians), nil
+}
+
+// sample returns the color at (x, y), interpolated bilinearly between the
+// four nearest pixels.
+func (p *pixelBuffer) sample(x, y float64) Color {
+  x0, y0 := int(math.Floor(x)), int(math.Floor(y))
+  fx, fy := x - float64(x0), y - float64(y0)
+  mix := func(a, b, c, d uint32) uint32 {
+    top := float64(a) * (1 - fx) + float64(b) * fx
+    bottom := float64(c) * (1 - fx) + float64(d) * fx
+    return uint32(math.Round(top * (1 - fy) + bottom * fy))
+  }
+  x0, y0 = x0 + p.Rect.Min.X, y0 + p.Rect.Min.Y
+  c00, c10 := p.at(x0, y0), p.at(x0 + 1, y0)
+  c01, c11 := p.at(x0, y0 + 1), p.at(x0 + 1, y0 + 1)
+  return Color{
+    R: mix(c00.R, c10.R, c01.R, c11.R),
+    G: mix(c00.G, c10.G, c01.G, c11.G),
+    B: mix(c00.B, c10.B, c01.B, c11.B),
+    A: mix(c00.A, c10.A, c01.A, c11.A),
+  }
+}
+
+// resized scales the buffer to width by height with bilinear sampling. When
+// shrinking, each pixel averages several samples spread over the area it
+// covers, so fine detail blurs the way it does in a downscaled copy.
+func (p *pixelBuffer) resized(width, height int) *pixelBuffer {
+  scaled := &pixelBuffer{Rect: image.Rect(0, 0, width, height), Pix: make([]Color, width * height)}
+  scaleX, scaleY := float64(p.Rect.Dx()) / float64(width), float64(p.Rect.Dy()) / float64(height)
+  samplesX, samplesY := int(math.Ceil(scaleX)), int(math.Ceil(scaleY))
+  maxX, maxY := float64(p.Rect.Dx() - 1), float64(p.Rect.Dy() - 1)
+  for y := 0; y < height; y++ {
+    for x := 0; x < width; x++ {
+      var r, g, b, a uint64
+      for j := 0; j < samplesY; j++ {
+        sy := math.Min(math.Max(float64(y) * scaleY + (float64(j) + 0.5) * scaleY / float64(samplesY) - 0.5, 0), maxY)
+        for i := 0; i < samplesX; i++ {
+          sx := math.Min(math.Max(float64(x) * scaleX + (float64(i) + 0.5) * scaleX / float64(samplesX) - 0.5, 0), maxX)
+          c := p.sample(sx, sy)
+          r, g, b, a = r + uint64(c.R), g + uint64(c.G), b + uint64(c.B), a + uint64(c.A)
+        }
+      }
+      n := uint64(samplesX * samplesY)
+      scaled.Pix[y * width + x] = Color{R: uint32(r / n), G: uint32(g / n), B: uint32(b / n), A: uint32(a / n)}
+    }
+  }
+  return scaled
+}
+
+// axisLines resamples the image along parallel lines in the direction
+// (dx, dy), one pixel apart, each sampled once per pixel of its length.
+// Lines shorter than four pixels are left out.
+func (p *pixelBuffer) axisLines(dx, dy float64) [][]Color {
+  maxX, maxY := float64(p.Rect.Dx() - 1), float64(p.Rect.Dy() - 1)
+  cx, cy := maxX / 2, maxY / 2
+  // The lines are spread out along the normal of the direction, far enough
+  // to cover every corner of the image.
+  nx, ny := -dy, dx
+  reach := math.Ceil(math.Hypot(cx, cy))
+
+  // span narrows [lo, hi] to the steps along a line that stay in [0, limit]
+  // in one coordinate.
+  span := func(start, step, limit, lo, hi float64) (float64, float64) {
+    if math.Abs(step) < 1e-12 {
+      if start < 0 || start > limit {
+        return 1, 0
+      }
+      return lo, hi
+    }
+    a, b := (0 - start) / step, (limit - start) / step
+    return math.Max(lo, math.Min(a, b)), math.Min(hi, math.Max(a, b))
+  }
+
+  var lines [][]Color
+  for t := -reach; t <= reach; t++ {
+    x0, y0 := cx + t * nx, cy + t * ny
+    lo, hi := span(x0, dx, maxX, math.Inf(-1), math.Inf(1))
+    lo, hi = span(y0, dy, maxY, lo, hi)
+    lo = math.Ceil(lo)
+    if hi - lo < 3 {
+      continue
+    }
+    var line []Color
+    for step := lo; step <= hi; step++ {
+      line = append(line, p.sample(x0 + step * dx, y0 + step * dy))
+    }
+    lines = append(lines, line)
+  }
+  return lines
+}
+
+// resampledPeriod returns the shortest lag whose PeriodScore is a local
+// minimum close to the best one, among lags that leave at least a quarter of the line to
+// compare. Unlike the cyclic detections it does not need the line to hold a
+// whole number of periods, which resampled lines rarely do, and it tolerates
+// the blur of the resampling. A line too short to compare gives its length.
+func resampledPeriod(colors []Color) int {
+  n := len(colors)
+  scores := make([]float64, n + 1)
+  best, bestLag := 1.0, n
+  for k := 2; 4 * k <= 3 * n; k++ {
+    scores[k] = PeriodScore(colors, k)
+    if scores[k] < best {
+      best, bestLag = scores[k], k
+    }
+  }
+  // Close means within a tenth of the way from the best score to the typical
+  // one, since the pixel grid lines up better with some multiples of the
+  // period than with others.
+  typical := medianOf(scores[2:(3 * n) / 4 + 1])
+  for k := 2; k < bestLag; k++ {
+    if scores[k] <= best + 0.1 * (typical - best) && scores[k] <= scores[k - 1] && scores[k] <= scores[k + 1] {
+      return k
+    }
+  }
+  return bestLag
+}
+
+// axisPeriodicities returns the detected period of every resampled line
+// that repeats.
+func (p *pixelBuffer) axisPeriodicities(dx, dy float64, withMargin bool) []LineResult {
+  lines := p.axisLines(dx, dy)
+  results := make([]LineResult, len(lines))
+  var wg sync.WaitGroup
+  for idx := range lines {
+    wg.Add(1)
+    go func(idx int) {
+      defer wg.Done()
+      colors := lines[idx]
+      period := resampledPeriod(colors)
+      results[idx] = LineResult{Period: period, Score: PeriodScore(colors, period)}
+      if withMargin {
+        results[idx].Margin = PeriodMargin(colors, period)
+      }
+    }(idx)
+  }
+  wg.Wait()
+
+  var repeating []LineResult
+  for idx, result := range results {
+    if result.Period < len(lines[idx]) {
+      repeating = append(repeating, result)
+    }
+  }
+  return repeating
+}
+
+const (
+  // polarAngles is the number of angles a circle is unwrapped into. It has
+  // many divisors so that most folds shift by whole samples.
+  polarAngles = 1440
+  // maxFold is the highest rotational symmetry that is looked for.
+  maxFold = 64
+)
+
+// unwrap samples the image along circles around (cx, cy), one row of
+// polarAngles colors per radius, starting to the right of the center and
+// turning clockwise on screen.
+func (p *pixelBuffer) unwrap(cx, cy float64, radii []float64) [][]Color {
+  rows := make([][]Color, len(radii))
+  for idx, radius := range radii {
+    row := make([]Color, polarAngles)
+    for a := range row {
+      angle := 2 * math.Pi * float64(a) / polarAngles
+      row[a] = p.sample(cx + radius * math.Cos(angle), cy + radius * math.Sin(angle))
+    }
+    rows[idx] = row
+  }
+  return rows
+}
+
+// foldScores returns, for every fold from 2 to maxFold, the mean squared
+// color difference, normalized to [0, 1], between the unwrapped rows and the
+// rows turned by a full circle divided by the fold.
+func foldScores(rows [][]Color) []float64 {
+  scores := make([]float64, maxFold + 1)
+  for fold := 2; fold <= maxFold; fold++ {
+    shift := int(math.Round(float64(polarAngles) / float64(fold)))
+    var sum int64
+    for _, row := range rows {
+      for a, c := range row {
+        sum += ColorDiff(row[(a + shift) % polarAngles], c)
+      }
+    }
+    scores[fold] = float64(sum) / float64(len(rows) * polarAngles) / maxColorDiff
+  }
+  return scores
+}
+
+// bestFold returns the highest fold whose score comes close to the best one,
+// since a pattern with a symmetry of some fold also matches when turned by
+// any multiple of that angle. It returns false if no fold stands out from the
+// typical score.
+func bestFold(scores []float64) (int, bool) {
+  best := 2
+  for fold := 3; fold <= maxFold; fold++ {
+    if scores[fold] < scores[best] {
+      best = fold
+    }
+  }
+  typical := medianOf(scores[2:])
+  if scores[best] > 0.5 * typical {
+    return 0, false
+  }
+  for fold := maxFold; fold > best; fold-- {
+    if scores[fold] <= scores[best] + 0.1 * (typical - scores[best]) {
+      return fold, true
+    }
+  }
+  return best, true
+}
+
+// polarRadius returns the radius of the largest circle around (cx, cy) that
+// fits in the image.
+func (p *pixelBuffer) polarRadius(cx, cy float64) float64 {
+  return math.Min(math.Min(cx, float64(p.Rect.Dx() - 1) - cx), math.Min(cy, float64(p.Rect.Dy() - 1) - cy))
+}
+
+// findCenter looks for the point around which the image is most
+// rotationally symmetric, starting from a coarse grid around the middle of
+// the image and refining it around the best point found.
+func (p *pixelBuffer) findCenter() (float64, float64) {
+  cx, cy := float64(p.Rect.Dx() - 1) / 2, float64(p.Rect.Dy() - 1) / 2
+  score := func(x, y float64) float64 {
+    radius := p.polarRadius(x, y)
+    if radius < 8 {
+      return math.Inf(1)
+    }
+    var radii []float64
+    for idx := 1; idx <= 16; idx++ {
+      radii = append(radii, radius * float64(idx) / 16)
+    }
+    scores := foldScores(p.unwrap(x, y, radii))
+    best := math.Inf(1)
+    for _, s := range scores[2:] {
+      best = math.Min(best, s)
+    }
+    return best
+  }
+
+  step := math.Max(1, math.Min(float64(p.Rect.Dx()), float64(p.Rect.Dy())) / 32)
+  bestScore := score(cx, cy)
+  for step >= 0.5 {
+    bestX, bestY := cx, cy
+    for dy := -4; dy <= 4; dy++ {
+      for dx := -4; dx <= 4; dx++ {
+        x, y := cx + float64(dx) * step, cy + float64(dy) * step
+        if s := score(x, y); s < bestScore {
+          bestScore, bestX, bestY = s, x, y
+        }
+      }
+    }
+    cx, cy = bestX, bestY
+    step /= 4
+  }
+  return cx, cy
+}
+
+// Wedge cuts the wedge of one fold of a rotationally symmetric image out of
+// img: the pixels within radius of (cx, cy) whose angle, measured clockwise
+// on screen from the right, is below a full circle divided by fold. The
+// pixels of the bounding box outside the wedge are transparent.
+func Wedge(img image.Image, cx, cy, radius float64, fold int) *image.NRGBA {
+  bounds := img.Bounds()
+  wedgeAngle := 2 * math.Pi / float64(fold)
+  inside := func(x, y float64) bool {
+    dx, dy := x - cx, y - cy
+    if math.Hypot(dx, dy) > radius {
+      return false
+    }
+    angle := math.Atan2(dy, dx)
+    if angle < 0 {
+      angle += 2 * math.Pi
+    }
+    return angle < wedgeAngle
+  }
+
+  region := image.Rectangle{}
+  for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+    for x := bounds.Min.X; x < bounds.Max.X; x++ {
+      if inside(float64(x - bounds.Min.X), float64(y - bounds.Min.Y)) {
+        region = region.Union(image.Rect(x, y, x + 1, y + 1))
+      }
+    }
+  }
+  wedge := image.NewNRGBA(image.Rect(0, 0, region.Dx(), region.Dy()))
+  for y := region.Min.Y; y < region.Max.Y; y++ {
+    for x := region.Min.X; x < region.Max.X; x++ {
+      if inside(float64(x - bounds.Min.X), float64(y - bounds.Min.Y)) {
+        wedge.Set(x - region.Min.X, y - region.Min.Y, img.At(x, y))
+      }
+    }
+  }
+  return wedge
+}
+
+// parseCenter parses a point given as x,y.
+func parseCenter(center string) (float64, float64, error) {
+  parts := strings.Split(center, ",")
+  if len(parts) == 2 {
+    x, errX := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+    y, errY := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+    if errX == nil && errY == nil {
+      return x, y, nil
+    }
+  }
+  return 0, 0, fmt.Errorf("invalid center %q, expected x,y", center)
+}
+
+// maxFriezeSamples is the number of pixels of the strip each symmetry is
+// scored on.
+const maxFriezeSamples = 65536
+
+// classifyFrieze returns the frieze group of the strip at origin that
+// repeats every period pixels and is length pixels across, running along the
+// rows when horizontal is set and along the cols otherwise. A symmetry counts
+// when the strip differs from its mirrored or turned copy by a normalized
+// mean squared difference of at most threshold. The group is named in IUC
+// notation followed by Conway's name for it.
+func (p *pixelBuffer) classifyFrieze(origin image.Point, period, length int, horizontal bool, threshold float64) string {
+  // at returns the color at u along the strip, wrapping around the period,
+  // and v across it.
+  at := func(u, v int) Color {
+    if horizontal {
+      return p.at(origin.X + mod(u, period), origin.Y + v)
+    }
+    return p.at(origin.X + v, origin.Y + mod(u, period))
+  }
+  step := int(math.Ceil(math.Sqrt(float64(period * length) / maxFriezeSamples)))
+  // symmetric reports whether the strip matches itself moved by transform.
+  symmetric := func(transform func(u, v int) (int, int)) bool {
+    var sum int64
+    count := 0
+    for v := 0; v < length; v += step {
+      for u := 0; u < period; u += step {
+        tu, tv := transform(u, v)
+        sum += ColorDiff(at(u, v), at(tu, tv))
+        count++
+      }
+    }
+    return float64(sum) / float64(count) / maxColorDiff <= threshold
+  }
+  // anyAxis reports whether some mirror line across the strip, which may
+  // fall between two pixels, makes transform a symmetry.
+  anyAxis := func(flip bool) bool {
+    for c := 0; c < 2 * period; c++ {
+      if symmetric(func(u, v int) (int, int) {
+        if flip {
+          return c - u, length - 1 - v
+        }
+        return c - u, v
+      }) {
+        return true
+      }
+    }
+    return false
+  }
+
+  horizontalMirror := symmetric(func(u, v int) (int, int) { return u, length - 1 - v })
+  verticalMirror := anyAxis(false)
+  switch {
+  case horizontalMirror && verticalMirror:
+    return "p2mm (spinning jump)"
+  case horizontalMirror:
+    return "p11m (jump)"
+  }
+  glide := symmetric(func(u, v int) (int, int) { return u + period / 2, length - 1 - v })
+  halfTurn := anyAxis(true)
+  switch {
+  case verticalMirror && (glide || halfTurn):
+    return "p2mg (spinning sidle)"
+  case verticalMirror:
+    return "p1m1 (sidle)"
+  case glide:
+    return "p11g (step)"
+  case halfTurn:
+    return "p2 (spinning hop)"
+  }
+  return "p1 (hop)"
+}
+
+// extractStrip votes on the period along the rows, or along the cols when
+// horizontal is not set, and extracts a strip of that period spanning the
+// whole image the other way, for borders and friezes that only repeat along
+// one axis. It also reports the frieze group of the strip.
+func (a *analysis) extractStrip(horizontal bool, s settings, logger *log.Logger) (extraction, error) {
+  bounds := a.img.Bounds()
+  ext := extraction{Origin: bounds.Min, Width: bounds.Dx(), Height: bounds.Dy()}
+  var period, length int
+  var err error
+  if horizontal {
+    if period, ext.RowConfidence, err = consensusPeriod(logger, "Row", a.rowLines, s.weightedVote, s.rowTolerance, s.rowPreferFrequency, s.tieBreak); err != nil {
+      return extraction{}, err
+    }
+    ext.Origin.X += s.offsetX
+    ext.Width, length = period, bounds.Dy()
+  } else {
+    if period, ext.ColConfidence, err = consensusPeriod(logger, "Col", a.colLines, s.weightedVote, s.colTolerance, s.colPreferFrequency, s.tieBreak); err != nil {
+      return extraction{}, err
+    }
+    ext.Origin.Y += s.offsetY
+    ext.Height, length = period, bounds.Dx()
+  }
+  if ext.Width >= bounds.Dx() && ext.Height >= bounds.Dy() {
+    return extraction{}, fmt.Errorf("%w along the strip", ErrNoPeriodicity)
+  }
+
+  ext.Error, ext.Grade = a.grade(s, logger, ext.Origin, ext.Width, ext.Height)
+  logger.Printf(tr("Frieze group: %s\n"), a.buffer().classifyFrieze(ext.Origin, period, length, horizontal, nearExactError))
+  return ext, nil
+}
+
+// stripAxis tells which way the image genuinely repeats, for web backgrounds
+// made of a gradient one way and a repeating texture the other: horizontal
+// when the rows vote on a period shorter than the image and the cols do not,
+// and the other way around. If both do, the clearer vote wins.
+func (a *analysis) stripAxis(s settings, logger *log.Logger) (bool, error) {
+  bounds := a.img.Bounds()
+  rowPeriod, rowShare, rowReached := votePeriod(a.rowLines, s.weightedVote, s.rowTolerance, s.rowPreferFrequency, s.tieBreak)
+  colPeriod, colShare, colReached := votePeriod(a.colLines, s.weightedVote, s.colTolerance, s.colPreferFrequency, s.tieBreak)
+  rows := rowReached && rowPeriod > 0 && rowPeriod < bounds.Dx()
+  cols := colReached && colPeriod > 0 && colPeriod < bounds.Dy()
+  var horizontal bool
+  switch {
+  case rows && cols:
+    horizontal = rowShare >= colShare
+  case rows || cols:
+    horizontal = rows
+  default:
+    return false, fmt.Errorf("%w along the rows or the cols", ErrNoPeriodicity)
+  }
+  if horizontal {
+    logger.Println(tr("The image repeats along its rows, extracting a horizontal strip"))
+  } else {
+    logger.Println(tr("The image repeats down its cols, extracting a vertical strip"))
+  }
+  return horizontal, nil
+}
@@ -0,0 +1,599 @@
+/*
+TileEx : A Tiling Pattern Extractor written in Go
+Copyright (C) 2023, Sarthak Shah (shahsarthakw@gmail.com)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+  "encoding/binary"
+  "errors"
+  "io"
+  "image"
+  "image/draw"
+  "math"
+)
+
+// textureBlock holds the straight RGBA colors of a block of 4x4 pixels of a
+// texture, row by row, the unit that BC and ETC compress.
+type textureBlock [16][4]uint8
+
+// textureBlocks splits img into blocks, row by row. The blocks along the
+// right and bottom of a tile whose size is no multiple of 4 are filled up
+// with the pixels the tile wraps around to, which they are sampled with when
+// the texture is filtered.
+func textureBlocks(img *image.NRGBA) []textureBlock {
+  width, height := img.Rect.Dx(), img.Rect.Dy()
+  var blocks []textureBlock
+  for by := 0; by < height; by += 4 {
+    for bx := 0; bx < width; bx += 4 {
+      var block textureBlock
+      for i := range block {
+        at := (by + i / 4) % height * img.Stride + (bx + i % 4) % width * 4
+        copy(block[i][:], img.Pix[at:at + 4])
+      }
+      blocks = append(blocks, block)
+    }
+  }
+  return blocks
+}
+
+// rgb565 packs a color into the 5, 6 and 5 bits of BC1, and expand565
+// unpacks it again.
+func rgb565(c [3]float64) uint16 {
+  q := func(v float64, max float64) uint16 {
+    return uint16(math.Round(math.Max(0, math.Min(255, v)) * max / 255))
+  }
+  return q(c[0], 31) << 11 | q(c[1], 63) << 5 | q(c[2], 31)
+}
+
+func expand565(c uint16) [3]int {
+  r, g, b := int(c >> 11), int(c >> 5 & 63), int(c & 31)
+  return [3]int{r << 3 | r >> 2, g << 2 | g >> 4, b << 3 | b >> 2}
+}
+
+// bc1Block compresses the colors of block to BC1, which keeps two colors
+// of 16 bits and picks one of them or a mix of them for every pixel. The two
+// lie at the ends of the line through the colors along which they spread
+// the most. With punchThrough, pixels below half alpha become transparent,
+// which costs one of the mixes.
+func bc1Block(block *textureBlock, punchThrough bool) [8]byte {
+  transparent := func(i int) bool {
+    return punchThrough && block[i][3] < 0x80
+  }
+  var mean [3]float64
+  count, hasTransparent := 0, false
+  for i := range block {
+    if transparent(i) {
+      hasTransparent = true
+      continue
+    }
+    for c := 0; c < 3; c++ {
+      mean[c] += float64(block[i][c])
+    }
+    count++
+  }
+  var out [8]byte
+  if count == 0 {
+    // Equal colors select the mode with transparency.
+    binary.LittleEndian.PutUint32(out[4:], 0xffffffff)
+    return out
+  }
+  for c := range mean {
+    mean[c] /= float64(count)
+  }
+  var cov [3][3]float64
+  for i := range block {
+    if transparent(i) {
+      continue
+    }
+    for j := 0; j < 3; j++ {
+      for k := 0; k < 3; k++ {
+        cov[j][k] += (float64(block[i][j]) - mean[j]) * (float64(block[i][k]) - mean[k])
+      }
+    }
+  }
+  // A few steps of power iteration find the main direction of the colors.
+  // They start from the covariances of the channel that spreads the most,
+  // as a start across the direction, such as gray for red and blue, would
+  // never turn towards it.
+  widest := 0
+  for c := range cov {
+    if cov[c][c] > cov[widest][widest] {
+      widest = c
+    }
+  }
+  axis := [3]float64{1, 1, 1}
+  if cov[widest][widest] > 0 {
+    axis = cov[widest]
+  }
+  for step := 0; step < 8; step++ {
+    var next [3]float64
+    norm := 0.0
+    for j := 0; j < 3; j++ {
+      for k := 0; k < 3; k++ {
+        next[j] += cov[j][k] * axis[k]
+      }
+      norm = math.Max(norm, math.Abs(next[j]))
+    }
+    if norm == 0 {
+      break
+    }
+    for j := range next {
+      axis[j] = next[j] / norm
+    }
+  }
+  low, high := math.Inf(1), math.Inf(-1)
+  for i := range block {
+    if transparent(i) {
+      continue
+    }
+    t := 0.0
+    for c := 0; c < 3; c++ {
+      t += (float64(block[i][c]) - mean[c]) * axis[c]
+    }
+    low, high = math.Min(low, t), math.Max(high, t)
+  }
+  norm := axis[0] * axis[0] + axis[1] * axis[1] + axis[2] * axis[2]
+  var ends [2][3]float64
+  for c := 0; c < 3; c++ {
+    ends[0][c] = mean[c] + axis[c] * high / norm
+    ends[1][c] = mean[c] + axis[c] * low / norm
+  }
+  // fit orders the two colors, which selects the mode: four colors if the
+  // first is greater, three and transparency otherwise. It then picks the
+  // closest color for every pixel and sums up the squared errors.
+  fit := func(ends [2][3]float64) (uint16, uint16, uint32, int) {
+    c0, c1 := rgb565(ends[0]), rgb565(ends[1])
+    if (c0 < c1) != hasTransparent {
+      c0, c1 = c1, c0
+    }
+    e0, e1 := expand565(c0), expand565(c1)
+    palette := [][3]int{e0, e1}
+    if hasTransparent || c0 == c1 {
+      palette = append(palette, [3]int{(e0[0] + e1[0]) / 2, (e0[1] + e1[1]) / 2, (e0[2] + e1[2]) / 2})
+    } else {
+      palette = append(palette, [3]int{(2 * e0[0] + e1[0]) / 3, (2 * e0[1] + e1[1]) / 3, (2 * e0[2] + e1[2]) / 3}, [3]int{(e0[0] + 2 * e1[0]) / 3, (e0[1] + 2 * e1[1]) / 3, (e0[2] + 2 * e1[2]) / 3})
+    }
+    var indices uint32
+    total := 0
+    for i := range block {
+      best := 3
+      if !transparent(i) {
+        bestDist := math.MaxInt
+        for idx, p := range palette {
+          dist := 0
+          for c := 0; c < 3; c++ {
+            d := int(block[i][c]) - p[c]
+            dist += d * d
+          }
+          if dist < bestDist {
+            best, bestDist = idx, dist
+          }
+        }
+        total += bestDist
+      }
+      indices |= uint32(best) << (2 * i)
+    }
+    return c0, c1, indices, total
+  }
+  c0, c1, indices, total := fit(ends)
+  if !hasTransparent && c0 != c1 {
+    // The colors at the ends of the spread are then refined by least
+    // squares to the ones that the mixes of the pixels fit best.
+    var aa, ab, bb float64
+    var ax, bx [3]float64
+    for i := range block {
+      w := [4]float64{1, 0, 2.0 / 3, 1.0 / 3}[indices >> (2 * i) & 3]
+      aa, ab, bb = aa + w * w, ab + w * (1 - w), bb + (1 - w) * (1 - w)
+      for c := 0; c < 3; c++ {
+        ax[c] += w * float64(block[i][c])
+        bx[c] += (1 - w) * float64(block[i][c])
+      }
+    }
+    if det := aa * bb - ab * ab; det > 1e-9 {
+      var refined [2][3]float64
+      for c := 0; c < 3; c++ {
+        refined[0][c] = (ax[c] * bb - bx[c] * ab) / det
+        refined[1][c] = (bx[c] * aa - ax[c] * ab) / det
+      }
+      if r0, r1, rIndices, rTotal := fit(refined); rTotal < total {
+        c0, c1, indices = r0, r1, rIndices
+      }
+    }
+  }
+  binary.LittleEndian.PutUint16(out[0:], c0)
+  binary.LittleEndian.PutUint16(out[2:], c1)
+  binary.LittleEndian.PutUint32(out[4:], indices)
+  return out
+}
+
+// bc4Block compresses one channel of block, alpha in BC3, to its lowest and
+// highest value and 3-bit indices to either of them or one of the six values
+// evenly between.
+func bc4Block(block *textureBlock, channel int) [8]byte {
+  low, high := 255, 0
+  for i := range block {
+    low, high = min(low, int(block[i][channel])), max(high, int(block[i][channel]))
+  }
+  out := [8]byte{byte(high), byte(low)}
+  if low == high {
+    return out
+  }
+  values := []int{high, low}
+  for i := 1; i < 7; i++ {
+    values = append(values, ((7 - i) * high + i * low) / 7)
+  }
+  var indices uint64
+  for i := range block {
+    best := 0
+    for idx, v := range values {
+      if absInt(v - int(block[i][channel])) < absInt(values[best] - int(block[i][channel])) {
+        best = idx
+      }
+    }
+    indices |= uint64(best) << (3 * i)
+  }
+  for i := 0; i < 6; i++ {
+    out[2 + i] = byte(indices >> (8 * i))
+  }
+  return out
+}
+
+// etcModifiers are the tables of ETC1 that a pixel adds to or subtracts
+// from the base color of its half of the block, the small or the large one.
+var etcModifiers = [8][2]int{{2, 8}, {5, 17}, {9, 29}, {13, 42}, {18, 60}, {24, 80}, {33, 106}, {47, 183}}
+
+// etcBlock compresses the colors of block to ETC1, which ETC2 decodes the
+// same. Each half of the block has a base color, the mean of its pixels,
+// that the modifiers of a table brighten or darken for every pixel. The
+// halves lie side by side or on top of each other, whichever fits better,
+// and store their bases with 4 bits each or, if the bases are close, with
+// 5 bits and the difference of the second to the first.
+func etcBlock(block *textureBlock) [8]byte {
+  var best uint64
+  bestErr := math.MaxInt
+  for flip := 0; flip < 2; flip++ {
+    half := func(i int) int {
+      if flip == 1 {
+        return i / 8
+      }
+      return i % 4 / 2
+    }
+    var mean [2][3]float64
+    for i := range block {
+      for c := 0; c < 3; c++ {
+        mean[half(i)][c] += float64(block[i][c]) / 8
+      }
+    }
+    for differential := 1; differential >= 0; differential-- {
+      levels := 15.0
+      if differential == 1 {
+        levels = 31
+      }
+      var codes [2][3]int
+      var bases [2][3]int
+      fits := true
+      for h := 0; h < 2; h++ {
+        for c := 0; c < 3; c++ {
+          code := int(math.Round(mean[h][c] * levels / 255))
+          codes[h][c] = code
+          if differential == 1 {
+            bases[h][c] = code << 3 | code >> 2
+          } else {
+            bases[h][c] = code << 4 | code
+          }
+        }
+      }
+      for c := 0; c < 3 && differential == 1; c++ {
+        if d := codes[1][c] - codes[0][c]; d < -4 || d > 3 {
+          fits = false
+        }
+      }
+      if !fits {
+        continue
+      }
+      // Every half picks the table that serves its pixels best.
+      var tables [2]int
+      var modifiers [16]int
+      total := 0
+      for h := 0; h < 2; h++ {
+        halfErr := math.MaxInt
+        for table, steps := range etcModifiers {
+          tableErr := 0
+          var picks [16]int
+          for i := range block {
+            if half(i) != h {
+              continue
+            }
+            pixelErr := math.MaxInt
+            for idx, step := range []int{steps[0], steps[1], -steps[0], -steps[1]} {
+              dist := 0
+              for c := 0; c < 3; c++ {
+                d := min(255, max(0, bases[h][c] + step)) - int(block[i][c])
+                dist += d * d
+              }
+              if dist < pixelErr {
+                pixelErr, picks[i] = dist, idx
+              }
+            }
+            tableErr += pixelErr
+          }
+          if tableErr < halfErr {
+            halfErr, tables[h] = tableErr, table
+            for i := range block {
+              if half(i) == h {
+                modifiers[i] = picks[i]
+              }
+            }
+          }
+        }
+        total += halfErr
+      }
+      if total >= bestErr {
+        continue
+      }
+      bestErr = total
+      var bits uint64
+      for c := 0; c < 3; c++ {
+        shift := 59 - 8 * c
+        if differential == 1 {
+          bits |= uint64(codes[0][c]) << shift | uint64((codes[1][c] - codes[0][c]) & 7) << (shift - 3)
+        } else {
+          bits |= uint64(codes[0][c]) << (shift + 1) | uint64(codes[1][c]) << (shift - 3)
+        }
+      }
+      bits |= uint64(tables[0]) << 37 | uint64(tables[1]) << 34 | uint64(differential) << 33 | uint64(flip) << 32
+      // The indices go column by column, their high bits apart from their
+      // low bits.
+      for i, idx := range modifiers {
+        at := i % 4 * 4 + i / 4
+        bits |= uint64(idx >> 1) << (16 + at) | uint64(idx & 1) << at
+      }
+      best = bits
+    }
+  }
+  var out [8]byte
+  binary.BigEndian.PutUint64(out[:], best)
+  return out
+}
+
+// eacModifiers are the tables of EAC, the alpha of ETC2, that a pixel adds
+// to the base value of the block times a multiplier.
+var eacModifiers = [16][8]int{
+  {-3, -6, -9, -15, 2, 5, 8, 14}, {-3, -7, -10, -13, 2, 6, 9, 12}, {-2, -5, -8, -13, 1, 4, 7, 12}, {-2, -4, -6, -13, 1, 3, 5, 12},
+  {-3, -6, -8, -12, 2, 5, 7, 11}, {-3, -7, -9, -11, 2, 6, 8, 10}, {-4, -7, -8, -11, 3, 6, 7, 10}, {-3, -5, -8, -11, 2, 4, 7, 10},
+  {-2, -6, -8, -10, 1, 5, 7, 9}, {-2, -5, -8, -10, 1, 4, 7, 9}, {-2, -4, -8, -10, 1, 3, 7, 9}, {-2, -5, -7, -10, 1, 4, 6, 9},
+  {-3, -4, -7, -10, 2, 3, 6, 9}, {-1, -2, -3, -10, 0, 1, 2, 9}, {-4, -6, -8, -9, 3, 5, 7, 8}, {-3, -5, -7, -9, 2, 4, 6, 8},
+}
+
+// eacBlock compresses the alpha of block to EAC, trying every table and
+// multiplier with the base that centers it on the range of the pixels.
+func eacBlock(block *textureBlock) [8]byte {
+  low, high := 255, 0
+  for i := range block {
+    low, high = min(low, int(block[i][3])), max(high, int(block[i][3]))
+  }
+  var out [8]byte
+  if low == high {
+    // Table 13 has a modifier of 0, which keeps the base as it is.
+    binary.BigEndian.PutUint64(out[:], uint64(low) << 56 | 1 << 52 | 13 << 48 | 0x924924924924)
+    return out
+  }
+  var best uint64
+  bestErr := math.MaxInt
+  for table, steps := range eacModifiers {
+    for multiplier := 1; multiplier < 16; multiplier++ {
+      base := min(255, max(0, (low + high - multiplier * (steps[3] + steps[7])) / 2))
+      total := 0
+      var indices uint64
+      for i := range block {
+        pick, pickErr := 0, math.MaxInt
+        for idx, step := range steps {
+          if d := absInt(min(255, max(0, base + step * multiplier)) - int(block[i][3])); d < pickErr {
+            pick, pickErr = idx, d
+          }
+        }
+        total += pickErr * pickErr
+        indices |= uint64(pick) << (45 - 3 * (i % 4 * 4 + i / 4))
+      }
+      if total < bestErr {
+        bestErr = total
+        best = uint64(base) << 56 | uint64(multiplier) << 52 | uint64(table) << 48 | indices
+      }
+    }
+  }
+  binary.BigEndian.PutUint64(out[:], best)
+  return out
+}
+
+// The formats textures are stored in: straight RGBA, BC1 with transparency,
+// BC3, and ETC2 with or without alpha.
+const (
+  textureRGBA = iota
+  textureBC1
+  textureBC3
+  textureETC2
+  textureETC2Alpha
+)
+
+// compressTexture stores img in the format compression asks for, none, bc
+// or etc, and returns the data and the format. BC and ETC use their
+// variants with alpha only for tiles that are not opaque.
+func compressTexture(img image.Image, compression string) ([]byte, int) {
+  bounds := img.Bounds()
+  nrgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+  draw.Draw(nrgba, nrgba.Rect, img, bounds.Min, draw.Src)
+  if compression == "none" {
+    return nrgba.Pix, textureRGBA
+  }
+  format := textureBC1
+  switch {
+  case compression == "etc" && nrgba.Opaque():
+    format = textureETC2
+  case compression == "etc":
+    format = textureETC2Alpha
+  default:
+    // BC1 has no more than a bit of alpha, so only tiles with nothing but
+    // transparent and opaque pixels keep to it.
+    for i := 3; i < len(nrgba.Pix); i += 4 {
+      if nrgba.Pix[i] != 0 && nrgba.Pix[i] != 0xff {
+        format = textureBC3
+        break
+      }
+    }
+  }
+  var data []byte
+  for _, block := range textureBlocks(nrgba) {
+    switch format {
+    case textureBC1:
+      b := bc1Block(&block, true)
+      data = append(data, b[:]...)
+    case textureBC3:
+      alpha, colors := bc4Block(&block, 3), bc1Block(&block, false)
+      data = append(append(data, alpha[:]...), colors[:]...)
+    case textureETC2:
+      b := etcBlock(&block)
+      data = append(data, b[:]...)
+    case textureETC2Alpha:
+      alpha, colors := eacBlock(&block), etcBlock(&block)
+      data = append(append(data, alpha[:]...), colors[:]...)
+    }
+  }
+  return data, format
+}
+
+// encodeDDS writes img to w as a DDS texture of a single level, the format
+// of DirectX, compressed with BC unless compression is none. DDS has no
+// place for ETC.
+func encodeDDS(w io.Writer, img image.Image, compression string) error {
+  if compression == "etc" {
+    return errors.New("DDS textures cannot hold ETC, save a .ktx2 instead")
+  }
+  data, format := compressTexture(img, compression)
+  width, height := img.Bounds().Dx(), img.Bounds().Dy()
+  header := make([]byte, 128)
+  le := binary.LittleEndian
+  copy(header, "DDS ")
+  // The size of the header, and that the caps, height, width and pixel
+  // format are given, along with the pitch or size of the pixels.
+  le.PutUint32(header[4:], 124)
+  le.PutUint32(header[12:], uint32(height))
+  le.PutUint32(header[16:], uint32(width))
+  le.PutUint32(header[76:], 32)
+  if format == textureRGBA {
+    le.PutUint32(header[8:], 0x1 | 0x2 | 0x4 | 0x1000 | 0x8)
+    le.PutUint32(header[20:], uint32(4 * width))
+    le.PutUint32(header[80:], 0x40 | 0x1)
+    le.PutUint32(header[88:], 32)
+    for i, mask := range []uint32{0xff, 0xff00, 0xff0000, 0xff000000} {
+      le.PutUint32(header[92 + 4 * i:], mask)
+    }
+  } else {
+    le.PutUint32(header[8:], 0x1 | 0x2 | 0x4 | 0x1000 | 0x80000)
+    le.PutUint32(header[20:], uint32(len(data)))
+    le.PutUint32(header[80:], 0x4)
+    copy(header[84:], map[int]string{textureBC1: "DXT1", textureBC3: "DXT5"}[format])
+  }
+  // A texture.
+  le.PutUint32(header[108:], 0x1000)
+  if _, err := w.Write(header); err != nil {
+    return err
+  }
+  _, err := w.Write(data)
+  return err
+}
+
+// ktx2Formats are the Vulkan formats of the sRGB textures KTX2 holds, the
+// color model of their data format descriptor and the size of their blocks.
+var ktx2Formats = map[int]struct {
+  vkFormat, model, blockBytes int
+}{
+  textureRGBA: {43, 1, 4},
+  textureBC1: {134, 128, 8},
+  textureBC3: {138, 130, 16},
+  textureETC2: {148, 161, 8},
+  textureETC2Alpha: {152, 161, 16},
+}
+
+// encodeKTX2 writes img to w as a KTX2 texture of a single level, the
+// format of Khronos that Vulkan and OpenGL engines load, compressed with BC
+// or ETC unless compression is none.
+func encodeKTX2(w io.Writer, img image.Image, compression string) error {
+  data, format := compressTexture(img, compression)
+  kind := ktx2Formats[format]
+  // The data format descriptor describes the samples of a pixel or block:
+  // their offset and length in bits, their channel and their range. Alpha
+  // is linear where the colors are sRGB.
+  type sample struct {
+    offset, length, channel int
+    upper uint32
+  }
+  samples := []sample{{0, 64, 0, 0xffffffff}}
+  switch format {
+  case textureRGBA:
+    samples = []sample{{0, 8, 0, 255}, {8, 8, 1, 255}, {16, 8, 2, 255}, {24, 8, 0x8f, 255}}
+  case textureBC1:
+    samples[0].channel = 1
+  case textureBC3:
+    samples = []sample{{0, 64, 0x8f, 0xffffffff}, {64, 64, 0, 0xffffffff}}
+  case textureETC2:
+    samples[0].channel = 2
+  case textureETC2Alpha:
+    samples = []sample{{0, 64, 0x8f, 0xffffffff}, {64, 64, 2, 0xffffffff}}
+  }
+  le := binary.LittleEndian
+  blockSize := 24 + 16 * len(samples)
+  dfd := make([]byte, 4 + blockSize)
+  le.PutUint32(dfd, uint32(len(dfd)))
+  le.PutUint32(dfd[8:], 2 | uint32(blockSize) << 16)
+  // The color model, BT.709 primaries and the sRGB transfer function.
+  le.PutUint32(dfd[12:], uint32(kind.model) | 1 << 8 | 2 << 16)
+  if format != textureRGBA {
+    dfd[16], dfd[17] = 3, 3
+  }
+  dfd[20] = byte(kind.blockBytes)
+  for i, s := range samples {
+    at := 28 + 16 * i
+    le.PutUint32(dfd[at:], uint32(s.offset) | uint32(s.length - 1) << 16 | uint32(s.channel) << 24)
+    le.PutUint32(dfd[at + 12:], s.upper)
+  }
+
+  width, height := img.Bounds().Dx(), img.Bounds().Dy()
+  header := make([]byte, 104)
+  copy(header, "\xabKTX 20\xbb\r\n\x1a\n")
+  le.PutUint32(header[12:], uint32(kind.vkFormat))
+  // The size of the data type, a byte for all of these formats.
+  le.PutUint32(header[16:], 1)
+  le.PutUint32(header[20:], uint32(width))
+  le.PutUint32(header[24:], uint32(height))
+  // One face and one level.
+  le.PutUint32(header[36:], 1)
+  le.PutUint32(header[40:], 1)
+  le.PutUint32(header[48:], 104)
+  le.PutUint32(header[52:], uint32(len(dfd)))
+  // The level starts on a whole block after the descriptor.
+  at := 104 + len(dfd)
+  padding := (kind.blockBytes - at % kind.blockBytes) % kind.blockBytes
+  le.PutUint64(header[80:], uint64(at + padding))
+  le.PutUint64(header[88:], uint64(len(data)))
+  le.PutUint64(header[96:], uint64(len(data)))
+  for _, part := range [][]byte{header, dfd, make([]byte, padding), data} {
+    if _, err := w.Write(part); err != nil {
+      return err
+    }
+  }
+  return nil
+}
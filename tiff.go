@@ -0,0 +1,360 @@
+/*
+TileEx : A Tiling Pattern Extractor written in Go
+Copyright (C) 2023, Sarthak Shah (shahsarthakw@gmail.com)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+  "bytes"
+  "compress/zlib"
+  "encoding/binary"
+  "errors"
+  "io"
+  "fmt"
+  "sort"
+  "image"
+  "image/color"
+  "image/draw"
+
+  "golang.org/x/image/tiff"
+)
+
+// tiffIFD holds the tags of a TIFF image file directory that hold
+// integers, which are all that finding and rewriting pages needs, and
+// where the directory is.
+type tiffIFD struct {
+  offset uint32
+  tags map[uint16][]uint32
+}
+
+func (ifd tiffIFD) get(tag uint16, fallback uint32) uint32 {
+  if values := ifd.tags[tag]; len(values) > 0 {
+    return values[0]
+  }
+  return fallback
+}
+
+// readTIFF returns the byte order of the TIFF in data and its image file
+// directories, one per page.
+func readTIFF(data []byte) (binary.ByteOrder, []tiffIFD, error) {
+  if len(data) < 8 {
+    return nil, nil, errors.New("tiff: file too short")
+  }
+  var order binary.ByteOrder
+  switch string(data[:2]) {
+  case "II":
+    order = binary.LittleEndian
+  case "MM":
+    order = binary.BigEndian
+  default:
+    return nil, nil, errors.New("tiff: invalid byte order")
+  }
+  if order.Uint16(data[2:4]) != 42 {
+    return nil, nil, errors.New("tiff: not a TIFF, or a BigTIFF, which is not supported")
+  }
+  sizes := map[uint16]uint32{1: 1, 3: 2, 4: 4, 7: 1}
+  var ifds []tiffIFD
+  seen := make(map[uint32]bool)
+  for offset := order.Uint32(data[4:8]); offset != 0; {
+    if seen[offset] || int64(offset) + 2 > int64(len(data)) {
+      return nil, nil, errors.New("tiff: invalid directory offset")
+    }
+    seen[offset] = true
+    count := uint32(order.Uint16(data[offset:]))
+    end := int64(offset) + 2 + 12 * int64(count)
+    if end + 4 > int64(len(data)) {
+      return nil, nil, errors.New("tiff: truncated directory")
+    }
+    ifd := tiffIFD{offset, make(map[uint16][]uint32)}
+    for i := uint32(0); i < count; i++ {
+      entry := data[offset + 2 + 12 * i:]
+      tag, kind, n := order.Uint16(entry[0:2]), order.Uint16(entry[2:4]), order.Uint32(entry[4:8])
+      size, ok := sizes[kind]
+      if !ok {
+        continue
+      }
+      // Values that fit in four bytes are stored in place of their offset.
+      values := entry[8:12]
+      if total := int64(size) * int64(n); total > 4 {
+        at := int64(order.Uint32(entry[8:12]))
+        if at + total > int64(len(data)) {
+          return nil, nil, fmt.Errorf("tiff: tag %d points past the end of the file", tag)
+        }
+        values = data[at:at + total]
+      }
+      ifd.tags[tag] = make([]uint32, n)
+      for j := range ifd.tags[tag] {
+        switch size {
+        case 1:
+          ifd.tags[tag][j] = uint32(values[j])
+        case 2:
+          ifd.tags[tag][j] = uint32(order.Uint16(values[2 * j:]))
+        case 4:
+          ifd.tags[tag][j] = order.Uint32(values[4 * j:])
+        }
+      }
+    }
+    ifds = append(ifds, ifd)
+    offset = order.Uint32(data[end:])
+  }
+  if len(ifds) == 0 {
+    return nil, nil, errors.New("tiff: no images")
+  }
+  return order, ifds, nil
+}
+
+// tiffCMYK reports whether the first page of the TIFF in data is CMYK.
+func tiffCMYK(data []byte) bool {
+  _, ifds, err := readTIFF(data)
+  return err == nil && ifds[0].get(262, 1) == 5
+}
+
+func decodeTIFFConfig(r io.Reader) (image.Config, error) {
+  data, err := io.ReadAll(r)
+  if err != nil {
+    return image.Config{}, err
+  }
+  order, ifds, err := readTIFF(data)
+  if err != nil {
+    return image.Config{}, err
+  }
+  page, err := tiffPageData(data, order, ifds[0])
+  if err != nil {
+    return image.Config{}, err
+  }
+  config, err := tiff.DecodeConfig(bytes.NewReader(page))
+  if ifds[0].get(262, 1) == 5 {
+    config.ColorModel = color.CMYKModel
+  }
+  return config, err
+}
+
+// tiffPageData returns a copy of data whose first page is the one that ifd
+// describes, and which golang.org/x/image/tiff reads if that page is CMYK.
+func tiffPageData(data []byte, order binary.ByteOrder, ifd tiffIFD) ([]byte, error) {
+  page := bytes.Clone(data)
+  if ifd.get(262, 1) != 5 {
+    order.PutUint32(page[4:], ifd.offset)
+    return page, nil
+  }
+  if ifd.get(277, 1) != 4 || ifd.get(258, 1) != 8 && ifd.get(258, 1) != 16 || ifd.get(332, 1) != 1 {
+    return nil, errors.New("tiff: only 8 and 16-bit CMYK inks without alpha are supported")
+  }
+  // The inks are read as RGB and straight alpha from a new directory at the
+  // end, which stores every value as LONGs after its entries.
+  tags := map[uint16][]uint32{262: {2}, 338: {2}}
+  for id, values := range ifd.tags {
+    if tags[id] == nil {
+      tags[id] = values
+    }
+  }
+  ids := make([]uint16, 0, len(tags))
+  for id := range tags {
+    ids = append(ids, id)
+  }
+  sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+  page = append(page, make([]byte, len(page) % 2)...)
+  order.PutUint32(page[4:], uint32(len(page)))
+  appendOrder := order.(binary.AppendByteOrder)
+  at := uint32(len(page)) + 2 + 12 * uint32(len(ids)) + 4
+  page = appendOrder.AppendUint16(page, uint16(len(ids)))
+  var values []byte
+  for _, id := range ids {
+    page = appendOrder.AppendUint16(page, id)
+    page = appendOrder.AppendUint16(page, 4)
+    page = appendOrder.AppendUint32(page, uint32(len(tags[id])))
+    switch len(tags[id]) {
+    case 0:
+      page = appendOrder.AppendUint32(page, 0)
+    case 1:
+      page = appendOrder.AppendUint32(page, tags[id][0])
+    default:
+      page = appendOrder.AppendUint32(page, at + uint32(len(values)))
+      for _, v := range tags[id] {
+        values = appendOrder.AppendUint32(values, v)
+      }
+    }
+  }
+  page = appendOrder.AppendUint32(page, 0)
+  return append(page, values...), nil
+}
+
+// decodeTIFFPage decodes the page that ifd describes.
+func decodeTIFFPage(data []byte, order binary.ByteOrder, ifd tiffIFD) (image.Image, error) {
+  page, err := tiffPageData(data, order, ifd)
+  if err != nil {
+    return nil, err
+  }
+  config, err := tiff.DecodeConfig(bytes.NewReader(page))
+  if err != nil {
+    return nil, err
+  }
+  if err := checkMaxSize(config.Width, config.Height); err != nil {
+    return nil, err
+  }
+  img, err := tiff.Decode(bytes.NewReader(page))
+  if err != nil || ifd.get(262, 1) != 5 {
+    return img, err
+  }
+  // image.CMYK has neither alpha nor 16-bit inks, so 16-bit inks keep their
+  // high bytes.
+  inks := image.NewCMYK(img.Bounds())
+  switch rgba := img.(type) {
+  case *image.NRGBA:
+    copy(inks.Pix, rgba.Pix)
+  case *image.NRGBA64:
+    for i := range inks.Pix {
+      inks.Pix[i] = rgba.Pix[2 * i]
+    }
+  }
+  return inks, nil
+}
+
+// tiffPage decodes page of the TIFF in data, counting from 1.
+func tiffPage(data []byte, page int) (image.Image, error) {
+  order, ifds, err := readTIFF(data)
+  if err != nil {
+    return nil, err
+  }
+  if page < 1 || page > len(ifds) {
+    return nil, fmt.Errorf("the TIFF has %d pages, there is no page %d", len(ifds), page)
+  }
+  return decodeTIFFPage(data, order, ifds[page - 1])
+}
+
+// tiffPages decodes every page of the TIFF in data.
+func tiffPages(data []byte) ([]image.Image, error) {
+  order, ifds, err := readTIFF(data)
+  if err != nil {
+    return nil, err
+  }
+  pages := make([]image.Image, len(ifds))
+  for idx, ifd := range ifds {
+    if pages[idx], err = decodeTIFFPage(data, order, ifd); err != nil {
+      return nil, fmt.Errorf("page %d: %w", idx + 1, err)
+    }
+  }
+  return pages, nil
+}
+
+// encodeTIFF writes img to w as a single-strip RGB TIFF, or RGBA with
+// straight alpha if it is not opaque, compressed with Deflate after the
+// horizontal predictor. 16-bit images keep their depth, and all others are
+// stored with 8 bits per sample. CMYK images keep their inks, and others
+// are converted to CMYK as well if cmyk is set.
+func encodeTIFF(w io.Writer, img image.Image, cmyk bool) error {
+  bounds := img.Bounds()
+  width, height := bounds.Dx(), bounds.Dy()
+  depth, photometric := 8, uint32(2)
+  var pix []byte
+  var stride int
+  var opaque bool
+  inks, isCMYK := img.(*image.CMYK)
+  if cmyk && !isCMYK {
+    inks, isCMYK = image.NewCMYK(image.Rect(0, 0, width, height)), true
+    draw.Draw(inks, inks.Rect, img, bounds.Min, draw.Src)
+  }
+  if isCMYK {
+    photometric, pix, stride, opaque = 5, inks.Pix[inks.PixOffset(inks.Rect.Min.X, inks.Rect.Min.Y):], inks.Stride, true
+  } else if is16Bit(img) {
+    nrgba := image.NewNRGBA64(image.Rect(0, 0, width, height))
+    draw.Draw(nrgba, nrgba.Rect, img, bounds.Min, draw.Src)
+    depth, pix, stride, opaque = 16, nrgba.Pix, nrgba.Stride, nrgba.Opaque()
+  } else {
+    nrgba := image.NewNRGBA(image.Rect(0, 0, width, height))
+    draw.Draw(nrgba, nrgba.Rect, img, bounds.Min, draw.Src)
+    pix, stride, opaque = nrgba.Pix, nrgba.Stride, nrgba.Opaque()
+  }
+  samples := 4
+  if opaque && !isCMYK {
+    samples = 3
+  }
+  order := binary.LittleEndian
+  var compressed bytes.Buffer
+  z := zlib.NewWriter(&compressed)
+  row := make([]byte, width * samples * depth / 8)
+  for y := 0; y < height; y++ {
+    src := pix[y * stride:]
+    for x := 0; x < width; x++ {
+      for c := 0; c < samples; c++ {
+        if depth == 8 {
+          row[x * samples + c] = src[4 * x + c]
+        } else {
+          order.PutUint16(row[2 * (x * samples + c):], binary.BigEndian.Uint16(src[8 * x + 2 * c:]))
+        }
+      }
+    }
+    for i := width * samples - 1; i >= samples; i-- {
+      if depth == 8 {
+        row[i] -= row[i - samples]
+      } else {
+        order.PutUint16(row[2 * i:], order.Uint16(row[2 * i:]) - order.Uint16(row[2 * (i - samples):]))
+      }
+    }
+    z.Write(row)
+  }
+  if err := z.Close(); err != nil {
+    return err
+  }
+
+  // The strip follows the header, then the bits per sample, which take
+  // more than the four bytes of an entry, and the directory comes last.
+  stripAt := uint32(8)
+  depthsAt := stripAt + uint32(compressed.Len())
+  ifdAt := depthsAt + 2 * uint32(samples)
+  type entry struct {
+    tag, kind uint16
+    count, value uint32
+  }
+  entries := []entry{
+    {256, 4, 1, uint32(width)},
+    {257, 4, 1, uint32(height)},
+    {258, 3, uint32(samples), depthsAt},
+    {259, 3, 1, 8},
+    {262, 3, 1, photometric},
+    {273, 4, 1, stripAt},
+    {277, 3, 1, uint32(samples)},
+    {278, 4, 1, uint32(height)},
+    {279, 4, 1, uint32(compressed.Len())},
+    {284, 3, 1, 1},
+    {317, 3, 1, 2},
+  }
+  if samples == 4 && !isCMYK {
+    entries = append(entries, entry{338, 3, 1, 2})
+  }
+  data := make([]byte, ifdAt + 2 + 12 * uint32(len(entries)) + 4)
+  copy(data, "II")
+  order.PutUint16(data[2:], 42)
+  order.PutUint32(data[4:], ifdAt)
+  copy(data[stripAt:], compressed.Bytes())
+  for i := 0; i < samples; i++ {
+    order.PutUint16(data[depthsAt + 2 * uint32(i):], uint16(depth))
+  }
+  order.PutUint16(data[ifdAt:], uint16(len(entries)))
+  for i, e := range entries {
+    at := data[ifdAt + 2 + 12 * uint32(i):]
+    order.PutUint16(at[0:], e.tag)
+    order.PutUint16(at[2:], e.kind)
+    order.PutUint32(at[4:], e.count)
+    if e.kind == 3 && e.count == 1 {
+      order.PutUint16(at[8:], uint16(e.value))
+    } else {
+      order.PutUint32(at[8:], e.value)
+    }
+  }
+  _, err := w.Write(data)
+  return err
+}
@@ -0,0 +1,287 @@
+/*
+TileEx : A Tiling Pattern Extractor written in Go
+Copyright (C) 2023, Sarthak Shah (shahsarthakw@gmail.com)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+  "bytes"
+  "fmt"
+  "sort"
+  "image"
+  "image/color"
+  "image/draw"
+  "math"
+)
+
+// maxTraceColors is the most colors a tile may have for TraceSVG, beyond
+// which it is not made of flat regions.
+const maxTraceColors = 16
+
+// TraceSVG returns an SVG drawing of a tile made of flat color regions, such
+// as a checkerboard or stripes. The most common color fills the background
+// and every other region is drawn as rectangles on top of it, merged along
+// rows and then down columns, so that the drawing reproduces the tile
+// exactly. Tiles with more than maxTraceColors colors, like photographs or
+// antialiased edges, return an error.
+func TraceSVG(tile image.Image) ([]byte, error) {
+  bounds := tile.Bounds()
+  w, h := bounds.Dx(), bounds.Dy()
+  pixels := make([]color.NRGBA, w * h)
+  counts := make(map[color.NRGBA]int)
+  for y := 0; y < h; y++ {
+    for x := 0; x < w; x++ {
+      c := color.NRGBAModel.Convert(tile.At(bounds.Min.X + x, bounds.Min.Y + y)).(color.NRGBA)
+      pixels[y * w + x] = c
+      counts[c]++
+      if len(counts) > maxTraceColors {
+        return nil, fmt.Errorf("The tile has more than %d colors, so it is not made of flat regions that can be traced", maxTraceColors)
+      }
+    }
+  }
+  var background color.NRGBA
+  for c, n := range counts {
+    if n > counts[background] || (n == counts[background] && fmt.Sprint(c) < fmt.Sprint(background)) {
+      background = c
+    }
+  }
+
+  type run struct {
+    x0, x1 int
+    c color.NRGBA
+  }
+  type rect struct {
+    x0, y0, x1, y1 int
+    c color.NRGBA
+  }
+  var rects []rect
+  // open holds the rectangles that reach the previous row, by their run.
+  open := make(map[run]*rect)
+  for y := 0; y <= h; y++ {
+    next := make(map[run]*rect)
+    for x := 0; y < h && x < w; {
+      c := pixels[y * w + x]
+      end := x + 1
+      for end < w && pixels[y * w + end] == c {
+        end++
+      }
+      if c != background {
+        r := run{x, end, c}
+        if rc, ok := open[r]; ok {
+          rc.y1 = y + 1
+          next[r] = rc
+          delete(open, r)
+        } else {
+          next[r] = &rect{x, y, end, y + 1, c}
+        }
+      }
+      x = end
+    }
+    for _, rc := range open {
+      rects = append(rects, *rc)
+    }
+    open = next
+  }
+  sort.Slice(rects, func(i, j int) bool {
+    if rects[i].y0 != rects[j].y0 {
+      return rects[i].y0 < rects[j].y0
+    }
+    return rects[i].x0 < rects[j].x0
+  })
+
+  fill := func(c color.NRGBA) string {
+    if c.A == 0xff {
+      return fmt.Sprintf(`fill="#%02x%02x%02x"`, c.R, c.G, c.B)
+    }
+    return fmt.Sprintf(`fill="#%02x%02x%02x" fill-opacity="%.3f"`, c.R, c.G, c.B, float64(c.A) / 0xff)
+  }
+  var svg bytes.Buffer
+  fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+"\n", w, h, w, h)
+  if background.A != 0 {
+    fmt.Fprintf(&svg, `<rect width="%d" height="%d" %s/>`+"\n", w, h, fill(background))
+  }
+  for _, r := range rects {
+    fmt.Fprintf(&svg, `<rect x="%d" y="%d" width="%d" height="%d" %s/>`+"\n", r.x0, r.y0, r.x1 - r.x0, r.y1 - r.y0, fill(r.c))
+  }
+  svg.WriteString("</svg>\n")
+  return svg.Bytes(), nil
+}
+
+// Retile repeats tile across a new width by height image, starting with the
+// top left corner of the tile at the top left corner of the image.
+func Retile(tile image.Image, width, height int) draw.Image {
+  bounds := tile.Bounds()
+  tiled := newCanvas(tile, image.Rect(0, 0, width, height))
+  if bounds.Empty() {
+    return tiled
+  }
+  for y := 0; y < height; y += bounds.Dy() {
+    for x := 0; x < width; x += bounds.Dx() {
+      draw.Draw(tiled, image.Rect(x, y, x + bounds.Dx(), y + bounds.Dy()), tile, bounds.Min, draw.Src)
+    }
+  }
+  return tiled
+}
+
+// ResizeTile scales a seamless tile to width by height. It treats the tile as
+// toroidal, so the filter wraps around at the edges and samples the opposite
+// side instead of clamping, and the resized tile stays seamless. Shrinking
+// averages a triangle filter over the area each pixel covers, while growing
+// interpolates bilinearly.
+func ResizeTile(tile image.Image, width, height int) *image.RGBA64 {
+  bounds := tile.Bounds()
+  resized := image.NewRGBA64(image.Rect(0, 0, width, height))
+  if bounds.Empty() || width <= 0 || height <= 0 {
+    return resized
+  }
+  w, h := bounds.Dx(), bounds.Dy()
+  // Premultiplied channels, so that transparent pixels do not bleed their
+  // color into their neighbours.
+  src := make([][4]float64, w * h)
+  for y := 0; y < h; y++ {
+    for x := 0; x < w; x++ {
+      r, g, b, a := tile.At(bounds.Min.X + x, bounds.Min.Y + y).RGBA()
+      src[y * w + x] = [4]float64{float64(r), float64(g), float64(b), float64(a)}
+    }
+  }
+  // Resize the rows first, then the columns of the result.
+  out := wrapResize(wrapResize(src, w, h, width), h, width, height)
+  for i, c := range out {
+    clamp := func(v float64) uint16 {
+      return uint16(math.Min(math.Max(math.Round(v), 0), 0xffff))
+    }
+    a := clamp(c[3])
+    px := color.RGBA64{clamp(math.Min(c[0], c[3])), clamp(math.Min(c[1], c[3])), clamp(math.Min(c[2], c[3])), a}
+    resized.SetRGBA64(i % width, i / width, px)
+  }
+  return resized
+}
+
+// wrapResize resamples each of the given number of lines of n pixels, stored
+// one after the other in src, to size pixels, wrapping around at the ends of
+// every line. The result is transposed, holding the first pixel of every
+// line, then the second and so on, so that calling it twice resizes the rows
+// and then the columns of an image.
+func wrapResize(src [][4]float64, n, lines, size int) [][4]float64 {
+  dst := make([][4]float64, lines * size)
+  scale := float64(n) / float64(size)
+  radius := math.Max(scale, 1)
+  // The weights only depend on the position along the line.
+  type tap struct {
+    index int
+    weight float64
+  }
+  taps := make([][]tap, size)
+  for i := range taps {
+    center := (float64(i) + 0.5) * scale
+    var total float64
+    for j := int(math.Floor(center - radius)); j <= int(math.Ceil(center + radius)); j++ {
+      weight := 1 - math.Abs(float64(j) + 0.5 - center) / radius
+      if weight <= 0 {
+        continue
+      }
+      taps[i] = append(taps[i], tap{((j % n) + n) % n, weight})
+      total += weight
+    }
+    for k := range taps[i] {
+      taps[i][k].weight /= total
+    }
+  }
+  for l := 0; l < lines; l++ {
+    for i, ts := range taps {
+      var c [4]float64
+      for _, t := range ts {
+        p := src[l * n + t.index]
+        for k := range c {
+          c[k] += p[k] * t.weight
+        }
+      }
+      dst[i * lines + l] = c
+    }
+  }
+  return dst
+}
+
+// cropPreserving copies rect out of img into a new image of the same type, so
+// that palettes, grayscale and 16-bit depths survive the crop. It returns nil
+// when rect does not lie within img or the type of img is not supported, in
+// which case the tile has to be drawn into an RGBA image instead.
+func cropPreserving(img image.Image, rect image.Rectangle) image.Image {
+  if !rect.In(img.Bounds()) {
+    return nil
+  }
+  dstRect := rect.Sub(rect.Min)
+  switch src := img.(type) {
+  case *image.Paletted:
+    sub := src.SubImage(rect).(*image.Paletted)
+    dst := image.NewPaletted(dstRect, src.Palette)
+    copyRows(dst.Pix, dst.Stride, sub.Pix, sub.Stride, rect.Dx(), rect.Dy())
+    return dst
+  case *image.Gray:
+    sub := src.SubImage(rect).(*image.Gray)
+    dst := image.NewGray(dstRect)
+    copyRows(dst.Pix, dst.Stride, sub.Pix, sub.Stride, rect.Dx(), rect.Dy())
+    return dst
+  case *image.Gray16:
+    sub := src.SubImage(rect).(*image.Gray16)
+    dst := image.NewGray16(dstRect)
+    copyRows(dst.Pix, dst.Stride, sub.Pix, sub.Stride, rect.Dx() * 2, rect.Dy())
+    return dst
+  case *image.Alpha:
+    sub := src.SubImage(rect).(*image.Alpha)
+    dst := image.NewAlpha(dstRect)
+    copyRows(dst.Pix, dst.Stride, sub.Pix, sub.Stride, rect.Dx(), rect.Dy())
+    return dst
+  case *image.Alpha16:
+    sub := src.SubImage(rect).(*image.Alpha16)
+    dst := image.NewAlpha16(dstRect)
+    copyRows(dst.Pix, dst.Stride, sub.Pix, sub.Stride, rect.Dx() * 2, rect.Dy())
+    return dst
+  case *image.RGBA:
+    sub := src.SubImage(rect).(*image.RGBA)
+    dst := image.NewRGBA(dstRect)
+    copyRows(dst.Pix, dst.Stride, sub.Pix, sub.Stride, rect.Dx() * 4, rect.Dy())
+    return dst
+  case *image.RGBA64:
+    sub := src.SubImage(rect).(*image.RGBA64)
+    dst := image.NewRGBA64(dstRect)
+    copyRows(dst.Pix, dst.Stride, sub.Pix, sub.Stride, rect.Dx() * 8, rect.Dy())
+    return dst
+  case *image.NRGBA:
+    sub := src.SubImage(rect).(*image.NRGBA)
+    dst := image.NewNRGBA(dstRect)
+    copyRows(dst.Pix, dst.Stride, sub.Pix, sub.Stride, rect.Dx() * 4, rect.Dy())
+    return dst
+  case *image.NRGBA64:
+    sub := src.SubImage(rect).(*image.NRGBA64)
+    dst := image.NewNRGBA64(dstRect)
+    copyRows(dst.Pix, dst.Stride, sub.Pix, sub.Stride, rect.Dx() * 8, rect.Dy())
+    return dst
+  case *image.CMYK:
+    sub := src.SubImage(rect).(*image.CMYK)
+    dst := image.NewCMYK(dstRect)
+    copyRows(dst.Pix, dst.Stride, sub.Pix, sub.Stride, rect.Dx() * 4, rect.Dy())
+    return dst
+  }
+  return nil
+}
+
+// copyRows copies rows rows of rowBytes bytes between pixel buffers.
+func copyRows(dst []uint8, dstStride int, src []uint8, srcStride int, rowBytes, rows int) {
+  for y := 0; y < rows; y++ {
+    copy(dst[y * dstStride:y * dstStride + rowBytes], src[y * srcStride:y * srcStride + rowBytes])
+  }
+}
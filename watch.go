@@ -0,0 +1,179 @@
+/*
+TileEx : A Tiling Pattern Extractor written in Go
+Copyright (C) 2023, Sarthak Shah (shahsarthakw@gmail.com)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+  "context"
+  "io"
+  "os"
+  "path/filepath"
+  "fmt"
+  "flag"
+  "time"
+)
+
+// watchOptions holds the flags of the watch subcommand.
+type watchOptions struct {
+  s settings
+  b batch
+  o outputSettings
+  outputDir string
+  interval time.Duration
+  notify, once bool
+}
+
+func (w *watchOptions) addFlags(fs *flag.FlagSet) {
+  fs.StringVar(&w.outputDir, "output-dir", "", "Where to save the tiles (default: a tiles folder inside the watched folder)")
+  fs.DurationVar(&w.interval, "interval", 2 * time.Second, "How often to look for new images")
+  fs.BoolVar(&w.notify, "notify", true, "Show a desktop notification for every processed image")
+  fs.BoolVar(&w.once, "once", false, "Process the images already in the folder and exit instead of watching it")
+  addSettingsFlags(fs, &w.s)
+  addBatchFlags(fs, &w.b)
+  addOutputFlags(fs, &w.o)
+}
+
+// runWatch implements the watch subcommand, which extracts the tile of every
+// image dropped into a folder. An image is only processed once its size has
+// stayed the same for one interval, so that files still being copied are
+// left alone, and again whenever it is modified.
+func runWatch(args []string) int {
+  var w watchOptions
+  watchFlags := flag.NewFlagSet("watch", flag.ContinueOnError)
+  w.addFlags(watchFlags)
+  watchFlags.Usage = func() {
+    fmt.Fprintln(watchFlags.Output(), tr("Usage: tileex watch [flags] folder"))
+    watchFlags.PrintDefaults()
+  }
+  parseFlags(watchFlags, "watch", args)
+
+  if watchFlags.NArg() != 1 {
+    watchFlags.Usage()
+    return exitUsage
+  }
+  if err := w.s.prepare(); err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitUsage
+  }
+  if err := w.b.prepare(); err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitUsage
+  }
+  if err := w.o.prepare(); err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitUsage
+  }
+  return w.watch(os.Stdout, watchFlags.Arg(0))
+}
+
+// watch polls dir for new and modified images until the batch is halted, or
+// once with -once, and returns the exit status of the watch subcommand. The
+// settings have to be prepared already.
+func (w *watchOptions) watch(out io.Writer, dir string) int {
+  if w.outputDir == "" {
+    w.outputDir = filepath.Join(dir, "tiles")
+  }
+  if err := os.MkdirAll(w.outputDir, 0755); err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitFailure
+  }
+
+  if !w.once {
+    fmt.Fprintf(out, "Watching %s, saving tiles to %s\n", dir, w.outputDir)
+  }
+  processed := make(map[string]time.Time)
+  pending := make(map[string]int64)
+  for {
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+      fmt.Fprintln(os.Stderr, tr("Error:"), err)
+      return exitFailure
+    }
+    for _, entry := range entries {
+      if entry.IsDir() || !isImageFile(entry.Name()) {
+        continue
+      }
+      info, err := entry.Info()
+      if err != nil {
+        continue
+      }
+      input := filepath.Join(dir, entry.Name())
+      if modTime, ok := processed[input]; ok && modTime.Equal(info.ModTime()) {
+        continue
+      }
+      if size, ok := pending[input]; !w.once && (!ok || size != info.Size()) {
+        pending[input] = info.Size()
+        continue
+      }
+      delete(pending, input)
+      processed[input] = info.ModTime()
+      w.process(out, input)
+      if w.b.halted {
+        break
+      }
+    }
+    if w.once || w.b.halted {
+      break
+    }
+    time.Sleep(w.interval)
+  }
+
+  if err := w.b.finish(); err != nil {
+    fmt.Fprintln(os.Stderr, tr("Error:"), err)
+    return exitFailure
+  }
+  if len(w.b.Failures) > 0 {
+    return 1
+  }
+  return 0
+}
+
+// process extracts and saves the tile of one dropped image and tells the
+// user about it.
+func (w *watchOptions) process(out io.Writer, input string) {
+  output := filepath.Join(w.outputDir, w.o.defaultName(filepath.Base(defaultTileOutput(input))))
+  var summary string
+  err := w.b.run(input, func() error {
+    img, err := w.o.decode(input)
+    if err != nil {
+      return err
+    }
+    logger := w.b.logger(out, input)
+    ctx, cancel := w.s.context(context.Background())
+    defer cancel()
+    a, ext, err := w.b.extractTile(ctx, img, input, w.s, logger)
+    if err != nil {
+      return err
+    }
+    if err := w.o.save(output, w.o.tile(a.img, ext.Origin, ext.Width, ext.Height)); err != nil {
+      return err
+    }
+    summary = fmt.Sprintf("%dx%d tile (%s) saved to %s", ext.Width, ext.Height, ext.Grade, output)
+    return nil
+  })
+  if err != nil {
+    fmt.Fprintf(out, "error    %s: %v\n", input, err)
+    if w.notify {
+      notify("TileEx: " + filepath.Base(input) + " failed", err.Error(), "")
+    }
+    return
+  }
+  fmt.Fprintf(out, "ok       %s: %s\n", input, summary)
+  if w.notify {
+    notify("TileEx: " + filepath.Base(input), summary, output)
+  }
+}